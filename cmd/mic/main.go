@@ -33,6 +33,28 @@ var (
 	immutableUserMSIs   string
 	cmConfig            mic.CMConfig
 	typeUpgradeConfig   mic.TypeUpgradeConfig
+	matchAnnotation     string
+	defaultIdentityRG   string
+	excludedNamespaces  string
+	includedNamespaces  string
+	assignOnly          bool
+	maxConcurrentARMOps int64
+	stuckThreshold      time.Duration
+	minResync           time.Duration
+	maxResync           time.Duration
+	allowSystemAssigned bool
+	enableSecretRefs    bool
+	reconcileInterval   time.Duration
+	reconcileDetach     bool
+	maxIdentitiesNode   int
+	userAgentSuffix     string
+	nodeMappingCM       string
+	crdOnly             bool
+	assignedIDNaming    string
+	assignedIDTemplate  string
+	allowHostNetwork    bool
+	perIdentityMetrics  bool
+	maxMetricIdentities int
 )
 
 func main() {
@@ -81,13 +103,71 @@ func main() {
 	flag.StringVar(&typeUpgradeConfig.TypeUpgradeStatusKey, "type-upgrade-status-key", "type-upgrade-status", "Configmap key for type upgrade status")
 	flag.BoolVar(&typeUpgradeConfig.EnableTypeUpgrade, "enable-type-upgrade", true, "Enable type upgrade")
 
+	// Pod annotation used as a fallback selector when the aadpodidbinding label is not set
+	flag.StringVar(&matchAnnotation, "match-annotation", "", "pod annotation key to match binding selectors when the aadpodidbinding label is absent")
+
+	// Resource group used to resolve identities specified by name
+	flag.StringVar(&defaultIdentityRG, "default-identity-resource-group", "", "resource group to resolve AzureIdentity names in. default is the resource group in the cloud config")
+
+	// Namespaces identities are never assigned to pods in, or the only namespaces they are assigned to pods in
+	flag.StringVar(&excludedNamespaces, "excluded-namespaces", "", "comma-separated list of namespaces in which identities are never assigned to pods")
+	flag.StringVar(&includedNamespaces, "included-namespaces", "", "comma-separated list of namespaces in which identities are assigned to pods. default is all namespaces")
+
+	// Assign identities without ever removing them, cleanup is left to an external process
+	flag.BoolVar(&assignOnly, "assign-only", false, "Assign identities to nodes and create assigned identities, but never remove identities from nodes or delete assigned identities")
+
+	// Maximum number of VM and VMSS updates in flight across all nodes
+	flag.Int64Var(&maxConcurrentARMOps, "max-concurrent-arm-ops", 0, "maximum number of VM and VMSS updates in flight across all nodes, further updates are queued. default is unbounded")
+
+	// Time after which an assigned identity waiting to be assigned is reported as stuck
+	flag.DurationVar(&stuckThreshold, "stuck-assignment-threshold", 10*time.Minute, "time after which an assigned identity waiting to be assigned is reported as stuck. set to 0 to disable")
+
+	// Bounds of the periodic sync interval, which backs off while the API server throttles or is slow
+	flag.DurationVar(&minResync, "min-resync", 0, "minimum interval of the periodic sync loop. default is syncRetryDuration")
+	flag.DurationVar(&maxResync, "max-resync", 0, "maximum interval the periodic sync loop backs off to while the API server throttles or is slow. default is no backoff")
+
+	// Enable the system assigned identity of nodes for the system assigned identities assigned to their pods
+	flag.BoolVar(&allowSystemAssigned, "allow-enable-system-assigned", false, "Enable the system assigned identity of the VM or VMSS of a node when a system assigned identity is assigned to its pods, and disable it when no longer in use if MIC enabled it")
+
+	// Read the client id and resource id of AzureIdentities from the secrets they reference
+	flag.BoolVar(&enableSecretRefs, "enable-secret-refs", false, "read the client id and resource id of the AzureIdentities referencing a secret, requires permission to get secrets")
+
+	// Periodic reconciliation of the identities of the VMs and VMSS against the identities in ARM
+	flag.DurationVar(&reconcileInterval, "arm-reconcile-interval", 0, "interval at which the identities of the VMs and VMSS are read from ARM and the assigned identities missing in ARM are re-attached. set to 0 to disable")
+	flag.BoolVar(&reconcileDetach, "arm-reconcile-detach", false, "detach the identities of AzureIdentities attached to a VM or VMSS without being assigned to a pod of its nodes during the reconciliation")
+
+	// Max number of user assigned identities attached to a VM or VMSS
+	flag.IntVar(&maxIdentitiesNode, "max-identities-per-node", mic.DefaultMaxIdentitiesPerNode, "max number of user assigned identities MIC attaches to the VM or VMSS of a node, further assignments are refused. set to 0 to disable")
+
+	// Suffix of the user agent of the requests to the API server and Azure
+	flag.StringVar(&userAgentSuffix, "user-agent-suffix", "", "suffix appended to the user agent of the requests to the API server and Azure, e.g. to tag the deployment")
+
+	// Resolution of the compute resources of the nodes without access to the nodes
+	flag.StringVar(&nodeMappingCM, "node-mapping-config-map", "", "name of the config map in the namespace of MIC mapping node names to the provider id of the VM, VMSS instance or Azure Arc machine backing them")
+	flag.BoolVar(&crdOnly, "crd-only", false, "resolve the nodes from the node mapping config map only, without reading the nodes of the cluster. requires --node-mapping-config-map")
+
+	// Naming of the assigned identities
+	flag.StringVar(&assignedIDNaming, "assigned-id-naming-scheme", mic.AssignedIDNamingDefault, "scheme naming the AzureAssignedIdentities: default (<pod>-<namespace>-<identity>), hash-suffix (default name suffixed with a hash of the pod and identity) or template")
+	flag.StringVar(&assignedIDTemplate, "assigned-id-name-template", "", "text/template of the AzureAssignedIdentity names of the template naming scheme, referencing .PodName, .PodNamespace and .IdentityName")
+
+	// Assignment of identities to the pods using the host network
+	flag.BoolVar(&allowHostNetwork, "allow-hostnetwork-assignment", false, "assign identities to the pods using the host network without the aadpodidentity.k8s.io/allow-hostnetwork-assignment=true label. host network pods share the IP of their node")
+
+	// Metrics broken down by AzureIdentity
+	flag.BoolVar(&perIdentityMetrics, "per-identity-metrics", false, "report the assignments and removals of identities to and from nodes by AzureIdentity")
+	flag.IntVar(&maxMetricIdentities, "per-identity-metrics-max-identities", mic.DefaultMaxMetricIdentities, "max number of AzureIdentities broken down in the per identity metrics, the others are reported as _other")
+
 	flag.Parse()
+	version.SetUserAgentSuffix(userAgentSuffix)
 
 	podns := os.Getenv("MIC_POD_NAMESPACE")
 	if podns == "" {
 		klog.Fatalf("namespace not specified. Please add meta.namespace as env variable MIC_POD_NAMESPACE")
 	}
 	cmConfig.Namespace = podns
+	if crdOnly && nodeMappingCM == "" {
+		klog.Fatalf("--crd-only requires --node-mapping-config-map")
+	}
 
 	if versionInfo {
 		version.PrintVersionAndExit()
@@ -140,6 +220,28 @@ func main() {
 		ImmutableUserMSIsList: immutableUserMSIsList,
 		CMcfg:                 &cmConfig,
 		TypeUpgradeCfg:        &typeUpgradeConfig,
+		MatchAnnotation:       matchAnnotation,
+
+		DefaultIdentityResourceGroup: defaultIdentityRG,
+		ExcludedNamespaces:           strings.Split(excludedNamespaces, ","),
+		IncludedNamespaces:           strings.Split(includedNamespaces, ","),
+		AssignOnly:                   assignOnly,
+		MaxConcurrentARMOps:          maxConcurrentARMOps,
+		StuckAssignmentThreshold:     stuckThreshold,
+		MinResync:                    minResync,
+		MaxResync:                    maxResync,
+		AllowEnableSystemAssigned:    allowSystemAssigned,
+		EnableSecretRefs:             enableSecretRefs,
+		ARMReconcileInterval:         reconcileInterval,
+		ARMReconcileDetach:           reconcileDetach,
+		MaxIdentitiesPerNode:         maxIdentitiesNode,
+		NodeMappingConfigMap:         nodeMappingCM,
+		CRDOnly:                      crdOnly,
+		AssignedIDNamingScheme:       assignedIDNaming,
+		AssignedIDNameTemplate:       assignedIDTemplate,
+		AllowHostNetworkAssignment:   allowHostNetwork,
+		PerIdentityMetrics:           perIdentityMetrics,
+		MaxMetricIdentities:          maxMetricIdentities,
 	}
 
 	micClient, err := mic.NewMICClient(micConfig)
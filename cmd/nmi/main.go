@@ -8,11 +8,13 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 
+	"github.com/Azure/aad-pod-identity/pkg/auth"
 	"github.com/Azure/aad-pod-identity/pkg/metrics"
 	"github.com/Azure/aad-pod-identity/pkg/nmi"
 	server "github.com/Azure/aad-pod-identity/pkg/nmi/server"
 	"github.com/Azure/aad-pod-identity/pkg/probes"
 	"github.com/Azure/aad-pod-identity/version"
+	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/spf13/pflag"
 	"k8s.io/klog"
 )
@@ -48,6 +50,15 @@ var (
 	metadataHeaderRequired             = pflag.Bool("metadata-header-required", false, "Metadata header required for querying Azure Instance Metadata service")
 	prometheusPort                     = pflag.String("prometheus-port", "9090", "Prometheus port for metrics")
 	operationMode                      = pflag.String("operation-mode", "standard", "NMI operation mode")
+	debugAddr                          = pflag.String("debug-addr", "", "address to serve the /debug/identities and /debug/config endpoints on. An address without a host is bound to localhost")
+	warmupInterval                     = pflag.Duration("warmup-interval", 0, "interval at which tokens are pre-acquired for the identities assigned on the node. Disabled when 0")
+	responseHeader                     = pflag.String("response-header", server.DefaultResponseHeader, "header added to the token responses served by NMI. Disabled when empty")
+	responseHeaderValue                = pflag.String("response-header-value", "", "value of the header added to the token responses served by NMI. Defaults to the NMI version")
+	upstreamMaxIdleConnsPerHost        = pflag.Int("upstream-max-idle-conns-per-host", auth.DefaultMaxIdleConnsPerHost, "maximum number of idle connections to each of IMDS and AAD kept open for reuse")
+	serveStaleOnError                  = pflag.Bool("serve-stale-on-error", false, "serve the last token acquired for an identity and resource when acquiring a new token fails, until the token expires")
+	auditLog                           = pflag.String("audit-log", "", "output of the JSON audit records of the tokens granted and denied to pods, \"stdout\" or the path of a file. Disabled when empty")
+	userAgentSuffix                    = pflag.String("user-agent-suffix", "", "suffix appended to the user agent of the requests to the API server and Azure, e.g. to tag the deployment")
+	upstreamIdleConnTimeout            = pflag.Duration("upstream-idle-conn-timeout", auth.DefaultIdleConnTimeout, "time an idle connection to IMDS or AAD is kept open for reuse")
 )
 
 func main() {
@@ -61,6 +72,15 @@ func main() {
 
 	klog.Infof("Starting nmi process. Version: %v. Build date: %v.", version.NMIVersion, version.BuildDate)
 
+	if *userAgentSuffix != "" {
+		version.SetUserAgentSuffix(*userAgentSuffix)
+		// the user agent of the token requests is set when the auth package is initialized, before
+		// the flags are parsed
+		if err := adal.AddToUserAgent(*userAgentSuffix); err != nil {
+			klog.Fatalf("failed to add the user agent suffix, err: %+v", err)
+		}
+	}
+
 	if *enableProfile {
 		profilePort := "6060"
 		klog.Infof("Starting profiling on port %s", profilePort)
@@ -91,6 +111,26 @@ func main() {
 	s.HostIP = *hostIP
 	s.NodeName = *nodename
 	s.IPTableUpdateTimeIntervalInSeconds = *ipTableUpdateTimeIntervalInSeconds
+	s.DebugAddr = *debugAddr
+	s.WarmupInterval = *warmupInterval
+	s.ServeStaleOnError = *serveStaleOnError
+	if *auditLog != "" {
+		if s.AuditLog, err = server.OpenAuditLog(*auditLog); err != nil {
+			klog.Fatalf("failed to open audit log %s, err: %+v", *auditLog, err)
+		}
+	}
+	s.ResponseHeaderName = *responseHeader
+	s.ResponseHeaderValue = *responseHeaderValue
+	if s.ResponseHeaderValue == "" {
+		s.ResponseHeaderValue = version.NMIVersion
+	}
+	upstreamClient := &http.Client{Transport: auth.NewUpstreamTransport(*upstreamMaxIdleConnsPerHost, *upstreamIdleConnTimeout)}
+	auth.InitUpstreamClient(upstreamClient)
+	s.UpstreamClient = upstreamClient
+	s.DebugConfig = make(map[string]string)
+	pflag.VisitAll(func(f *pflag.Flag) {
+		s.DebugConfig[f.Name] = f.Value.String()
+	})
 
 	nmiConfig := nmi.Config{
 		Mode:                               strings.ToLower(*operationMode),
@@ -21,6 +21,7 @@ limitations under the License.
 package aadpodidentity
 
 import (
+	v1 "k8s.io/api/core/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -294,6 +295,16 @@ func (in *AzureIdentityList) DeepCopyObject() runtime.Object {
 func (in *AzureIdentitySpec) DeepCopyInto(out *AzureIdentitySpec) {
 	*out = *in
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	if in.ClientIDSecretRef != nil {
+		in, out := &in.ClientIDSecretRef, &out.ClientIDSecretRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ResourceIDSecretRef != nil {
+		in, out := &in.ResourceIDSecretRef, &out.ResourceIDSecretRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
 	out.ClientPassword = in.ClientPassword
 	if in.Replicas != nil {
 		in, out := &in.Replicas, &out.Replicas
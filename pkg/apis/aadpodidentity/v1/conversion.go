@@ -29,7 +29,12 @@ func ConvertV1IdentityToInternalIdentity(identity AzureIdentity) (resIdentity aa
 			ObjectMeta:     identity.Spec.ObjectMeta,
 			Type:           aadpodid.IdentityType(identity.Spec.Type),
 			ResourceID:     identity.Spec.ResourceID,
+			IdentityName:   identity.Spec.IdentityName,
 			ClientID:       identity.Spec.ClientID,
+
+			ClientIDSecretRef:   identity.Spec.ClientIDSecretRef,
+			ResourceIDSecretRef: identity.Spec.ResourceIDSecretRef,
+
 			ClientPassword: identity.Spec.ClientPassword,
 			TenantID:       identity.Spec.TenantID,
 			ADResourceID:   identity.Spec.ADResourceID,
@@ -101,7 +106,12 @@ func ConvertInternalIdentityToV1Identity(identity aadpodid.AzureIdentity) (resId
 			ObjectMeta:     identity.Spec.ObjectMeta,
 			Type:           IdentityType(identity.Spec.Type),
 			ResourceID:     identity.Spec.ResourceID,
+			IdentityName:   identity.Spec.IdentityName,
 			ClientID:       identity.Spec.ClientID,
+
+			ClientIDSecretRef:   identity.Spec.ClientIDSecretRef,
+			ResourceIDSecretRef: identity.Spec.ResourceIDSecretRef,
+
 			ClientPassword: identity.Spec.ClientPassword,
 			TenantID:       identity.Spec.TenantID,
 			ADResourceID:   identity.Spec.ADResourceID,
@@ -5,6 +5,7 @@ import (
 
 	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
 	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -18,6 +19,7 @@ var assignedIDPod string = "assignedIDPod"
 var replicas int32 = 3
 var weight int = 1
 var podLabels = map[string]string{"testkey1": "testval1", "testkey2": "testval2"}
+var clientIDSecretRef = &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "secretName"}, Key: "clientid"}
 
 func CreateV1Binding() (retV1Binding AzureIdentityBinding) {
 	return AzureIdentityBinding{
@@ -49,9 +51,10 @@ func CreateV1Identity() (retV1Identity AzureIdentity) {
 			APIVersion: "aadpodidentity.k8s.io/v1",
 		},
 		Spec: AzureIdentitySpec{
-			Type:       idTypeV1,
-			ResourceID: rID,
-			Replicas:   &replicas,
+			Type:              idTypeV1,
+			ResourceID:        rID,
+			ClientIDSecretRef: clientIDSecretRef,
+			Replicas:          &replicas,
 		},
 		Status: AzureIdentityStatus{
 			AvailableReplicas: replicas,
@@ -113,9 +116,10 @@ func CreateInternalIdentity() (retInternalIdentity aadpodid.AzureIdentity) {
 			APIVersion: "aadpodidentity.k8s.io/v1",
 		},
 		Spec: aadpodid.AzureIdentitySpec{
-			Type:       idTypeInternal,
-			ResourceID: rID,
-			Replicas:   &replicas,
+			Type:              idTypeInternal,
+			ResourceID:        rID,
+			ClientIDSecretRef: clientIDSecretRef,
+			Replicas:          &replicas,
 		},
 		Status: aadpodid.AzureIdentityStatus{
 			AvailableReplicas: replicas,
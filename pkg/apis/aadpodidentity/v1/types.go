@@ -19,6 +19,13 @@ const (
 	AssignedIDAssigned = "Assigned"
 	// AssignedIDUnAssigned status indicates identity has been unassigned from the node
 	AssignedIDUnAssigned = "Unassigned"
+	// AssignedIDPodNameLabel, AssignedIDPodNamespaceLabel, AssignedIDNodeNameLabel and
+	// AssignedIDIdentityNameLabel are the labels of the pod, node and identity set by mic on the
+	// azure assigned identities to select them, e.g. aadpodidentity.k8s.io/node-name=node1
+	AssignedIDPodNameLabel      = "aadpodidentity.k8s.io/pod-name"
+	AssignedIDPodNamespaceLabel = "aadpodidentity.k8s.io/pod-namespace"
+	AssignedIDNodeNameLabel     = "aadpodidentity.k8s.io/node-name"
+	AssignedIDIdentityNameLabel = "aadpodidentity.k8s.io/identity-name"
 )
 
 /*** Global data structures ***/
@@ -107,18 +114,30 @@ type IdentityType int
 const (
 	UserAssignedMSI  IdentityType = 0
 	ServicePrincipal IdentityType = 1
+	// SystemAssignedMSI is the system assigned identity of the VM or VMSS of the node
+	SystemAssignedMSI IdentityType = 2
 )
 
 type AzureIdentitySpec struct {
 	metav1.ObjectMeta `json:"metadata,omitempty"`
-	// UserAssignedMSI or Service Principal
+	// UserAssignedMSI, Service Principal or SystemAssignedMSI
 	Type IdentityType `json:"type"`
 
 	// User assigned MSI resource id.
 	ResourceID string `json:"resourceID"`
+	// Name of the user assigned MSI. Used to resolve the resource id in the
+	// default identity resource group of MIC when the resource id is not set.
+	IdentityName string `json:"name,omitempty"`
 	//Both User Assigned MSI and SP can use this field.
 	ClientID string `json:"clientID"`
 
+	// Key of a secret in the namespace of the identity holding the client id. Takes precedence over
+	// the client id when set.
+	ClientIDSecretRef *api.SecretKeySelector `json:"clientIDSecretRef,omitempty"`
+	// Key of a secret in the namespace of the identity holding the user assigned MSI resource id.
+	// Takes precedence over the resource id when set.
+	ResourceIDSecretRef *api.SecretKeySelector `json:"resourceIDSecretRef,omitempty"`
+
 	//Used for service principal
 	ClientPassword api.SecretReference `json:"clientPassword"`
 	// Service principal tenant id.
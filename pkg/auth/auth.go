@@ -1,7 +1,11 @@
 package auth
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/Azure/aad-pod-identity/pkg/metrics"
@@ -38,6 +42,7 @@ func GetServicePrincipalTokenFromMSI(resource string) (*adal.Token, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to acquire a token for MSI. Error: %v", err)
 	}
+	setSender(spt)
 	// obtain a fresh token
 	err = spt.Refresh()
 	if err != nil {
@@ -72,6 +77,7 @@ func GetServicePrincipalTokenFromMSIWithUserAssignedID(clientID, resource string
 	if err != nil {
 		return nil, fmt.Errorf("Failed to acquire a token using the MSI VM extension. Error: %v", err)
 	}
+	setSender(spt)
 
 	// obtain a fresh token
 	err = spt.Refresh()
@@ -82,8 +88,9 @@ func GetServicePrincipalTokenFromMSIWithUserAssignedID(clientID, resource string
 	return &token, nil
 }
 
-// GetServicePrincipalToken return the token for the assigned user
-func GetServicePrincipalToken(tenantID, clientID, secret, resource string) (*adal.Token, error) {
+// GetServicePrincipalToken return the token for the assigned user. A non-empty claims challenge
+// is forwarded to AAD with the token request.
+func GetServicePrincipalToken(tenantID, clientID, secret, resource, claims string) (*adal.Token, error) {
 	begin := time.Now()
 	var err error
 
@@ -103,6 +110,11 @@ func GetServicePrincipalToken(tenantID, clientID, secret, resource string) (*ada
 	if err != nil {
 		return nil, err
 	}
+	if claims != "" {
+		setSender(spt, withClaims(claims))
+	} else {
+		setSender(spt)
+	}
 	// obtain a fresh token
 	err = spt.Refresh()
 	if err != nil {
@@ -112,6 +124,32 @@ func GetServicePrincipalToken(tenantID, clientID, secret, resource string) (*ada
 	return &token, nil
 }
 
+// withClaims returns a decorator adding the claims challenge to the form of the token requests,
+// since adal doesn't support claims challenges
+func withClaims(claims string) adal.SendDecorator {
+	return func(s adal.Sender) adal.Sender {
+		return adal.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			if r.Method != http.MethodPost || r.Body == nil {
+				return s.Do(r)
+			}
+			body, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			form, err := url.ParseQuery(string(body))
+			if err != nil {
+				return nil, err
+			}
+			form.Set("claims", claims)
+			body = []byte(form.Encode())
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			return s.Do(r)
+		})
+	}
+}
+
 func init() {
 	err := adal.AddToUserAgent(version.GetUserAgent("NMI", version.NMIVersion))
 	if err != nil {
@@ -1,9 +1,13 @@
 package auth
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	"github.com/Azure/go-autorest/autorest/adal"
 )
 
 func TestGetServicePrincipalToken(t *testing.T) {
@@ -12,8 +16,51 @@ func TestGetServicePrincipalToken(t *testing.T) {
 		t.Fatalf("expected nil error, got: %+v", err)
 	}
 	InitReporter(reporter)
-	_, err = GetServicePrincipalToken("tid", "cid", "", "")
+	_, err = GetServicePrincipalToken("tid", "cid", "", "", "")
 	if err == nil {
 		t.Fatal("should be error with empty secret")
 	}
 }
+
+func TestWithClaims(t *testing.T) {
+	cases := []struct {
+		name           string
+		claims         string
+		expectedClaims string
+	}{
+		{name: "claims challenge is added to the token request", claims: "challenge", expectedClaims: "challenge"},
+		{name: "no claims challenge leaves the token request unchanged", expectedClaims: ""},
+	}
+
+	for _, tc := range cases {
+		var form url.Values
+		aad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			form = r.PostForm
+			w.Write([]byte(`{"access_token":"token","expires_in":"3599","expires_on":"1586219870","not_before":"1586132170","resource":"resource","token_type":"Bearer"}`))
+		}))
+
+		oauthConfig, err := adal.NewOAuthConfig(aad.URL, "tid")
+		if err != nil {
+			t.Fatalf("%s: expected nil error, got: %+v", tc.name, err)
+		}
+		spt, err := adal.NewServicePrincipalToken(*oauthConfig, "cid", "secret", "resource")
+		if err != nil {
+			t.Fatalf("%s: expected nil error, got: %+v", tc.name, err)
+		}
+		if tc.claims != "" {
+			spt.SetSender(adal.CreateSender(withClaims(tc.claims)))
+		}
+		if err := spt.Refresh(); err != nil {
+			t.Fatalf("%s: expected nil error, got: %+v", tc.name, err)
+		}
+		aad.Close()
+
+		if claims := form.Get("claims"); claims != tc.expectedClaims {
+			t.Errorf("%s: expected claims %q, got: %q", tc.name, tc.expectedClaims, claims)
+		}
+		if form.Get("client_id") != "cid" || form.Get("client_secret") != "secret" || form.Get("resource") != "resource" {
+			t.Errorf("%s: unexpected token request form %v", tc.name, form)
+		}
+	}
+}
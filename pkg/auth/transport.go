@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	adal "github.com/Azure/go-autorest/autorest/adal"
+)
+
+const (
+	// DefaultMaxIdleConnsPerHost is the default number of idle connections kept open to each of IMDS and AAD
+	DefaultMaxIdleConnsPerHost = 10
+	// DefaultIdleConnTimeout is the default time an idle connection to IMDS or AAD is kept open
+	DefaultIdleConnTimeout = 90 * time.Second
+
+	// upstreamTCPKeepAlive is the keep-alive period of the connections to IMDS and AAD
+	upstreamTCPKeepAlive = 30 * time.Second
+	// upstreamDialTimeout is the timeout of the connections to IMDS and AAD
+	upstreamDialTimeout = 30 * time.Second
+)
+
+var (
+	// upstreamSender sends the token requests to IMDS and AAD, the adal default sender when nil
+	upstreamSender adal.Sender
+	// upstreamConnections is the number of open connections of the upstream transports
+	upstreamConnections   int64
+	upstreamConnectionsMu sync.Mutex
+)
+
+// NewUpstreamTransport returns the transport of the requests of NMI to IMDS and AAD. Connections are
+// kept alive and up to maxIdleConnsPerHost idle connections to each host are reused by the following
+// requests for idleConnTimeout, so busy nodes don't open a connection per request.
+func NewUpstreamTransport(maxIdleConnsPerHost int, idleConnTimeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   upstreamDialTimeout,
+		KeepAlive: upstreamTCPKeepAlive,
+	}
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			addUpstreamConnections(1)
+			return &countedConn{Conn: conn}, nil
+		},
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		// same minimum version as the adal default sender
+		TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+}
+
+// InitUpstreamClient sets the http client the token requests to IMDS and AAD are sent with, nil
+// for the adal default sender
+func InitUpstreamClient(client *http.Client) {
+	if client == nil {
+		upstreamSender = nil
+		return
+	}
+	upstreamSender = client
+}
+
+// setSender sets the upstream sender of the token, decorated with the decorators
+func setSender(spt *adal.ServicePrincipalToken, decorators ...adal.SendDecorator) {
+	if upstreamSender == nil {
+		if len(decorators) > 0 {
+			spt.SetSender(adal.CreateSender(decorators...))
+		}
+		return
+	}
+	spt.SetSender(adal.DecorateSender(upstreamSender, decorators...))
+}
+
+// countedConn decrements the number of open upstream connections when closed
+type countedConn struct {
+	net.Conn
+	closeOnce sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() {
+		addUpstreamConnections(-1)
+	})
+	return c.Conn.Close()
+}
+
+// addUpstreamConnections adds delta to the number of open upstream connections and reports it
+func addUpstreamConnections(delta int64) {
+	upstreamConnectionsMu.Lock()
+	defer upstreamConnectionsMu.Unlock()
+
+	upstreamConnections += delta
+	if reporter != nil {
+		reporter.Report(metrics.NMIUpstreamConnectionsM.M(upstreamConnections))
+	}
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+func TestUpstreamTransportReusesConnections(t *testing.T) {
+	var mu sync.Mutex
+	newConns := 0
+	imds := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"token","expires_in":"3599","expires_on":"1586219870","not_before":"1586132170","resource":"resource","token_type":"Bearer"}`))
+	}))
+	imds.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			newConns++
+			mu.Unlock()
+		}
+	}
+	imds.Start()
+	defer imds.Close()
+
+	transport := NewUpstreamTransport(DefaultMaxIdleConnsPerHost, DefaultIdleConnTimeout)
+	InitUpstreamClient(&http.Client{Transport: transport})
+	defer InitUpstreamClient(nil)
+
+	for i := 0; i < 5; i++ {
+		spt, err := adal.NewServicePrincipalTokenFromMSI(imds.URL, "resource")
+		if err != nil {
+			t.Fatalf("expected nil error, got: %+v", err)
+		}
+		setSender(spt)
+		if err := spt.Refresh(); err != nil {
+			t.Fatalf("expected token request %d to succeed, got: %+v", i, err)
+		}
+	}
+
+	mu.Lock()
+	if newConns != 1 {
+		t.Errorf("expected sequential token requests to reuse a single connection, got %d connections", newConns)
+	}
+	mu.Unlock()
+	if n := openUpstreamConnections(); n != 1 {
+		t.Errorf("expected 1 open upstream connection, got %d", n)
+	}
+
+	transport.CloseIdleConnections()
+	if n := openUpstreamConnections(); n != 0 {
+		t.Errorf("expected no open upstream connection after closing the idle connections, got %d", n)
+	}
+}
+
+func TestUpstreamTransportKeepsAlive(t *testing.T) {
+	transport := NewUpstreamTransport(5, time.Minute)
+	if transport.DisableKeepAlives {
+		t.Error("expected keep-alives to be enabled")
+	}
+	if transport.MaxIdleConnsPerHost != 5 || transport.IdleConnTimeout != time.Minute {
+		t.Errorf("expected 5 idle connections per host for 1m, got %d for %s", transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+}
+
+func openUpstreamConnections() int64 {
+	upstreamConnectionsMu.Lock()
+	defer upstreamConnectionsMu.Unlock()
+
+	return upstreamConnections
+}
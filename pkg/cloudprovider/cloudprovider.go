@@ -1,6 +1,7 @@
 package cloudprovider
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -21,18 +22,44 @@ import (
 	"k8s.io/klog"
 )
 
+// SystemAssignedTag is the tag MIC sets on the VM or VMSS it enabled the system assigned identity
+// of, so it only disables the identities it enabled, including across restarts and failovers
+const SystemAssignedTag = "aad-pod-identity-system-assigned"
+
+// maxStaleETagRetries is the number of times the read-modify-write of the identities
+// is retried when the write is rejected because the resource was modified since it was read.
+const maxStaleETagRetries = 5
+
+// ErrStaleETag is returned when an update is rejected because the ETag the resource was
+// read with no longer matches the ETag of the resource in ARM.
+var ErrStaleETag = errors.New("resource was modified since it was read (etag mismatch)")
+
+// ErrComputeResourceNotFound is returned when the VM or VMSS of a node is not found in ARM, such as
+// when it was deleted before the node was removed from the cluster.
+var ErrComputeResourceNotFound = errors.New("compute resource not found")
+
+// ErrHybridMachineUserMSINotSupported is returned when user assigned identities are added to an Azure Arc
+// machine. The hybrid compute API only supports the system assigned identity of the machine.
+var ErrHybridMachineUserMSINotSupported = errors.New("user assigned identities cannot be assigned to Azure Arc machines")
+
 // Client is a cloud provider client
 type Client struct {
-	VMClient   VMClientInt
-	VMSSClient VMSSClientInt
-	ExtClient  compute.VirtualMachineExtensionsClient
-	Config     config.AzureConfig
+	VMClient     VMClientInt
+	VMSSClient   VMSSClientInt
+	MSIClient    MSIClientInt
+	HybridClient HybridMachineClientInt
+	ExtClient    compute.VirtualMachineExtensionsClient
+	Config       config.AzureConfig
 }
 
 // ClientInt client interface
 type ClientInt interface {
 	UpdateUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs []string, name string, isvmss bool) error
 	GetUserMSIs(name string, isvmss bool) ([]string, error)
+	GetUserMSIResourceID(resourceGroup, name string) (string, error)
+	UpdateHybridMachineUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs []string, subscriptionID, resourceGroup, name string) error
+	GetHybridMachineUserMSIs(subscriptionID, resourceGroup, name string) ([]string, error)
+	UpdateSystemAssignedIdentity(enable bool, name string, isvmss bool) (bool, error)
 }
 
 // NewCloudProvider returns a azure cloud provider client
@@ -136,6 +163,16 @@ func NewCloudProvider(configFile string) (c *Client, e error) {
 		klog.Errorf("Create VM Client error: %+v", err)
 		return nil, err
 	}
+	client.MSIClient, err = NewMSIClient(azureConfig, spt)
+	if err != nil {
+		klog.Errorf("Create MSI Client error: %+v", err)
+		return nil, err
+	}
+	client.HybridClient, err = NewHybridMachineClient(azureConfig, spt)
+	if err != nil {
+		klog.Errorf("Create Hybrid Machine Client error: %+v", err)
+		return nil, err
+	}
 
 	return client, nil
 }
@@ -165,10 +202,46 @@ func (c *Client) GetUserMSIs(name string, isvmss bool) ([]string, error) {
 	return idList, nil
 }
 
+// GetUserMSIResourceID resolves the user assigned identity with the given name in the resource group
+// of the configured subscription and returns its resource id. The resource group of the cloud config
+// is used when no resource group is given.
+func (c *Client) GetUserMSIResourceID(resourceGroup, name string) (string, error) {
+	if resourceGroup == "" {
+		resourceGroup = c.Config.ResourceGroupName
+	}
+	id, err := c.MSIClient.Get(resourceGroup, name)
+	if err != nil {
+		if id.Response.Response != nil && id.StatusCode == http.StatusNotFound {
+			return "", fmt.Errorf("user assigned identity %s not found in resource group %s of subscription %s", name, resourceGroup, c.Config.SubscriptionID)
+		}
+		return "", err
+	}
+	if id.ID == nil {
+		return "", fmt.Errorf("user assigned identity %s in resource group %s has no resource id", name, resourceGroup)
+	}
+	return *id.ID, nil
+}
+
 // UpdateUserMSI will batch process the removal and addition of ids
+// The read-modify-write is retried when the write is rejected because another client
+// modified the resource between the read and the write, so their changes are not lost.
 func (c *Client) UpdateUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs []string, name string, isvmss bool) error {
+	err := c.updateUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs, name, isvmss)
+	for retry := 1; err == ErrStaleETag && retry <= maxStaleETagRetries; retry++ {
+		klog.Warningf("Identities on %s were modified since they were read, retrying update (retry %d of %d)", name, retry, maxStaleETagRetries)
+		err = c.updateUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs, name, isvmss)
+	}
+	return err
+}
+
+func (c *Client) updateUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs []string, name string, isvmss bool) error {
 	idH, updateFunc, err := c.getIdentityResource(name, isvmss)
 	if err != nil {
+		// no identity is left on a deleted VM or VMSS, so there is nothing to remove
+		if err == ErrComputeResourceNotFound && len(addUserAssignedMSIIDs) == 0 {
+			klog.Infof("%s not found, nothing to remove", name)
+			return nil
+		}
 		return err
 	}
 
@@ -199,31 +272,170 @@ func (c *Client) UpdateUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs [
 	return nil
 }
 
+// UpdateSystemAssignedIdentity enables or disables the system assigned identity of the VM or VMSS
+// and returns true if it was changed. The user assigned identities are kept. Enabling the identity
+// sets the SystemAssignedTag on the resource in the same update, and the identity is only disabled
+// when the resource carries the tag, so an identity enabled by other means is left enabled, also
+// after MIC restarted. The read-modify-write is retried on a stale ETag like UpdateUserMSI.
+func (c *Client) UpdateSystemAssignedIdentity(enable bool, name string, isvmss bool) (bool, error) {
+	changed, err := c.updateSystemAssignedIdentity(enable, name, isvmss)
+	for retry := 1; err == ErrStaleETag && retry <= maxStaleETagRetries; retry++ {
+		klog.Warningf("Identities on %s were modified since they were read, retrying update (retry %d of %d)", name, retry, maxStaleETagRetries)
+		changed, err = c.updateSystemAssignedIdentity(enable, name, isvmss)
+	}
+	return changed, err
+}
+
+func (c *Client) updateSystemAssignedIdentity(enable bool, name string, isvmss bool) (bool, error) {
+	idH, updateFunc, err := c.getIdentityResource(name, isvmss)
+	if err != nil {
+		if err == ErrComputeResourceNotFound && !enable {
+			klog.Infof("%s not found, nothing to disable", name)
+			return false, nil
+		}
+		return false, err
+	}
+
+	info := idH.IdentityInfo()
+	if enable {
+		if info == nil {
+			info = idH.ResetIdentity()
+		}
+		if !info.SetSystemAssigned(true) {
+			return false, nil
+		}
+	} else {
+		if !hasSystemAssignedTag(idH) {
+			return false, nil
+		}
+		// the tag is removed even when the identity was disabled by other means
+		if info != nil {
+			info.SetSystemAssigned(false)
+		}
+	}
+	setSystemAssignedTag(idH, enable)
+
+	klog.Infof("Updating system assigned identity on %s, enabled: %t", name, enable)
+	timeStarted := time.Now()
+	if err := updateFunc(); err != nil {
+		return false, err
+	}
+	klog.V(6).Infof("UpdateSystemAssignedIdentity of %s completed in %s", name, time.Since(timeStarted))
+	return true, nil
+}
+
+// GetHybridMachineUserMSIs returns the list of user assigned identities on the Azure Arc machine in
+// the resource group of the subscription. Azure Arc machines only have a system assigned identity,
+// so the list is always empty once the machine is found.
+func (c *Client) GetHybridMachineUserMSIs(subscriptionID, resourceGroup, name string) ([]string, error) {
+	if _, err := c.HybridClient.Get(subscriptionID, resourceGroup, name); err != nil {
+		klog.Errorf("GetHybridMachineUserMSIs: get machine %s failed with error %v", name, err)
+		return nil, err
+	}
+	return nil, nil
+}
+
+// UpdateHybridMachineUserMSI processes the removal and addition of ids on the Azure Arc machine.
+// Adding ids fails with ErrHybridMachineUserMSINotSupported. Removing ids succeeds without an
+// update as no user assigned identity can be on the machine, including when the machine was deleted.
+func (c *Client) UpdateHybridMachineUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs []string, subscriptionID, resourceGroup, name string) error {
+	machine, err := c.HybridClient.Get(subscriptionID, resourceGroup, name)
+	if err != nil {
+		if len(addUserAssignedMSIIDs) == 0 && machine.Response.Response != nil && machine.StatusCode == http.StatusNotFound {
+			klog.Infof("Azure Arc machine %s not found, nothing to remove", name)
+			return nil
+		}
+		return err
+	}
+	if len(addUserAssignedMSIIDs) > 0 {
+		return ErrHybridMachineUserMSINotSupported
+	}
+	return nil
+}
+
+// hasSystemAssignedTag returns true if the resource carries the SystemAssignedTag
+func hasSystemAssignedTag(idH IdentityHolder) bool {
+	value, ok := idH.Tags()[SystemAssignedTag]
+	return ok && value != nil && *value == "true"
+}
+
+// setSystemAssignedTag adds or removes the SystemAssignedTag, keeping the other tags
+func setSystemAssignedTag(idH IdentityHolder, set bool) {
+	tags := make(map[string]*string)
+	for k, v := range idH.Tags() {
+		tags[k] = v
+	}
+	if set {
+		value := "true"
+		tags[SystemAssignedTag] = &value
+	} else {
+		delete(tags, SystemAssignedTag)
+	}
+	idH.SetTags(tags)
+}
+
 func (c *Client) getIdentityResource(name string, isvmss bool) (idH IdentityHolder, update func() error, retErr error) {
 	rg := c.Config.ResourceGroupName
 
 	if isvmss {
 		vmss, err := c.VMSSClient.Get(rg, name)
 		if err != nil {
+			if vmss.Response.Response != nil && vmss.StatusCode == http.StatusNotFound {
+				klog.Warningf("VMSS %s not found, error: %v", name, err)
+				return nil, nil, ErrComputeResourceNotFound
+			}
 			return nil, nil, err
 		}
 
+		holder := &vmssIdentityHolder{vmss: &vmss}
 		update = func() error {
-			return c.VMSSClient.UpdateIdentities(rg, name, vmss)
+			updated := vmss
+			if !holder.tagsChanged {
+				updated.Tags = nil
+			}
+			return c.VMSSClient.UpdateIdentities(rg, name, updated)
 		}
-		idH = &vmssIdentityHolder{&vmss}
-		return idH, update, nil
+		return holder, update, nil
 	}
 
 	vm, err := c.VMClient.Get(rg, name)
 	if err != nil {
+		if vm.Response.Response != nil && vm.StatusCode == http.StatusNotFound {
+			klog.Warningf("VM %s not found, error: %v", name, err)
+			return nil, nil, ErrComputeResourceNotFound
+		}
 		return nil, nil, err
 	}
+	holder := &vmIdentityHolder{vm: &vm}
 	update = func() error {
-		return c.VMClient.UpdateIdentities(rg, name, vm)
+		updated := vm
+		if !holder.tagsChanged {
+			updated.Tags = nil
+		}
+		return c.VMClient.UpdateIdentities(rg, name, updated)
 	}
-	idH = &vmIdentityHolder{&vm}
-	return idH, update, nil
+	return holder, update, nil
+}
+
+// etagFromResponse returns the ETag of the response the resource was read from
+func etagFromResponse(resp autorest.Response) string {
+	if resp.Response == nil {
+		return ""
+	}
+	return resp.Header.Get("ETag")
+}
+
+// withIfMatch makes the request conditional on the resource still having the given ETag.
+// The request is left unconditional when the resource was read without an ETag.
+func withIfMatch(req *http.Request, etag string) {
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+}
+
+// isPreconditionFailed reports whether the write was rejected because of a stale ETag
+func isPreconditionFailed(resp *http.Response) bool {
+	return resp != nil && resp.StatusCode == http.StatusPreconditionFailed
 }
 
 const nestedResourceIDPatternText = `(?i)subscriptions/(.+)/resourceGroups/(.+)/providers/(.+?)/(.+?)/(.+?)/(.+)`
@@ -1,16 +1,21 @@
 package cloudprovider
 
 import (
+	"fmt"
+	"net/http"
 	"reflect"
 	"sort"
 	"testing"
 
 	"github.com/Azure/aad-pod-identity/pkg/config"
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-12-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/msi/mgmt/2018-11-30/msi"
+	"github.com/Azure/azure-sdk-for-go/services/preview/hybridcompute/mgmt/2019-12-12/hybridcompute"
 )
 
 func TestParseResourceID(t *testing.T) {
@@ -199,6 +204,10 @@ func (c *TestVMClient) UpdateIdentities(rg, nodeName string, vm compute.VirtualM
 		}
 	}
 
+	// tags are only sent when they were changed
+	if vm.Tags == nil && c.nodeMap[nodeName] != nil {
+		vm.Tags = c.nodeMap[nodeName].Tags
+	}
 	c.nodeMap[nodeName] = &vm
 	return nil
 }
@@ -290,6 +299,10 @@ func (c *TestVMSSClient) UpdateIdentities(rg, nodeName string, vmss compute.Virt
 		}
 	}
 
+	// tags are only sent when they were changed
+	if vmss.Tags == nil && c.nodeMap[nodeName] != nil {
+		vmss.Tags = c.nodeMap[nodeName].Tags
+	}
 	c.nodeMap[nodeName] = &vmss
 	return nil
 }
@@ -428,3 +441,320 @@ func NewTestCloudClient(cfg config.AzureConfig) *TestCloudClient {
 		vmssClient,
 	}
 }
+
+// TestConcurrentVMClient is a VM client which versions the VM with an ETag and rejects
+// writes made with a stale ETag. The modify func is called between the read and the
+// write to simulate another client modifying the VM concurrently.
+type TestConcurrentVMClient struct {
+	*TestVMClient
+	version int
+	modify  func(c *TestConcurrentVMClient) bool
+}
+
+func (c *TestConcurrentVMClient) etag() string {
+	return fmt.Sprintf("W/\"%d\"", c.version)
+}
+
+func (c *TestConcurrentVMClient) Get(rgName string, nodeName string) (compute.VirtualMachine, error) {
+	vm, err := c.TestVMClient.Get(rgName, nodeName)
+	if err != nil {
+		return vm, err
+	}
+	if vm.Identity == nil {
+		vm.Identity = &compute.VirtualMachineIdentity{}
+	}
+	vm.Response = autorest.Response{Response: &http.Response{Header: http.Header{"Etag": []string{c.etag()}}}}
+	return vm, nil
+}
+
+func (c *TestConcurrentVMClient) UpdateIdentities(rg, nodeName string, vm compute.VirtualMachine) error {
+	if c.modify != nil && c.modify(c) {
+		// another client has updated the vm since it was read
+		c.version++
+	}
+	if etagFromResponse(vm.Response) != c.etag() {
+		return ErrStaleETag
+	}
+	c.version++
+	return c.TestVMClient.UpdateIdentities(rg, nodeName, vm)
+}
+
+func TestUpdateUserMSIConcurrentModification(t *testing.T) {
+	vmClient := &TestConcurrentVMClient{TestVMClient: NewTestVMClient()}
+	cloudClient := &TestCloudClient{
+		Client:         &Client{VMClient: vmClient, VMSSClient: NewTestVMSSClient()},
+		testVMClient:   vmClient.TestVMClient,
+		testVMSSClient: NewTestVMSSClient(),
+	}
+
+	if err := cloudClient.UpdateUserMSI([]string{"ID0"}, nil, "node0", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// another client attaches an identity to the vm between our read and write, twice
+	concurrent := []string{"ID1", "ID2"}
+	vmClient.modify = func(c *TestConcurrentVMClient) bool {
+		if len(concurrent) == 0 {
+			return false
+		}
+		c.nodeIDs["node0"][concurrent[0]] = true
+		concurrent = concurrent[1:]
+		return true
+	}
+	if err := cloudClient.UpdateUserMSI([]string{"ID3"}, nil, "node0", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cloudClient.CompareMSI("node0", false, []string{"ID0", "ID1", "ID2", "ID3"}) {
+		cloudClient.PrintMSI(t)
+		t.Error("MSI mismatch, identities were lost on concurrent modification")
+	}
+
+	// the vm is modified on every attempt, the update is given up after the retries
+	vmClient.modify = func(c *TestConcurrentVMClient) bool {
+		return true
+	}
+	if err := cloudClient.UpdateUserMSI([]string{"ID4"}, nil, "node0", false); err != ErrStaleETag {
+		t.Fatalf("expected error %v, got: %v", ErrStaleETag, err)
+	}
+	if !cloudClient.CompareMSI("node0", false, []string{"ID0", "ID1", "ID2", "ID3"}) {
+		cloudClient.PrintMSI(t)
+		t.Error("MSI mismatch")
+	}
+}
+
+func TestUpdateSystemAssignedIdentity(t *testing.T) {
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+
+	systemAssignedType := func() compute.ResourceIdentityType {
+		return cloudClient.testVMClient.nodeMap["node0"].Identity.Type
+	}
+	tagged := func() bool {
+		_, ok := cloudClient.testVMClient.nodeMap["node0"].Tags[SystemAssignedTag]
+		return ok
+	}
+
+	if err := cloudClient.UpdateUserMSI([]string{"ID0"}, nil, "node0", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// disabling the identity of a vm without system assigned identity doesn't update it
+	changed, err := cloudClient.UpdateSystemAssignedIdentity(false, "node0", false)
+	if err != nil || changed {
+		t.Fatalf("expected no change, got changed: %t, err: %v", changed, err)
+	}
+
+	changed, err = cloudClient.UpdateSystemAssignedIdentity(true, "node0", false)
+	if err != nil || !changed {
+		t.Fatalf("expected change, got changed: %t, err: %v", changed, err)
+	}
+	if systemAssignedType() != compute.ResourceIdentityTypeSystemAssignedUserAssigned {
+		t.Fatalf("expected identity type %s, got: %s", compute.ResourceIdentityTypeSystemAssignedUserAssigned, systemAssignedType())
+	}
+	if !cloudClient.CompareMSI("node0", false, []string{"ID0"}) {
+		cloudClient.PrintMSI(t)
+		t.Error("MSI mismatch, user assigned identities were changed")
+	}
+	if !tagged() {
+		t.Fatalf("expected node0 to be tagged with %s", SystemAssignedTag)
+	}
+
+	// the tag is kept by the updates of the user assigned identities
+	if err := cloudClient.UpdateUserMSI([]string{"ID1"}, nil, "node0", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !tagged() {
+		t.Fatalf("expected node0 to keep the tag %s", SystemAssignedTag)
+	}
+
+	// already enabled
+	changed, err = cloudClient.UpdateSystemAssignedIdentity(true, "node0", false)
+	if err != nil || changed {
+		t.Fatalf("expected no change, got changed: %t, err: %v", changed, err)
+	}
+
+	changed, err = cloudClient.UpdateSystemAssignedIdentity(false, "node0", false)
+	if err != nil || !changed {
+		t.Fatalf("expected change, got changed: %t, err: %v", changed, err)
+	}
+	if systemAssignedType() != compute.ResourceIdentityTypeUserAssigned {
+		t.Fatalf("expected identity type %s, got: %s", compute.ResourceIdentityTypeUserAssigned, systemAssignedType())
+	}
+	if !cloudClient.CompareMSI("node0", false, []string{"ID0", "ID1"}) {
+		cloudClient.PrintMSI(t)
+		t.Error("MSI mismatch, user assigned identities were changed")
+	}
+	if tagged() {
+		t.Fatalf("expected the tag %s to be removed from node0", SystemAssignedTag)
+	}
+
+	// a system assigned identity enabled by other means isn't disabled
+	cloudClient.testVMClient.nodeMap["node0"].Identity.Type = compute.ResourceIdentityTypeSystemAssignedUserAssigned
+	changed, err = cloudClient.UpdateSystemAssignedIdentity(false, "node0", false)
+	if err != nil || changed {
+		t.Fatalf("expected no change, got changed: %t, err: %v", changed, err)
+	}
+	if systemAssignedType() != compute.ResourceIdentityTypeSystemAssignedUserAssigned {
+		t.Fatalf("expected identity type %s, got: %s", compute.ResourceIdentityTypeSystemAssignedUserAssigned, systemAssignedType())
+	}
+}
+
+// TestErrorVMClient is a VM client whose Get fails with the given status code
+type TestErrorVMClient struct {
+	*TestVMClient
+	statusCode int
+}
+
+func (c *TestErrorVMClient) Get(rgName string, nodeName string) (compute.VirtualMachine, error) {
+	resp := autorest.Response{Response: &http.Response{StatusCode: c.statusCode}}
+	return compute.VirtualMachine{Response: resp}, autorest.NewErrorWithError(fmt.Errorf("get failed"), "compute.VirtualMachinesClient", "Get", resp.Response, "Failure responding to request")
+}
+
+func TestUpdateUserMSIComputeResourceNotFound(t *testing.T) {
+	vmClient := &TestErrorVMClient{TestVMClient: NewTestVMClient(), statusCode: http.StatusNotFound}
+	cloudClient := &Client{VMClient: vmClient, VMSSClient: NewTestVMSSClient()}
+
+	// removing identities from a deleted vm succeeds as no identity is left on it
+	if err := cloudClient.UpdateUserMSI(nil, []string{"ID0"}, "node0", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := cloudClient.UpdateSystemAssignedIdentity(false, "node0", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cloudClient.UpdateUserMSI([]string{"ID1"}, []string{"ID0"}, "node0", false); err != ErrComputeResourceNotFound {
+		t.Fatalf("expected error %v, got: %v", ErrComputeResourceNotFound, err)
+	}
+	if _, err := cloudClient.GetUserMSIs("node0", false); err != ErrComputeResourceNotFound {
+		t.Fatalf("expected error %v, got: %v", ErrComputeResourceNotFound, err)
+	}
+
+	// other errors are returned so the removal is retried
+	vmClient.statusCode = http.StatusInternalServerError
+	if err := cloudClient.UpdateUserMSI(nil, []string{"ID0"}, "node0", false); err == nil || err == ErrComputeResourceNotFound {
+		t.Fatalf("expected the get error, got: %v", err)
+	}
+}
+
+type TestMSIClient struct {
+	*MSIClient
+	identities map[string]string
+}
+
+func (c *TestMSIClient) Get(rgName string, name string) (msi.Identity, error) {
+	resourceID, ok := c.identities[rgName+"/"+name]
+	if !ok {
+		resp := autorest.Response{Response: &http.Response{StatusCode: http.StatusNotFound}}
+		return msi.Identity{Response: resp}, autorest.NewErrorWithError(fmt.Errorf("not found"), "msi.UserAssignedIdentitiesClient", "Get", resp.Response, "Failure responding to request")
+	}
+	return msi.Identity{ID: &resourceID}, nil
+}
+
+func TestGetUserMSIResourceID(t *testing.T) {
+	resourceID := "/subscriptions/fakeSub/resourceGroups/fakeGroup/providers/Microsoft.ManagedIdentity/userAssignedIdentities/test-msi"
+	cloudClient := &Client{
+		Config: config.AzureConfig{SubscriptionID: "fakeSub", ResourceGroupName: "fakeGroup"},
+		MSIClient: &TestMSIClient{identities: map[string]string{
+			"fakeGroup/test-msi": resourceID,
+		}},
+	}
+
+	for _, c := range []struct {
+		desc          string
+		resourceGroup string
+		name          string
+		expect        string
+		xErr          bool
+	}{
+		{"resource group of cloud config", "", "test-msi", resourceID, false},
+		{"explicit resource group", "fakeGroup", "test-msi", resourceID, false},
+		{"not found", "", "missing-msi", "", true},
+		{"not found in resource group", "otherGroup", "test-msi", "", true},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			r, err := cloudClient.GetUserMSIResourceID(c.resourceGroup, c.name)
+			if (err != nil) != c.xErr {
+				t.Fatalf("expected err==%v, got: %v", c.xErr, err)
+			}
+			if r != c.expect {
+				t.Fatalf("expected resource id %s, got: %s", c.expect, r)
+			}
+		})
+	}
+}
+
+type TestHybridMachineClient struct {
+	*HybridMachineClient
+	machines map[string]bool
+}
+
+func (c *TestHybridMachineClient) Get(subscriptionID string, rgName string, name string) (hybridcompute.Machine, error) {
+	if !c.machines[subscriptionID+"/"+rgName+"/"+name] {
+		resp := autorest.Response{Response: &http.Response{StatusCode: http.StatusNotFound}}
+		return hybridcompute.Machine{Response: resp}, autorest.NewErrorWithError(fmt.Errorf("not found"), "hybridcompute.MachinesClient", "Get", resp.Response, "Failure responding to request")
+	}
+	return hybridcompute.Machine{Name: &name}, nil
+}
+
+func TestUpdateHybridMachineUserMSI(t *testing.T) {
+	cloudClient := &Client{
+		HybridClient: &TestHybridMachineClient{machines: map[string]bool{
+			"arcSub/arcGroup/arc-machine1": true,
+		}},
+	}
+
+	for _, c := range []struct {
+		desc   string
+		add    []string
+		remove []string
+		name   string
+		expect error
+		xErr   bool
+	}{
+		{"add", []string{"ID0"}, nil, "arc-machine1", ErrHybridMachineUserMSINotSupported, true},
+		{"remove", nil, []string{"ID0"}, "arc-machine1", nil, false},
+		{"remove from deleted machine", nil, []string{"ID0"}, "arc-machine2", nil, false},
+		{"add to deleted machine", []string{"ID0"}, nil, "arc-machine2", nil, true},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			err := cloudClient.UpdateHybridMachineUserMSI(c.add, c.remove, "arcSub", "arcGroup", c.name)
+			if (err != nil) != c.xErr {
+				t.Fatalf("expected err==%v, got: %v", c.xErr, err)
+			}
+			if c.expect != nil && err != c.expect {
+				t.Fatalf("expected error %v, got: %v", c.expect, err)
+			}
+		})
+	}
+
+	ids, err := cloudClient.GetHybridMachineUserMSIs("arcSub", "arcGroup", "arc-machine1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("expected no user assigned identities, got: %v", ids)
+	}
+	if _, err := cloudClient.GetHybridMachineUserMSIs("arcSub", "arcGroup", "arc-machine2"); err == nil {
+		t.Fatalf("expected error for missing machine")
+	}
+	if _, err := cloudClient.GetHybridMachineUserMSIs("clusterSub", "arcGroup", "arc-machine1"); err == nil {
+		t.Fatalf("expected error for the machine looked up in another subscription")
+	}
+}
+
+func TestIsHybridMachine(t *testing.T) {
+	for _, c := range []struct {
+		providerID string
+		expect     bool
+	}{
+		{"azure:///subscriptions/fakeSub/resourceGroups/arcGroup/providers/Microsoft.HybridCompute/machines/arc-machine1", true},
+		{"azure:///subscriptions/fakeSub/resourceGroups/arcGroup/providers/microsoft.hybridcompute/machines/arc-machine1", true},
+		{"azure:///subscriptions/fakeSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachines/node1", false},
+		{"azure:///subscriptions/fakeSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachineScaleSets/vmss/virtualMachines/0", false},
+	} {
+		r, err := ParseResourceID(c.providerID)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %v", c.providerID, err)
+		}
+		if got := IsHybridMachine(r); got != c.expect {
+			t.Errorf("IsHybridMachine(%s) expected %v, got: %v", c.providerID, c.expect, got)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package cloudprovider
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Azure/aad-pod-identity/pkg/config"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	"github.com/Azure/aad-pod-identity/version"
+	"github.com/Azure/azure-sdk-for-go/services/preview/hybridcompute/mgmt/2019-12-12/hybridcompute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"k8s.io/klog"
+)
+
+const (
+	// HybridComputeProvider is the resource provider of Azure Arc machines
+	HybridComputeProvider = "Microsoft.HybridCompute"
+	// HybridMachineResourceType Azure Arc machine resource type
+	HybridMachineResourceType = "machines"
+)
+
+// HybridMachineClient client for Azure Arc machines. Azure Arc machines are usually in another
+// subscription than the cluster, so the machines are read in the subscription of their resource id.
+type HybridMachineClient struct {
+	client   hybridcompute.MachinesClient
+	reporter *metrics.Reporter
+}
+
+// HybridMachineClientInt is the interface used by "cloudprovider" for interacting with Azure Arc machines
+type HybridMachineClientInt interface {
+	Get(subscriptionID string, rgName string, name string) (hybridcompute.Machine, error)
+}
+
+// NewHybridMachineClient creates a new Azure Arc machine client.
+func NewHybridMachineClient(config config.AzureConfig, spt *adal.ServicePrincipalToken) (c *HybridMachineClient, e error) {
+	client := hybridcompute.NewMachinesClient(config.SubscriptionID)
+
+	azureEnv, err := azure.EnvironmentFromName(config.Cloud)
+	if err != nil {
+		klog.Errorf("Get cloud env error: %+v", err)
+		return nil, err
+	}
+	client.BaseURI = azureEnv.ResourceManagerEndpoint
+	client.Authorizer = autorest.NewBearerAuthorizer(spt)
+	client.AddToUserAgent(version.GetUserAgent("MIC", version.MICVersion))
+
+	reporter, err := metrics.NewReporter()
+	if err != nil {
+		klog.Errorf("New reporter error: %+v", err)
+		return nil, err
+	}
+
+	return &HybridMachineClient{
+		client:   client,
+		reporter: reporter,
+	}, nil
+}
+
+// Get gets the Azure Arc machine with the given name in the resource group of the subscription,
+// of the subscription of the cluster when the subscription id is empty.
+func (c *HybridMachineClient) Get(subscriptionID string, rgName string, name string) (hybridcompute.Machine, error) {
+	ctx := context.Background()
+	begin := time.Now()
+	var err error
+
+	defer func() {
+		if err != nil {
+			c.reporter.ReportCloudProviderOperationError(metrics.GetHybridMachineOperationName)
+			return
+		}
+		c.reporter.ReportCloudProviderOperationDuration(metrics.GetHybridMachineOperationName, time.Since(begin))
+	}()
+
+	client := c.client
+	if subscriptionID != "" {
+		client.SubscriptionID = subscriptionID
+	}
+	machine, err := client.Get(ctx, rgName, name, "")
+	if err != nil {
+		klog.Error(err)
+		return machine, err
+	}
+	return machine, nil
+}
+
+// IsHybridMachine returns true if the resource is an Azure Arc machine
+func IsHybridMachine(r azure.Resource) bool {
+	return strings.EqualFold(r.Provider, HybridComputeProvider) && strings.EqualFold(r.ResourceType, HybridMachineResourceType)
+}
@@ -10,6 +10,10 @@ import (
 type IdentityHolder interface {
 	IdentityInfo() IdentityInfo
 	ResetIdentity() IdentityInfo
+	// Tags returns the tags of the resource
+	Tags() map[string]*string
+	// SetTags replaces the tags of the resource, they're only sent on update once set
+	SetTags(tags map[string]*string)
 }
 
 // IdentityInfo is used to interact with different implementations of Azure compute identities.
@@ -19,6 +23,9 @@ type IdentityHolder interface {
 type IdentityInfo interface {
 	GetUserIdentityList() []string
 	SetUserIdentities(map[string]bool) bool
+	// SetSystemAssigned enables or disables the system assigned identity, keeping the user
+	// assigned identities, and returns true if it was changed
+	SetSystemAssigned(enabled bool) bool
 }
 
 func checkIfIDInList(idList []string, desiredID string) bool {
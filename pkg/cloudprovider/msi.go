@@ -0,0 +1,73 @@
+package cloudprovider
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/aad-pod-identity/pkg/config"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	"github.com/Azure/aad-pod-identity/version"
+	"github.com/Azure/azure-sdk-for-go/services/msi/mgmt/2018-11-30/msi"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"k8s.io/klog"
+)
+
+// MSIClient client for user assigned identities
+type MSIClient struct {
+	client   msi.UserAssignedIdentitiesClient
+	reporter *metrics.Reporter
+}
+
+// MSIClientInt is the interface used by "cloudprovider" for interacting with Azure user assigned identities
+type MSIClientInt interface {
+	Get(rgName string, name string) (msi.Identity, error)
+}
+
+// NewMSIClient creates a new user assigned identity client.
+func NewMSIClient(config config.AzureConfig, spt *adal.ServicePrincipalToken) (c *MSIClient, e error) {
+	client := msi.NewUserAssignedIdentitiesClient(config.SubscriptionID)
+
+	azureEnv, err := azure.EnvironmentFromName(config.Cloud)
+	if err != nil {
+		klog.Errorf("Get cloud env error: %+v", err)
+		return nil, err
+	}
+	client.BaseURI = azureEnv.ResourceManagerEndpoint
+	client.Authorizer = autorest.NewBearerAuthorizer(spt)
+	client.AddToUserAgent(version.GetUserAgent("MIC", version.MICVersion))
+
+	reporter, err := metrics.NewReporter()
+	if err != nil {
+		klog.Errorf("New reporter error: %+v", err)
+		return nil, err
+	}
+
+	return &MSIClient{
+		client:   client,
+		reporter: reporter,
+	}, nil
+}
+
+// Get gets the user assigned identity with the given name in the resource group.
+func (c *MSIClient) Get(rgName string, name string) (msi.Identity, error) {
+	ctx := context.Background()
+	begin := time.Now()
+	var err error
+
+	defer func() {
+		if err != nil {
+			c.reporter.ReportCloudProviderOperationError(metrics.GetUserAssignedIdentityOperationName)
+			return
+		}
+		c.reporter.ReportCloudProviderOperationDuration(metrics.GetUserAssignedIdentityOperationName, time.Since(begin))
+	}()
+
+	id, err := c.client.Get(ctx, rgName, name)
+	if err != nil {
+		klog.Error(err)
+		return id, err
+	}
+	return id, nil
+}
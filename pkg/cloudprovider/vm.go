@@ -77,7 +77,8 @@ func (c *VMClient) Get(rgName string, nodeName string) (compute.VirtualMachine,
 	return vm, nil
 }
 
-// UpdateIdentities updates the user assigned identities for the provided node
+// UpdateIdentities updates the user assigned identities for the provided node, and its tags when
+// they are set
 func (c *VMClient) UpdateIdentities(rg, nodeName string, vm compute.VirtualMachine) error {
 	var future compute.VirtualMachinesUpdateFuture
 	var err error
@@ -92,12 +93,25 @@ func (c *VMClient) UpdateIdentities(rg, nodeName string, vm compute.VirtualMachi
 		c.reporter.ReportCloudProviderOperationDuration(metrics.PutVMOperationName, time.Since(begin))
 	}()
 
-	if future, err = c.client.Update(ctx, rg, nodeName, compute.VirtualMachineUpdate{
-		Identity: vm.Identity}); err != nil {
+	req, err := c.client.UpdatePreparer(ctx, rg, nodeName, compute.VirtualMachineUpdate{
+		Identity: vm.Identity,
+		Tags:     vm.Tags})
+	if err != nil {
+		klog.Errorf("Failed to prepare VM update with error %v", err)
+		return err
+	}
+	withIfMatch(req, etagFromResponse(vm.Response))
+	if future, err = c.client.UpdateSender(req); err != nil {
+		if isPreconditionFailed(future.Response()) {
+			err = ErrStaleETag
+		}
 		klog.Errorf("Failed to update VM with error %v", err)
 		return err
 	}
 	if err = future.WaitForCompletionRef(ctx, c.client.Client); err != nil {
+		if isPreconditionFailed(future.Response()) {
+			err = ErrStaleETag
+		}
 		klog.Error(err)
 		return err
 	}
@@ -107,7 +121,8 @@ func (c *VMClient) UpdateIdentities(rg, nodeName string, vm compute.VirtualMachi
 }
 
 type vmIdentityHolder struct {
-	vm *compute.VirtualMachine
+	vm          *compute.VirtualMachine
+	tagsChanged bool
 }
 
 func (h *vmIdentityHolder) IdentityInfo() IdentityInfo {
@@ -122,6 +137,15 @@ func (h *vmIdentityHolder) ResetIdentity() IdentityInfo {
 	return h.IdentityInfo()
 }
 
+func (h *vmIdentityHolder) Tags() map[string]*string {
+	return h.vm.Tags
+}
+
+func (h *vmIdentityHolder) SetTags(tags map[string]*string) {
+	h.vm.Tags = tags
+	h.tagsChanged = true
+}
+
 type vmIdentityInfo struct {
 	info *compute.VirtualMachineIdentity
 }
@@ -169,7 +193,8 @@ func (i *vmIdentityInfo) SetUserIdentities(ids map[string]bool) bool {
 	// all identities are the node are to be removed
 	if len(nodeList) == 0 {
 		i.info.UserAssignedIdentities = nil
-		if i.info.Type == compute.ResourceIdentityTypeSystemAssignedUserAssigned {
+		// the system assigned identity is kept
+		if i.info.Type == compute.ResourceIdentityTypeSystemAssignedUserAssigned || i.info.Type == compute.ResourceIdentityTypeSystemAssigned {
 			i.info.Type = compute.ResourceIdentityTypeSystemAssigned
 		} else {
 			i.info.Type = compute.ResourceIdentityTypeNone
@@ -187,3 +212,32 @@ func (i *vmIdentityInfo) SetUserIdentities(ids map[string]bool) bool {
 	i.info.UserAssignedIdentities = userAssignedIdentities
 	return len(i.info.UserAssignedIdentities) > 0
 }
+
+func (i *vmIdentityInfo) SetSystemAssigned(enabled bool) bool {
+	systemAssigned := i.info.Type == compute.ResourceIdentityTypeSystemAssigned || i.info.Type == compute.ResourceIdentityTypeSystemAssignedUserAssigned
+	if systemAssigned == enabled {
+		return false
+	}
+
+	// the user assigned identities on the node are patched unchanged
+	userAssignedIdentities := make(map[string]*compute.VirtualMachineIdentityUserAssignedIdentitiesValue)
+	for id := range i.info.UserAssignedIdentities {
+		userAssignedIdentities[id] = &compute.VirtualMachineIdentityUserAssignedIdentitiesValue{}
+	}
+
+	switch {
+	case enabled && len(userAssignedIdentities) > 0:
+		i.info.Type = compute.ResourceIdentityTypeSystemAssignedUserAssigned
+	case enabled:
+		i.info.Type = compute.ResourceIdentityTypeSystemAssigned
+	case len(userAssignedIdentities) > 0:
+		i.info.Type = compute.ResourceIdentityTypeUserAssigned
+	default:
+		i.info.Type = compute.ResourceIdentityTypeNone
+	}
+	if len(userAssignedIdentities) == 0 {
+		userAssignedIdentities = nil
+	}
+	i.info.UserAssignedIdentities = userAssignedIdentities
+	return true
+}
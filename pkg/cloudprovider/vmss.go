@@ -53,7 +53,8 @@ func NewVMSSClient(config config.AzureConfig, spt *adal.ServicePrincipalToken) (
 	}, nil
 }
 
-// UpdateIdentities updates the user assigned identities for the provided node
+// UpdateIdentities updates the user assigned identities for the provided node, and its tags when
+// they are set
 func (c *VMSSClient) UpdateIdentities(rg, vmssName string, vmssIdentities compute.VirtualMachineScaleSet) error {
 	var future compute.VirtualMachineScaleSetsUpdateFuture
 	var err error
@@ -68,12 +69,25 @@ func (c *VMSSClient) UpdateIdentities(rg, vmssName string, vmssIdentities comput
 		c.reporter.ReportCloudProviderOperationDuration(metrics.PutVmssOperationName, time.Since(begin))
 	}()
 
-	if future, err = c.client.Update(ctx, rg, vmssName, compute.VirtualMachineScaleSetUpdate{
-		Identity: vmssIdentities.Identity}); err != nil {
-		klog.Errorf("Failed to update VM with error %v", err)
+	req, err := c.client.UpdatePreparer(ctx, rg, vmssName, compute.VirtualMachineScaleSetUpdate{
+		Identity: vmssIdentities.Identity,
+		Tags:     vmssIdentities.Tags})
+	if err != nil {
+		klog.Errorf("Failed to prepare VMSS update with error %v", err)
+		return err
+	}
+	withIfMatch(req, etagFromResponse(vmssIdentities.Response))
+	if future, err = c.client.UpdateSender(req); err != nil {
+		if isPreconditionFailed(future.Response()) {
+			err = ErrStaleETag
+		}
+		klog.Errorf("Failed to update VMSS with error %v", err)
 		return err
 	}
 	if err = future.WaitForCompletionRef(ctx, c.client.Client); err != nil {
+		if isPreconditionFailed(future.Response()) {
+			err = ErrStaleETag
+		}
 		klog.Error(err)
 		return err
 	}
@@ -106,7 +120,8 @@ func (c *VMSSClient) Get(rgName string, vmssName string) (ret compute.VirtualMac
 
 // vmssIdentityHolder implements `IdentityHolder` for vmss resources.
 type vmssIdentityHolder struct {
-	vmss *compute.VirtualMachineScaleSet
+	vmss        *compute.VirtualMachineScaleSet
+	tagsChanged bool
 }
 
 func (h *vmssIdentityHolder) IdentityInfo() IdentityInfo {
@@ -124,6 +139,15 @@ func (h *vmssIdentityHolder) ResetIdentity() IdentityInfo {
 	return h.IdentityInfo()
 }
 
+func (h *vmssIdentityHolder) Tags() map[string]*string {
+	return h.vmss.Tags
+}
+
+func (h *vmssIdentityHolder) SetTags(tags map[string]*string) {
+	h.vmss.Tags = tags
+	h.tagsChanged = true
+}
+
 type vmssIdentityInfo struct {
 	info *compute.VirtualMachineScaleSetIdentity
 }
@@ -171,7 +195,8 @@ func (i *vmssIdentityInfo) SetUserIdentities(ids map[string]bool) bool {
 	// all identities are the node are to be removed
 	if len(nodeList) == 0 {
 		i.info.UserAssignedIdentities = nil
-		if i.info.Type == compute.ResourceIdentityTypeSystemAssignedUserAssigned {
+		// the system assigned identity is kept
+		if i.info.Type == compute.ResourceIdentityTypeSystemAssignedUserAssigned || i.info.Type == compute.ResourceIdentityTypeSystemAssigned {
 			i.info.Type = compute.ResourceIdentityTypeSystemAssigned
 		} else {
 			i.info.Type = compute.ResourceIdentityTypeNone
@@ -189,3 +214,32 @@ func (i *vmssIdentityInfo) SetUserIdentities(ids map[string]bool) bool {
 	i.info.UserAssignedIdentities = userAssignedIdentities
 	return len(i.info.UserAssignedIdentities) > 0
 }
+
+func (i *vmssIdentityInfo) SetSystemAssigned(enabled bool) bool {
+	systemAssigned := i.info.Type == compute.ResourceIdentityTypeSystemAssigned || i.info.Type == compute.ResourceIdentityTypeSystemAssignedUserAssigned
+	if systemAssigned == enabled {
+		return false
+	}
+
+	// the user assigned identities on the vmss are patched unchanged
+	userAssignedIdentities := make(map[string]*compute.VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue)
+	for id := range i.info.UserAssignedIdentities {
+		userAssignedIdentities[id] = &compute.VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue{}
+	}
+
+	switch {
+	case enabled && len(userAssignedIdentities) > 0:
+		i.info.Type = compute.ResourceIdentityTypeSystemAssignedUserAssigned
+	case enabled:
+		i.info.Type = compute.ResourceIdentityTypeSystemAssigned
+	case len(userAssignedIdentities) > 0:
+		i.info.Type = compute.ResourceIdentityTypeUserAssigned
+	default:
+		i.info.Type = compute.ResourceIdentityTypeNone
+	}
+	if len(userAssignedIdentities) == 0 {
+		userAssignedIdentities = nil
+	}
+	i.info.UserAssignedIdentities = userAssignedIdentities
+	return true
+}
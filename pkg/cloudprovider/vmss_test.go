@@ -22,3 +22,37 @@ func TestSetUserIdentities(t *testing.T) {
 	update = testIdentityInfo.SetUserIdentities(map[string]bool{"id3": true, "id4": true, "id1": false})
 	assert.True(t, update)
 }
+
+func TestSetSystemAssigned(t *testing.T) {
+	testIdentityInfo := &vmssIdentityInfo{
+		info: &compute.VirtualMachineScaleSetIdentity{
+			Type: compute.ResourceIdentityTypeUserAssigned,
+			UserAssignedIdentities: map[string]*compute.VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue{
+				"id1": {},
+			},
+		},
+	}
+
+	// enabling keeps the user assigned identity
+	assert.True(t, testIdentityInfo.SetSystemAssigned(true))
+	assert.Equal(t, compute.ResourceIdentityTypeSystemAssignedUserAssigned, testIdentityInfo.info.Type)
+	assert.Equal(t, []string{"id1"}, testIdentityInfo.GetUserIdentityList())
+	// already enabled
+	assert.False(t, testIdentityInfo.SetSystemAssigned(true))
+	// disabling keeps the user assigned identity
+	assert.True(t, testIdentityInfo.SetSystemAssigned(false))
+	assert.Equal(t, compute.ResourceIdentityTypeUserAssigned, testIdentityInfo.info.Type)
+	assert.Equal(t, []string{"id1"}, testIdentityInfo.GetUserIdentityList())
+
+	// without user assigned identities
+	testIdentityInfo = &vmssIdentityInfo{
+		info: &compute.VirtualMachineScaleSetIdentity{},
+	}
+	assert.True(t, testIdentityInfo.SetSystemAssigned(true))
+	assert.Equal(t, compute.ResourceIdentityTypeSystemAssigned, testIdentityInfo.info.Type)
+	// removing the user assigned identities keeps the system assigned identity
+	testIdentityInfo.SetUserIdentities(map[string]bool{"id1": false})
+	assert.Equal(t, compute.ResourceIdentityTypeSystemAssigned, testIdentityInfo.info.Type)
+	assert.True(t, testIdentityInfo.SetSystemAssigned(false))
+	assert.Equal(t, compute.ResourceIdentityTypeNone, testIdentityInfo.info.Type)
+}
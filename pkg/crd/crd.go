@@ -13,6 +13,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/meta"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
@@ -41,6 +42,7 @@ type ClientInt interface {
 	RemoveAssignedIdentity(assignedIdentity *aadpodid.AzureAssignedIdentity) error
 	CreateAssignedIdentity(assignedIdentity *aadpodid.AzureAssignedIdentity) error
 	UpdateAzureAssignedIdentityStatus(assignedIdentity *aadpodid.AzureAssignedIdentity, status string) error
+	UpdateAzureAssignedIdentityLabels(assignedIdentity *aadpodid.AzureAssignedIdentity, labels map[string]string) error
 	UpgradeAll() error
 	ListBindings() (res *[]aadpodid.AzureIdentityBinding, err error)
 	ListAssignedIDs() (res *[]aadpodid.AzureAssignedIdentity, err error)
@@ -316,6 +318,36 @@ func (c *Client) getObjectList(resource string, i runtime.Object) (runtime.Objec
 	return i, err
 }
 
+// ListPodAssignedIDs lists the AzureAssignedIdentities of the pod from the API server, selected by
+// their podname and podnamespace labels. Unlike the list methods of Client, it doesn't require the
+// informers to be started.
+func ListPodAssignedIDs(config *rest.Config, podName, podNamespace string) ([]aadpodid.AzureAssignedIdentity, error) {
+	r, err := newRestClient(config)
+	if err != nil {
+		return nil, err
+	}
+	options := v1.ListOptions{
+		LabelSelector: labels.Set{"podname": podName, "podnamespace": podNamespace}.String(),
+	}
+	body, err := r.Get().Namespace(v1.NamespaceAll).Resource(aadpodv1.AzureAssignedIDResource).VersionedParams(&options, v1.ParameterCodec).Do().Raw()
+	if err != nil {
+		return nil, fmt.Errorf("get failed for %s with error: %v", aadpodv1.AzureAssignedIDResource, err)
+	}
+	var list aadpodv1.AzureAssignedIdentityList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("unmarshal to object: %T, error: %v", list, err)
+	}
+
+	var res []aadpodid.AzureAssignedIdentity
+	for _, o := range list.Items {
+		if o.Spec.AzureIdentityRef == nil || o.Spec.AzureBindingRef == nil {
+			continue
+		}
+		res = append(res, aadpodv1.ConvertV1AssignedIdentityToInternalAssignedIdentity(o))
+	}
+	return res, nil
+}
+
 func (c *Client) setObject(resource, ns, name string, i interface{}) error {
 	err := c.rest.Put().Namespace(ns).Resource(resource).Name(name).Body(i).Do().Into(nil)
 	if err != nil {
@@ -714,3 +746,36 @@ func (c *Client) UpdateAzureAssignedIdentityStatus(assignedIdentity *aadpodid.Az
 	klog.V(5).Infof("Patch of %s took: %v", assignedIdentity.Name, time.Since(begin))
 	return err
 }
+
+// UpdateAzureAssignedIdentityLabels sets the labels on the AzureAssignedIdentity, keeping its other labels
+func (c *Client) UpdateAzureAssignedIdentityLabels(assignedIdentity *aadpodid.AzureAssignedIdentity, labels map[string]string) (err error) {
+	klog.Infof("Updating assigned identity %s/%s labels to %v", assignedIdentity.Namespace, assignedIdentity.Name, labels)
+
+	defer func() {
+		if err != nil {
+			c.reporter.ReportKubernetesAPIOperationError(metrics.UpdateAzureAssignedIdentityLabelsOperationName)
+		}
+	}()
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": labels,
+		},
+	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	begin := time.Now()
+	err = c.rest.
+		Patch(types.MergePatchType).
+		Namespace(assignedIdentity.Namespace).
+		Resource("azureassignedidentities").
+		Name(assignedIdentity.Name).
+		Body(patchBytes).
+		Do().
+		Error()
+	klog.V(5).Infof("Patch of %s labels took: %v", assignedIdentity.Name, time.Since(begin))
+	return err
+}
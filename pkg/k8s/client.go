@@ -44,6 +44,8 @@ type Client interface {
 	GetSecret(secretRef *v1.SecretReference) (*v1.Secret, error)
 	// ListPodIdentityExceptions returns list of azurepodidentityexceptions
 	ListPodIdentityExceptions(namespace string) (*[]aadpodid.AzurePodIdentityException, error)
+	// ListAssignedIDsOnNode returns the azure assigned identities of the pods on the node
+	ListAssignedIDsOnNode(nodeName string) ([]aadpodid.AzureAssignedIdentity, error)
 }
 
 // KubeClient k8s client
@@ -245,6 +247,25 @@ func (c *KubeClient) ListPodIdentityExceptions(ns string) (*[]aadpodid.AzurePodI
 	return c.CrdClient.ListPodIdentityExceptions(ns)
 }
 
+// ListAssignedIDsOnNode lists the azure assigned identities of the pods on the node. Assigned
+// identities are only watched in standard mode.
+func (c *KubeClient) ListAssignedIDsOnNode(nodeName string) ([]aadpodid.AzureAssignedIdentity, error) {
+	if c.CrdClient.AssignedIDInformer == nil {
+		return nil, fmt.Errorf("azure assigned identities are not available in this operation mode")
+	}
+	list, err := c.CrdClient.ListAssignedIDs()
+	if err != nil {
+		return nil, err
+	}
+	var assignedIDs []aadpodid.AzureAssignedIdentity
+	for _, assignedID := range *list {
+		if assignedID.Spec.NodeName == nodeName {
+			assignedIDs = append(assignedIDs, assignedID)
+		}
+	}
+	return assignedIDs, nil
+}
+
 // GetSecret returns secret the secretRef represents
 func (c *KubeClient) GetSecret(secretRef *v1.SecretReference) (*v1.Secret, error) {
 	secret, err := c.ClientSet.CoreV1().Secrets(secretRef.Namespace).Get(secretRef.Name, metav1.GetOptions{})
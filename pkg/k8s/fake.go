@@ -43,6 +43,11 @@ func (c *FakeClient) ListPodIdentityExceptions(ns string) (*[]aadpodid.AzurePodI
 	return nil, nil
 }
 
+// ListAssignedIDsOnNode for node
+func (c *FakeClient) ListAssignedIDsOnNode(nodeName string) ([]aadpodid.AzureAssignedIdentity, error) {
+	return nil, nil
+}
+
 // GetSecret returns secret the secretRef represents
 func (c *FakeClient) GetSecret(secretRef *v1.SecretReference) (*v1.Secret, error) {
 	return nil, nil
@@ -27,6 +27,18 @@ const (
 	kubernetesAPIOperationsErrorsCountName = "kubernetes_api_operations_errors_count"
 	imdsOperationsErrorsCountName          = "imds_operations_errors_count"
 	imdsOperationsDurationName             = "imds_operations_duration_seconds"
+	micARMOperationsInFlightName           = "mic_arm_operations_in_flight"
+	micARMOperationsQueuedName             = "mic_arm_operations_queued"
+	micStuckAssignmentsName                = "mic_stuck_assignments"
+	micResyncPeriodName                    = "mic_resync_period_seconds"
+	micARMDriftCorrectionsCountName        = "mic_arm_drift_corrections_count"
+	nmiUpstreamConnectionsName             = "nmi_upstream_connections"
+	micIdentityCapacityExceededCountName   = "mic_identity_capacity_exceeded_count"
+	nmiStaleTokensServedCountName          = "nmi_stale_tokens_served_count"
+	micAPIWriteBackoffName                 = "mic_api_write_backoff_assigned_identities"
+	micAPIWriteErrorsCountName             = "mic_api_write_errors_count"
+	micIdentityOperationsCountName         = "mic_identity_operations_count"
+	micIdentityOperationsDurationName      = "mic_identity_operations_duration_seconds"
 
 	// AdalTokenFromMSIOperationName ...
 	AdalTokenFromMSIOperationName = "adal_token_msi"
@@ -42,16 +54,31 @@ const (
 	GetVMOperationName = "vm_get"
 	// PutVMOperationName ...
 	PutVMOperationName = "vm_create_or_update"
+	// GetUserAssignedIdentityOperationName ...
+	GetUserAssignedIdentityOperationName = "user_assigned_identity_get"
+	// GetHybridMachineOperationName ...
+	GetHybridMachineOperationName = "hybrid_machine_get"
 	// AssignedIdentityDeletionOperationName ...
 	AssignedIdentityDeletionOperationName = "assigned_identity_deletion"
 	// AssignedIdentityAdditionOperationName ...
 	AssignedIdentityAdditionOperationName = "assigned_identity_addition"
 	// UpdateAzureAssignedIdentityStatusOperationName ...
 	UpdateAzureAssignedIdentityStatusOperationName = "update_azure_assigned_identity_status"
+	// UpdateAzureAssignedIdentityLabelsOperationName ...
+	UpdateAzureAssignedIdentityLabelsOperationName = "update_azure_assigned_identity_labels"
 	// GetPodListOperationName
 	GetPodListOperationName = "get_pod_list"
 	// GetSecretOperationName
 	GetSecretOperationName = "get_secret"
+	// IdentityAssignmentOperationName ...
+	IdentityAssignmentOperationName = "identity_assignment"
+	// IdentityRemovalOperationName ...
+	IdentityRemovalOperationName = "identity_removal"
+
+	// ResultSuccess is the result of the operations that succeeded
+	ResultSuccess = "success"
+	// ResultFailure is the result of the operations that failed
+	ResultFailure = "failure"
 )
 
 // The following variables are measures
@@ -132,6 +159,78 @@ var (
 		imdsOperationsDurationName,
 		"Duration in seconds of imds token operations",
 		stats.UnitMilliseconds)
+
+	// MICARMOperationsInFlightM is a measure that tracks the number of VM and VMSS updates mic has in flight.
+	MICARMOperationsInFlightM = stats.Int64(
+		micARMOperationsInFlightName,
+		"Number of VM and VMSS updates in flight in mic",
+		stats.UnitDimensionless)
+
+	// MICARMOperationsQueuedM is a measure that tracks the number of VM and VMSS updates waiting for the concurrency limit in mic.
+	MICARMOperationsQueuedM = stats.Int64(
+		micARMOperationsQueuedName,
+		"Number of VM and VMSS updates waiting for the concurrency limit in mic",
+		stats.UnitDimensionless)
+
+	// MICStuckAssignmentsM is a measure that tracks the number of assigned identities waiting to be assigned for longer than the stuck assignment threshold.
+	MICStuckAssignmentsM = stats.Int64(
+		micStuckAssignmentsName,
+		"Number of assigned identities waiting to be assigned for longer than the stuck assignment threshold",
+		stats.UnitDimensionless)
+
+	// MICResyncPeriodM is a measure that tracks the current interval of the periodic sync in mic.
+	MICResyncPeriodM = stats.Float64(
+		micResyncPeriodName,
+		"Current interval of the periodic sync in mic, in seconds",
+		stats.UnitMilliseconds)
+
+	// MICARMDriftCorrectionsCountM is a measure that tracks the cumulative number of identities re-attached to or detached from VMs and VMSS to correct drift from the assigned identities.
+	MICARMDriftCorrectionsCountM = stats.Int64(
+		micARMDriftCorrectionsCountName,
+		"Total number of identities re-attached to or detached from VMs and VMSS to correct drift from the assigned identities",
+		stats.UnitDimensionless)
+
+	// NMIUpstreamConnectionsM is a measure that tracks the number of open connections of nmi to IMDS and AAD.
+	NMIUpstreamConnectionsM = stats.Int64(
+		nmiUpstreamConnectionsName,
+		"Number of open connections of nmi to IMDS and AAD",
+		stats.UnitDimensionless)
+
+	// MICIdentityCapacityExceededCountM is a measure that tracks the cumulative number of assignments refused as the node reached the max identities per node.
+	MICIdentityCapacityExceededCountM = stats.Int64(
+		micIdentityCapacityExceededCountName,
+		"Total number of identity assignments refused as the VM or VMSS of the node reached the max identities per node",
+		stats.UnitDimensionless)
+
+	// NMIStaleTokensServedCountM is a measure that tracks the cumulative number of cached tokens served by nmi as acquiring a new token failed.
+	NMIStaleTokensServedCountM = stats.Int64(
+		nmiStaleTokensServedCountName,
+		"Total number of cached tokens served by nmi as acquiring a new token failed",
+		stats.UnitDimensionless)
+
+	// MICAPIWriteBackoffAssignedIdentitiesM is a measure that tracks the number of assigned identities whose writes to the api server are backing off in mic.
+	MICAPIWriteBackoffAssignedIdentitiesM = stats.Int64(
+		micAPIWriteBackoffName,
+		"Number of assigned identities whose writes to the api server are backing off after failing",
+		stats.UnitDimensionless)
+
+	// MICAPIWriteErrorsCountM is a measure that tracks the cumulative number of failed writes of assigned identities to the api server by mic.
+	MICAPIWriteErrorsCountM = stats.Int64(
+		micAPIWriteErrorsCountName,
+		"Total number of writes of assigned identities to the api server that failed in mic, by operation",
+		stats.UnitDimensionless)
+
+	// MICIdentityOperationsCountM is a measure that tracks the cumulative number of assignments and removals of identities to and from nodes by AzureIdentity and result.
+	MICIdentityOperationsCountM = stats.Int64(
+		micIdentityOperationsCountName,
+		"Total number of assignments and removals of identities to and from nodes in mic, by AzureIdentity",
+		stats.UnitDimensionless)
+
+	// MICIdentityOperationsDurationM is a measure that tracks the duration in seconds of assignments and removals of identities to and from nodes by AzureIdentity and result.
+	MICIdentityOperationsDurationM = stats.Float64(
+		micIdentityOperationsDurationName,
+		"Duration in seconds of assignments and removals of identities to and from nodes in mic, by AzureIdentity",
+		stats.UnitMilliseconds)
 )
 
 var (
@@ -139,6 +238,10 @@ var (
 	statusCodeKey    = tag.MustNewKey("status_code")
 	namespaceKey     = tag.MustNewKey("namespace")
 	resourceKey      = tag.MustNewKey("resource")
+
+	identityNamespaceKey = tag.MustNewKey("identity_namespace")
+	identityNameKey      = tag.MustNewKey("identity_name")
+	resultKey            = tag.MustNewKey("result")
 )
 
 const componentNamespace = "aadpodidentity"
@@ -222,6 +325,70 @@ func registerViews() error {
 			Aggregation: view.Distribution(0.01, 0.02, 0.05, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1, 2, 3, 4, 5, 10),
 			TagKeys:     []tag.Key{operationTypeKey},
 		},
+		&view.View{
+			Description: MICARMOperationsInFlightM.Description(),
+			Measure:     MICARMOperationsInFlightM,
+			Aggregation: view.LastValue(),
+		},
+		&view.View{
+			Description: MICARMOperationsQueuedM.Description(),
+			Measure:     MICARMOperationsQueuedM,
+			Aggregation: view.LastValue(),
+		},
+		&view.View{
+			Description: MICStuckAssignmentsM.Description(),
+			Measure:     MICStuckAssignmentsM,
+			Aggregation: view.LastValue(),
+		},
+		&view.View{
+			Description: MICResyncPeriodM.Description(),
+			Measure:     MICResyncPeriodM,
+			Aggregation: view.LastValue(),
+		},
+		&view.View{
+			Description: MICARMDriftCorrectionsCountM.Description(),
+			Measure:     MICARMDriftCorrectionsCountM,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{operationTypeKey},
+		},
+		&view.View{
+			Description: NMIUpstreamConnectionsM.Description(),
+			Measure:     NMIUpstreamConnectionsM,
+			Aggregation: view.LastValue(),
+		},
+		&view.View{
+			Description: MICIdentityCapacityExceededCountM.Description(),
+			Measure:     MICIdentityCapacityExceededCountM,
+			Aggregation: view.Count(),
+		},
+		&view.View{
+			Description: NMIStaleTokensServedCountM.Description(),
+			Measure:     NMIStaleTokensServedCountM,
+			Aggregation: view.Count(),
+		},
+		&view.View{
+			Description: MICAPIWriteBackoffAssignedIdentitiesM.Description(),
+			Measure:     MICAPIWriteBackoffAssignedIdentitiesM,
+			Aggregation: view.LastValue(),
+		},
+		&view.View{
+			Description: MICAPIWriteErrorsCountM.Description(),
+			Measure:     MICAPIWriteErrorsCountM,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{operationTypeKey},
+		},
+		&view.View{
+			Description: MICIdentityOperationsCountM.Description(),
+			Measure:     MICIdentityOperationsCountM,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{operationTypeKey, identityNamespaceKey, identityNameKey, resultKey},
+		},
+		&view.View{
+			Description: MICIdentityOperationsDurationM.Description(),
+			Measure:     MICIdentityOperationsDurationM,
+			Aggregation: view.Distribution(0.5, 1, 5, 10, 30, 60, 120, 300, 600, 900, 1200),
+			TagKeys:     []tag.Key{operationTypeKey, identityNamespaceKey, identityNameKey, resultKey},
+		},
 	}
 	err := view.Register(views...)
 	return err
@@ -294,6 +461,25 @@ func (r *Reporter) ReportOperation(operationType string, measurement stats.Measu
 	return nil
 }
 
+// ReportIdentityOperation records given measurements by operation type and result for the AzureIdentity with the given namespace and name.
+func (r *Reporter) ReportIdentityOperation(operationType, identityNamespace, identityName, result string, ms ...stats.Measurement) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ctx, err := tag.New(
+		r.ctx,
+		tag.Insert(operationTypeKey, operationType),
+		tag.Insert(identityNamespaceKey, identityNamespace),
+		tag.Insert(identityNameKey, identityName),
+		tag.Insert(resultKey, result),
+	)
+	if err != nil {
+		return err
+	}
+	record(ctx, ms...)
+	return nil
+}
+
 // RegisterAndExport register the views for the measures and expose via prometheus exporter
 func RegisterAndExport(port string) error {
 	err := registerViews()
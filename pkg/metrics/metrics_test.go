@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"sync"
 	"testing"
 
 	"go.opencensus.io/stats"
@@ -73,10 +74,16 @@ func testCounterMetric(t *testing.T, reporter *Reporter, m *stats.Int64Measure)
 	}
 }
 
+// registerOnce registers the views once for all the tests, as the distribution views can't be registered again
+var registerOnce sync.Once
+
 // initTest initialize the view and reporter for the test
 func initTest() (*Reporter, error) {
 	// initilize the views
-	err := registerViews()
+	var err error
+	registerOnce.Do(func() {
+		err = registerViews()
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -86,3 +93,50 @@ func initTest() (*Reporter, error) {
 	}
 	return reporter, nil
 }
+
+// TestIdentityOperationReport tests the counts of identity operations are broken down by identity and result
+func TestIdentityOperationReport(t *testing.T) {
+	reporter, err := initTest()
+	if err != nil {
+		t.Fatalf("Failed to initialize Test:%v", err)
+	}
+
+	reporter.ReportIdentityOperation(IdentityAssignmentOperationName, "default", "id1", ResultSuccess, MICIdentityOperationsCountM.M(1), MICIdentityOperationsDurationM.M(1))
+	reporter.ReportIdentityOperation(IdentityAssignmentOperationName, "default", "id1", ResultSuccess, MICIdentityOperationsCountM.M(1), MICIdentityOperationsDurationM.M(3))
+	reporter.ReportIdentityOperation(IdentityAssignmentOperationName, "default", "id2", ResultFailure, MICIdentityOperationsCountM.M(1), MICIdentityOperationsDurationM.M(2))
+
+	rows, err := view.RetrieveData(MICIdentityOperationsCountM.Name())
+	if err != nil {
+		t.Fatalf("Error when retrieving data: %v from %v", err, MICIdentityOperationsCountM.Name())
+	}
+	counts := make(map[string]int64)
+	for _, row := range rows {
+		tags := make(map[string]string)
+		for _, tag := range row.Tags {
+			tags[tag.Key.Name()] = tag.Value
+		}
+		counts[tags[identityNameKey.Name()]+"/"+tags[resultKey.Name()]] = row.Data.(*view.CountData).Value
+	}
+	if counts["id1/"+ResultSuccess] != 2 {
+		t.Errorf("Expected 2 successes of id1, got %d", counts["id1/"+ResultSuccess])
+	}
+	if counts["id2/"+ResultFailure] != 1 {
+		t.Errorf("Expected 1 failure of id2, got %d", counts["id2/"+ResultFailure])
+	}
+	if len(counts) != 2 {
+		t.Errorf("Expected 2 series, got %v", counts)
+	}
+
+	rows, err = view.RetrieveData(MICIdentityOperationsDurationM.Name())
+	if err != nil {
+		t.Fatalf("Error when retrieving data: %v from %v", err, MICIdentityOperationsDurationM.Name())
+	}
+	for _, row := range rows {
+		duration := row.Data.(*view.DistributionData)
+		for _, tag := range row.Tags {
+			if tag.Key.Name() == identityNameKey.Name() && tag.Value == "id1" && (duration.Count != 2 || duration.Max != 3) {
+				t.Errorf("Expected 2 durations of id1 up to 3 seconds, got %d up to %v", duration.Count, duration.Max)
+			}
+		}
+	}
+}
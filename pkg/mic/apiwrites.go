@@ -0,0 +1,161 @@
+package mic
+
+import (
+	"sync"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+const (
+	// DefaultAPIWriteBackoffBase and DefaultAPIWriteBackoffMax bound the delay before the writes of
+	// an assigned identity are retried after failing on the API server
+	DefaultAPIWriteBackoffBase = time.Second
+	DefaultAPIWriteBackoffMax  = 2 * time.Minute
+
+	// apiWriteSummaryInterval is the interval at which the writes failed or skipped while backing
+	// off are logged
+	apiWriteSummaryInterval = time.Minute
+)
+
+// errAPIWriteBackoff is the error of the writes skipped while their assigned identity backs off
+var errAPIWriteBackoff = errors.New("backing off after previous failures")
+
+// apiWriteError is the error of a write of an assigned identity that isn't reported on its own as
+// the writes to the API server are backing off. It is part of the periodic summary instead.
+type apiWriteError struct {
+	err error
+}
+
+func (e *apiWriteError) Error() string {
+	return e.err.Error()
+}
+
+// isSummarizedAPIWriteError returns true if the error of a write of an assigned identity is part of
+// the periodic summary of the writes backing off, rather than reported on its own
+func isSummarizedAPIWriteError(err error) bool {
+	_, ok := err.(*apiWriteError)
+	return ok
+}
+
+// apiWriteBackoff backs off the writes of the assigned identities failing on the API server, e.g.
+// while a webhook is down or etcd is slow, apart from the backoff of the ARM operations. The writes
+// of an assigned identity that failed are skipped by the syncs until its exponential delay is
+// over, and every assigned identity stops backing off as soon as a write succeeds again.
+type apiWriteBackoff struct {
+	limiter  workqueue.RateLimiter
+	reporter *metrics.Reporter
+
+	mu sync.Mutex
+	// notBefore is the time before which the writes of the assigned identities backing off are skipped
+	notBefore map[string]time.Time
+	// failed, skipped and lastErr are the writes failed and skipped since the last summary
+	failed      int
+	skipped     int
+	lastErr     error
+	lastSummary time.Time
+}
+
+// newAPIWriteBackoff returns a backoff with the delay from base doubling up to max
+func newAPIWriteBackoff(base, max time.Duration, reporter *metrics.Reporter) *apiWriteBackoff {
+	return &apiWriteBackoff{
+		limiter:   workqueue.NewItemExponentialFailureRateLimiter(base, max),
+		reporter:  reporter,
+		notBefore: make(map[string]time.Time),
+	}
+}
+
+// write runs the write of the assigned identity unless it's backing off. The error of a write
+// failing or skipped while the writes are backing off is an apiWriteError. The failed writes are
+// counted by operation.
+func (b *apiWriteBackoff) write(assignedID *aadpodid.AzureAssignedIdentity, operation string, write func() error) error {
+	if b == nil {
+		return write()
+	}
+	key := assignedID.Namespace + "/" + assignedID.Name
+	if !b.allow(key) {
+		return &apiWriteError{err: errors.Wrapf(errAPIWriteBackoff, "write of assigned identity %s skipped", key)}
+	}
+	err := write()
+	if b.done(key, operation, err) {
+		return err
+	}
+	return &apiWriteError{err: err}
+}
+
+// allow returns false if the writes of the assigned identity are backing off
+func (b *apiWriteBackoff) allow(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if notBefore, ok := b.notBefore[key]; ok && time.Now().Before(notBefore) {
+		b.skipped++
+		b.logSummary()
+		return false
+	}
+	return true
+}
+
+// done records the outcome of the write of the assigned identity and returns false if its error
+// isn't reported on its own, as the writes were already backing off
+func (b *apiWriteBackoff) done(key, operation string, err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if len(b.notBefore) > 0 {
+			klog.Infof("Write of assigned identity %s succeeded, %d assigned identities no longer backing off", key, len(b.notBefore))
+			for k := range b.notBefore {
+				b.limiter.Forget(k)
+			}
+			b.notBefore = make(map[string]time.Time)
+			b.report()
+		}
+		b.limiter.Forget(key)
+		return true
+	}
+
+	if b.reporter != nil {
+		b.reporter.ReportOperation(operation, metrics.MICAPIWriteErrorsCountM.M(1))
+	}
+	backingOff := len(b.notBefore) > 0
+	b.notBefore[key] = time.Now().Add(b.limiter.When(key))
+	b.failed++
+	b.lastErr = err
+	if !backingOff {
+		// the summaries start from the first failure
+		b.lastSummary = time.Now()
+	}
+	b.report()
+	b.logSummary()
+	return !backingOff
+}
+
+// logSummary logs the writes failed and skipped since the last summary, at most once per interval
+func (b *apiWriteBackoff) logSummary() {
+	if b.failed+b.skipped == 0 || time.Since(b.lastSummary) < apiWriteSummaryInterval {
+		return
+	}
+	klog.Errorf("%d writes of assigned identities failed and %d were skipped in the last %s, %d assigned identities backing off, last error: %v",
+		b.failed, b.skipped, time.Since(b.lastSummary).Round(time.Second), len(b.notBefore), b.lastErr)
+	b.failed, b.skipped = 0, 0
+	b.lastSummary = time.Now()
+}
+
+// backingOff returns the number of assigned identities whose writes are backing off
+func (b *apiWriteBackoff) backingOff() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.notBefore)
+}
+
+func (b *apiWriteBackoff) report() {
+	if b.reporter != nil {
+		b.reporter.Report(metrics.MICAPIWriteBackoffAssignedIdentitiesM.M(int64(len(b.notBefore))))
+	}
+}
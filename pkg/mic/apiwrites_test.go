@@ -0,0 +1,245 @@
+package mic
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	internalaadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity/v1"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// failingCrdClient fails the creates and removals of assigned identities with err when set
+type failingCrdClient struct {
+	*TestCrdClient
+	mu     sync.Mutex
+	err    error
+	writes int
+}
+
+func (c *failingCrdClient) setError(err error) {
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+}
+
+func (c *failingCrdClient) write() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes++
+	return c.err
+}
+
+func (c *failingCrdClient) CreateAssignedIdentity(assignedID *internalaadpodid.AzureAssignedIdentity) error {
+	if err := c.write(); err != nil {
+		return err
+	}
+	return c.TestCrdClient.CreateAssignedIdentity(assignedID)
+}
+
+func (c *failingCrdClient) RemoveAssignedIdentity(assignedID *internalaadpodid.AzureAssignedIdentity) error {
+	if err := c.write(); err != nil {
+		return err
+	}
+	return c.TestCrdClient.RemoveAssignedIdentity(assignedID)
+}
+
+func (c *failingCrdClient) getWrites() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes
+}
+
+func newTestAssignedID(name string) *internalaadpodid.AzureAssignedIdentity {
+	return &internalaadpodid.AzureAssignedIdentity{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: internalaadpodid.AzureAssignedIdentitySpec{
+			AzureBindingRef: &internalaadpodid.AzureIdentityBinding{ObjectMeta: v1.ObjectMeta{Name: "test-binding", Namespace: "default"}},
+			Pod:             name,
+			PodNamespace:    "default",
+			NodeName:        "test-node",
+		},
+	}
+}
+
+func TestAPIWriteBackoff(t *testing.T) {
+	b := newAPIWriteBackoff(time.Hour, time.Hour, nil)
+	writeErr := errors.New("admission webhook unavailable")
+	writes := 0
+	failing := func() error {
+		writes++
+		return writeErr
+	}
+
+	// the first failure is reported on its own
+	if err := b.write(newTestAssignedID("id1"), metrics.AssignedIdentityAdditionOperationName, failing); err != writeErr {
+		t.Fatalf("expected the error of the first failed write, got: %v", err)
+	}
+	// the writes of the assigned identity are skipped while backing off
+	err := b.write(newTestAssignedID("id1"), metrics.AssignedIdentityAdditionOperationName, failing)
+	if writes != 1 {
+		t.Fatalf("expected the write of the assigned identity backing off to be skipped, got %d writes", writes)
+	}
+	if !isSummarizedAPIWriteError(err) || !strings.Contains(err.Error(), errAPIWriteBackoff.Error()) {
+		t.Errorf("expected the skipped write to be summarized, got: %v", err)
+	}
+	// the failures of the other assigned identities are summarized while backing off
+	if err := b.write(newTestAssignedID("id2"), metrics.AssignedIdentityAdditionOperationName, failing); !isSummarizedAPIWriteError(err) {
+		t.Errorf("expected the failure while backing off to be summarized, got: %v", err)
+	}
+	if n := b.backingOff(); n != 2 {
+		t.Errorf("expected 2 assigned identities backing off, got %d", n)
+	}
+
+	// a write succeeding stops every assigned identity from backing off
+	if err := b.write(newTestAssignedID("id3"), metrics.AssignedIdentityAdditionOperationName, func() error { return nil }); err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+	if n := b.backingOff(); n != 0 {
+		t.Errorf("expected no assigned identity backing off once a write succeeded, got %d", n)
+	}
+	if err := b.write(newTestAssignedID("id1"), metrics.AssignedIdentityAdditionOperationName, failing); err != writeErr || writes != 3 {
+		t.Errorf("expected the write of the assigned identity to be retried and reported, got %d writes and error %v", writes, err)
+	}
+}
+
+// apiWriteErrorsCount returns the count of the failed writes of the operation
+func apiWriteErrorsCount(t *testing.T, viewName, operation string) int64 {
+	rows, err := view.RetrieveData(viewName)
+	if err != nil {
+		t.Fatalf("failed to retrieve the api write errors: %v", err)
+	}
+	for _, row := range rows {
+		for _, tag := range row.Tags {
+			if tag.Key.Name() == "operation_type" && tag.Value == operation {
+				return row.Data.(*view.CountData).Value
+			}
+		}
+	}
+	return 0
+}
+
+func TestAPIWriteErrorsCount(t *testing.T) {
+	// count view of the failed writes broken down like the exported view, the views of the metrics
+	// package not being registered in the tests
+	v := &view.View{
+		Name:        "test_mic_api_write_errors_count",
+		Measure:     metrics.MICAPIWriteErrorsCountM,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{tag.MustNewKey("operation_type")},
+	}
+	if err := view.Register(v); err != nil {
+		t.Fatalf("failed to register the api write errors view: %v", err)
+	}
+	defer view.Unregister(v)
+
+	reporter, err := metrics.NewReporter()
+	if err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	b := newAPIWriteBackoff(time.Hour, time.Hour, reporter)
+	failing := func() error { return errors.New("admission webhook unavailable") }
+
+	// the failures are counted whether reported on their own or summarized while backing off
+	_ = b.write(newTestAssignedID("id1"), metrics.AssignedIdentityAdditionOperationName, failing)
+	_ = b.write(newTestAssignedID("id2"), metrics.AssignedIdentityAdditionOperationName, failing)
+	_ = b.write(newTestAssignedID("id3"), metrics.AssignedIdentityDeletionOperationName, failing)
+	// the skipped writes and the successful writes aren't failures
+	_ = b.write(newTestAssignedID("id1"), metrics.AssignedIdentityAdditionOperationName, failing)
+	_ = b.write(newTestAssignedID("id4"), metrics.AssignedIdentityAdditionOperationName, func() error { return nil })
+
+	if n := apiWriteErrorsCount(t, v.Name, metrics.AssignedIdentityAdditionOperationName); n != 2 {
+		t.Errorf("expected 2 failed writes of %s, got %d", metrics.AssignedIdentityAdditionOperationName, n)
+	}
+	if n := apiWriteErrorsCount(t, v.Name, metrics.AssignedIdentityDeletionOperationName); n != 1 {
+		t.Errorf("expected 1 failed write of %s, got %d", metrics.AssignedIdentityDeletionOperationName, n)
+	}
+}
+
+func TestAPIWriteBackoffExponentialDelay(t *testing.T) {
+	b := newAPIWriteBackoff(20*time.Millisecond, time.Second, nil)
+	failing := func() error { return errors.New("etcd timeout") }
+	assignedID := newTestAssignedID("id1")
+
+	delays := make([]time.Duration, 0, 3)
+	for i := 0; i < 3; i++ {
+		_ = b.write(assignedID, metrics.AssignedIdentityAdditionOperationName, failing)
+		b.mu.Lock()
+		delay := time.Until(b.notBefore["default/id1"])
+		b.mu.Unlock()
+		delays = append(delays, delay)
+		time.Sleep(delay + 5*time.Millisecond)
+	}
+	for i := 1; i < len(delays); i++ {
+		if delays[i] <= delays[i-1] {
+			t.Errorf("expected the delays to grow, got: %v", delays)
+		}
+	}
+}
+
+func TestCleanUpBacksOffAPIWriteFailures(t *testing.T) {
+	crdClient := &failingCrdClient{TestCrdClient: NewTestCrdClient(nil)}
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+	c := &Client{
+		CRDClient:     crdClient,
+		EventRecorder: &evtRecorder,
+		apiWrites:     newAPIWriteBackoff(50*time.Millisecond, time.Second, nil),
+	}
+
+	var trackList trackUserAssignedMSIIds
+	for _, name := range []string{"test-pod1", "test-pod2", "test-pod3"} {
+		assignedID := newTestAssignedID(name)
+		assignedID.Status.Status = aadpodid.AssignedIDAssigned
+		_ = crdClient.TestCrdClient.CreateAssignedIdentity(assignedID)
+		trackList.assignedIDsToDelete = append(trackList.assignedIDsToDelete, *assignedID)
+	}
+	cleanUp := func() int {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		c.cleanUpAllAssignedIdentitiesOnNode("test-node", trackList, &wg)
+		wg.Wait()
+		events := len(evtRecorder.eventChannel)
+		for i := 0; i < events; i++ {
+			<-evtRecorder.eventChannel
+		}
+		return events
+	}
+
+	crdClient.setError(errors.New("Internal error occurred: failed calling webhook"))
+	if events := cleanUp(); events != 1 {
+		t.Errorf("expected a single event for the failures of the api server writes, got %d", events)
+	}
+	if writes := crdClient.getWrites(); writes != 3 {
+		t.Fatalf("expected 3 writes, got %d", writes)
+	}
+
+	// the api server is still failing, the assigned identities are backing off
+	if events := cleanUp(); events != 0 {
+		t.Errorf("expected no events while backing off, got %d", events)
+	}
+	if writes := crdClient.getWrites(); writes != 3 {
+		t.Fatalf("expected no writes while backing off, got %d", writes-3)
+	}
+
+	// the api server healed, the writes are retried once the delay is over
+	crdClient.setError(nil)
+	time.Sleep(60 * time.Millisecond)
+	if events := cleanUp(); events != 3 {
+		t.Errorf("expected the 3 assigned identities to be removed, got %d events", events)
+	}
+	if n := c.apiWrites.backingOff(); n != 0 {
+		t.Errorf("expected no assigned identity backing off, got %d", n)
+	}
+	assignedIDs, _ := crdClient.ListAssignedIDs()
+	if len(*assignedIDs) != 0 {
+		t.Errorf("expected the assigned identities to be removed, got %d", len(*assignedIDs))
+	}
+}
@@ -0,0 +1,63 @@
+package mic
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	"golang.org/x/sync/semaphore"
+)
+
+// armOpsLimiter bounds the number of VM and VMSS updates in flight across all nodes. Updates
+// beyond the limit wait until an update in flight completes.
+type armOpsLimiter struct {
+	sem      *semaphore.Weighted
+	reporter *metrics.Reporter
+
+	mu       sync.Mutex
+	inFlight int64
+	queued   int64
+}
+
+// newARMOpsLimiter returns a limiter for max concurrent updates, or nil when max is not positive
+// which doesn't limit the updates
+func newARMOpsLimiter(max int64, reporter *metrics.Reporter) *armOpsLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &armOpsLimiter{
+		sem:      semaphore.NewWeighted(max),
+		reporter: reporter,
+	}
+}
+
+// do runs the update once fewer than the max updates are in flight
+func (l *armOpsLimiter) do(update func() error) error {
+	if l == nil {
+		return update()
+	}
+
+	l.add(0, 1)
+	// acquiring with a background context only returns once the semaphore is acquired
+	_ = l.sem.Acquire(context.Background(), 1)
+	l.add(1, -1)
+	defer func() {
+		l.sem.Release(1)
+		l.add(-1, 0)
+	}()
+
+	return update()
+}
+
+func (l *armOpsLimiter) add(inFlight, queued int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight += inFlight
+	l.queued += queued
+	if l.reporter != nil {
+		l.reporter.Report(
+			metrics.MICARMOperationsInFlightM.M(l.inFlight),
+			metrics.MICARMOperationsQueuedM.M(l.queued))
+	}
+}
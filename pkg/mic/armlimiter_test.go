@@ -0,0 +1,70 @@
+package mic
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+)
+
+func TestARMOpsLimiter(t *testing.T) {
+	reporter, _ := metrics.NewReporter()
+	limiter := newARMOpsLimiter(3, reporter)
+
+	var mu sync.Mutex
+	inFlight, maxInFlight, completed := 0, 0, 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := limiter.do(func() error {
+				mu.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				mu.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				mu.Lock()
+				inFlight--
+				completed++
+				mu.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxInFlight > 3 {
+		t.Errorf("expected at most 3 updates in flight, got: %d", maxInFlight)
+	}
+	if maxInFlight < 3 {
+		t.Errorf("expected updates to run concurrently up to the limit, got: %d", maxInFlight)
+	}
+	if completed != 20 {
+		t.Errorf("expected all 20 queued updates to complete, got: %d", completed)
+	}
+	if limiter.inFlight != 0 || limiter.queued != 0 {
+		t.Errorf("expected no updates in flight or queued, got in flight: %d, queued: %d", limiter.inFlight, limiter.queued)
+	}
+}
+
+func TestARMOpsLimiterUnbounded(t *testing.T) {
+	limiter := newARMOpsLimiter(0, nil)
+	if limiter != nil {
+		t.Fatalf("expected no limiter when max is 0")
+	}
+	expectedErr := errors.New("update failed")
+	if err := limiter.do(func() error { return expectedErr }); err != expectedErr {
+		t.Errorf("expected error %v, got: %v", expectedErr, err)
+	}
+}
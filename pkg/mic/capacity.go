@@ -0,0 +1,117 @@
+package mic
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// DefaultMaxIdentitiesPerNode is the Azure limit of user assigned identities of a VM or VMSS
+const DefaultMaxIdentitiesPerNode = 20
+
+// enforceIdentityCapacity removes the assignments that would attach more than the max identities
+// per node to a VM or VMSS from the node map, so the update of the VM or VMSS isn't rejected by ARM.
+// The identities of the assigned identities not being deleted are kept, and the identities to
+// assign are accepted in the order of the names of their assigned identities until the max is
+// reached. Refused assignments are retried by the following syncs. Identities attached outside MIC
+// aren't counted.
+func (c *Client) enforceIdentityCapacity(currentAssignedIDs, deleteList map[string]aadpodid.AzureAssignedIdentity, nodeMap map[string]trackUserAssignedMSIIds) {
+	if c.maxIdentitiesPerNode <= 0 {
+		return
+	}
+
+	// the identities attached by MIC to each compute resource after this sync
+	attached := make(map[string]map[string]bool)
+	resourceKeys := make(map[string]string)
+	for name, assignedID := range currentAssignedIDs {
+		id := assignedID.Spec.AzureIdentityRef
+		if _, deleted := deleteList[name]; deleted || id == nil || !c.checkIfUserAssignedMSI(id) {
+			continue
+		}
+		nodeName := assignedID.Spec.NodeName
+		key, ok := resourceKeys[nodeName]
+		if !ok {
+			r, err := c.getComputeResource(nodeName)
+			if err != nil {
+				klog.Errorf("Unable to get compute resource of node %s for the identities per node. Error %v", nodeName, err)
+			}
+			if r != nil {
+				key = systemAssignedKey(r.name, r.trackList.isvmss)
+			}
+			resourceKeys[nodeName] = key
+		}
+		if key == "" {
+			continue
+		}
+		if attached[key] == nil {
+			attached[key] = make(map[string]bool)
+		}
+		attached[key][strings.ToLower(id.Spec.ResourceID)] = true
+	}
+
+	for nodeOrVMSSName, trackList := range nodeMap {
+		if len(trackList.assignedIDsToCreate) == 0 {
+			continue
+		}
+		key := systemAssignedKey(nodeOrVMSSName, trackList.isvmss)
+		ids := attached[key]
+		if ids == nil {
+			ids = make(map[string]bool)
+			attached[key] = ids
+		}
+
+		creates := append([]aadpodid.AzureAssignedIdentity(nil), trackList.assignedIDsToCreate...)
+		sort.Slice(creates, func(i, j int) bool {
+			return creates[i].Name < creates[j].Name
+		})
+		var kept []aadpodid.AzureAssignedIdentity
+		refused := make(map[string]bool)
+		for _, createID := range creates {
+			id := createID.Spec.AzureIdentityRef
+			if !c.checkIfUserAssignedMSI(id) {
+				kept = append(kept, createID)
+				continue
+			}
+			resourceID := strings.ToLower(id.Spec.ResourceID)
+			if ids[resourceID] || len(ids) < c.maxIdentitiesPerNode {
+				ids[resourceID] = true
+				kept = append(kept, createID)
+				continue
+			}
+			refused[resourceID] = true
+			c.recordCapacityExceeded(createID, nodeOrVMSSName)
+		}
+		if len(refused) == 0 {
+			continue
+		}
+
+		trackList.assignedIDsToCreate = kept
+		var add []string
+		for _, resourceID := range trackList.addUserAssignedMSIIDs {
+			if !refused[strings.ToLower(resourceID)] {
+				add = append(add, resourceID)
+			}
+		}
+		trackList.addUserAssignedMSIIDs = add
+		nodeMap[nodeOrVMSSName] = trackList
+	}
+}
+
+// recordCapacityExceeded records the event and metric of the assignment refused as the VM or VMSS
+// has the max identities per node
+func (c *Client) recordCapacityExceeded(assignedID aadpodid.AzureAssignedIdentity, nodeOrVMSSName string) {
+	message := fmt.Sprintf("Identity %s not assigned to pod %s/%s, %s already has the max of %d identities per node",
+		assignedID.Spec.AzureIdentityRef.Spec.ResourceID, assignedID.Spec.PodNamespace, assignedID.Spec.Pod, nodeOrVMSSName, c.maxIdentitiesPerNode)
+	klog.Warning(message)
+	if binding := assignedID.Spec.AzureBindingRef; binding != nil {
+		c.EventRecorder.Event(binding, corev1.EventTypeWarning, "identity capacity exceeded", message)
+	}
+	if c.Reporter != nil {
+		c.Reporter.Report(metrics.MICIdentityCapacityExceededCountM.M(1))
+	}
+}
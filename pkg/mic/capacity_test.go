@@ -0,0 +1,136 @@
+package mic
+
+import (
+	"fmt"
+	"testing"
+
+	internalaadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity/v1"
+	"github.com/Azure/aad-pod-identity/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestIdentityCapacity(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// pods are the identity index of each pod on the node
+		pods             []int
+		events           int
+		expectedIDs      []string
+		expectedAssigned int
+	}{
+		{
+			name:             "at limit",
+			pods:             []int{1, 2},
+			events:           2,
+			expectedIDs:      []string{"test-user-msi-resourceid1", "test-user-msi-resourceid2"},
+			expectedAssigned: 2,
+		},
+		{
+			name: "over limit",
+			// the pod of the third identity is refused, the pod of an identity already attached isn't
+			pods:             []int{1, 2, 3, 1},
+			events:           4,
+			expectedIDs:      []string{"test-user-msi-resourceid1", "test-user-msi-resourceid2"},
+			expectedAssigned: 3,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			eventCh := make(chan internalaadpodid.EventType, 100)
+			cloudClient := NewTestCloudClient(config.AzureConfig{})
+			crdClient := NewTestCrdClient(nil)
+			podClient := NewTestPodClient()
+			nodeClient := NewTestNodeClient()
+			var evtRecorder TestEventRecorder
+			evtRecorder.lastEvent = new(LastEvent)
+			evtRecorder.eventChannel = make(chan bool, 100)
+
+			micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+			micClient.maxIdentitiesPerNode = 2
+
+			for i := 1; i <= 3; i++ {
+				crdClient.CreateID(fmt.Sprintf("test-id%d", i), "default", aadpodid.UserAssignedMSI, fmt.Sprintf("test-user-msi-resourceid%d", i), fmt.Sprintf("test-user-msi-clientid%d", i), nil, "", "", "", "")
+				crdClient.CreateBinding(fmt.Sprintf("testbinding%d", i), "default", fmt.Sprintf("test-id%d", i), fmt.Sprintf("test-select%d", i), "")
+			}
+			nodeClient.AddNode("test-node1")
+			for i, id := range tc.pods {
+				podClient.AddPod(fmt.Sprintf("test-pod%d", i+1), "default", "test-node1", fmt.Sprintf("test-select%d", id))
+			}
+
+			eventCh <- internalaadpodid.PodCreated
+			defer micClient.testRunSync()(t)
+
+			if !evtRecorder.WaitForEvents(tc.events) {
+				t.Fatalf("Timeout waiting for mic sync cycles")
+			}
+			if !cloudClient.CompareMSI("test-node1", tc.expectedIDs) {
+				cloudClient.PrintMSI()
+				t.Fatalf("expected identities %v on the node", tc.expectedIDs)
+			}
+			assignedIDs, err := crdClient.ListAssignedIDs()
+			if err != nil {
+				t.Fatalf("expected nil error, got: %v", err)
+			}
+			if len(*assignedIDs) != tc.expectedAssigned {
+				t.Fatalf("expected %d assigned identities, got %d", tc.expectedAssigned, len(*assignedIDs))
+			}
+			for _, assignedID := range *assignedIDs {
+				if assignedID.Spec.AzureIdentityRef.Name == "test-id3" {
+					t.Errorf("expected no assigned identity for the identity over the limit, got %s", assignedID.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestEnforceIdentityCapacity(t *testing.T) {
+	nodeClient := NewTestNodeClient()
+	nodeClient.AddNode("test-node1")
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+	c := &Client{NodeClient: nodeClient, EventRecorder: &evtRecorder, maxIdentitiesPerNode: 2}
+
+	newAssignedID := func(name, resourceID string) internalaadpodid.AzureAssignedIdentity {
+		assignedID := internalaadpodid.AzureAssignedIdentity{
+			Spec: internalaadpodid.AzureAssignedIdentitySpec{
+				AzureIdentityRef: &internalaadpodid.AzureIdentity{Spec: internalaadpodid.AzureIdentitySpec{Type: internalaadpodid.UserAssignedMSI, ResourceID: resourceID}},
+				AzureBindingRef:  &internalaadpodid.AzureIdentityBinding{},
+				Pod:              name,
+				PodNamespace:     "default",
+				NodeName:         "test-node1",
+			},
+		}
+		assignedID.Name = name
+		return assignedID
+	}
+	// id1 is assigned and kept, id2 is being removed with its assigned identity
+	current := map[string]internalaadpodid.AzureAssignedIdentity{
+		"a": newAssignedID("a", "id1"),
+		"b": newAssignedID("b", "ID2"),
+	}
+	deleteList := map[string]internalaadpodid.AzureAssignedIdentity{"b": current["b"]}
+	nodeMap := map[string]trackUserAssignedMSIIds{
+		"test-node1": {
+			addUserAssignedMSIIDs: []string{"id4", "id3", "id1"},
+			assignedIDsToCreate:   []internalaadpodid.AzureAssignedIdentity{newAssignedID("d", "id4"), newAssignedID("c", "id3"), newAssignedID("e", "ID1")},
+		},
+	}
+
+	c.enforceIdentityCapacity(current, deleteList, nodeMap)
+
+	trackList := nodeMap["test-node1"]
+	var created []string
+	for _, createID := range trackList.assignedIDsToCreate {
+		created = append(created, createID.Name)
+	}
+	if fmt.Sprint(created) != "[c e]" {
+		t.Errorf("expected the assigned identities c and e to be created, got %v", created)
+	}
+	if fmt.Sprint(trackList.addUserAssignedMSIIDs) != "[id3 id1]" {
+		t.Errorf("expected identities id3 and id1 to be assigned, got %v", trackList.addUserAssignedMSIIDs)
+	}
+	if evtRecorder.lastEvent.Type != corev1.EventTypeWarning || evtRecorder.lastEvent.Reason != "identity capacity exceeded" {
+		t.Errorf("expected an identity capacity exceeded warning, got %+v", evtRecorder.lastEvent)
+	}
+}
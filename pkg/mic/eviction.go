@@ -0,0 +1,43 @@
+package mic
+
+import (
+	"sync"
+
+	"github.com/Azure/aad-pod-identity/pkg/cloudprovider"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// isNodeNotReady returns true if the ready condition of the node is false or unknown. A node
+// without a ready condition isn't considered not ready.
+func isNodeNotReady(node *corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status != corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// isNodeEvicted returns true if the node is not ready and the VM or VMSS backing it is not found
+// in ARM, such as a spot node reclaimed by Azure before it is removed from the cluster. Detaching
+// identities from such a node fails while its assigned identities can simply be deleted. Nodes
+// drained and shut down gracefully keep their VM and are updated as usual. The VMSS, not the
+// instance, is looked up for VMSS nodes, the identities of a VMSS being attached to the VMSS.
+func (c *Client) isNodeEvicted(node *corev1.Node, nodeOrVMSSName string, nodeTrackList trackUserAssignedMSIIds) bool {
+	if nodeTrackList.hybridMachine != nil || !isNodeNotReady(node) {
+		return false
+	}
+	_, err := c.CloudClient.GetUserMSIs(nodeOrVMSSName, nodeTrackList.isvmss)
+	return err == cloudprovider.ErrComputeResourceNotFound
+}
+
+// cleanUpEvictedNode deletes the assigned identities to delete of the evicted node without
+// detaching their identities from the VM or VMSS, which no longer exists. The identities to assign
+// to the node are skipped, they are assigned by a later sync if the node recovers.
+func (c *Client) cleanUpEvictedNode(node string, nodeTrackList trackUserAssignedMSIIds, wg *sync.WaitGroup) {
+	defer wg.Done()
+	klog.Warningf("Node %s is not ready and its compute resource is not found, assuming it was evicted: deleting %d assigned identities without detaching their identities and skipping %d assignments",
+		node, len(nodeTrackList.assignedIDsToDelete), len(nodeTrackList.assignedIDsToCreate))
+	c.removeAssignedIdentitiesOfNode(nodeTrackList)
+}
@@ -0,0 +1,139 @@
+package mic
+
+import (
+	"testing"
+
+	internalaadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity/v1"
+	"github.com/Azure/aad-pod-identity/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// withNodeReady sets the ready condition of the node to the status
+func withNodeReady(status corev1.ConditionStatus) func(*corev1.Node) {
+	return func(n *corev1.Node) {
+		n.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status}}
+	}
+}
+
+func TestIsNodeNotReady(t *testing.T) {
+	cases := []struct {
+		name     string
+		opts     []func(*corev1.Node)
+		expected bool
+	}{
+		{name: "ready", opts: []func(*corev1.Node){withNodeReady(corev1.ConditionTrue)}},
+		{name: "not ready", opts: []func(*corev1.Node){withNodeReady(corev1.ConditionFalse)}, expected: true},
+		{name: "unknown", opts: []func(*corev1.Node){withNodeReady(corev1.ConditionUnknown)}, expected: true},
+		{name: "no ready condition"},
+	}
+	for _, tc := range cases {
+		nodeClient := NewTestNodeClient()
+		nodeClient.AddNode("test-node", tc.opts...)
+		node, _ := nodeClient.Get("test-node")
+		if notReady := isNodeNotReady(node); notReady != tc.expected {
+			t.Errorf("%s: expected not ready to be %v, got %v", tc.name, tc.expected, notReady)
+		}
+	}
+}
+
+func TestSyncEvictedNode(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid1", "test-user-msi-clientid1", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	crdClient.CreateID("test-id2", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid2", "test-user-msi-clientid2", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding2", "default", "test-id2", "test-select2", "")
+	nodeClient.AddNode("test-spot-node", withNodeReady(corev1.ConditionTrue))
+	nodeClient.AddNode("test-drained-node", withNodeReady(corev1.ConditionTrue))
+	podClient.AddPod("test-pod1", "default", "test-spot-node", "test-select1")
+	podClient.AddPod("test-pod2", "default", "test-drained-node", "test-select1")
+
+	eventCh <- internalaadpodid.PodCreated
+	defer micClient.testRunSync()(t)
+
+	if !evtRecorder.WaitForEvents(2) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	spotWrites, _ := cloudClient.testVMClient.Writes("test-spot-node")
+	drainedWrites, _ := cloudClient.testVMClient.Writes("test-drained-node")
+
+	// Azure reclaims the spot node abruptly: the node turns not ready and its VM is gone while the
+	// node is still in the cluster. A pod is also scheduled to it before the node turned not ready.
+	// The other node is drained gracefully: it stays ready and keeps its VM.
+	nodeClient.AddNode("test-spot-node", withNodeReady(corev1.ConditionUnknown))
+	cloudClient.testVMClient.DeleteVM("test-spot-node")
+	podClient.DeletePod("test-pod1", "default")
+	podClient.AddPod("test-pod3", "default", "test-spot-node", "test-select2")
+	podClient.DeletePod("test-pod2", "default")
+	eventCh <- internalaadpodid.PodDeleted
+
+	if !evtRecorder.WaitForEvents(2) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+
+	listAssignedIDs, err := crdClient.ListAssignedIDs()
+	if err != nil {
+		t.Fatalf("error from list assigned ids: %v", err)
+	}
+	if len(*listAssignedIDs) != 0 {
+		t.Fatalf("expected the assigned identities of the deleted pods to be removed and no assignment to the evicted node, got: %v", *listAssignedIDs)
+	}
+	// the evicted node isn't updated, neither to detach nor to assign an identity
+	if writes, _ := cloudClient.testVMClient.Writes("test-spot-node"); writes != spotWrites {
+		t.Errorf("expected no update of the evicted node, got %d updates", writes-spotWrites)
+	}
+	// the identity is detached from the drained node as usual
+	if writes, _ := cloudClient.testVMClient.Writes("test-drained-node"); writes != drainedWrites+1 || !cloudClient.CompareMSI("test-drained-node", []string{}) {
+		cloudClient.PrintMSI()
+		t.Errorf("expected the identity to be detached from the drained node, got %d updates", writes-drainedWrites)
+	}
+}
+
+func TestSyncNotReadyNodeWithVM(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid1", "test-user-msi-clientid1", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1", withNodeReady(corev1.ConditionTrue))
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+	eventCh <- internalaadpodid.PodCreated
+	defer micClient.testRunSync()(t)
+
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	writes, _ := cloudClient.testVMClient.Writes("test-node1")
+
+	// the node is not ready, e.g. shut down, but its VM still exists so the identity is detached
+	nodeClient.AddNode("test-node1", withNodeReady(corev1.ConditionFalse))
+	podClient.DeletePod("test-pod1", "default")
+	eventCh <- internalaadpodid.PodDeleted
+
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if updated, _ := cloudClient.testVMClient.Writes("test-node1"); updated != writes+1 || !cloudClient.CompareMSI("test-node1", []string{}) {
+		cloudClient.PrintMSI()
+		t.Errorf("expected the identity to be detached from the not ready node, got %d updates", updated-writes)
+	}
+}
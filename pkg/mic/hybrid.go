@@ -0,0 +1,88 @@
+package mic
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/cloudprovider"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	"github.com/Azure/go-autorest/autorest/azure"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// hybridMachineFromNode returns the Azure Arc machine of the node or nil if the
+// provider id of the node is not an Azure Arc machine.
+func hybridMachineFromNode(n *corev1.Node) (*azure.Resource, error) {
+	if n.Spec.ProviderID == "" {
+		return nil, nil
+	}
+	r, err := cloudprovider.ParseResourceID(n.Spec.ProviderID)
+	if err != nil {
+		return nil, err
+	}
+	if !cloudprovider.IsHybridMachine(r) {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+// hybridRefusals records the bindings whose user assigned identities were refused on Azure Arc
+// nodes, so that a refusal is reported by a single event per binding rather than by every sync.
+// The zero value is ready to use.
+type hybridRefusals struct {
+	mu sync.Mutex
+	// bindings is keyed by the namespace, name and uid of the binding, so a binding recreated
+	// with the same name is reported again
+	bindings map[string]bool
+}
+
+// refuse records the refusal of the binding and returns true if it wasn't refused before
+func (r *hybridRefusals) refuse(binding *aadpodid.AzureIdentityBinding) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := strings.Join([]string{binding.Namespace, binding.Name, string(binding.UID)}, "/")
+	if r.bindings[key] {
+		return false
+	}
+	if r.bindings == nil {
+		r.bindings = make(map[string]bool)
+	}
+	r.bindings[key] = true
+	return true
+}
+
+// refuseHybridUserMSIs returns the track list of the Azure Arc node without the user assigned
+// identities to assign, which the hybrid compute API can't attach to the machine. Instead of
+// failing the update of the machine in every sync, the refused assigned identities are left
+// created but not assigned and a warning event is recorded once per binding.
+func (c *Client) refuseHybridUserMSIs(nodeName string, nodeTrackList trackUserAssignedMSIIds, begin time.Time) trackUserAssignedMSIIds {
+	if nodeTrackList.hybridMachine == nil || len(nodeTrackList.addUserAssignedMSIIDs) == 0 {
+		return nodeTrackList
+	}
+
+	var assignedIDsToCreate []aadpodid.AzureAssignedIdentity
+	for _, createID := range nodeTrackList.assignedIDsToCreate {
+		if !c.checkIfUserAssignedMSI(createID.Spec.AzureIdentityRef) {
+			assignedIDsToCreate = append(assignedIDsToCreate, createID)
+			continue
+		}
+		c.stuckAssignments.recordError(createID.Name, cloudprovider.ErrHybridMachineUserMSINotSupported)
+		c.identityMetrics.report(metrics.IdentityAssignmentOperationName, &createID, false, begin)
+		binding := createID.Spec.AzureBindingRef
+		if !c.hybridRefusals.refuse(binding) {
+			continue
+		}
+		message := fmt.Sprintf("Applying binding %s node %s for pod %s resulted in error %v", binding.Name, createID.Spec.NodeName, createID.Name, cloudprovider.ErrHybridMachineUserMSINotSupported)
+		c.EventRecorder.Event(binding, corev1.EventTypeWarning, "binding apply error", message)
+		klog.Error(message)
+	}
+	klog.V(5).Infof("Skipping %d user assigned identities to assign to Azure Arc node %s", len(nodeTrackList.addUserAssignedMSIIDs), nodeName)
+	nodeTrackList.assignedIDsToCreate = assignedIDsToCreate
+	nodeTrackList.addUserAssignedMSIIDs = nil
+	return nodeTrackList
+}
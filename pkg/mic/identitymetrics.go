@@ -0,0 +1,87 @@
+package mic
+
+import (
+	"sync"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	"k8s.io/klog"
+)
+
+const (
+	// DefaultMaxMetricIdentities is the default max number of AzureIdentities broken down in the
+	// per identity metrics
+	DefaultMaxMetricIdentities = 100
+
+	// overflowIdentityLabel is the identity namespace and name the operations of the AzureIdentities
+	// past the max are reported with. It isn't a valid name so it never collides with an AzureIdentity.
+	overflowIdentityLabel = "_other"
+)
+
+// identityMetrics reports the result and duration of the assignments and removals of identities to
+// and from nodes by AzureIdentity. As each AzureIdentity adds series to the metrics, only the first
+// maxIdentities AzureIdentities seen are broken down, the others being reported together. The
+// AzureIdentities deleted keep their place, as the exporter keeps reporting their series.
+type identityMetrics struct {
+	maxIdentities int
+	reporter      *metrics.Reporter
+
+	mu sync.Mutex
+	// identities are the namespace/name of the AzureIdentities broken down
+	identities map[string]bool
+	warned     bool
+}
+
+// newIdentityMetrics returns the per identity metrics, or nil when not enabled which doesn't report
+// them. maxIdentities defaults to DefaultMaxMetricIdentities when not positive.
+func newIdentityMetrics(enabled bool, maxIdentities int, reporter *metrics.Reporter) *identityMetrics {
+	if !enabled || reporter == nil {
+		return nil
+	}
+	if maxIdentities <= 0 {
+		maxIdentities = DefaultMaxMetricIdentities
+	}
+	return &identityMetrics{
+		maxIdentities: maxIdentities,
+		reporter:      reporter,
+		identities:    make(map[string]bool),
+	}
+}
+
+// labels returns the identity namespace and name the operations of the AzureIdentity are reported with
+func (m *identityMetrics) labels(id *aadpodid.AzureIdentity) (string, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := id.Namespace + "/" + id.Name
+	if !m.identities[key] {
+		if len(m.identities) >= m.maxIdentities {
+			if !m.warned {
+				m.warned = true
+				klog.Warningf("Per identity metrics are limited to %d AzureIdentities, the operations of %s and further AzureIdentities are reported as %s", m.maxIdentities, key, overflowIdentityLabel)
+			}
+			return overflowIdentityLabel, overflowIdentityLabel
+		}
+		m.identities[key] = true
+	}
+	return id.Namespace, id.Name
+}
+
+// report records the result of the assignment or removal of the identity of the assigned identity,
+// begun at begin
+func (m *identityMetrics) report(operation string, assignedID *aadpodid.AzureAssignedIdentity, succeeded bool, begin time.Time) {
+	if m == nil || assignedID.Spec.AzureIdentityRef == nil {
+		return
+	}
+	result := metrics.ResultSuccess
+	if !succeeded {
+		result = metrics.ResultFailure
+	}
+	namespace, name := m.labels(assignedID.Spec.AzureIdentityRef)
+	if err := m.reporter.ReportIdentityOperation(operation, namespace, name, result,
+		metrics.MICIdentityOperationsCountM.M(1),
+		metrics.MICIdentityOperationsDurationM.M(metrics.SinceInSeconds(begin))); err != nil {
+		klog.Errorf("Failed to report the %s metrics of identity %s/%s, error: %+v", operation, namespace, name, err)
+	}
+}
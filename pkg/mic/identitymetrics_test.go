@@ -0,0 +1,179 @@
+package mic
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	internalaadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity/v1"
+	"github.com/Azure/aad-pod-identity/pkg/config"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-12-01/compute"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testIdentityOperationsView = "test_mic_identity_operations_count"
+
+// registerIdentityOperationsView registers a count view of the identity operations broken down
+// like the exported view, the views of the metrics package not being registered in the tests
+func registerIdentityOperationsView(t *testing.T) *view.View {
+	v := &view.View{
+		Name:        testIdentityOperationsView,
+		Measure:     metrics.MICIdentityOperationsCountM,
+		Aggregation: view.Count(),
+		TagKeys: []tag.Key{
+			tag.MustNewKey("operation_type"),
+			tag.MustNewKey("identity_namespace"),
+			tag.MustNewKey("identity_name"),
+			tag.MustNewKey("result"),
+		},
+	}
+	if err := view.Register(v); err != nil {
+		t.Fatalf("failed to register the identity operations view: %v", err)
+	}
+	return v
+}
+
+// identityOperationsCount returns the count of the operations of the identity with the result
+func identityOperationsCount(t *testing.T, operation, identityNamespace, identityName, result string) int64 {
+	rows, err := view.RetrieveData(testIdentityOperationsView)
+	if err != nil {
+		t.Fatalf("failed to retrieve the identity operations: %v", err)
+	}
+	expected := map[string]string{
+		"operation_type":     operation,
+		"identity_namespace": identityNamespace,
+		"identity_name":      identityName,
+		"result":             result,
+	}
+	for _, row := range rows {
+		matched := 0
+		for _, tag := range row.Tags {
+			if expected[tag.Key.Name()] == tag.Value {
+				matched++
+			}
+		}
+		if matched == len(expected) {
+			return row.Data.(*view.CountData).Value
+		}
+	}
+	return 0
+}
+
+func newIdentityMetricsTestAssignedID(identityNamespace, identityName string) *internalaadpodid.AzureAssignedIdentity {
+	return &internalaadpodid.AzureAssignedIdentity{
+		Spec: internalaadpodid.AzureAssignedIdentitySpec{
+			AzureIdentityRef: &internalaadpodid.AzureIdentity{
+				ObjectMeta: metav1.ObjectMeta{Name: identityName, Namespace: identityNamespace},
+			},
+		},
+	}
+}
+
+func TestIdentityMetrics(t *testing.T) {
+	v := registerIdentityOperationsView(t)
+	defer view.Unregister(v)
+
+	reporter, _ := metrics.NewReporter()
+	m := newIdentityMetrics(true, 2, reporter)
+	begin := time.Now()
+	m.report(metrics.IdentityAssignmentOperationName, newIdentityMetricsTestAssignedID("default", "id1"), true, begin)
+	m.report(metrics.IdentityAssignmentOperationName, newIdentityMetricsTestAssignedID("default", "id1"), true, begin)
+	m.report(metrics.IdentityAssignmentOperationName, newIdentityMetricsTestAssignedID("default", "id2"), false, begin)
+	// the identities past the max are reported together
+	m.report(metrics.IdentityAssignmentOperationName, newIdentityMetricsTestAssignedID("default", "id3"), false, begin)
+	m.report(metrics.IdentityAssignmentOperationName, newIdentityMetricsTestAssignedID("other", "id4"), false, begin)
+	// the identities broken down are still reported by identity
+	m.report(metrics.IdentityRemovalOperationName, newIdentityMetricsTestAssignedID("default", "id2"), true, begin)
+
+	cases := []struct {
+		operation, identityNamespace, identityName, result string
+		expected                                           int64
+	}{
+		{metrics.IdentityAssignmentOperationName, "default", "id1", metrics.ResultSuccess, 2},
+		{metrics.IdentityAssignmentOperationName, "default", "id1", metrics.ResultFailure, 0},
+		{metrics.IdentityAssignmentOperationName, "default", "id2", metrics.ResultFailure, 1},
+		{metrics.IdentityAssignmentOperationName, "default", "id3", metrics.ResultFailure, 0},
+		{metrics.IdentityAssignmentOperationName, overflowIdentityLabel, overflowIdentityLabel, metrics.ResultFailure, 2},
+		{metrics.IdentityRemovalOperationName, "default", "id2", metrics.ResultSuccess, 1},
+	}
+	for _, tc := range cases {
+		if count := identityOperationsCount(t, tc.operation, tc.identityNamespace, tc.identityName, tc.result); count != tc.expected {
+			t.Errorf("expected %d %s %s of %s/%s, got %d", tc.expected, tc.operation, tc.result, tc.identityNamespace, tc.identityName, count)
+		}
+	}
+}
+
+func TestIdentityMetricsDisabled(t *testing.T) {
+	reporter, _ := metrics.NewReporter()
+	m := newIdentityMetrics(false, 0, reporter)
+	if m != nil {
+		t.Fatalf("expected no per identity metrics when disabled")
+	}
+	// reporting to the disabled metrics is a no-op
+	m.report(metrics.IdentityAssignmentOperationName, newIdentityMetricsTestAssignedID("default", "id1"), true, time.Now())
+
+	if m := newIdentityMetrics(true, 0, reporter); m == nil || m.maxIdentities != DefaultMaxMetricIdentities {
+		t.Errorf("expected the max identities to default to %d", DefaultMaxMetricIdentities)
+	}
+}
+
+func TestSyncPerIdentityMetrics(t *testing.T) {
+	v := registerIdentityOperationsView(t)
+	defer view.Unregister(v)
+
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+	micClient.syncRetryInterval = 10 * time.Second
+	micClient.identityMetrics = newIdentityMetrics(true, 0, micClient.Reporter)
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid", "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+	eventCh <- internalaadpodid.PodCreated
+	defer micClient.testRunSync()(t)
+
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if count := identityOperationsCount(t, metrics.IdentityAssignmentOperationName, "default", "test-id1", metrics.ResultSuccess); count != 1 {
+		t.Errorf("expected 1 successful assignment of default/test-id1, got %d", count)
+	}
+
+	// the removal of the identity from the node fails, then succeeds in the retry
+	podClient.DeletePod("test-pod1", "default")
+	cloudClient.SetError(errors.New("error removing identity from node"))
+	cloudClient.testVMClient.identity = &compute.VirtualMachineIdentity{
+		UserAssignedIdentities: map[string]*compute.VirtualMachineIdentityUserAssignedIdentitiesValue{
+			"test-user-msi-resourceid": &compute.VirtualMachineIdentityUserAssignedIdentitiesValue{},
+		},
+	}
+	eventCh <- internalaadpodid.PodDeleted
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if count := identityOperationsCount(t, metrics.IdentityRemovalOperationName, "default", "test-id1", metrics.ResultFailure); count != 1 {
+		t.Errorf("expected 1 failed removal of default/test-id1, got %d", count)
+	}
+
+	cloudClient.UnSetError()
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync retry cycle")
+	}
+	if count := identityOperationsCount(t, metrics.IdentityRemovalOperationName, "default", "test-id1", metrics.ResultSuccess); count != 1 {
+		t.Errorf("expected 1 successful removal of default/test-id1, got %d", count)
+	}
+}
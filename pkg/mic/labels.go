@@ -0,0 +1,72 @@
+package mic
+
+import (
+	"strings"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog"
+)
+
+// assignedIDLabels returns the labels of the pod, node and identity of an assigned identity. A name
+// that isn't a valid label value, such as a pod name longer than 63 characters, isn't labeled since
+// the assigned identity would be rejected by the api server.
+func assignedIDLabels(podName, podNamespace, nodeName, identityName string) map[string]string {
+	labels := make(map[string]string)
+	for _, l := range []struct {
+		keys  []string
+		value string
+	}{
+		// the labels without prefix are kept for the queries of previous versions
+		{keys: []string{"podname", aadpodid.AssignedIDPodNameLabel}, value: podName},
+		{keys: []string{"podnamespace", aadpodid.AssignedIDPodNamespaceLabel}, value: podNamespace},
+		{keys: []string{"nodename", aadpodid.AssignedIDNodeNameLabel}, value: nodeName},
+		{keys: []string{aadpodid.AssignedIDIdentityNameLabel}, value: identityName},
+	} {
+		if errs := validation.IsValidLabelValue(l.value); len(errs) > 0 {
+			klog.V(5).Infof("Not labeling assigned identity with %s %s: %s", l.keys[len(l.keys)-1], l.value, strings.Join(errs, ", "))
+			continue
+		}
+		for _, key := range l.keys {
+			labels[key] = l.value
+		}
+	}
+	return labels
+}
+
+// syncAssignedIDLabels sets the labels of the pod, node and identity on the assigned identities
+// missing them or with different values, such as the assigned identities created by a previous
+// version of mic. The assigned identities being deleted are skipped.
+func (c *Client) syncAssignedIDLabels(currentAssignedIDs, deleteList map[string]aadpodid.AzureAssignedIdentity) {
+	for name, assignedID := range currentAssignedIDs {
+		if _, deleted := deleteList[name]; deleted {
+			continue
+		}
+		identityName := ""
+		if assignedID.Spec.AzureIdentityRef != nil {
+			identityName = assignedID.Spec.AzureIdentityRef.Name
+		}
+		labels := assignedIDLabels(assignedID.Spec.Pod, assignedID.Spec.PodNamespace, assignedID.Spec.NodeName, identityName)
+		if labelsInSync(assignedID.Labels, labels) {
+			continue
+		}
+		assignedID := assignedID
+		err := c.apiWrites.write(&assignedID, metrics.UpdateAzureAssignedIdentityLabelsOperationName, func() error {
+			return c.CRDClient.UpdateAzureAssignedIdentityLabels(&assignedID, labels)
+		})
+		if err != nil && !isSummarizedAPIWriteError(err) {
+			klog.Errorf("Updating labels of assigned identity %s/%s failed with error %v", assignedID.Namespace, name, err)
+		}
+	}
+}
+
+// labelsInSync returns true if every label of expected has the same value in labels
+func labelsInSync(labels, expected map[string]string) bool {
+	for k, v := range expected {
+		if value, ok := labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
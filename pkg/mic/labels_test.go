@@ -0,0 +1,79 @@
+package mic
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	internalaadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAssignedIDLabels(t *testing.T) {
+	labels := assignedIDLabels("test-pod1", "default", "test-node1", "test-id1")
+	expected := map[string]string{
+		"podname":      "test-pod1",
+		"podnamespace": "default",
+		"nodename":     "test-node1",
+
+		internalaadpodid.AssignedIDPodNameLabel:      "test-pod1",
+		internalaadpodid.AssignedIDPodNamespaceLabel: "default",
+		internalaadpodid.AssignedIDNodeNameLabel:     "test-node1",
+		internalaadpodid.AssignedIDIdentityNameLabel: "test-id1",
+	}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected labels %v, got %v", expected, labels)
+	}
+
+	// a pod name longer than a label value isn't labeled
+	labels = assignedIDLabels(strings.Repeat("p", 64), "default", "test-node1", "test-id1")
+	if _, ok := labels[internalaadpodid.AssignedIDPodNameLabel]; ok {
+		t.Errorf("expected no pod name label for a pod name longer than 63 characters, got %v", labels)
+	}
+	if _, ok := labels["podname"]; ok {
+		t.Errorf("expected no podname label for a pod name longer than 63 characters, got %v", labels)
+	}
+	if labels[internalaadpodid.AssignedIDNodeNameLabel] != "test-node1" {
+		t.Errorf("expected the node name label to be set, got %v", labels)
+	}
+}
+
+func TestSyncAssignedIDLabels(t *testing.T) {
+	crdClient := NewTestCrdClient(nil)
+	c := &Client{CRDClient: crdClient}
+
+	newAssignedID := func(name, podName string, labels map[string]string) internalaadpodid.AzureAssignedIdentity {
+		return internalaadpodid.AzureAssignedIdentity{
+			ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default", Labels: labels},
+			Spec: internalaadpodid.AzureAssignedIdentitySpec{
+				AzureIdentityRef: &internalaadpodid.AzureIdentity{ObjectMeta: v1.ObjectMeta{Name: "test-id1"}},
+				Pod:              podName,
+				PodNamespace:     "default",
+				NodeName:         "test-node1",
+			},
+		}
+	}
+	current := map[string]internalaadpodid.AzureAssignedIdentity{
+		// created by a previous version of mic with the labels without prefix only
+		"previous": newAssignedID("previous", "test-pod1", map[string]string{"podname": "test-pod1", "podnamespace": "default", "nodename": "test-node1", "app": "demo"}),
+		"in-sync":  newAssignedID("in-sync", "test-pod2", assignedIDLabels("test-pod2", "default", "test-node1", "test-id1")),
+		"deleted":  newAssignedID("deleted", "test-pod3", nil),
+	}
+	for _, assignedID := range current {
+		assignedID := assignedID
+		crdClient.CreateAssignedIdentity(&assignedID)
+	}
+
+	c.syncAssignedIDLabels(current, map[string]internalaadpodid.AzureAssignedIdentity{"deleted": current["deleted"]})
+
+	if crdClient.labelUpdates != 1 {
+		t.Fatalf("expected the labels of 1 assigned identity to be updated, got %d", crdClient.labelUpdates)
+	}
+	labels := crdClient.assignedIDMap["previous"].Labels
+	if labels[internalaadpodid.AssignedIDPodNameLabel] != "test-pod1" || labels[internalaadpodid.AssignedIDIdentityNameLabel] != "test-id1" {
+		t.Errorf("expected the labels of the pod and identity to be backfilled, got %v", labels)
+	}
+	if labels["app"] != "demo" {
+		t.Errorf("expected the other labels to be kept, got %v", labels)
+	}
+}
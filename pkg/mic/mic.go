@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,10 +17,12 @@ import (
 	"github.com/Azure/aad-pod-identity/pkg/pod"
 	"github.com/Azure/aad-pod-identity/pkg/stats"
 	"github.com/Azure/aad-pod-identity/version"
+	"github.com/Azure/go-autorest/autorest/azure"
 	"golang.org/x/sync/semaphore"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -72,12 +75,58 @@ type Client struct {
 	EventRecorder        record.EventRecorder
 	EventChannel         chan aadpodid.EventType
 	NodeClient           NodeGetter
+	SecretClient         SecretGetter
 	IsNamespaced         bool
 	SyncLoopStarted      bool
 	syncRetryInterval    time.Duration
 	enableScaleFeatures  bool
 	createDeleteBatch    int64
 	ImmutableUserMSIsMap map[string]bool
+	matchAnnotation      string
+	// selectorConflicts are the conflicting label and annotation values of the pods whose
+	// selector conflicted, by pod UID, so each conflict is only reported when it first appears
+	// or changes rather than in every sync
+	selectorConflicts map[types.UID]string
+	// defaultIdentityResourceGroup is the resource group identities referenced by name are resolved in
+	defaultIdentityResourceGroup string
+	// resolvedIdentityIDs caches the resource ids of the identities resolved by name
+	resolvedIdentityIDs map[string]string
+	// excludedNamespaces are the namespaces identities are never assigned to pods in
+	excludedNamespaces map[string]bool
+	// includedNamespaces, when set, are the only namespaces identities are assigned to pods in
+	includedNamespaces map[string]bool
+	// assignOnly disables the removal of identities from nodes and the deletion of assigned identities
+	assignOnly bool
+	// armOps bounds the number of VM and VMSS updates in flight across all nodes, nil when unbounded
+	armOps *armOpsLimiter
+	// nodeInstances are the node instances seen for the node names of the assigned identities in
+	// the previous sync, used to detect replaced nodes
+	nodeInstances map[string]nodeInstance
+	// stuckAssignments tracks the assigned identities waiting to be assigned, nil when not tracked
+	stuckAssignments *stuckAssignmentTracker
+	// resync adapts the interval of the periodic sync to the API server, nil for the fixed syncRetryInterval
+	resync *resyncBackoff
+	// allowEnableSystemAssigned allows MIC to enable the system assigned identity of the VM or VMSS
+	// of a node, and to disable it once no longer in use if MIC enabled it
+	allowEnableSystemAssigned bool
+	// armReconcile triggers the periodic reconciliation of the identities in ARM, nil when disabled
+	armReconcile *armReconciler
+	// maxIdentitiesPerNode is the max number of user assigned identities MIC attaches to a VM or
+	// VMSS, unbounded when not positive
+	maxIdentitiesPerNode int
+	// apiWrites backs off the writes of the assigned identities failing on the API server, nil when
+	// the writes are retried by every sync
+	apiWrites *apiWriteBackoff
+	// assignedIDNames names the assigned identities, nil for the default naming scheme
+	assignedIDNames *assignedIDNamer
+	// allowHostNetworkAssignment assigns identities to the pods using the host network without the
+	// AllowHostNetworkAssignmentLabel
+	allowHostNetworkAssignment bool
+	// identityMetrics reports the assignments and removals of identities by AzureIdentity, nil when
+	// the per identity metrics are disabled
+	identityMetrics *identityMetrics
+	// hybridRefusals records the bindings whose user assigned identities were refused on Azure Arc nodes
+	hybridRefusals hybridRefusals
 
 	syncing int32 // protect against conucrrent sync's
 
@@ -101,6 +150,67 @@ type Config struct {
 	ImmutableUserMSIsList []string
 	CMcfg                 *CMConfig
 	TypeUpgradeCfg        *TypeUpgradeConfig
+	MatchAnnotation       string
+	// DefaultIdentityResourceGroup is the resource group identities referenced by name are resolved in
+	DefaultIdentityResourceGroup string
+	// ExcludedNamespaces are the namespaces identities are never assigned to pods in
+	ExcludedNamespaces []string
+	// IncludedNamespaces, when set, are the only namespaces identities are assigned to pods in.
+	// ExcludedNamespaces takes precedence for namespaces in both lists.
+	IncludedNamespaces []string
+	// AssignOnly disables the removal of identities from nodes and the deletion of assigned
+	// identities, leaving cleanup to an external process
+	AssignOnly bool
+	// MaxConcurrentARMOps is the maximum number of VM and VMSS updates in flight across all nodes,
+	// unbounded when not positive
+	MaxConcurrentARMOps int64
+	// StuckAssignmentThreshold is the time after which an assigned identity waiting to be assigned
+	// is reported as stuck, not tracked when not positive
+	StuckAssignmentThreshold time.Duration
+	// MinResync and MaxResync bound the interval of the periodic sync, which backs off from MinResync
+	// toward MaxResync while the API server throttles or is slow. MinResync defaults to
+	// SyncRetryInterval and the interval is fixed when MaxResync is not greater than MinResync.
+	MinResync time.Duration
+	MaxResync time.Duration
+	// AllowEnableSystemAssigned allows MIC to enable the system assigned identity of the VM or VMSS
+	// of a node for the system assigned identities assigned to its pods. MIC disables it again when
+	// no longer in use, only if it enabled it.
+	AllowEnableSystemAssigned bool
+	// EnableSecretRefs allows MIC to read the client id and resource id of the AzureIdentities
+	// referencing a secret, which requires permission to get secrets
+	EnableSecretRefs bool
+	// ARMReconcileInterval is the interval at which the user assigned identities of the VMs and VMSS
+	// are read from ARM and the identities of assigned identities missing in ARM are re-attached,
+	// disabled when not positive
+	ARMReconcileInterval time.Duration
+	// ARMReconcileDetach also detaches the identities of AzureIdentities attached to a VM or VMSS
+	// without being assigned to a pod of its nodes during the reconciliation
+	ARMReconcileDetach bool
+	// MaxIdentitiesPerNode is the max number of user assigned identities MIC attaches to a VM or
+	// VMSS, further assignments to its nodes are refused. Unbounded when not positive.
+	MaxIdentitiesPerNode int
+	// NodeMappingConfigMap is the name of the config map in the namespace of MIC mapping node names
+	// to the provider id of the compute resource backing them, the nodes are resolved from the
+	// cluster only when not set
+	NodeMappingConfigMap string
+	// CRDOnly stops MIC from reading the nodes of the cluster, the nodes are only resolved from the
+	// NodeMappingConfigMap
+	CRDOnly bool
+	// AssignedIDNamingScheme is the scheme naming the assigned identities, one of
+	// AssignedIDNamingDefault, AssignedIDNamingHashSuffix or AssignedIDNamingTemplate. It defaults
+	// to AssignedIDNamingDefault.
+	AssignedIDNamingScheme string
+	// AssignedIDNameTemplate is the text/template of the names of the assigned identities of the
+	// AssignedIDNamingTemplate scheme, e.g. {{.PodNamespace}}-{{.PodName}}-{{.IdentityName}}
+	AssignedIDNameTemplate string
+	// AllowHostNetworkAssignment assigns identities to the pods using the host network, which share
+	// the IP of their node with the other host network pods of the node. Otherwise only the host
+	// network pods with the AllowHostNetworkAssignmentLabel are assigned identities.
+	AllowHostNetworkAssignment bool
+	// PerIdentityMetrics reports the assignments and removals of identities by AzureIdentity, for at
+	// most MaxMetricIdentities AzureIdentities, DefaultMaxMetricIdentities when not positive
+	PerIdentityMetrics  bool
+	MaxMetricIdentities int
 }
 
 // ClientInt ...
@@ -115,13 +225,32 @@ type trackUserAssignedMSIIds struct {
 	assignedIDsToCreate      []aadpodid.AzureAssignedIdentity
 	assignedIDsToDelete      []aadpodid.AzureAssignedIdentity
 	isvmss                   bool
+	// enableSystemAssigned is true when the system assigned identity is required by an identity to assign
+	enableSystemAssigned bool
+	// disableSystemAssigned is true when the system assigned identity is no longer in use by the
+	// identities of the node
+	disableSystemAssigned bool
+	// hybridMachine is the Azure Arc machine of the node, nil for Azure VM and VMSS nodes
+	hybridMachine *azure.Resource
 }
 
 // NewMICClient returnes new mic client
 func NewMICClient(cfg *Config) (*Client, error) {
 	klog.Infof("Starting to create the pod identity client. Version: %v. Build date: %v", version.MICVersion, version.BuildDate)
 
-	clientSet := kubernetes.NewForConfigOrDie(cfg.RestConfig)
+	reporter, err := metrics.NewReporter()
+	if err != nil {
+		klog.Errorf("Not able to create New Reporter. Error: %+v", err)
+		return nil, err
+	}
+	minResync := cfg.MinResync
+	if minResync <= 0 {
+		minResync = cfg.SyncRetryInterval
+	}
+	resync := newResyncBackoff(minResync, cfg.MaxResync, reporter)
+	restConfig := observeRequests(cfg.RestConfig, resync)
+
+	clientSet := kubernetes.NewForConfigOrDie(restConfig)
 
 	k8sVersion, err := clientSet.ServerVersion()
 	if err == nil {
@@ -138,13 +267,13 @@ func NewMICClient(cfg *Config) (*Client, error) {
 
 	eventCh := make(chan aadpodid.EventType, 100)
 
-	crdClient, err := crd.NewCRDClient(cfg.RestConfig, eventCh)
+	crdClient, err := crd.NewCRDClient(restConfig, eventCh)
 	if err != nil {
 		return nil, err
 	}
 	klog.V(1).Infof("CRD client initialized")
 
-	podClient := pod.NewPodClient(informer, eventCh)
+	podClient := pod.NewPodClient(informer, eventCh, cfg.MatchAnnotation)
 	klog.V(1).Infof("Pod Client initialized")
 
 	eventBroadcaster := record.NewBroadcaster()
@@ -161,6 +290,21 @@ func NewMICClient(cfg *Config) (*Client, error) {
 		}
 	}
 
+	var nodeClient NodeGetter = &NodeClient{informer.Core().V1().Nodes()}
+	if cfg.NodeMappingConfigMap != "" {
+		if cfg.CRDOnly {
+			nodeClient = NewNodeMappingClient(clientSet, cfg.CMcfg.Namespace, cfg.NodeMappingConfigMap, nil)
+			klog.Infof("CRD only mode is enabled, nodes are resolved from config map %s/%s only", cfg.CMcfg.Namespace, cfg.NodeMappingConfigMap)
+		} else {
+			nodeClient = NewNodeMappingClient(clientSet, cfg.CMcfg.Namespace, cfg.NodeMappingConfigMap, nodeClient)
+		}
+	}
+
+	assignedIDNames, err := newAssignedIDNamer(cfg.AssignedIDNamingScheme, cfg.AssignedIDNameTemplate)
+	if err != nil {
+		return nil, err
+	}
+
 	var cmClient typedcorev1.ConfigMapInterface
 	if cfg.TypeUpgradeCfg.EnableTypeUpgrade {
 		cmClient = clientSet.CoreV1().ConfigMaps(cfg.CMcfg.Namespace)
@@ -172,7 +316,7 @@ func NewMICClient(cfg *Config) (*Client, error) {
 		PodClient:            podClient,
 		EventRecorder:        recorder,
 		EventChannel:         eventCh,
-		NodeClient:           &NodeClient{informer.Core().V1().Nodes()},
+		NodeClient:           nodeClient,
 		IsNamespaced:         cfg.IsNamespaced,
 		syncRetryInterval:    cfg.SyncRetryInterval,
 		enableScaleFeatures:  cfg.EnableScaleFeatures,
@@ -181,6 +325,24 @@ func NewMICClient(cfg *Config) (*Client, error) {
 		TypeUpgradeCfg:       cfg.TypeUpgradeCfg,
 		CMCfg:                cfg.CMcfg,
 		CMClient:             cmClient,
+		matchAnnotation:      cfg.MatchAnnotation,
+
+		defaultIdentityResourceGroup: cfg.DefaultIdentityResourceGroup,
+		excludedNamespaces:           namespaceSet(cfg.ExcludedNamespaces),
+		includedNamespaces:           namespaceSet(cfg.IncludedNamespaces),
+		assignOnly:                   cfg.AssignOnly,
+		allowEnableSystemAssigned:    cfg.AllowEnableSystemAssigned,
+		maxIdentitiesPerNode:         cfg.MaxIdentitiesPerNode,
+		assignedIDNames:              assignedIDNames,
+		allowHostNetworkAssignment:   cfg.AllowHostNetworkAssignment,
+	}
+
+	if cfg.EnableSecretRefs {
+		c.SecretClient = &SecretClient{clientSet.CoreV1()}
+	}
+
+	if c.assignOnly {
+		klog.Warning("Assign only mode is enabled, identities will not be removed from nodes and assigned identities will not be deleted. Cleanup is left to an external process")
 	}
 
 	leaderElector, err := c.NewLeaderElector(clientSet, recorder, cfg.LeaderElectionCfg)
@@ -190,12 +352,13 @@ func NewMICClient(cfg *Config) (*Client, error) {
 	}
 	c.leaderElector = leaderElector
 
-	reporter, err := metrics.NewReporter()
-	if err != nil {
-		klog.Errorf("Not able to create New Reporter. Error: %+v", err)
-		return nil, err
-	}
 	c.Reporter = reporter
+	c.armOps = newARMOpsLimiter(cfg.MaxConcurrentARMOps, reporter)
+	c.stuckAssignments = newStuckAssignmentTracker(cfg.StuckAssignmentThreshold, reporter)
+	c.armReconcile = newARMReconciler(cfg.ARMReconcileInterval, cfg.ARMReconcileDetach, reporter)
+	c.apiWrites = newAPIWriteBackoff(DefaultAPIWriteBackoffBase, DefaultAPIWriteBackoffMax, reporter)
+	c.identityMetrics = newIdentityMetrics(cfg.PerIdentityMetrics, cfg.MaxMetricIdentities, reporter)
+	c.resync = resync
 	return c, nil
 }
 
@@ -346,8 +509,12 @@ func (c *Client) Sync(exit <-chan struct{}) {
 	}
 	defer c.setStopped()
 
-	ticker := time.NewTicker(c.syncRetryInterval)
-	defer ticker.Stop()
+	resync := time.NewTimer(c.resyncInterval())
+	defer resync.Stop()
+	reconcile, stopReconcile := c.armReconcile.tick()
+	defer stopReconcile()
+	// the reconciliation runs in the first sync and in the first sync after each tick
+	reconcileDue := c.armReconcile != nil
 
 	klog.Info("Sync thread started.")
 	c.SyncLoopStarted = true
@@ -361,8 +528,17 @@ func (c *Client) Sync(exit <-chan struct{}) {
 			return
 		case event = <-c.EventChannel:
 			klog.V(6).Infof("Received event: %v", event)
-		case <-ticker.C:
+			// the events received during a burst are coalesced into a single sync, which sees the
+			// state after all of them
+			if coalesced := c.drainEvents(); coalesced > 0 {
+				klog.V(6).Infof("Coalesced %d pending events into this sync", coalesced)
+			}
+		case <-resync.C:
 			klog.V(6).Infof("Running periodic sync loop")
+			resync.Reset(c.resyncInterval())
+		case <-reconcile:
+			klog.V(6).Infof("Running periodic reconciliation of the identities in ARM")
+			reconcileDue = true
 		}
 		totalSyncCycles++
 		stats.Init()
@@ -394,7 +570,8 @@ func (c *Client) Sync(exit <-chan struct{}) {
 			continue
 		}
 		klog.V(6).Infof("Number of identities: %d", len(*listIDs))
-		idMap, err := c.convertIDListToMap(*listIDs)
+		ids := c.resolveIdentitySecretRefs(*listIDs)
+		idMap, err := c.convertIDListToMap(ids)
 		if err != nil {
 			klog.Error(err)
 			continue
@@ -406,6 +583,7 @@ func (c *Client) Sync(exit <-chan struct{}) {
 		}
 		klog.V(6).Infof("Number of assigned identities: %d", len(currentAssignedIDs))
 		stats.Put(stats.System, time.Since(systemTime))
+		c.stuckAssignments.check(currentAssignedIDs, time.Now())
 
 		beginNewListTime := time.Now()
 		newAssignedIDs, nodeRefs, err := c.createDesiredAssignedIdentityList(listPods, listBindings, idMap)
@@ -427,7 +605,13 @@ func (c *Client) Sync(exit <-chan struct{}) {
 			klog.Error(err)
 			continue
 		}
+		if c.assignOnly && len(deleteList) > 0 {
+			klog.V(5).Infof("Assign only mode, skipping deletion of %d assigned identities", len(deleteList))
+			deleteList = nil
+		}
 		klog.V(5).Infof("del: %v, add: %v", deleteList, addList)
+		// the labels of the assigned identities created by previous versions of mic are backfilled
+		c.syncAssignedIDLabels(currentAssignedIDs, deleteList)
 
 		// the node map is used to track assigned ids to create/delete, identities to assign/remove
 		// for each node or vmss
@@ -446,12 +630,27 @@ func (c *Client) Sync(exit <-chan struct{}) {
 			workDone = true
 			c.getListOfIdsToAssign(addList, nodeMap)
 		}
+		// a node replaced by a node with the same name doesn't have the identities assigned to the previous node
+		if replacedNodes := c.getReplacedNodes(currentAssignedIDs); len(replacedNodes) > 0 {
+			workDone = true
+			c.getListOfIdsToReapply(currentAssignedIDs, deleteList, replacedNodes, nodeMap)
+		}
+		// identities attached or detached outside MIC are corrected from the identities in ARM
+		if reconcileDue {
+			reconcileDue = false
+			if c.getListOfDriftedIds(currentAssignedIDs, deleteList, idMap, nodeMap) > 0 {
+				workDone = true
+			}
+		}
 
 		var wg sync.WaitGroup
 
 		// check if vmss and consolidate vmss nodes into vmss if necessary
 		c.consolidateVMSSNodes(nodeMap, &wg)
 
+		// assignments beyond the identities a VM or VMSS can have are refused before its update
+		c.enforceIdentityCapacity(currentAssignedIDs, deleteList, nodeMap)
+
 		// one final createorupdate to each node or vmss in the map
 		c.updateNodeAndDeps(newAssignedIDs, nodeMap, nodeRefs, &wg)
 
@@ -489,6 +688,27 @@ func (c *Client) Sync(exit <-chan struct{}) {
 	}
 }
 
+// drainEvents removes the events pending in the event channel and returns their number
+func (c *Client) drainEvents() int {
+	drained := 0
+	for {
+		select {
+		case <-c.EventChannel:
+			drained++
+		default:
+			return drained
+		}
+	}
+}
+
+// resyncInterval returns the interval of the periodic sync
+func (c *Client) resyncInterval() time.Duration {
+	if c.resync == nil {
+		return c.syncRetryInterval
+	}
+	return c.resync.interval()
+}
+
 func (c *Client) convertAssignedIDListToMap(addList, deleteList map[string]aadpodid.AzureAssignedIdentity, nodeMap map[string]trackUserAssignedMSIIds) {
 	if addList != nil {
 		for _, createID := range addList {
@@ -522,6 +742,9 @@ func (c *Client) createDesiredAssignedIdentityList(
 	nodeRefs := make(map[string]bool)
 	newAssignedIDs := make(map[string]aadpodid.AzureAssignedIdentity)
 
+	// The pods are processed in creation order, so the assignments are made in the same order in
+	// every sync and the pods created first win the ties between bindings.
+	sortPodsByCreation(listPods)
 	for _, pod := range listPods {
 		klog.V(6).Infof("Checking pod %s/%s", pod.Namespace, pod.Name)
 		if pod.Spec.NodeName == "" {
@@ -529,10 +752,10 @@ func (c *Client) createDesiredAssignedIdentityList(
 			klog.V(2).Infof("Pod %s/%s has no assigned node yet. it will be ignored", pod.Namespace, pod.Name)
 			continue
 		}
-		crdPodLabelVal := pod.Labels[aadpodid.CRDLabelKey]
+		crdPodLabelVal := c.getPodSelector(pod)
 		klog.V(6).Infof("Pod: %s/%s. Label value: %v", pod.Namespace, pod.Name, crdPodLabelVal)
 		if crdPodLabelVal == "" {
-			//No binding mentioned in the label. Just continue to the next pod
+			//No binding mentioned in the label or annotation. Just continue to the next pod
 			klog.V(2).Infof("Pod %s/%s has correct %s label but with no value. it will be ignored", pod.Namespace, pod.Name, aadpodid.CRDLabelKey)
 			continue
 		}
@@ -542,10 +765,26 @@ func (c *Client) createDesiredAssignedIdentityList(
 			if allBinding.Spec.Selector == crdPodLabelVal {
 				klog.V(5).Infof("Found binding match for pod %s/%s with binding %s/%s", pod.Namespace, pod.Name, allBinding.Namespace, allBinding.Name)
 				matchedBindings = append(matchedBindings, allBinding)
-				nodeRefs[pod.Spec.NodeName] = true
 			}
 		}
-
+		if len(matchedBindings) == 0 {
+			continue
+		}
+		if !c.isNamespaceAllowed(pod.Namespace) {
+			klog.V(5).Infof("Pod %s/%s matches %d binding(s) but namespace %s is excluded from identity assignment, it will be ignored", pod.Namespace, pod.Name, len(matchedBindings), pod.Namespace)
+			continue
+		}
+		if !c.isHostNetworkAssignmentAllowed(pod) {
+			continue
+		}
+		nodeRefs[pod.Spec.NodeName] = true
+
+		// A pod can match multiple bindings, each resulting in a distinct assigned identity per identity.
+		// The bindings are sorted so the same binding is used for an identity matched through multiple
+		// bindings in every sync, otherwise the assigned identity would be recreated on every sync.
+		sort.Slice(matchedBindings, func(i, j int) bool {
+			return getIDKey(matchedBindings[i].Namespace, matchedBindings[i].Name) < getIDKey(matchedBindings[j].Namespace, matchedBindings[j].Name)
+		})
 		for _, binding := range matchedBindings {
 			klog.V(5).Infof("Looking up id map: %s/%s", binding.Namespace, binding.Spec.AzureIdentity)
 			if azureID, idPresent := idMap[getIDKey(binding.Namespace, binding.Spec.AzureIdentity)]; idPresent {
@@ -558,6 +797,14 @@ func (c *Client) createDesiredAssignedIdentityList(
 						continue
 					}
 				}
+				if c.checkIfUserAssignedMSI(&azureID) {
+					resourceID, err := c.getIdentityResourceID(&azureID)
+					if err != nil {
+						klog.Errorf("failed to resolve resource id of identity %s/%s for pod %s/%s with error %v", azureID.Namespace, azureID.Name, pod.Namespace, pod.Name, err)
+						continue
+					}
+					azureID.Spec.ResourceID = resourceID
+				}
 				klog.V(5).Infof("identity %s/%s assigned to %s/%s via %s/%s", azureID.Namespace, azureID.Name, pod.Namespace, pod.Name, binding.Namespace, binding.Name)
 				assignedID, err := c.makeAssignedIDs(azureID, binding, pod.Name, pod.Namespace, pod.Spec.NodeName)
 
@@ -565,6 +812,11 @@ func (c *Client) createDesiredAssignedIdentityList(
 					klog.Errorf("failed to create assignment for pod %s/%s with identity %s/%s with error %v", pod.Namespace, pod.Name, azureID.Namespace, azureID.Name, err.Error())
 					continue
 				}
+				if existing, exists := newAssignedIDs[assignedID.Name]; exists {
+					klog.V(5).Infof("identity %s/%s already assigned to %s/%s via %s/%s, binding %s/%s will be ignored", azureID.Namespace, azureID.Name, pod.Namespace, pod.Name,
+						existing.Spec.AzureBindingRef.Namespace, existing.Spec.AzureBindingRef.Name, binding.Namespace, binding.Name)
+					continue
+				}
 				newAssignedIDs[assignedID.Name] = *assignedID
 			} else {
 				// This is the case where the identity has been deleted.
@@ -575,9 +827,90 @@ func (c *Client) createDesiredAssignedIdentityList(
 			}
 		}
 	}
+	c.pruneSelectorConflicts(listPods)
 	return newAssignedIDs, nodeRefs, nil
 }
 
+// sortPodsByCreation sorts the pods by creation timestamp, then by namespace and name
+func sortPodsByCreation(pods []*corev1.Pod) {
+	sort.SliceStable(pods, func(i, j int) bool {
+		ti, tj := pods[i].CreationTimestamp, pods[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return getIDKey(pods[i].Namespace, pods[i].Name) < getIDKey(pods[j].Namespace, pods[j].Name)
+	})
+}
+
+// getIdentityResourceID returns the resource id of the user assigned identity. The resourceID of the
+// identity takes precedence, otherwise the identity name is resolved in the default identity resource group.
+// Resolved resource ids are cached so the identity is only looked up once.
+func (c *Client) getIdentityResourceID(id *aadpodid.AzureIdentity) (string, error) {
+	if id.Spec.ResourceID != "" || id.Spec.IdentityName == "" {
+		return id.Spec.ResourceID, nil
+	}
+	if resourceID, ok := c.resolvedIdentityIDs[id.Spec.IdentityName]; ok {
+		return resourceID, nil
+	}
+	resourceID, err := c.CloudClient.GetUserMSIResourceID(c.defaultIdentityResourceGroup, id.Spec.IdentityName)
+	if err != nil {
+		return "", err
+	}
+	if c.resolvedIdentityIDs == nil {
+		c.resolvedIdentityIDs = make(map[string]string)
+	}
+	c.resolvedIdentityIDs[id.Spec.IdentityName] = resourceID
+	klog.Infof("Resolved identity %s/%s with name %s to %s", id.Namespace, id.Name, id.Spec.IdentityName, resourceID)
+	return resourceID, nil
+}
+
+// getPodSelector returns the value used to match the pod against the binding selectors.
+// The aadpodidbinding label always takes precedence; the match annotation (if configured)
+// is only used when the label is absent or empty.
+func (c *Client) getPodSelector(pod *corev1.Pod) string {
+	labelVal := pod.Labels[aadpodid.CRDLabelKey]
+	if c.matchAnnotation == "" {
+		return labelVal
+	}
+	annotationVal := pod.Annotations[c.matchAnnotation]
+	if labelVal == "" {
+		return annotationVal
+	}
+	if annotationVal == "" || annotationVal == labelVal {
+		delete(c.selectorConflicts, pod.UID)
+		return labelVal
+	}
+	message := fmt.Sprintf("Pod %s/%s has %s label %q and %s annotation %q. Using the label value", pod.Namespace, pod.Name, aadpodid.CRDLabelKey, labelVal, c.matchAnnotation, annotationVal)
+	conflict := labelVal + "/" + annotationVal
+	if reported, ok := c.selectorConflicts[pod.UID]; ok && reported == conflict {
+		klog.V(5).Info(message)
+		return labelVal
+	}
+	if c.selectorConflicts == nil {
+		c.selectorConflicts = make(map[types.UID]string)
+	}
+	c.selectorConflicts[pod.UID] = conflict
+	c.EventRecorder.Event(pod, corev1.EventTypeWarning, "selector conflict", message)
+	klog.Warning(message)
+	return labelVal
+}
+
+// pruneSelectorConflicts forgets the selector conflicts of the pods no longer listed
+func (c *Client) pruneSelectorConflicts(listPods []*corev1.Pod) {
+	if len(c.selectorConflicts) == 0 {
+		return
+	}
+	listed := make(map[types.UID]bool, len(listPods))
+	for _, pod := range listPods {
+		listed[pod.UID] = true
+	}
+	for uid := range c.selectorConflicts {
+		if !listed[uid] {
+			delete(c.selectorConflicts, uid)
+		}
+	}
+}
+
 // getListOfIdsToDelete will go over the delete list to determine if the id is required to be deleted
 // only user assigned identity not in use are added to the remove list for the node
 func (c *Client) getListOfIdsToDelete(deleteList map[string]aadpodid.AzureAssignedIdentity,
@@ -608,6 +941,9 @@ func (c *Client) getListOfIdsToDelete(deleteList map[string]aadpodid.AzureAssign
 			if !inUse && isUserAssignedMSI && !isImmutableIdentity {
 				c.appendToRemoveListForNode(id.Spec.ResourceID, delID.Spec.NodeName, nodeMap)
 			}
+			if !inUse && c.checkIfSystemAssignedMSI(id) && c.allowEnableSystemAssigned {
+				c.setSystemAssignedForNode(false, delID.Spec.NodeName, nodeMap)
+			}
 		}
 		klog.V(5).Infof("Binding removed: %+v", delID.Spec.AzureBindingRef)
 	}
@@ -623,6 +959,9 @@ func (c *Client) getListOfIdsToAssign(addList map[string]aadpodid.AzureAssignedI
 			if isUserAssignedMSI {
 				c.appendToAddListForNode(id.Spec.ResourceID, createID.Spec.NodeName, nodeMap)
 			}
+			if c.checkIfSystemAssignedMSI(id) && c.allowEnableSystemAssigned {
+				c.setSystemAssignedForNode(true, createID.Spec.NodeName, nodeMap)
+			}
 		}
 		klog.V(5).Infof("Binding applied: %+v", createID.Spec.AzureBindingRef)
 	}
@@ -648,6 +987,9 @@ func (c *Client) matchAssignedID(x aadpodid.AzureAssignedIdentity, y aadpodid.Az
 		bindingX.ResourceVersion == bindingY.ResourceVersion &&
 		idX.Name == idY.Name &&
 		idX.ResourceVersion == idY.ResourceVersion &&
+		// the client id and resource id of identities referencing a secret change with the secret
+		idX.Spec.ClientID == idY.Spec.ClientID &&
+		idX.Spec.ResourceID == idY.Spec.ResourceID &&
 		x.Spec.Pod == y.Spec.Pod &&
 		x.Spec.PodNamespace == y.Spec.PodNamespace &&
 		x.Spec.NodeName == y.Spec.NodeName
@@ -721,14 +1063,9 @@ func (c *Client) makeAssignedIDs(azID aadpodid.AzureIdentity, azBinding aadpodid
 	binding := azBinding
 	id := azID
 
-	labels := make(map[string]string)
-	labels["nodename"] = nodeName
-	labels["podnamespace"] = podNameSpace
-	labels["podname"] = podName
-
 	oMeta := v1.ObjectMeta{
 		Name:   c.getAssignedIDName(podName, podNameSpace, azID.Name),
-		Labels: labels,
+		Labels: assignedIDLabels(podName, podNameSpace, nodeName, azID.Name),
 	}
 	assignedID := &aadpodid.AzureAssignedIdentity{
 		ObjectMeta: oMeta,
@@ -759,19 +1096,15 @@ func (c *Client) makeAssignedIDs(azID aadpodid.AzureIdentity, azBinding aadpodid
 }
 
 func (c *Client) createAssignedIdentity(assignedID *aadpodid.AzureAssignedIdentity) error {
-	err := c.CRDClient.CreateAssignedIdentity(assignedID)
-	if err != nil {
-		return err
-	}
-	return nil
+	return c.apiWrites.write(assignedID, metrics.AssignedIdentityAdditionOperationName, func() error {
+		return c.CRDClient.CreateAssignedIdentity(assignedID)
+	})
 }
 
 func (c *Client) removeAssignedIdentity(assignedID *aadpodid.AzureAssignedIdentity) error {
-	err := c.CRDClient.RemoveAssignedIdentity(assignedID)
-	if err != nil {
-		return err
-	}
-	return nil
+	return c.apiWrites.write(assignedID, metrics.AssignedIdentityDeletionOperationName, func() error {
+		return c.CRDClient.RemoveAssignedIdentity(assignedID)
+	})
 }
 
 func (c *Client) appendToRemoveListForNode(resourceID, nodeName string, nodeMap map[string]trackUserAssignedMSIIds) {
@@ -792,12 +1125,28 @@ func (c *Client) appendToAddListForNode(resourceID, nodeName string, nodeMap map
 	nodeMap[nodeName] = trackUserAssignedMSIIds{addUserAssignedMSIIDs: []string{resourceID}}
 }
 
+// setSystemAssignedForNode marks the system assigned identity of the node to be enabled or disabled.
+// Enabling takes precedence when both are required in the same sync.
+func (c *Client) setSystemAssignedForNode(enable bool, nodeName string, nodeMap map[string]trackUserAssignedMSIIds) {
+	trackList := nodeMap[nodeName]
+	if enable {
+		trackList.enableSystemAssigned = true
+	} else {
+		trackList.disableSystemAssigned = true
+	}
+	nodeMap[nodeName] = trackList
+}
+
 func (c *Client) checkIfUserAssignedMSI(id *aadpodid.AzureIdentity) bool {
 	return id.Spec.Type == aadpodid.UserAssignedMSI
 }
 
+func (c *Client) checkIfSystemAssignedMSI(id *aadpodid.AzureIdentity) bool {
+	return id.Spec.Type == aadpodid.SystemAssignedMSI
+}
+
 func (c *Client) getAssignedIDName(podName, podNameSpace, idName string) string {
-	return podName + "-" + podNameSpace + "-" + idName
+	return c.assignedIDNames.name(podName, podNameSpace, idName)
 }
 
 func (c *Client) checkIfMSIExistsOnNode(id *aadpodid.AzureIdentity, nodeName string, nodeMSIList []string) bool {
@@ -809,8 +1158,22 @@ func (c *Client) checkIfMSIExistsOnNode(id *aadpodid.AzureIdentity, nodeName str
 	return false
 }
 
-func (c *Client) getUserMSIListForNode(nodeOrVMSSName string, isvmss bool) ([]string, error) {
-	return c.CloudClient.GetUserMSIs(nodeOrVMSSName, isvmss)
+func (c *Client) getUserMSIListForNode(nodeOrVMSSName string, nodeTrackList trackUserAssignedMSIIds) ([]string, error) {
+	if m := nodeTrackList.hybridMachine; m != nil {
+		return c.CloudClient.GetHybridMachineUserMSIs(m.SubscriptionID, m.ResourceGroup, m.ResourceName)
+	}
+	return c.CloudClient.GetUserMSIs(nodeOrVMSSName, nodeTrackList.isvmss)
+}
+
+// updateUserMSIOnNode updates the user assigned identities through the hybrid compute API for
+// Azure Arc machines and through the VM or VMSS API otherwise.
+func (c *Client) updateUserMSIOnNode(addUserAssignedMSIIDs, removeUserAssignedMSIIDs []string, nodeOrVMSSName string, nodeTrackList trackUserAssignedMSIIds) error {
+	return c.armOps.do(func() error {
+		if m := nodeTrackList.hybridMachine; m != nil {
+			return c.CloudClient.UpdateHybridMachineUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs, m.SubscriptionID, m.ResourceGroup, m.ResourceName)
+		}
+		return c.CloudClient.UpdateUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs, nodeOrVMSSName, nodeTrackList.isvmss)
+	})
 }
 
 func getIDKey(ns, name string) string {
@@ -831,19 +1194,26 @@ func (c *Client) checkIfInUse(checkAssignedID aadpodid.AzureAssignedIdentity, as
 		id := assignedID.Spec.AzureIdentityRef
 		// If they have the same client id, reside on the same node but the pod name is different, then the
 		// assigned id is in use.
-		// This is applicable only for user assigned MSI since that is node specific. Ignore other cases.
-		if checkID.Spec.Type != aadpodid.UserAssignedMSI {
-			continue
-		}
-
-		if checkAssignedID.Spec.Pod == assignedID.Spec.Pod {
-			// No need to do the rest of the checks in this case, since it's the same assignment
-			// The same identity won't be assigned to a pod twice, so it's the same reference.
+		// This is applicable only for user and system assigned MSI since those are node specific. Ignore other cases.
+		if checkID.Spec.Type != aadpodid.UserAssignedMSI && checkID.Spec.Type != aadpodid.SystemAssignedMSI {
 			continue
 		}
 
-		if checkID.Spec.ClientID != id.Spec.ClientID {
-			continue
+		if checkID.Spec.Type == aadpodid.SystemAssignedMSI {
+			// the system assigned identity of the node is shared by all system assigned identities, so
+			// any other system assigned assignment on the node, even to the same pod, keeps it in use.
+			if assignedID.Name == checkAssignedID.Name || id.Spec.Type != aadpodid.SystemAssignedMSI {
+				continue
+			}
+		} else {
+			if checkAssignedID.Spec.Pod == assignedID.Spec.Pod {
+				// No need to do the rest of the checks in this case, since it's the same assignment
+				// The same identity won't be assigned to a pod twice, so it's the same reference.
+				continue
+			}
+			if checkID.Spec.ClientID != id.Spec.ClientID {
+				continue
+			}
 		}
 
 		if checkAssignedID.Spec.NodeName == assignedID.Spec.NodeName {
@@ -876,17 +1246,46 @@ func (c *Client) getUniqueIDs(idList []string) []string {
 	for id := range idSet {
 		uniqueList = append(uniqueList, id)
 	}
+	sort.Strings(uniqueList)
 	return uniqueList
 }
 
+// coalesceUserMSIIDs returns the unique identities to assign and remove in a single update of the
+// node. An identity both to assign and to remove is kept, as it's in the desired identities of the
+// node, so the identities of the node never go through an intermediate state during a burst.
+func (c *Client) coalesceUserMSIIDs(addUserAssignedMSIIDs, removeUserAssignedMSIIDs []string) ([]string, []string) {
+	add := c.getUniqueIDs(addUserAssignedMSIIDs)
+	adding := make(map[string]bool, len(add))
+	for _, id := range add {
+		adding[id] = true
+	}
+	var remove []string
+	for _, id := range c.getUniqueIDs(removeUserAssignedMSIIDs) {
+		if adding[id] {
+			klog.V(5).Infof("Identity %s is both assigned and removed, keeping it", id)
+			continue
+		}
+		remove = append(remove, id)
+	}
+	return add, remove
+}
+
 func (c *Client) updateAssignedIdentityStatus(assignedID *aadpodid.AzureAssignedIdentity, status string) error {
-	return c.CRDClient.UpdateAzureAssignedIdentityStatus(assignedID, status)
+	return c.apiWrites.write(assignedID, metrics.UpdateAzureAssignedIdentityStatusOperationName, func() error {
+		return c.CRDClient.UpdateAzureAssignedIdentityStatus(assignedID, status)
+	})
 }
 
 func (c *Client) updateNodeAndDeps(newAssignedIDs map[string]aadpodid.AzureAssignedIdentity, nodeMap map[string]trackUserAssignedMSIIds, nodeRefs map[string]bool, wg *sync.WaitGroup) {
-	for nodeName, nodeTrackList := range nodeMap {
+	// the nodes are updated in order so they queue for the ARM operations limit in the same order
+	nodeNames := make([]string, 0, len(nodeMap))
+	for nodeName := range nodeMap {
+		nodeNames = append(nodeNames, nodeName)
+	}
+	sort.Strings(nodeNames)
+	for _, nodeName := range nodeNames {
 		wg.Add(1)
-		go c.updateUserMSI(newAssignedIDs, nodeName, nodeTrackList, nodeRefs, wg)
+		go c.updateUserMSI(newAssignedIDs, nodeName, nodeMap[nodeName], nodeRefs, wg)
 	}
 }
 
@@ -917,7 +1316,7 @@ func (c *Client) updateUserMSI(newAssignedIDs map[string]aadpodid.AzureAssignedI
 
 				assignedID.Status.Status = aadpodid.AssignedIDCreated
 				err := c.createAssignedIdentity(&assignedID)
-				if err != nil {
+				if err != nil && !isSummarizedAPIWriteError(err) {
 					c.EventRecorder.Event(binding, corev1.EventTypeWarning, "binding apply error",
 						fmt.Sprintf("Creating assigned identity for pod %s resulted in error %v", assignedID.Name, err))
 					klog.Error(err)
@@ -931,16 +1330,29 @@ func (c *Client) updateUserMSI(newAssignedIDs map[string]aadpodid.AzureAssignedI
 		klog.Errorf("Failed to acquire semaphore at the end of creates: %v", err)
 		return
 	}
+	nodeTrackList = c.refuseHybridUserMSIs(nodeOrVMSSName, nodeTrackList, beginAdding)
 	// generate unique list so we don't make multiple calls to assign/remove same id
-	addUserAssignedMSIIDs := c.getUniqueIDs(nodeTrackList.addUserAssignedMSIIDs)
-	removeUserAssignedMSIIDs := c.getUniqueIDs(nodeTrackList.removeUserAssignedMSIIDs)
+	addUserAssignedMSIIDs, removeUserAssignedMSIIDs := c.coalesceUserMSIIDs(nodeTrackList.addUserAssignedMSIIDs, nodeTrackList.removeUserAssignedMSIIDs)
 
-	err := c.CloudClient.UpdateUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs, nodeOrVMSSName, nodeTrackList.isvmss)
+	err := c.updateUserMSIOnNode(addUserAssignedMSIIDs, removeUserAssignedMSIIDs, nodeOrVMSSName, nodeTrackList)
+	if err == nil {
+		err = c.updateSystemAssignedOnNode(nodeOrVMSSName, nodeTrackList)
+	}
 	if err != nil {
 		klog.Errorf("Updating msis on node %s, add [%d], del [%d] failed with error %v", nodeOrVMSSName, len(nodeTrackList.assignedIDsToCreate), len(nodeTrackList.assignedIDsToDelete), err)
-		idList, getErr := c.getUserMSIListForNode(nodeOrVMSSName, nodeTrackList.isvmss)
+		idList, getErr := c.getUserMSIListForNode(nodeOrVMSSName, nodeTrackList)
+		if getErr == cloudprovider.ErrComputeResourceNotFound {
+			// the VM or VMSS was deleted, no identity is left on it so the removals succeeded
+			// while the identities to assign are retried in the next sync
+			klog.Warningf("%s not found, proceeding as if no identity is assigned to it", nodeOrVMSSName)
+			idList, getErr = nil, nil
+		}
 		if getErr != nil {
 			klog.Errorf("Getting list of msis from node %s resulted in error %v", nodeOrVMSSName, getErr)
+			for _, createID := range nodeTrackList.assignedIDsToCreate {
+				c.stuckAssignments.recordError(createID.Name, err)
+				c.identityMetrics.report(metrics.IdentityAssignmentOperationName, &createID, false, beginAdding)
+			}
 			return
 		}
 
@@ -951,20 +1363,26 @@ func (c *Client) updateUserMSI(newAssignedIDs map[string]aadpodid.AzureAssignedI
 			isUserAssignedMSI := c.checkIfUserAssignedMSI(id)
 			idExistsOnNode := c.checkIfMSIExistsOnNode(id, createID.Spec.NodeName, idList)
 
-			if isUserAssignedMSI && !idExistsOnNode {
+			// the system assigned identity may not have been enabled when the update failed
+			systemAssignedNotEnabled := c.checkIfSystemAssignedMSI(id) && nodeTrackList.enableSystemAssigned
+
+			if (isUserAssignedMSI && !idExistsOnNode) || systemAssignedNotEnabled {
+				c.stuckAssignments.recordError(createID.Name, err)
+				c.identityMetrics.report(metrics.IdentityAssignmentOperationName, &createID, false, beginAdding)
 				message := fmt.Sprintf("Applying binding %s node %s for pod %s resulted in error %v", binding.Name, createID.Spec.NodeName, createID.Name, err.Error())
 				c.EventRecorder.Event(binding, corev1.EventTypeWarning, "binding apply error", message)
 				klog.Error(message)
 				continue
 			}
 			// the identity was successfully assigned to the node
+			c.identityMetrics.report(metrics.IdentityAssignmentOperationName, &createID, true, beginAdding)
 			c.EventRecorder.Event(binding, corev1.EventTypeNormal, "binding applied",
 				fmt.Sprintf("Binding %s applied on node %s for pod %s", binding.Name, createID.Spec.NodeName, createID.Name))
 
 			klog.Infof("Updating msis on node %s failed, but identity %s has successfully been assigned to node", createID.Spec.NodeName, binding.Name)
 
 			// Identity is successfully assigned to node, so update the status of assigned identity to assigned
-			if updateErr := c.updateAssignedIdentityStatus(&createID, aadpodid.AssignedIDAssigned); updateErr != nil {
+			if updateErr := c.updateAssignedIdentityStatus(&createID, aadpodid.AssignedIDAssigned); updateErr != nil && !isSummarizedAPIWriteError(updateErr) {
 				message := fmt.Sprintf("Updating assigned identity %s status to %s for pod %s failed with error %v", createID.Name, aadpodid.AssignedIDAssigned, createID.Spec.Pod, updateErr.Error())
 				c.EventRecorder.Event(&createID, corev1.EventTypeWarning, "status update error", message)
 				klog.Error(message)
@@ -987,21 +1405,27 @@ func (c *Client) updateUserMSI(newAssignedIDs map[string]aadpodid.AzureAssignedI
 				continue
 			}
 			// the identity still exists on node, which means removing the identity from the node failed
-			if isUserAssignedMSI && !inUse && idExistsOnNode {
+			// the system assigned identity MIC enabled may not have been disabled when the update failed
+			systemAssignedNotDisabled := c.checkIfSystemAssignedMSI(id) && !inUse && nodeTrackList.disableSystemAssigned
+			if (isUserAssignedMSI && !inUse && idExistsOnNode) || systemAssignedNotDisabled {
+				c.identityMetrics.report(metrics.IdentityRemovalOperationName, &delID, false, beginAdding)
 				message := fmt.Sprintf("Binding %s removal from node %s for pod %s resulted in error %v", removedBinding.Name, delID.Spec.NodeName, delID.Spec.Pod, err.Error())
 				c.EventRecorder.Event(removedBinding, corev1.EventTypeWarning, "binding remove error", message)
 				klog.Error(message)
 				continue
 			}
+			c.identityMetrics.report(metrics.IdentityRemovalOperationName, &delID, true, beginAdding)
 
 			klog.Infof("Updating msis on node %s failed, but identity %s has successfully been removed from node", delID.Spec.NodeName, removedBinding.Name)
 
 			// remove assigned identity crd from cluster as the identity has successfully been removed from the node
 			err = c.removeAssignedIdentity(&delID)
 			if err != nil {
-				c.EventRecorder.Event(removedBinding, corev1.EventTypeWarning, "binding remove error",
-					fmt.Sprintf("Removing assigned identity binding %s node %s for pod %s resulted in error %v", removedBinding.Name, delID.Spec.NodeName, delID.Name, err.Error()))
-				klog.Error(err)
+				if !isSummarizedAPIWriteError(err) {
+					c.EventRecorder.Event(removedBinding, corev1.EventTypeWarning, "binding remove error",
+						fmt.Sprintf("Removing assigned identity binding %s node %s for pod %s resulted in error %v", removedBinding.Name, delID.Spec.NodeName, delID.Name, err.Error()))
+					klog.Error(err)
+				}
 				continue
 			}
 			// the identity was successfully removed from node
@@ -1012,6 +1436,14 @@ func (c *Client) updateUserMSI(newAssignedIDs map[string]aadpodid.AzureAssignedI
 		return
 	}
 
+	// the identities were successfully assigned to and removed from the node
+	for _, createID := range nodeTrackList.assignedIDsToCreate {
+		c.identityMetrics.report(metrics.IdentityAssignmentOperationName, &createID, true, beginAdding)
+	}
+	for _, delID := range nodeTrackList.assignedIDsToDelete {
+		c.identityMetrics.report(metrics.IdentityRemovalOperationName, &delID, true, beginAdding)
+	}
+
 	semUpdate := semaphore.NewWeighted(c.createDeleteBatch)
 
 	for _, createID := range nodeTrackList.assignedIDsToCreate {
@@ -1025,9 +1457,11 @@ func (c *Client) updateUserMSI(newAssignedIDs map[string]aadpodid.AzureAssignedI
 			// update the status to assigned for assigned identity as identity was successfully assigned to node.
 			err := c.updateAssignedIdentityStatus(&assignedID, aadpodid.AssignedIDAssigned)
 			if err != nil {
-				message := fmt.Sprintf("Updating assigned identity %s status to %s for pod %s failed with error %v", assignedID.Name, aadpodid.AssignedIDAssigned, assignedID.Spec.Pod, err.Error())
-				c.EventRecorder.Event(&assignedID, corev1.EventTypeWarning, "status update error", message)
-				klog.Error(message)
+				if !isSummarizedAPIWriteError(err) {
+					message := fmt.Sprintf("Updating assigned identity %s status to %s for pod %s failed with error %v", assignedID.Name, aadpodid.AssignedIDAssigned, assignedID.Spec.Pod, err.Error())
+					c.EventRecorder.Event(&assignedID, corev1.EventTypeWarning, "status update error", message)
+					klog.Error(message)
+				}
 				return
 			}
 			c.EventRecorder.Event(binding, corev1.EventTypeNormal, "binding applied",
@@ -1055,17 +1489,21 @@ func (c *Client) updateUserMSI(newAssignedIDs map[string]aadpodid.AzureAssignedI
 			// this will ensure on next sync loop we only try to delete the assigned identity instead of doing everything.
 			err := c.updateAssignedIdentityStatus(&assignedID, aadpodid.AssignedIDUnAssigned)
 			if err != nil {
-				message := fmt.Sprintf("Updating assigned identity %s status to %s for pod %s failed with error %v", assignedID.Name, aadpodid.AssignedIDUnAssigned, assignedID.Spec.Pod, err.Error())
-				c.EventRecorder.Event(&assignedID, corev1.EventTypeWarning, "status update error", message)
-				klog.Error(message)
+				if !isSummarizedAPIWriteError(err) {
+					message := fmt.Sprintf("Updating assigned identity %s status to %s for pod %s failed with error %v", assignedID.Name, aadpodid.AssignedIDUnAssigned, assignedID.Spec.Pod, err.Error())
+					c.EventRecorder.Event(&assignedID, corev1.EventTypeWarning, "status update error", message)
+					klog.Error(message)
+				}
 				return
 			}
 			// remove assigned identity crd from cluster as the identity has successfully been removed from the node
 			err = c.removeAssignedIdentity(&assignedID)
 			if err != nil {
-				c.EventRecorder.Event(removedBinding, corev1.EventTypeWarning, "binding remove error",
-					fmt.Sprintf("Removing assigned identity binding %s node %s for pod %s resulted in error %v", removedBinding.Name, assignedID.Spec.NodeName, assignedID.Name, err))
-				klog.Error(err)
+				if !isSummarizedAPIWriteError(err) {
+					c.EventRecorder.Event(removedBinding, corev1.EventTypeWarning, "binding remove error",
+						fmt.Sprintf("Removing assigned identity binding %s node %s for pod %s resulted in error %v", removedBinding.Name, assignedID.Spec.NodeName, assignedID.Name, err))
+					klog.Error(err)
+				}
 				return
 			}
 			// the identity was successfully removed from node
@@ -1089,14 +1527,22 @@ func (c *Client) updateUserMSI(newAssignedIDs map[string]aadpodid.AzureAssignedI
 func (c *Client) cleanUpAllAssignedIdentitiesOnNode(node string, nodeTrackList trackUserAssignedMSIIds, wg *sync.WaitGroup) {
 	defer wg.Done()
 	klog.Infof("deleting all assigned identites for %s as node not found", node)
+	c.removeAssignedIdentitiesOfNode(nodeTrackList)
+}
+
+// removeAssignedIdentitiesOfNode deletes the assigned identities to delete of the node without
+// updating the identities of its VM or VMSS
+func (c *Client) removeAssignedIdentitiesOfNode(nodeTrackList trackUserAssignedMSIIds) {
 	for _, deleteID := range nodeTrackList.assignedIDsToDelete {
 		binding := deleteID.Spec.AzureBindingRef
 
 		err := c.removeAssignedIdentity(&deleteID)
 		if err != nil {
-			c.EventRecorder.Event(binding, corev1.EventTypeWarning, "binding remove error",
-				fmt.Sprintf("Removing assigned identity binding %s node %s for pod %s resulted in error %v", binding.Name, deleteID.Spec.NodeName, deleteID.Name, err.Error()))
-			klog.Error(err)
+			if !isSummarizedAPIWriteError(err) {
+				c.EventRecorder.Event(binding, corev1.EventTypeWarning, "binding remove error",
+					fmt.Sprintf("Removing assigned identity binding %s node %s for pod %s resulted in error %v", binding.Name, deleteID.Spec.NodeName, deleteID.Name, err.Error()))
+				klog.Error(err)
+			}
 			continue
 		}
 		c.EventRecorder.Event(binding, corev1.EventTypeNormal, "binding removed",
@@ -1130,6 +1576,29 @@ func (c *Client) consolidateVMSSNodes(nodeMap map[string]trackUserAssignedMSIIds
 			klog.Errorf("error checking if node %s is vmss. Error: %v", nodeName, err)
 			continue
 		}
+		if !isvmss {
+			hybridMachine, err := hybridMachineFromNode(node)
+			if err != nil {
+				klog.Errorf("error checking if node %s is an Azure Arc machine. Error: %v", nodeName, err)
+				continue
+			}
+			if hybridMachine != nil {
+				nodeTrackList.hybridMachine = hybridMachine
+				nodeMap[nodeName] = nodeTrackList
+			}
+		}
+		computeName, computeTrackList := nodeName, nodeTrackList
+		if isvmss {
+			computeName, computeTrackList.isvmss = getVMSSName(vmssName), true
+		}
+		if c.isNodeEvicted(node, computeName, computeTrackList) {
+			wg.Add(1)
+			// the compute resource of the node is gone, its assigned identities are deleted without
+			// detaching their identities
+			go c.cleanUpEvictedNode(nodeName, nodeTrackList, wg)
+			delete(nodeMap, nodeName)
+			continue
+		}
 		if isvmss {
 			if nodes, ok := vmssMap[vmssName]; ok {
 				nodes = append(nodes, nodeName)
@@ -1153,6 +1622,8 @@ func (c *Client) consolidateVMSSNodes(nodeMap map[string]trackUserAssignedMSIIds
 			vmssTrackList.removeUserAssignedMSIIDs = append(vmssTrackList.removeUserAssignedMSIIDs, nodeMap[vmssNode].removeUserAssignedMSIIDs...)
 			vmssTrackList.assignedIDsToCreate = append(vmssTrackList.assignedIDsToCreate, nodeMap[vmssNode].assignedIDsToCreate...)
 			vmssTrackList.assignedIDsToDelete = append(vmssTrackList.assignedIDsToDelete, nodeMap[vmssNode].assignedIDsToDelete...)
+			vmssTrackList.enableSystemAssigned = vmssTrackList.enableSystemAssigned || nodeMap[vmssNode].enableSystemAssigned
+			vmssTrackList.disableSystemAssigned = vmssTrackList.disableSystemAssigned || nodeMap[vmssNode].disableSystemAssigned
 			vmssTrackList.isvmss = true
 
 			delete(nodeMap, vmssNode)
@@ -1162,6 +1633,53 @@ func (c *Client) consolidateVMSSNodes(nodeMap map[string]trackUserAssignedMSIIds
 	}
 }
 
+// isNamespaceAllowed returns false if identities must not be assigned to pods in the namespace,
+// either because the namespace is excluded or because it is not in the included namespaces
+func (c *Client) isNamespaceAllowed(ns string) bool {
+	if c.excludedNamespaces[ns] {
+		return false
+	}
+	if len(c.includedNamespaces) > 0 && !c.includedNamespaces[ns] {
+		return false
+	}
+	return true
+}
+
+// isHostNetworkAssignmentAllowed returns false and records a warning event on the pod if it uses
+// the host network and identities must not be assigned to it. The host network pods share the IP
+// of their node, which NMI resolves the pods of the token requests from, so a token request of one
+// of them may be served the identity of another pod of the node.
+func (c *Client) isHostNetworkAssignmentAllowed(pod *corev1.Pod) bool {
+	if !pod.Spec.HostNetwork || c.allowHostNetworkAssignment {
+		return true
+	}
+	if pod.Labels[aadpodid.AllowHostNetworkAssignmentLabel] == "true" {
+		klog.V(5).Infof("Pod %s/%s uses the host network and has the %s label, identities will be assigned", pod.Namespace, pod.Name, aadpodid.AllowHostNetworkAssignmentLabel)
+		return true
+	}
+	message := fmt.Sprintf("Identities not assigned to pod %s/%s, it uses the host network and shares the IP of node %s with its other host network pods. "+
+		"Set the %s=true label on the pod to acknowledge it, or --allow-hostnetwork-assignment on MIC", pod.Namespace, pod.Name, pod.Spec.NodeName, aadpodid.AllowHostNetworkAssignmentLabel)
+	klog.Warning(message)
+	c.EventRecorder.Event(pod, corev1.EventTypeWarning, "host network assignment refused", message)
+	return false
+}
+
+// namespaceSet returns the set of namespaces in the list, nil if the list is empty
+func namespaceSet(namespaces []string) map[string]bool {
+	var set map[string]bool
+	for _, ns := range namespaces {
+		ns = strings.TrimSpace(ns)
+		if ns == "" {
+			continue
+		}
+		if set == nil {
+			set = make(map[string]bool)
+		}
+		set[ns] = true
+	}
+	return set
+}
+
 // checkIfIdentityImmutable checks if the identity is immutable
 // if identity is immutable, then it will not be removed from underlying node/vmss
 // returns true if identity is immutable
@@ -3,8 +3,10 @@ package mic
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -16,6 +18,9 @@ import (
 	"github.com/Azure/aad-pod-identity/pkg/metrics"
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-12-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/msi/mgmt/2018-11-30/msi"
+	"github.com/Azure/azure-sdk-for-go/services/preview/hybridcompute/mgmt/2019-12-12/hybridcompute"
+	"github.com/Azure/go-autorest/autorest"
 
 	cp "github.com/Azure/aad-pod-identity/pkg/cloudprovider"
 	api "k8s.io/api/core/v1"
@@ -43,6 +48,12 @@ type TestVMClient struct {
 	nodeIDs  map[string]map[string]bool
 	err      *error
 	identity *compute.VirtualMachineIdentity
+	// deleted are the nodes whose VM was deleted in ARM
+	deleted map[string]bool
+	// writes are the number of identity updates of each node
+	writes map[string]int
+	// removed are the identities removed from each node
+	removed map[string][]string
 }
 
 func (c *TestVMClient) SetError(err error) {
@@ -61,6 +72,11 @@ func (c *TestVMClient) Get(rgName string, nodeName string) (ret compute.VirtualM
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.deleted[nodeName] {
+		resp := autorest.Response{Response: &http.Response{StatusCode: http.StatusNotFound}}
+		return compute.VirtualMachine{Response: resp}, autorest.NewErrorWithError(errors.New("not found"), "compute.VirtualMachinesClient", "Get", resp.Response, "Failure responding to request")
+	}
+
 	stored := c.nodeMap[nodeName]
 	if stored == nil {
 		vm := new(compute.VirtualMachine)
@@ -69,6 +85,10 @@ func (c *TestVMClient) Get(rgName string, nodeName string) (ret compute.VirtualM
 		return *vm, nil
 	}
 
+	// a VM read before its first update has no identity
+	if stored.Identity == nil {
+		stored.Identity = &compute.VirtualMachineIdentity{}
+	}
 	storedIDs := c.nodeIDs[nodeName]
 	newVMIdentity := make(map[string]*compute.VirtualMachineIdentityUserAssignedIdentitiesValue)
 	for id := range storedIDs {
@@ -86,9 +106,11 @@ func (c *TestVMClient) UpdateIdentities(rg, nodeName string, vm compute.VirtualM
 		return *c.err
 	}
 
+	c.writes[nodeName]++
 	if vm.Identity != nil && vm.Identity.UserAssignedIdentities != nil {
 		for k, v := range vm.Identity.UserAssignedIdentities {
 			if v == nil {
+				c.removed[nodeName] = append(c.removed[nodeName], k)
 				delete(c.nodeIDs[nodeName], k)
 			} else {
 				c.nodeIDs[nodeName][k] = true
@@ -101,10 +123,22 @@ func (c *TestVMClient) UpdateIdentities(rg, nodeName string, vm compute.VirtualM
 		}
 	}
 
+	// tags are only sent when they were changed
+	if vm.Tags == nil && c.nodeMap[nodeName] != nil {
+		vm.Tags = c.nodeMap[nodeName].Tags
+	}
 	c.nodeMap[nodeName] = &vm
 	return nil
 }
 
+// Writes returns the number of identity updates of the node and the identities removed from it
+func (c *TestVMClient) Writes(nodeName string) (int, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.writes[nodeName], append([]string(nil), c.removed[nodeName]...)
+}
+
 func (c *TestVMClient) ListMSI() (ret map[string]*[]string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -146,6 +180,82 @@ func (c *TestVMClient) CompareMSI(nodeName string, userIDs []string) bool {
 	return reflect.DeepEqual(ids, userIDs)
 }
 
+// SystemAssigned returns true if the system assigned identity of the VM of the node is enabled
+func (c *TestVMClient) SystemAssigned(nodeName string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stored := c.nodeMap[nodeName]
+	if stored == nil || stored.Identity == nil {
+		return false
+	}
+	return stored.Identity.Type == compute.ResourceIdentityTypeSystemAssigned || stored.Identity.Type == compute.ResourceIdentityTypeSystemAssignedUserAssigned
+}
+
+// EnableSystemAssigned simulates the system assigned identity of the node being enabled outside MIC
+func (c *TestVMClient) EnableSystemAssigned(nodeName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.nodeMap[nodeName] == nil {
+		c.nodeMap[nodeName] = new(compute.VirtualMachine)
+		c.nodeIDs[nodeName] = make(map[string]bool)
+	}
+	c.nodeMap[nodeName].Identity = &compute.VirtualMachineIdentity{Type: compute.ResourceIdentityTypeSystemAssigned}
+}
+
+// SystemAssignedTagged returns true if the VM of the node carries the tag MIC sets when it enables
+// the system assigned identity
+func (c *TestVMClient) SystemAssignedTagged(nodeName string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stored := c.nodeMap[nodeName]
+	if stored == nil {
+		return false
+	}
+	_, ok := stored.Tags[cp.SystemAssignedTag]
+	return ok
+}
+
+// DeleteVM simulates the VM of the node being deleted in ARM while the node is still in the cluster
+func (c *TestVMClient) DeleteVM(nodeName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.deleted == nil {
+		c.deleted = make(map[string]bool)
+	}
+	c.deleted[nodeName] = true
+	delete(c.nodeMap, nodeName)
+	delete(c.nodeIDs, nodeName)
+}
+
+// ReplaceVM simulates the VM of the node being replaced by a new VM without identities
+func (c *TestVMClient) ReplaceVM(nodeName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.nodeMap, nodeName)
+	delete(c.nodeIDs, nodeName)
+}
+
+// AttachIdentity simulates the identity being attached to the VM of the node outside MIC
+func (c *TestVMClient) AttachIdentity(nodeName, resourceID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nodeIDs[nodeName][resourceID] = true
+}
+
+// DetachIdentity simulates the identity being detached from the VM of the node outside MIC
+func (c *TestVMClient) DetachIdentity(nodeName, resourceID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.nodeIDs[nodeName], resourceID)
+}
+
 type TestVMSSClient struct {
 	*cp.VMSSClient
 
@@ -207,6 +317,10 @@ func (c *TestVMSSClient) UpdateIdentities(rg, nodeName string, vmss compute.Virt
 		}
 	}
 
+	// tags are only sent when they were changed
+	if vmss.Tags == nil && c.nodeMap[nodeName] != nil {
+		vmss.Tags = c.nodeMap[nodeName].Tags
+	}
 	c.nodeMap[nodeName] = &vmss
 	return nil
 }
@@ -296,6 +410,8 @@ func NewTestVMClient() *TestVMClient {
 		nodeMap:  nodeMap,
 		nodeIDs:  nodeIDs,
 		identity: identity,
+		writes:   make(map[string]int),
+		removed:  make(map[string][]string),
 	}
 }
 
@@ -315,13 +431,75 @@ func NewTestVMSSClient() *TestVMSSClient {
 	}
 }
 
+type TestMSIClient struct {
+	*cp.MSIClient
+	identities map[string]string
+	gets       int
+}
+
+func (c *TestMSIClient) Get(rgName string, name string) (msi.Identity, error) {
+	c.gets++
+	resourceID, ok := c.identities[rgName+"/"+name]
+	if !ok {
+		resp := autorest.Response{Response: &http.Response{StatusCode: http.StatusNotFound}}
+		return msi.Identity{Response: resp}, autorest.NewErrorWithError(errors.New("not found"), "msi.UserAssignedIdentitiesClient", "Get", resp.Response, "Failure responding to request")
+	}
+	return msi.Identity{ID: &resourceID}, nil
+}
+
+func NewTestMSIClient() *TestMSIClient {
+	return &TestMSIClient{
+		MSIClient:  &cp.MSIClient{},
+		identities: make(map[string]string),
+	}
+}
+
+type TestHybridMachineClient struct {
+	*cp.HybridMachineClient
+	mu       sync.Mutex
+	machines map[string]bool
+	gets     int
+}
+
+func (c *TestHybridMachineClient) Get(subscriptionID string, rgName string, name string) (hybridcompute.Machine, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gets++
+	if !c.machines[subscriptionID+"/"+rgName+"/"+name] {
+		resp := autorest.Response{Response: &http.Response{StatusCode: http.StatusNotFound}}
+		return hybridcompute.Machine{Response: resp}, autorest.NewErrorWithError(errors.New("not found"), "hybridcompute.MachinesClient", "Get", resp.Response, "Failure responding to request")
+	}
+	return hybridcompute.Machine{Name: &name}, nil
+}
+
+func (c *TestHybridMachineClient) AddMachine(subscriptionID string, rgName string, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.machines[subscriptionID+"/"+rgName+"/"+name] = true
+}
+
+func (c *TestHybridMachineClient) Gets() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gets
+}
+
+func NewTestHybridMachineClient() *TestHybridMachineClient {
+	return &TestHybridMachineClient{
+		HybridMachineClient: &cp.HybridMachineClient{},
+		machines:            make(map[string]bool),
+	}
+}
+
 func NewTestCloudClient(cfg config.AzureConfig) *TestCloudClient {
 	vmClient := NewTestVMClient()
 	vmssClient := NewTestVMSSClient()
 	cloudClient := &cp.Client{
-		Config:     cfg,
-		VMClient:   vmClient,
-		VMSSClient: vmssClient,
+		Config:       cfg,
+		VMClient:     vmClient,
+		VMSSClient:   vmssClient,
+		MSIClient:    NewTestMSIClient(),
+		HybridClient: NewTestHybridMachineClient(),
 	}
 
 	return &TestCloudClient{
@@ -407,6 +585,8 @@ type TestCrdClient struct {
 	bindingMap    map[string]*aadpodid.AzureIdentityBinding
 	idMap         map[string]*aadpodid.AzureIdentity
 	err           *error
+	// labelUpdates is the number of label updates of assigned identities
+	labelUpdates int
 }
 
 func NewTestCrdClient(config *rest.Config) *TestCrdClient {
@@ -462,6 +642,27 @@ func (c *TestCrdClient) UpdateAzureAssignedIdentityStatus(assignedIdentity *inte
 	return nil
 }
 
+func (c *TestCrdClient) UpdateAzureAssignedIdentityLabels(assignedIdentity *internalaadpodid.AzureAssignedIdentity, labels map[string]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	existing, ok := c.assignedIDMap[assignedIdentity.Name]
+	if !ok {
+		return fmt.Errorf("assigned identity %s not found", assignedIdentity.Name)
+	}
+	assignedIdentityToStore := *existing //Make a copy to store in the map.
+	assignedIdentityToStore.Labels = make(map[string]string)
+	for k, v := range existing.Labels {
+		assignedIdentityToStore.Labels[k] = v
+	}
+	for k, v := range labels {
+		assignedIdentityToStore.Labels[k] = v
+	}
+	c.labelUpdates++
+	c.assignedIDMap[assignedIdentity.Name] = &assignedIdentityToStore
+	return nil
+}
+
 func (c *TestCrdClient) CreateBinding(name, ns, idName, selector, resourceVersion string) {
 	binding := &aadpodid.AzureIdentityBinding{
 		ObjectMeta: v1.ObjectMeta{
@@ -479,6 +680,12 @@ func (c *TestCrdClient) CreateBinding(name, ns, idName, selector, resourceVersio
 	c.mu.Unlock()
 }
 
+func (c *TestCrdClient) DeleteBinding(name, ns string) {
+	c.mu.Lock()
+	delete(c.bindingMap, getIDKey(ns, name))
+	c.mu.Unlock()
+}
+
 func (c *TestCrdClient) CreateID(idName, ns string, t aadpodid.IdentityType, rID, cID string, cp *api.SecretReference, tID, adRID, adEpt, resourceVersion string) {
 	id := &aadpodid.AzureIdentity{
 		ObjectMeta: v1.ObjectMeta{
@@ -1620,3 +1827,1251 @@ func TestMicAddDelVMSSwithImmutableIdentities(t *testing.T) {
 		t.Fatalf("missing identity: %+v", cloudClient.ListMSI()["testvmss2"])
 	}
 }
+
+func TestMatchAnnotation(t *testing.T) {
+	annotationKey := "aadpodidentity.k8s.io/binding"
+	cases := []struct {
+		name             string
+		labels           map[string]string
+		annotations      map[string]string
+		expectedBinding  string
+		expectedConflict bool
+	}{
+		{
+			name:            "label only",
+			labels:          map[string]string{aadpodid.CRDLabelKey: "label-select"},
+			expectedBinding: "label-binding",
+		},
+		{
+			name:            "annotation only",
+			annotations:     map[string]string{annotationKey: "annotation-select"},
+			expectedBinding: "annotation-binding",
+		},
+		{
+			name:             "label and annotation conflict",
+			labels:           map[string]string{aadpodid.CRDLabelKey: "label-select"},
+			annotations:      map[string]string{annotationKey: "annotation-select"},
+			expectedBinding:  "label-binding",
+			expectedConflict: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			evtRecorder := &TestEventRecorder{lastEvent: new(LastEvent), eventChannel: make(chan bool, 100)}
+			micClient := &Client{EventRecorder: evtRecorder, matchAnnotation: annotationKey}
+
+			pod := &corev1.Pod{
+				ObjectMeta: v1.ObjectMeta{Name: "test-pod", Namespace: "default", Labels: tc.labels, Annotations: tc.annotations},
+				Spec:       corev1.PodSpec{NodeName: "test-node"},
+			}
+			bindings := []internalaadpodid.AzureIdentityBinding{
+				{
+					ObjectMeta: v1.ObjectMeta{Name: "label-binding", Namespace: "default"},
+					Spec:       internalaadpodid.AzureIdentityBindingSpec{AzureIdentity: "test-id", Selector: "label-select"},
+				},
+				{
+					ObjectMeta: v1.ObjectMeta{Name: "annotation-binding", Namespace: "default"},
+					Spec:       internalaadpodid.AzureIdentityBindingSpec{AzureIdentity: "test-id", Selector: "annotation-select"},
+				},
+			}
+			idMap := map[string]internalaadpodid.AzureIdentity{
+				getIDKey("default", "test-id"): {
+					ObjectMeta: v1.ObjectMeta{Name: "test-id", Namespace: "default"},
+					Spec:       internalaadpodid.AzureIdentitySpec{Type: internalaadpodid.UserAssignedMSI, ResourceID: "test-user-msi-resourceid"},
+				},
+			}
+
+			newAssignedIDs, _, err := micClient.createDesiredAssignedIdentityList([]*corev1.Pod{pod}, &bindings, idMap)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(newAssignedIDs) != 1 {
+				t.Fatalf("expected 1 assigned identity, got: %d", len(newAssignedIDs))
+			}
+			for _, assignedID := range newAssignedIDs {
+				if assignedID.Spec.AzureBindingRef.Name != tc.expectedBinding {
+					t.Fatalf("expected binding %s, got: %s", tc.expectedBinding, assignedID.Spec.AzureBindingRef.Name)
+				}
+			}
+
+			conflict := len(evtRecorder.eventChannel) > 0
+			if conflict != tc.expectedConflict {
+				t.Fatalf("expected conflict event: %v, got: %v", tc.expectedConflict, conflict)
+			}
+			if tc.expectedConflict && !evtRecorder.Validate(&LastEvent{Type: corev1.EventTypeWarning, Reason: "selector conflict",
+				Message: fmt.Sprintf("Pod default/test-pod has %s label %q and %s annotation %q. Using the label value", aadpodid.CRDLabelKey, "label-select", annotationKey, "annotation-select")}) {
+				t.Fatalf("event mismatch")
+			}
+		})
+	}
+}
+
+func TestSelectorConflictReportedOnce(t *testing.T) {
+	annotationKey := "aadpodidentity.k8s.io/binding"
+	evtRecorder := &TestEventRecorder{lastEvent: new(LastEvent), eventChannel: make(chan bool, 100)}
+	micClient := &Client{EventRecorder: evtRecorder, matchAnnotation: annotationKey}
+
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "test-pod",
+			Namespace:   "default",
+			UID:         "test-pod-uid",
+			Labels:      map[string]string{aadpodid.CRDLabelKey: "label-select"},
+			Annotations: map[string]string{annotationKey: "annotation-select"},
+		},
+		Spec: corev1.PodSpec{NodeName: "test-node"},
+	}
+	bindings := []internalaadpodid.AzureIdentityBinding{}
+	idMap := map[string]internalaadpodid.AzureIdentity{}
+	runSync := func(pods ...*corev1.Pod) int {
+		if _, _, err := micClient.createDesiredAssignedIdentityList(pods, &bindings, idMap); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		events := len(evtRecorder.eventChannel)
+		for i := 0; i < events; i++ {
+			<-evtRecorder.eventChannel
+		}
+		return events
+	}
+
+	steps := []struct {
+		name           string
+		update         func()
+		pods           []*corev1.Pod
+		expectedEvents int
+	}{
+		{name: "conflict appeared", pods: []*corev1.Pod{pod}, expectedEvents: 1},
+		{name: "same conflict", pods: []*corev1.Pod{pod}, expectedEvents: 0},
+		{name: "conflict changed", update: func() { pod.Annotations[annotationKey] = "other-select" }, pods: []*corev1.Pod{pod}, expectedEvents: 1},
+		{name: "conflict resolved", update: func() { pod.Annotations[annotationKey] = "label-select" }, pods: []*corev1.Pod{pod}, expectedEvents: 0},
+		{name: "conflict appeared again", update: func() { pod.Annotations[annotationKey] = "other-select" }, pods: []*corev1.Pod{pod}, expectedEvents: 1},
+		{name: "pod not listed", expectedEvents: 0},
+		{name: "pod listed again", pods: []*corev1.Pod{pod}, expectedEvents: 1},
+	}
+	for _, step := range steps {
+		if step.update != nil {
+			step.update()
+		}
+		if events := runSync(step.pods...); events != step.expectedEvents {
+			t.Fatalf("%s: expected %d selector conflict events, got: %d", step.name, step.expectedEvents, events)
+		}
+	}
+}
+
+func TestIdentityResolutionByName(t *testing.T) {
+	resolvedID := "/subscriptions/fakeSub/resourceGroups/identityGroup/providers/Microsoft.ManagedIdentity/userAssignedIdentities/test-msi"
+	cases := []struct {
+		name               string
+		spec               internalaadpodid.AzureIdentitySpec
+		expectedResourceID string
+		expectedAssigned   bool
+		expectedGets       int
+	}{
+		{
+			name:               "name resolved in default resource group",
+			spec:               internalaadpodid.AzureIdentitySpec{Type: internalaadpodid.UserAssignedMSI, IdentityName: "test-msi"},
+			expectedResourceID: resolvedID,
+			expectedAssigned:   true,
+			expectedGets:       1,
+		},
+		{
+			name:             "name not found",
+			spec:             internalaadpodid.AzureIdentitySpec{Type: internalaadpodid.UserAssignedMSI, IdentityName: "missing-msi"},
+			expectedAssigned: false,
+			expectedGets:     2,
+		},
+		{
+			name:               "resource id takes precedence over name",
+			spec:               internalaadpodid.AzureIdentitySpec{Type: internalaadpodid.UserAssignedMSI, IdentityName: "test-msi", ResourceID: "test-user-msi-resourceid"},
+			expectedResourceID: "test-user-msi-resourceid",
+			expectedAssigned:   true,
+			expectedGets:       0,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cloudClient := NewTestCloudClient(config.AzureConfig{SubscriptionID: "fakeSub", ResourceGroupName: "nodeGroup"})
+			msiClient := cloudClient.MSIClient.(*TestMSIClient)
+			msiClient.identities["identityGroup/test-msi"] = resolvedID
+			micClient := &Client{CloudClient: cloudClient, defaultIdentityResourceGroup: "identityGroup"}
+
+			pod := &corev1.Pod{
+				ObjectMeta: v1.ObjectMeta{Name: "test-pod", Namespace: "default", Labels: map[string]string{aadpodid.CRDLabelKey: "test-select"}},
+				Spec:       corev1.PodSpec{NodeName: "test-node"},
+			}
+			bindings := []internalaadpodid.AzureIdentityBinding{
+				{
+					ObjectMeta: v1.ObjectMeta{Name: "test-binding", Namespace: "default"},
+					Spec:       internalaadpodid.AzureIdentityBindingSpec{AzureIdentity: "test-id", Selector: "test-select"},
+				},
+			}
+			idMap := map[string]internalaadpodid.AzureIdentity{
+				getIDKey("default", "test-id"): {
+					ObjectMeta: v1.ObjectMeta{Name: "test-id", Namespace: "default"},
+					Spec:       tc.spec,
+				},
+			}
+
+			// run twice to validate the resolved resource id is cached
+			for i := 0; i < 2; i++ {
+				newAssignedIDs, _, err := micClient.createDesiredAssignedIdentityList([]*corev1.Pod{pod}, &bindings, idMap)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !tc.expectedAssigned {
+					if len(newAssignedIDs) != 0 {
+						t.Fatalf("expected no assigned identity, got: %d", len(newAssignedIDs))
+					}
+					continue
+				}
+				if len(newAssignedIDs) != 1 {
+					t.Fatalf("expected 1 assigned identity, got: %d", len(newAssignedIDs))
+				}
+				for _, assignedID := range newAssignedIDs {
+					if assignedID.Spec.AzureIdentityRef.Spec.ResourceID != tc.expectedResourceID {
+						t.Fatalf("expected resource id %s, got: %s", tc.expectedResourceID, assignedID.Spec.AzureIdentityRef.Spec.ResourceID)
+					}
+				}
+			}
+			if msiClient.gets != tc.expectedGets {
+				t.Fatalf("expected %d identity lookups, got: %d", tc.expectedGets, msiClient.gets)
+			}
+		})
+	}
+}
+
+func TestMultipleBindingsMatch(t *testing.T) {
+	micClient := &Client{}
+
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: "test-pod", Namespace: "default", Labels: map[string]string{aadpodid.CRDLabelKey: "test-select"}},
+		Spec:       corev1.PodSpec{NodeName: "test-node"},
+	}
+	bindings := []internalaadpodid.AzureIdentityBinding{
+		{
+			ObjectMeta: v1.ObjectMeta{Name: "msi-binding-b", Namespace: "default"},
+			Spec:       internalaadpodid.AzureIdentityBindingSpec{AzureIdentity: "test-msi", Selector: "test-select"},
+		},
+		{
+			ObjectMeta: v1.ObjectMeta{Name: "sp-binding", Namespace: "default"},
+			Spec:       internalaadpodid.AzureIdentityBindingSpec{AzureIdentity: "test-sp", Selector: "test-select"},
+		},
+		{
+			ObjectMeta: v1.ObjectMeta{Name: "msi-binding-a", Namespace: "default"},
+			Spec:       internalaadpodid.AzureIdentityBindingSpec{AzureIdentity: "test-msi", Selector: "test-select"},
+		},
+	}
+	idMap := map[string]internalaadpodid.AzureIdentity{
+		getIDKey("default", "test-msi"): {
+			ObjectMeta: v1.ObjectMeta{Name: "test-msi", Namespace: "default"},
+			Spec:       internalaadpodid.AzureIdentitySpec{Type: internalaadpodid.UserAssignedMSI, ResourceID: "test-user-msi-resourceid", ClientID: "test-msi-clientid"},
+		},
+		getIDKey("default", "test-sp"): {
+			ObjectMeta: v1.ObjectMeta{Name: "test-sp", Namespace: "default"},
+			Spec:       internalaadpodid.AzureIdentitySpec{Type: internalaadpodid.ServicePrincipal, ClientID: "test-sp-clientid"},
+		},
+	}
+
+	expected := map[string]struct {
+		idType  internalaadpodid.IdentityType
+		binding string
+	}{
+		"test-pod-default-test-msi": {internalaadpodid.UserAssignedMSI, "msi-binding-a"},
+		"test-pod-default-test-sp":  {internalaadpodid.ServicePrincipal, "sp-binding"},
+	}
+
+	// reverse the bindings between the runs to validate the matched binding doesn't depend on the order
+	for i := 0; i < 2; i++ {
+		newAssignedIDs, nodeRefs, err := micClient.createDesiredAssignedIdentityList([]*corev1.Pod{pod}, &bindings, idMap)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !nodeRefs["test-node"] {
+			t.Fatalf("expected node test-node to be referenced")
+		}
+		if len(newAssignedIDs) != len(expected) {
+			t.Fatalf("expected %d assigned identities, got: %d", len(expected), len(newAssignedIDs))
+		}
+		for name, e := range expected {
+			assignedID, ok := newAssignedIDs[name]
+			if !ok {
+				t.Fatalf("expected assigned identity %s", name)
+			}
+			if assignedID.Spec.AzureIdentityRef.Spec.Type != e.idType {
+				t.Fatalf("expected identity type %v for %s, got: %v", e.idType, name, assignedID.Spec.AzureIdentityRef.Spec.Type)
+			}
+			if assignedID.Spec.AzureBindingRef.Name != e.binding {
+				t.Fatalf("expected binding %s for %s, got: %s", e.binding, name, assignedID.Spec.AzureBindingRef.Name)
+			}
+		}
+
+		for l, r := 0, len(bindings)-1; l < r; l, r = l+1, r-1 {
+			bindings[l], bindings[r] = bindings[r], bindings[l]
+		}
+	}
+}
+
+func TestHybridMachineNode(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{SubscriptionID: "clusterSub"})
+	hybridClient := cloudClient.HybridClient.(*TestHybridMachineClient)
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid", "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+
+	hybridClient.AddMachine("arcSub", "arcGroup", "arc-machine1")
+	nodeClient.AddNode("arc-node1", func(n *corev1.Node) {
+		n.Spec.ProviderID = "azure:///subscriptions/arcSub/resourceGroups/arcGroup/providers/Microsoft.HybridCompute/machines/arc-machine1"
+	})
+	podClient.AddPod("test-pod1", "default", "arc-node1", "test-select1")
+
+	defer micClient.testRunSync()(t)
+
+	eventCh <- internalaadpodid.PodCreated
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+
+	listAssignedIDs, err := crdClient.ListAssignedIDs()
+	if err != nil {
+		t.Fatalf("list assigned failed: %v", err)
+	}
+	if len(*listAssignedIDs) != 1 {
+		t.Fatalf("expected assigned identities len: %d, got: %d", 1, len(*listAssignedIDs))
+	}
+	if (*listAssignedIDs)[0].Status.Status != aadpodid.AssignedIDCreated {
+		t.Fatalf("expected status to be %s, got: %s", aadpodid.AssignedIDCreated, (*listAssignedIDs)[0].Status.Status)
+	}
+	evtRecorder.mu.Lock()
+	reason := evtRecorder.lastEvent.Reason
+	evtRecorder.mu.Unlock()
+	if reason != "binding apply error" {
+		t.Fatalf("expected binding apply error event, got: %s", reason)
+	}
+	if hybridClient.Gets() == 0 {
+		t.Fatalf("expected the Azure Arc machine to be read through the hybrid compute client")
+	}
+	if _, ok := cloudClient.ListMSI()["arc-machine1"]; ok {
+		t.Fatalf("expected no VM update for the Azure Arc machine")
+	}
+
+	// remove the Azure Arc node, the assigned identity should be cleaned up
+	nodeClient.Delete("arc-node1")
+	podClient.DeletePod("test-pod1", "default")
+	eventCh <- internalaadpodid.PodDeleted
+
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+
+	listAssignedIDs, err = crdClient.ListAssignedIDs()
+	if err != nil {
+		t.Fatalf("list assigned failed: %v", err)
+	}
+	if len(*listAssignedIDs) != 0 {
+		t.Fatalf("expected assigned identities len: %d, got: %d", 0, len(*listAssignedIDs))
+	}
+}
+
+func TestHybridMachineNodeRefusedOnce(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{SubscriptionID: "clusterSub"})
+	hybridClient := cloudClient.HybridClient.(*TestHybridMachineClient)
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid1", "test-user-msi-clientid1", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	crdClient.CreateID("test-id2", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid2", "test-user-msi-clientid2", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding2", "default", "test-id2", "test-select2", "")
+
+	hybridClient.AddMachine("arcSub", "arcGroup", "arc-machine1")
+	nodeClient.AddNode("arc-node1", func(n *corev1.Node) {
+		n.Spec.ProviderID = "azure:///subscriptions/arcSub/resourceGroups/arcGroup/providers/Microsoft.HybridCompute/machines/arc-machine1"
+	})
+	podClient.AddPod("test-pod1", "default", "arc-node1", "test-select1")
+
+	defer micClient.testRunSync()(t)
+
+	eventCh <- internalaadpodid.PodCreated
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+
+	// the next sync retries the assigned identity of test-pod1, refused without a new event, and
+	// refuses the binding of test-pod2 with a single event
+	podClient.AddPod("test-pod2", "default", "arc-node1", "test-select2")
+	eventCh <- internalaadpodid.PodCreated
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	evtRecorder.mu.Lock()
+	lastEvent := *evtRecorder.lastEvent
+	evtRecorder.mu.Unlock()
+	if lastEvent.Reason != "binding apply error" || !strings.Contains(lastEvent.Message, "testbinding2") || !strings.Contains(lastEvent.Message, cp.ErrHybridMachineUserMSINotSupported.Error()) {
+		t.Errorf("expected a binding apply error event for testbinding2, got: %+v", lastEvent)
+	}
+	if events := len(evtRecorder.eventChannel); events != 0 {
+		t.Errorf("expected a single event per binding, got %d more events", events)
+	}
+
+	listAssignedIDs, err := crdClient.ListAssignedIDs()
+	if err != nil {
+		t.Fatalf("list assigned failed: %v", err)
+	}
+	if len(*listAssignedIDs) != 2 {
+		t.Fatalf("expected assigned identities len: %d, got: %d", 2, len(*listAssignedIDs))
+	}
+	for _, assignedID := range *listAssignedIDs {
+		if assignedID.Status.Status != aadpodid.AssignedIDCreated {
+			t.Errorf("expected status of %s to be %s, got: %s", assignedID.Name, aadpodid.AssignedIDCreated, assignedID.Status.Status)
+		}
+	}
+}
+
+func TestNamespaceFilter(t *testing.T) {
+	cases := []struct {
+		name        string
+		excluded    []string
+		included    []string
+		expectedPod map[string]bool
+	}{
+		{
+			name:        "no filter",
+			expectedPod: map[string]bool{"default": true, "tenant-a": true, "tenant-b": true},
+		},
+		{
+			name:        "excluded namespaces",
+			excluded:    []string{"tenant-a", " tenant-b"},
+			expectedPod: map[string]bool{"default": true},
+		},
+		{
+			name:        "included namespaces",
+			included:    []string{"tenant-a"},
+			expectedPod: map[string]bool{"tenant-a": true},
+		},
+		{
+			name:        "excluded takes precedence over included",
+			excluded:    []string{"tenant-a"},
+			included:    []string{"tenant-a", "tenant-b"},
+			expectedPod: map[string]bool{"tenant-b": true},
+		},
+		{
+			name:        "empty entries are ignored",
+			excluded:    []string{""},
+			included:    []string{""},
+			expectedPod: map[string]bool{"default": true, "tenant-a": true, "tenant-b": true},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			micClient := &Client{
+				excludedNamespaces: namespaceSet(tc.excluded),
+				includedNamespaces: namespaceSet(tc.included),
+			}
+
+			var pods []*corev1.Pod
+			var bindings []internalaadpodid.AzureIdentityBinding
+			idMap := make(map[string]internalaadpodid.AzureIdentity)
+			for _, ns := range []string{"default", "tenant-a", "tenant-b"} {
+				pods = append(pods, &corev1.Pod{
+					ObjectMeta: v1.ObjectMeta{Name: "test-pod", Namespace: ns, Labels: map[string]string{aadpodid.CRDLabelKey: "test-select"}},
+					Spec:       corev1.PodSpec{NodeName: "node-" + ns},
+				})
+				bindings = append(bindings, internalaadpodid.AzureIdentityBinding{
+					ObjectMeta: v1.ObjectMeta{Name: "test-binding", Namespace: ns},
+					Spec:       internalaadpodid.AzureIdentityBindingSpec{AzureIdentity: "test-sp", Selector: "test-select"},
+				})
+				idMap[getIDKey(ns, "test-sp")] = internalaadpodid.AzureIdentity{
+					ObjectMeta: v1.ObjectMeta{Name: "test-sp", Namespace: ns},
+					Spec:       internalaadpodid.AzureIdentitySpec{Type: internalaadpodid.ServicePrincipal, ClientID: "test-sp-clientid"},
+				}
+			}
+
+			newAssignedIDs, nodeRefs, err := micClient.createDesiredAssignedIdentityList(pods, &bindings, idMap)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assignedPods := make(map[string]bool)
+			for _, assignedID := range newAssignedIDs {
+				assignedPods[assignedID.Spec.PodNamespace] = true
+			}
+			for ns := range assignedPods {
+				if !tc.expectedPod[ns] {
+					t.Errorf("expected no identity assigned to the pod in namespace %s", ns)
+				}
+			}
+			for ns := range tc.expectedPod {
+				if !assignedPods[ns] {
+					t.Errorf("expected identity assigned to the pod in namespace %s", ns)
+				}
+				if !nodeRefs["node-"+ns] {
+					t.Errorf("expected node of the pod in namespace %s to be referenced", ns)
+				}
+			}
+			if len(nodeRefs) != len(tc.expectedPod) {
+				t.Errorf("expected %d referenced nodes, got: %v", len(tc.expectedPod), nodeRefs)
+			}
+		})
+	}
+}
+
+func TestHostNetworkAssignment(t *testing.T) {
+	cases := []struct {
+		name             string
+		allowHostNetwork bool
+		expectedPods     map[string]bool
+		expectedEvents   int
+	}{
+		{
+			name:           "host network pods refused without the label",
+			expectedPods:   map[string]bool{"pod-network": true, "host-network-acknowledged": true},
+			expectedEvents: 1,
+		},
+		{
+			name:             "host network pods allowed",
+			allowHostNetwork: true,
+			expectedPods:     map[string]bool{"pod-network": true, "host-network": true, "host-network-acknowledged": true},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var evtRecorder TestEventRecorder
+			evtRecorder.lastEvent = new(LastEvent)
+			evtRecorder.eventChannel = make(chan bool, 100)
+			micClient := &Client{
+				EventRecorder:              &evtRecorder,
+				allowHostNetworkAssignment: tc.allowHostNetwork,
+			}
+
+			labels := map[string]string{aadpodid.CRDLabelKey: "test-select"}
+			acknowledgedLabels := map[string]string{aadpodid.CRDLabelKey: "test-select", internalaadpodid.AllowHostNetworkAssignmentLabel: "true"}
+			pods := []*corev1.Pod{
+				{
+					ObjectMeta: v1.ObjectMeta{Name: "pod-network", Namespace: "default", Labels: labels},
+					Spec:       corev1.PodSpec{NodeName: "node-0"},
+				},
+				{
+					ObjectMeta: v1.ObjectMeta{Name: "host-network", Namespace: "default", Labels: labels},
+					Spec:       corev1.PodSpec{NodeName: "node-1", HostNetwork: true},
+				},
+				{
+					ObjectMeta: v1.ObjectMeta{Name: "host-network-acknowledged", Namespace: "default", Labels: acknowledgedLabels},
+					Spec:       corev1.PodSpec{NodeName: "node-2", HostNetwork: true},
+				},
+			}
+			bindings := []internalaadpodid.AzureIdentityBinding{{
+				ObjectMeta: v1.ObjectMeta{Name: "test-binding", Namespace: "default"},
+				Spec:       internalaadpodid.AzureIdentityBindingSpec{AzureIdentity: "test-sp", Selector: "test-select"},
+			}}
+			idMap := map[string]internalaadpodid.AzureIdentity{
+				getIDKey("default", "test-sp"): {
+					ObjectMeta: v1.ObjectMeta{Name: "test-sp", Namespace: "default"},
+					Spec:       internalaadpodid.AzureIdentitySpec{Type: internalaadpodid.ServicePrincipal, ClientID: "test-sp-clientid"},
+				},
+			}
+
+			newAssignedIDs, nodeRefs, err := micClient.createDesiredAssignedIdentityList(pods, &bindings, idMap)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assignedPods := make(map[string]bool)
+			for _, assignedID := range newAssignedIDs {
+				assignedPods[assignedID.Spec.Pod] = true
+			}
+			if !reflect.DeepEqual(assignedPods, tc.expectedPods) {
+				t.Errorf("expected identities assigned to pods %v, got: %v", tc.expectedPods, assignedPods)
+			}
+			if len(nodeRefs) != len(tc.expectedPods) {
+				t.Errorf("expected %d referenced nodes, got: %v", len(tc.expectedPods), nodeRefs)
+			}
+			if events := len(evtRecorder.eventChannel); events != tc.expectedEvents {
+				t.Fatalf("expected %d events, got %d", tc.expectedEvents, events)
+			}
+			if tc.expectedEvents > 0 && (evtRecorder.lastEvent.Reason != "host network assignment refused" || !strings.Contains(evtRecorder.lastEvent.Message, "default/host-network")) {
+				t.Errorf("expected a host network assignment refused event for pod default/host-network, got: %+v", evtRecorder.lastEvent)
+			}
+		})
+	}
+}
+
+func TestAssignOnly(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+	micClient.assignOnly = true
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid1", "test-user-msi-clientid1", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+	eventCh <- internalaadpodid.PodCreated
+	defer micClient.testRunSync()(t)
+
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if !cloudClient.CompareMSI("test-node1", []string{"test-user-msi-resourceid1"}) {
+		t.Fatalf("expected identity to be assigned to node")
+	}
+
+	// Delete the pod and add a pod with another identity on the same node, the event of the
+	// second pod shows the deletion of the first pod has been processed.
+	podClient.DeletePod("test-pod1", "default")
+	crdClient.CreateID("test-id2", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid2", "test-user-msi-clientid2", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding2", "default", "test-id2", "test-select2", "")
+	podClient.AddPod("test-pod2", "default", "test-node1", "test-select2")
+
+	eventCh <- internalaadpodid.PodDeleted
+	eventCh <- internalaadpodid.PodCreated
+
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+
+	if !cloudClient.CompareMSI("test-node1", []string{"test-user-msi-resourceid1", "test-user-msi-resourceid2"}) {
+		cloudClient.PrintMSI()
+		t.Fatalf("expected no identity to be removed from node in assign only mode")
+	}
+	listAssignedIDs, err := crdClient.ListAssignedIDs()
+	if err != nil {
+		t.Fatalf("error from list assigned ids: %v", err)
+	}
+	if len(*listAssignedIDs) != 2 {
+		t.Fatalf("expected no assigned identity to be deleted in assign only mode, got %d assigned identities", len(*listAssignedIDs))
+	}
+}
+
+func TestNodeReplacement(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid1", "test-user-msi-clientid1", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1", func(n *corev1.Node) { n.UID = "test-node1-uid" })
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+	eventCh <- internalaadpodid.PodCreated
+	defer micClient.testRunSync()(t)
+
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+
+	// Add a pod on another node, the event of the second pod shows a sync has run with the
+	// identity assigned to the first node.
+	crdClient.CreateID("test-id2", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid2", "test-user-msi-clientid2", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding2", "default", "test-id2", "test-select2", "")
+	nodeClient.AddNode("test-node2")
+	podClient.AddPod("test-pod2", "default", "test-node2", "test-select2")
+	eventCh <- internalaadpodid.PodCreated
+
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+
+	// Replace the node with a node with the same name backed by a new VM
+	cloudClient.testVMClient.ReplaceVM("test-node1")
+	nodeClient.AddNode("test-node1", func(n *corev1.Node) { n.UID = "test-node1-new-uid" })
+	eventCh <- internalaadpodid.PodUpdated
+
+	reapplied := false
+	for i := 0; i < 100 && !reapplied; i++ {
+		time.Sleep(100 * time.Millisecond)
+		reapplied = cloudClient.CompareMSI("test-node1", []string{"test-user-msi-resourceid1"})
+	}
+	if !reapplied {
+		cloudClient.PrintMSI()
+		t.Fatalf("expected identity to be re-applied to the replaced node")
+	}
+	if !cloudClient.CompareMSI("test-node2", []string{"test-user-msi-resourceid2"}) {
+		t.Fatalf("expected identity on the other node to be unchanged")
+	}
+}
+
+func TestGetReplacedNodes(t *testing.T) {
+	nodeClient := NewTestNodeClient()
+	micClient := &Client{NodeClient: nodeClient}
+	assignedIDs := map[string]internalaadpodid.AzureAssignedIdentity{
+		"assigned-id1": {Spec: internalaadpodid.AzureAssignedIdentitySpec{NodeName: "node1"}},
+		"assigned-id2": {Spec: internalaadpodid.AzureAssignedIdentitySpec{NodeName: "node2"}},
+	}
+	nodeClient.AddNode("node1")
+	nodeClient.AddNode("node2")
+
+	if replaced := micClient.getReplacedNodes(assignedIDs); len(replaced) != 0 {
+		t.Errorf("expected nodes seen for the first time not to be replaced, got: %v", replaced)
+	}
+
+	nodeClient.AddNode("node1", func(n *corev1.Node) {
+		n.Spec.ProviderID = "azure:///subscriptions/testSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachines/node1-new"
+	})
+	replaced := micClient.getReplacedNodes(assignedIDs)
+	if len(replaced) != 1 || !replaced["node1"] {
+		t.Errorf("expected node1 to be replaced, got: %v", replaced)
+	}
+
+	if replaced := micClient.getReplacedNodes(assignedIDs); len(replaced) != 0 {
+		t.Errorf("expected replaced node to be reported once, got: %v", replaced)
+	}
+
+	delete(assignedIDs, "assigned-id2")
+	micClient.getReplacedNodes(assignedIDs)
+	if _, ok := micClient.nodeInstances["node2"]; ok {
+		t.Errorf("expected node without assigned identities to be forgotten")
+	}
+}
+
+func TestSystemAssignedIdentity(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+	micClient.allowEnableSystemAssigned = true
+
+	// the system assigned identity of test-node2 was enabled before MIC assigned identities to it
+	cloudClient.testVMClient.EnableSystemAssigned("test-node2")
+
+	crdClient.CreateID("test-id1", "default", aadpodid.SystemAssignedMSI, "", "", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1")
+	nodeClient.AddNode("test-node2")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+	podClient.AddPod("test-pod2", "default", "test-node2", "test-select1")
+
+	eventCh <- internalaadpodid.PodCreated
+	defer micClient.testRunSync()(t)
+
+	if !evtRecorder.WaitForEvents(2) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if !cloudClient.testVMClient.SystemAssigned("test-node1") {
+		t.Fatalf("expected system assigned identity to be enabled on test-node1")
+	}
+	if !cloudClient.testVMClient.SystemAssignedTagged("test-node1") {
+		t.Fatalf("expected test-node1 to be tagged with the system assigned identity enabled by MIC")
+	}
+	if cloudClient.testVMClient.SystemAssignedTagged("test-node2") {
+		t.Fatalf("expected test-node2 not to be tagged with the system assigned identity enabled by MIC")
+	}
+
+	podClient.DeletePod("test-pod1", "default")
+	podClient.DeletePod("test-pod2", "default")
+	eventCh <- internalaadpodid.PodDeleted
+
+	if !evtRecorder.WaitForEvents(2) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if cloudClient.testVMClient.SystemAssigned("test-node1") {
+		t.Fatalf("expected system assigned identity enabled by MIC to be disabled on test-node1")
+	}
+	if !cloudClient.testVMClient.SystemAssigned("test-node2") {
+		t.Fatalf("expected system assigned identity not enabled by MIC to be kept on test-node2")
+	}
+	if cloudClient.testVMClient.SystemAssignedTagged("test-node1") {
+		t.Fatalf("expected the tag to be removed from test-node1 with its system assigned identity")
+	}
+	listAssignedIDs, err := crdClient.ListAssignedIDs()
+	if err != nil {
+		t.Fatalf("error from list assigned ids: %v", err)
+	}
+	if len(*listAssignedIDs) != 0 {
+		t.Fatalf("expected assigned identities to be deleted, got %d assigned identities", len(*listAssignedIDs))
+	}
+}
+
+func TestSystemAssignedIdentityInUseByPod(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+	micClient.allowEnableSystemAssigned = true
+
+	// the pod is bound to two system assigned identities, both using the system assigned identity of the node
+	crdClient.CreateID("test-id1", "default", aadpodid.SystemAssignedMSI, "", "", nil, "", "", "", "")
+	crdClient.CreateID("test-id2", "default", aadpodid.SystemAssignedMSI, "", "", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	crdClient.CreateBinding("testbinding2", "default", "test-id2", "test-select1", "")
+	nodeClient.AddNode("test-node1")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+	eventCh <- internalaadpodid.PodCreated
+	defer micClient.testRunSync()(t)
+
+	if !evtRecorder.WaitForEvents(2) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if !cloudClient.testVMClient.SystemAssigned("test-node1") {
+		t.Fatalf("expected system assigned identity to be enabled on test-node1")
+	}
+
+	crdClient.DeleteBinding("testbinding2", "default")
+	eventCh <- internalaadpodid.BindingDeleted
+
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if !cloudClient.testVMClient.SystemAssigned("test-node1") {
+		t.Fatalf("expected system assigned identity still assigned to test-pod1 through test-id1 to be kept on test-node1")
+	}
+	listAssignedIDs, err := crdClient.ListAssignedIDs()
+	if err != nil {
+		t.Fatalf("error from list assigned ids: %v", err)
+	}
+	if len(*listAssignedIDs) != 1 {
+		t.Fatalf("expected 1 assigned identity, got %d assigned identities", len(*listAssignedIDs))
+	}
+}
+
+func TestSystemAssignedIdentityAfterRestart(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+	micClient.allowEnableSystemAssigned = true
+
+	crdClient.CreateID("test-id1", "default", aadpodid.SystemAssignedMSI, "", "", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+	eventCh <- internalaadpodid.PodCreated
+	stop := micClient.testRunSync()
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	stop(t)
+	if !cloudClient.testVMClient.SystemAssigned("test-node1") {
+		t.Fatalf("expected system assigned identity to be enabled on test-node1")
+	}
+
+	// a new MIC, e.g. after a restart or a failover, disables the system assigned identity the
+	// previous one enabled
+	restartedEventCh := make(chan internalaadpodid.EventType, 100)
+	restarted := NewMICTestClient(restartedEventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+	restarted.allowEnableSystemAssigned = true
+
+	podClient.DeletePod("test-pod1", "default")
+	restartedEventCh <- internalaadpodid.PodDeleted
+	defer restarted.testRunSync()(t)
+
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if cloudClient.testVMClient.SystemAssigned("test-node1") {
+		t.Fatalf("expected system assigned identity enabled before the restart to be disabled on test-node1")
+	}
+	if cloudClient.testVMClient.SystemAssignedTagged("test-node1") {
+		t.Fatalf("expected the tag to be removed from test-node1")
+	}
+}
+
+func TestSystemAssignedIdentityNotAllowed(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+
+	crdClient.CreateID("test-id1", "default", aadpodid.SystemAssignedMSI, "", "", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+	eventCh <- internalaadpodid.PodCreated
+	defer micClient.testRunSync()(t)
+
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if cloudClient.testVMClient.SystemAssigned("test-node1") {
+		t.Fatalf("expected system assigned identity not to be enabled without --allow-enable-system-assigned")
+	}
+}
+
+func TestSyncComputeResourceNotFound(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid1", "test-user-msi-clientid1", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	crdClient.CreateID("test-id2", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid2", "test-user-msi-clientid2", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding2", "default", "test-id2", "test-select2", "")
+	nodeClient.AddNode("test-node1")
+	nodeClient.AddNode("test-node2")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+	podClient.AddPod("test-pod2", "default", "test-node2", "test-select1")
+
+	eventCh <- internalaadpodid.PodCreated
+	defer micClient.testRunSync()(t)
+
+	if !evtRecorder.WaitForEvents(2) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+
+	// The VMs of the nodes are deleted in ARM while the nodes are still in the cluster. The
+	// removal from test-node1 succeeds without an update, the removal from test-node2 is combined
+	// with an identity to assign which fails.
+	cloudClient.testVMClient.DeleteVM("test-node1")
+	cloudClient.testVMClient.DeleteVM("test-node2")
+	podClient.DeletePod("test-pod1", "default")
+	podClient.DeletePod("test-pod2", "default")
+	podClient.AddPod("test-pod3", "default", "test-node2", "test-select2")
+	eventCh <- internalaadpodid.PodDeleted
+
+	if !evtRecorder.WaitForEvents(3) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+
+	listAssignedIDs, err := crdClient.ListAssignedIDs()
+	if err != nil {
+		t.Fatalf("error from list assigned ids: %v", err)
+	}
+	if len(*listAssignedIDs) != 1 {
+		t.Fatalf("expected the assigned identities of the deleted pods to be removed, got %d assigned identities", len(*listAssignedIDs))
+	}
+	assignedID := (*listAssignedIDs)[0]
+	if assignedID.Spec.Pod != "test-pod3" || assignedID.Status.Status != aadpodid.AssignedIDCreated {
+		t.Fatalf("expected the assigned identity of test-pod3 to still be %s, got: %s %s", aadpodid.AssignedIDCreated, assignedID.Spec.Pod, assignedID.Status.Status)
+	}
+}
+
+func TestARMReconcile(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		detach   bool
+		expected []string
+	}{
+		{
+			name:     "re-attach missing identities",
+			expected: []string{"test-user-msi-resourceid1", "test-user-msi-resourceid2", "test-unmanaged-resourceid"},
+		},
+		{
+			name:     "re-attach missing and detach unexpected identities",
+			detach:   true,
+			expected: []string{"test-user-msi-resourceid1", "test-unmanaged-resourceid"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			eventCh := make(chan internalaadpodid.EventType, 100)
+			cloudClient := NewTestCloudClient(config.AzureConfig{})
+			crdClient := NewTestCrdClient(nil)
+			podClient := NewTestPodClient()
+			nodeClient := NewTestNodeClient()
+			var evtRecorder TestEventRecorder
+			evtRecorder.lastEvent = new(LastEvent)
+			evtRecorder.eventChannel = make(chan bool, 100)
+
+			micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+			micClient.armReconcile = newARMReconciler(100*time.Millisecond, tc.detach, micClient.Reporter)
+
+			crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid1", "test-user-msi-clientid1", nil, "", "", "", "")
+			crdClient.CreateID("test-id2", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid2", "test-user-msi-clientid2", nil, "", "", "", "")
+			crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+			nodeClient.AddNode("test-node1")
+			podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+			eventCh <- internalaadpodid.PodCreated
+			defer micClient.testRunSync()(t)
+
+			if !evtRecorder.WaitForEvents(1) {
+				t.Fatalf("Timeout waiting for mic sync cycles")
+			}
+			if !cloudClient.CompareMSI("test-node1", []string{"test-user-msi-resourceid1"}) {
+				cloudClient.PrintMSI()
+				t.Fatalf("expected identity to be assigned to the node")
+			}
+
+			// Detach the assigned identity and attach an identity of an AzureIdentity and an identity
+			// MIC doesn't manage outside MIC
+			cloudClient.testVMClient.DetachIdentity("test-node1", "test-user-msi-resourceid1")
+			cloudClient.testVMClient.AttachIdentity("test-node1", "test-user-msi-resourceid2")
+			cloudClient.testVMClient.AttachIdentity("test-node1", "test-unmanaged-resourceid")
+
+			reconciled := false
+			for i := 0; i < 100 && !reconciled; i++ {
+				time.Sleep(100 * time.Millisecond)
+				reconciled = cloudClient.CompareMSI("test-node1", tc.expected)
+			}
+			if !reconciled {
+				cloudClient.PrintMSI()
+				t.Fatalf("expected identities %v on the node after reconciliation", tc.expected)
+			}
+		})
+	}
+}
+
+func TestBurstCoalescedIntoSingleUpdate(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+
+	nodeClient.AddNode("test-node1")
+	var expected []string
+	for i := 0; i < 10; i++ {
+		resourceID := fmt.Sprintf("test-user-msi-resourceid%d", i)
+		crdClient.CreateID(fmt.Sprintf("test-id%d", i), "default", aadpodid.UserAssignedMSI, resourceID, fmt.Sprintf("test-user-msi-clientid%d", i), nil, "", "", "", "")
+		crdClient.CreateBinding(fmt.Sprintf("testbinding%d", i), "default", fmt.Sprintf("test-id%d", i), fmt.Sprintf("test-select%d", i), "")
+		podClient.AddPod(fmt.Sprintf("test-pod%d", i), "default", "test-node1", fmt.Sprintf("test-select%d", i))
+		expected = append(expected, resourceID)
+		eventCh <- internalaadpodid.PodCreated
+	}
+
+	defer micClient.testRunSync()(t)
+
+	if !evtRecorder.WaitForEvents(10) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if !cloudClient.CompareMSI("test-node1", expected) {
+		cloudClient.PrintMSI()
+		t.Fatalf("expected the identities of the burst to be assigned to the node")
+	}
+	if writes, _ := cloudClient.testVMClient.Writes("test-node1"); writes != 1 {
+		t.Fatalf("expected the burst to be coalesced into 1 update of the node, got %d", writes)
+	}
+}
+
+func TestBurstKeepsDesiredIdentities(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid1", "test-user-msi-clientid1", nil, "", "", "", "")
+	crdClient.CreateID("test-id2", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid2", "test-user-msi-clientid2", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	crdClient.CreateBinding("testbinding2", "default", "test-id2", "test-select2", "")
+	nodeClient.AddNode("test-node1")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+	eventCh <- internalaadpodid.PodCreated
+	defer micClient.testRunSync()(t)
+
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if !cloudClient.CompareMSI("test-node1", []string{"test-user-msi-resourceid1"}) {
+		cloudClient.PrintMSI()
+		t.Fatalf("expected identity to be assigned to the node")
+	}
+
+	// a pod using the identity is replaced by another one on the same node while a pod with
+	// another identity is created
+	podClient.DeletePod("test-pod1", "default")
+	podClient.AddPod("test-pod2", "default", "test-node1", "test-select1")
+	podClient.AddPod("test-pod3", "default", "test-node1", "test-select2")
+	eventCh <- internalaadpodid.PodDeleted
+	eventCh <- internalaadpodid.PodCreated
+	eventCh <- internalaadpodid.PodCreated
+
+	// the assigned identity of test-pod1 is deleted and those of test-pod2 and test-pod3 created
+	if !evtRecorder.WaitForEvents(3) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if !cloudClient.CompareMSI("test-node1", []string{"test-user-msi-resourceid1", "test-user-msi-resourceid2"}) {
+		cloudClient.PrintMSI()
+		t.Fatalf("expected both identities to be assigned to the node")
+	}
+	writes, removed := cloudClient.testVMClient.Writes("test-node1")
+	if len(removed) != 0 {
+		t.Errorf("expected no identity to be removed from the node during the burst, got %v", removed)
+	}
+	if writes != 2 {
+		t.Errorf("expected 2 updates of the node, got %d", writes)
+	}
+}
+
+func TestCoalesceUserMSIIDs(t *testing.T) {
+	c := &Client{}
+	add, remove := c.coalesceUserMSIIDs(
+		[]string{"id3", "id1", "id3"},
+		[]string{"id2", "id1", "id4", "id2"},
+	)
+	if !reflect.DeepEqual(add, []string{"id1", "id3"}) {
+		t.Errorf("expected sorted unique identities to assign, got %v", add)
+	}
+	if !reflect.DeepEqual(remove, []string{"id2", "id4"}) {
+		t.Errorf("expected sorted unique identities to remove without the identities to assign, got %v", remove)
+	}
+}
+
+func TestSortPodsByCreation(t *testing.T) {
+	now := time.Now()
+	newPod := func(ns, name string, created time.Time) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: name, Namespace: ns, CreationTimestamp: v1.NewTime(created)}}
+	}
+	pods := []*corev1.Pod{
+		newPod("default", "pod3", now.Add(time.Second)),
+		newPod("default", "pod2", now),
+		newPod("a", "pod1", now),
+		newPod("default", "pod0", now.Add(-time.Second)),
+	}
+	sortPodsByCreation(pods)
+
+	var order []string
+	for _, pod := range pods {
+		order = append(order, pod.Namespace+"/"+pod.Name)
+	}
+	expected := []string{"default/pod0", "a/pod1", "default/pod2", "default/pod3"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected pods in order %v, got %v", expected, order)
+	}
+}
+
+func TestMultipleBindingsMatchIdentityTypes(t *testing.T) {
+	micClient := &Client{}
+
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: "test-pod", Namespace: "default", Labels: map[string]string{aadpodid.CRDLabelKey: "test-select"}},
+		Spec:       corev1.PodSpec{NodeName: "test-node"},
+	}
+	bindings := []internalaadpodid.AzureIdentityBinding{
+		{
+			ObjectMeta: v1.ObjectMeta{Name: "msi-binding", Namespace: "default"},
+			Spec:       internalaadpodid.AzureIdentityBindingSpec{AzureIdentity: "test-msi", Selector: "test-select"},
+		},
+		{
+			ObjectMeta: v1.ObjectMeta{Name: "system-binding", Namespace: "default"},
+			Spec:       internalaadpodid.AzureIdentityBindingSpec{AzureIdentity: "test-system", Selector: "test-select"},
+		},
+	}
+
+	cases := []struct {
+		name             string
+		systemClientID   string
+		expectedClientID map[string]string
+	}{
+		{
+			name: "system assigned identity without client id",
+			expectedClientID: map[string]string{
+				"test-pod-default-test-msi":    "test-msi-clientid",
+				"test-pod-default-test-system": "",
+			},
+		},
+		{
+			name:           "system assigned identity with client id",
+			systemClientID: "test-system-clientid",
+			expectedClientID: map[string]string{
+				"test-pod-default-test-msi":    "test-msi-clientid",
+				"test-pod-default-test-system": "test-system-clientid",
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			idMap := map[string]internalaadpodid.AzureIdentity{
+				getIDKey("default", "test-msi"): {
+					ObjectMeta: v1.ObjectMeta{Name: "test-msi", Namespace: "default"},
+					Spec:       internalaadpodid.AzureIdentitySpec{Type: internalaadpodid.UserAssignedMSI, ResourceID: "test-user-msi-resourceid", ClientID: "test-msi-clientid"},
+				},
+				getIDKey("default", "test-system"): {
+					ObjectMeta: v1.ObjectMeta{Name: "test-system", Namespace: "default"},
+					Spec:       internalaadpodid.AzureIdentitySpec{Type: internalaadpodid.SystemAssignedMSI, ClientID: tc.systemClientID},
+				},
+			}
+
+			newAssignedIDs, nodeRefs, err := micClient.createDesiredAssignedIdentityList([]*corev1.Pod{pod}, &bindings, idMap)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !nodeRefs["test-node"] {
+				t.Fatalf("expected node test-node to be referenced")
+			}
+			if len(newAssignedIDs) != len(tc.expectedClientID) {
+				t.Fatalf("expected %d assigned identities, got: %d", len(tc.expectedClientID), len(newAssignedIDs))
+			}
+			for name, clientID := range tc.expectedClientID {
+				assignedID, ok := newAssignedIDs[name]
+				if !ok {
+					t.Fatalf("expected assigned identity %s", name)
+				}
+				if assignedID.Spec.AzureIdentityRef.Spec.ClientID != clientID {
+					t.Fatalf("expected client id %q for %s, got: %q", clientID, name, assignedID.Spec.AzureIdentityRef.Spec.ClientID)
+				}
+				if assignedID.Spec.AzureIdentityRef.Spec.Type != idMap[getIDKey("default", assignedID.Spec.AzureIdentityRef.Name)].Spec.Type {
+					t.Fatalf("expected identity type %v for %s, got: %v", idMap[getIDKey("default", assignedID.Spec.AzureIdentityRef.Name)].Spec.Type, name, assignedID.Spec.AzureIdentityRef.Spec.Type)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package mic
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// AssignedIDNamingDefault names the assigned identities <pod>-<pod namespace>-<identity>, as
+	// MIC always has
+	AssignedIDNamingDefault = "default"
+	// AssignedIDNamingHashSuffix appends a hash of the pod, its namespace and the identity to the
+	// default name, so that the names are unique even when the default names collide
+	AssignedIDNamingHashSuffix = "hash-suffix"
+	// AssignedIDNamingTemplate names the assigned identities with a text/template of the pod name,
+	// pod namespace and identity name
+	AssignedIDNamingTemplate = "template"
+
+	// assignedIDNameHashLen is the number of hex characters of the hash appended to the names
+	assignedIDNameHashLen = 16
+)
+
+// assignedIDNameData is the data of the template naming the assigned identities
+type assignedIDNameData struct {
+	PodName      string
+	PodNamespace string
+	IdentityName string
+}
+
+// assignedIDNamer names the assigned identities of the pairs of pod and identity with the naming
+// scheme. Every name is a valid object name of at most 253 characters: a name that would be longer
+// or, for a template, invalid is replaced by a truncation of the default name suffixed with a hash
+// of the pod, its namespace and the identity.
+type assignedIDNamer struct {
+	scheme   string
+	template *template.Template
+}
+
+// newAssignedIDNamer returns the namer of the naming scheme, the default scheme when empty. The
+// template is only used by the template scheme and must reference the pod name, pod namespace
+// and identity name so that the names are unique per pair of pod and identity.
+func newAssignedIDNamer(scheme, tmpl string) (*assignedIDNamer, error) {
+	n := &assignedIDNamer{scheme: scheme}
+	switch scheme {
+	case "", AssignedIDNamingDefault:
+		n.scheme = AssignedIDNamingDefault
+	case AssignedIDNamingHashSuffix:
+	case AssignedIDNamingTemplate:
+		if tmpl == "" {
+			return nil, errors.Errorf("the %s assigned identity naming scheme requires a template", AssignedIDNamingTemplate)
+		}
+		t, err := template.New("assignedIDName").Option("missingkey=error").Parse(tmpl)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse assigned identity name template %q", tmpl)
+		}
+		n.template = t
+		if err := n.validateTemplate(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Errorf("unknown assigned identity naming scheme %q, expected one of %s, %s or %s",
+			scheme, AssignedIDNamingDefault, AssignedIDNamingHashSuffix, AssignedIDNamingTemplate)
+	}
+	return n, nil
+}
+
+// validateTemplate returns an error if the template can't be executed or doesn't reference the
+// pod name, pod namespace and identity name
+func (n *assignedIDNamer) validateTemplate() error {
+	data := assignedIDNameData{PodName: "podname0", PodNamespace: "podnamespace0", IdentityName: "identityname0"}
+	name, err := n.execute(data)
+	if err != nil {
+		return errors.Wrapf(err, "failed to execute assigned identity name template")
+	}
+	for _, field := range []string{data.PodName, data.PodNamespace, data.IdentityName} {
+		if !strings.Contains(name, field) {
+			return errors.Errorf("assigned identity name template must reference .PodName, .PodNamespace and .IdentityName, got %q for %+v", name, data)
+		}
+	}
+	return nil
+}
+
+func (n *assignedIDNamer) execute(data assignedIDNameData) (string, error) {
+	var b bytes.Buffer
+	if err := n.template.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// name returns the name of the assigned identity of the identity assigned to the pod. A nil namer
+// uses the default scheme.
+func (n *assignedIDNamer) name(podName, podNamespace, idName string) string {
+	defaultName := podName + "-" + podNamespace + "-" + idName
+	scheme := AssignedIDNamingDefault
+	if n != nil {
+		scheme = n.scheme
+	}
+
+	name := defaultName
+	switch scheme {
+	case AssignedIDNamingHashSuffix:
+		return hashSuffixedName(defaultName, podName, podNamespace, idName)
+	case AssignedIDNamingTemplate:
+		var err error
+		name, err = n.execute(assignedIDNameData{PodName: podName, PodNamespace: podNamespace, IdentityName: idName})
+		if err != nil || len(validation.IsDNS1123Subdomain(name)) > 0 {
+			return hashSuffixedName(defaultName, podName, podNamespace, idName)
+		}
+	}
+	if len(name) > validation.DNS1123SubdomainMaxLength {
+		return hashSuffixedName(defaultName, podName, podNamespace, idName)
+	}
+	return name
+}
+
+// hashSuffixedName returns the prefix, truncated so that the name fits in 253 characters, suffixed
+// with a hash of the pod, its namespace and the identity
+func hashSuffixedName(prefix, podName, podNamespace, idName string) string {
+	// '/' can't be part of the names, the hashed string is unique per pair of pod and identity
+	sum := sha256.Sum256([]byte(podNamespace + "/" + podName + "/" + idName))
+	hash := hex.EncodeToString(sum[:])[:assignedIDNameHashLen]
+
+	if max := validation.DNS1123SubdomainMaxLength - len(hash) - 1; len(prefix) > max {
+		prefix = prefix[:max]
+	}
+	// the name must end with an alphanumeric character before the hash is appended
+	prefix = strings.TrimRight(prefix, "-.")
+	return prefix + "-" + hash
+}
@@ -0,0 +1,128 @@
+package mic
+
+import (
+	"strings"
+	"testing"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestNewAssignedIDNamer(t *testing.T) {
+	cases := []struct {
+		name        string
+		scheme      string
+		template    string
+		expectedErr string
+	}{
+		{name: "empty scheme", scheme: ""},
+		{name: "default scheme", scheme: AssignedIDNamingDefault},
+		{name: "hash suffix scheme", scheme: AssignedIDNamingHashSuffix},
+		{name: "template scheme", scheme: AssignedIDNamingTemplate, template: "{{.PodNamespace}}-{{.PodName}}-{{.IdentityName}}"},
+		{name: "unknown scheme", scheme: "random", expectedErr: "unknown assigned identity naming scheme"},
+		{name: "template scheme without template", scheme: AssignedIDNamingTemplate, expectedErr: "requires a template"},
+		{name: "template not parsed", scheme: AssignedIDNamingTemplate, template: "{{.PodName", expectedErr: "failed to parse"},
+		{name: "template with unknown field", scheme: AssignedIDNamingTemplate, template: "{{.Pod}}-{{.PodNamespace}}-{{.IdentityName}}", expectedErr: "failed to execute"},
+		{name: "template without namespace", scheme: AssignedIDNamingTemplate, template: "{{.PodName}}-{{.IdentityName}}", expectedErr: "must reference"},
+	}
+	for _, tc := range cases {
+		_, err := newAssignedIDNamer(tc.scheme, tc.template)
+		if tc.expectedErr == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		if tc.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedErr)) {
+			t.Errorf("%s: expected error containing %q, got: %v", tc.name, tc.expectedErr, err)
+		}
+	}
+}
+
+func TestAssignedIDName(t *testing.T) {
+	hashSuffix, _ := newAssignedIDNamer(AssignedIDNamingHashSuffix, "")
+	tmpl, _ := newAssignedIDNamer(AssignedIDNamingTemplate, "{{.PodNamespace}}.{{.PodName}}.{{.IdentityName}}")
+	upperTmpl, _ := newAssignedIDNamer(AssignedIDNamingTemplate, "{{.PodNamespace}}-{{.PodName}}-{{.IdentityName}}-X")
+
+	// the default names of the pod and identity
+	if name := (*assignedIDNamer)(nil).name("pod", "ns", "id"); name != "pod-ns-id" {
+		t.Errorf("expected the default name pod-ns-id, got %s", name)
+	}
+	if name := tmpl.name("pod", "ns", "id"); name != "ns.pod.id" {
+		t.Errorf("expected the templated name ns.pod.id, got %s", name)
+	}
+	name := hashSuffix.name("pod", "ns", "id")
+	if !strings.HasPrefix(name, "pod-ns-id-") || len(name) != len("pod-ns-id-")+assignedIDNameHashLen {
+		t.Errorf("expected the default name suffixed with a hash, got %s", name)
+	}
+	if again := hashSuffix.name("pod", "ns", "id"); again != name {
+		t.Errorf("expected the name to be deterministic, got %s and %s", name, again)
+	}
+	// an invalid templated name falls back to the hash suffixed name
+	if name := upperTmpl.name("pod", "ns", "id"); name != hashSuffix.name("pod", "ns", "id") {
+		t.Errorf("expected the invalid templated name to fall back to the hash suffixed name, got %s", name)
+	}
+}
+
+func TestAssignedIDNameLongNames(t *testing.T) {
+	hashSuffix, _ := newAssignedIDNamer(AssignedIDNamingHashSuffix, "")
+	tmpl, _ := newAssignedIDNamer(AssignedIDNamingTemplate, "{{.PodName}}-{{.PodNamespace}}-{{.IdentityName}}")
+	podName := strings.Repeat("p", 200)
+	idName := strings.Repeat("i", 100) + "-" + strings.Repeat("d", 100)
+
+	names := map[string]bool{}
+	for _, n := range []*assignedIDNamer{nil, hashSuffix, tmpl} {
+		for _, id := range []string{idName, idName + "2"} {
+			name := n.name(podName, "default", id)
+			if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+				t.Errorf("expected a valid name for %s, got %s: %v", id, name, errs)
+			}
+			names[name] = true
+		}
+	}
+	// the names only differing past the max length are still unique, whichever the scheme
+	if len(names) != 2 {
+		t.Errorf("expected 2 unique names for the 2 identities, got %d: %v", len(names), names)
+	}
+
+	// the truncated prefix never ends with a dash before the hash
+	name := hashSuffixedName(strings.Repeat("a", validation.DNS1123SubdomainMaxLength-assignedIDNameHashLen-2)+"-b", "pod", "ns", "id")
+	if strings.Contains(name, "--") || len(name) > validation.DNS1123SubdomainMaxLength {
+		t.Errorf("expected the dash at the end of the truncated prefix to be trimmed, got %s", name)
+	}
+}
+
+func TestAssignedIDNameCollisions(t *testing.T) {
+	hashSuffix, _ := newAssignedIDNamer(AssignedIDNamingHashSuffix, "")
+	// the default names of these pairs of pod and identity collide
+	pairs := [][3]string{
+		{"a-b", "c", "d"},
+		{"a", "b-c", "d"},
+		{"a", "b", "c-d"},
+	}
+	if (*assignedIDNamer)(nil).name(pairs[0][0], pairs[0][1], pairs[0][2]) != (*assignedIDNamer)(nil).name(pairs[1][0], pairs[1][1], pairs[1][2]) {
+		t.Fatalf("expected the default names to collide")
+	}
+	names := map[string]bool{}
+	for _, p := range pairs {
+		names[hashSuffix.name(p[0], p[1], p[2])] = true
+	}
+	if len(names) != len(pairs) {
+		t.Errorf("expected the hash suffixed names to be unique, got: %v", names)
+	}
+}
+
+func TestMakeAssignedIDsNamingScheme(t *testing.T) {
+	namer, err := newAssignedIDNamer(AssignedIDNamingTemplate, "{{.PodNamespace}}-{{.PodName}}-{{.IdentityName}}")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := &Client{assignedIDNames: namer}
+	azID := aadpodid.AzureIdentity{ObjectMeta: v1.ObjectMeta{Name: "test-id", Namespace: "default"}}
+	binding := aadpodid.AzureIdentityBinding{ObjectMeta: v1.ObjectMeta{Name: "test-binding", Namespace: "default"}}
+	assignedID, err := c.makeAssignedIDs(azID, binding, "test-pod", "test-ns", "test-node")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if assignedID.Name != "test-ns-test-pod-test-id" {
+		t.Errorf("expected the assigned identity to be named by the template, got %s", assignedID.Name)
+	}
+}
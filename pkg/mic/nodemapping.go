@@ -0,0 +1,117 @@
+package mic
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/aad-pod-identity/pkg/cloudprovider"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listerv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// NodeMappingClient resolves the nodes from a config map mapping node names to the provider id of
+// the VM, VMSS instance or Azure Arc machine backing them, so that MIC can resolve the compute
+// resources of the nodes without reading the nodes of the cluster.
+type NodeMappingClient struct {
+	namespace string
+	name      string
+	informer  cache.SharedIndexInformer
+	lister    listerv1.ConfigMapNamespaceLister
+	// nodes resolves the nodes missing from the mapping or with an invalid provider id, nil when
+	// MIC doesn't have access to the nodes
+	nodes NodeGetter
+}
+
+// NewNodeMappingClient returns a client resolving the nodes from the config map with the given
+// namespace and name, falling back to nodes when not nil.
+func NewNodeMappingClient(clientSet kubernetes.Interface, namespace, name string, nodes NodeGetter) *NodeMappingClient {
+	configMaps := informers.NewSharedInformerFactoryWithOptions(clientSet, 30*time.Second,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		})).Core().V1().ConfigMaps()
+	return &NodeMappingClient{
+		namespace: namespace,
+		name:      name,
+		informer:  configMaps.Informer(),
+		lister:    configMaps.Lister().ConfigMaps(namespace),
+		nodes:     nodes,
+	}
+}
+
+// Get gets the specified node. A node in the mapping only has its name and provider id set.
+func (c *NodeMappingClient) Get(name string) (*corev1.Node, error) {
+	providerID, err := c.getProviderID(name)
+	if err == nil && providerID != "" {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       corev1.NodeSpec{ProviderID: providerID},
+		}, nil
+	}
+	if c.nodes != nil {
+		if err != nil {
+			klog.Warningf("%v, resolving node %s from the cluster", err, name)
+		}
+		return c.nodes.Get(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// without access to the nodes, the nodes removed from the mapping are no longer in the cluster
+	return nil, apierrors.NewNotFound(corev1.Resource("nodes"), name)
+}
+
+// Start starts syncing the config map, and the nodes when resolved from the cluster.
+func (c *NodeMappingClient) Start(exit <-chan struct{}) {
+	go c.informer.Run(exit)
+	cache.WaitForCacheSync(exit, c.informer.HasSynced)
+	if c.nodes != nil {
+		c.nodes.Start(exit)
+	}
+}
+
+// getProviderID returns the validated provider id of the node in the mapping, empty when the node
+// isn't in the mapping. The errors don't read as the node not being found, since the assigned
+// identities of the nodes not found are deleted.
+func (c *NodeMappingClient) getProviderID(name string) (string, error) {
+	cm, err := c.lister.Get(c.name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", fmt.Errorf("node mapping config map %s/%s doesn't exist", c.namespace, c.name)
+		}
+		return "", err
+	}
+	providerID, ok := cm.Data[name]
+	if !ok {
+		return "", nil
+	}
+	if err := validateProviderID(providerID); err != nil {
+		return "", fmt.Errorf("invalid provider id of node %s in node mapping config map %s/%s: %v", name, c.namespace, c.name, err)
+	}
+	return providerID, nil
+}
+
+// validateProviderID returns an error if the provider id isn't the id of a VM, VMSS instance or
+// Azure Arc machine.
+func validateProviderID(providerID string) error {
+	r, err := cloudprovider.ParseResourceID(providerID)
+	if err != nil {
+		return err
+	}
+	if cloudprovider.IsHybridMachine(r) {
+		return nil
+	}
+	if !strings.EqualFold(r.Provider, "Microsoft.Compute") ||
+		(r.ResourceType != cloudprovider.VMResourceType && r.ResourceType != cloudprovider.VMSSResourceType) {
+		return fmt.Errorf("%s is not a virtual machine, virtual machine scale set instance or Azure Arc machine", providerID)
+	}
+	return nil
+}
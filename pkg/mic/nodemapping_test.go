@@ -0,0 +1,178 @@
+package mic
+
+import (
+	"strings"
+	"testing"
+
+	internalaadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity/v1"
+	"github.com/Azure/aad-pod-identity/pkg/config"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	listerv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const testVMSSProviderID = "azure:///subscriptions/fakeSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachineScaleSets/testvmss1/virtualMachines/0"
+
+// newTestNodeMappingClient returns a node mapping client with the given mapping, the config map
+// doesn't exist when mapping is nil
+func newTestNodeMappingClient(mapping map[string]string, nodes NodeGetter) *NodeMappingClient {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if mapping != nil {
+		_ = indexer.Add(&corev1.ConfigMap{ObjectMeta: v1.ObjectMeta{Name: "node-mapping", Namespace: "default"}, Data: mapping})
+	}
+	return &NodeMappingClient{
+		namespace: "default",
+		name:      "node-mapping",
+		lister:    listerv1.NewConfigMapLister(indexer).ConfigMaps("default"),
+		nodes:     nodes,
+	}
+}
+
+func TestNodeMappingClientGet(t *testing.T) {
+	nodeClient := NewTestNodeClient()
+	nodeClient.AddNode("test-node1")
+
+	cases := []struct {
+		name               string
+		mapping            map[string]string
+		nodes              NodeGetter
+		expectedProviderID string
+		expectedNotFound   bool
+		expectedErr        bool
+	}{
+		{
+			name:               "node in the mapping",
+			mapping:            map[string]string{"test-node1": testVMSSProviderID},
+			expectedProviderID: testVMSSProviderID,
+		},
+		{
+			name:               "node in the mapping resolved from the mapping first",
+			mapping:            map[string]string{"test-node1": testVMSSProviderID},
+			nodes:              nodeClient,
+			expectedProviderID: testVMSSProviderID,
+		},
+		{
+			name:             "node not in the mapping",
+			mapping:          map[string]string{"test-node2": testVMSSProviderID},
+			expectedNotFound: true,
+		},
+		{
+			name:               "node not in the mapping resolved from the cluster",
+			mapping:            map[string]string{"test-node2": testVMSSProviderID},
+			nodes:              nodeClient,
+			expectedProviderID: "azure:///subscriptions/testSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachines/test-node1",
+		},
+		{
+			name:        "invalid provider id",
+			mapping:     map[string]string{"test-node1": "azure:///subscriptions/fakeSub/resourceGroups/fakeGroup/providers/Microsoft.Network/loadBalancers/lb"},
+			expectedErr: true,
+		},
+		{
+			name:               "invalid provider id resolved from the cluster",
+			mapping:            map[string]string{"test-node1": "vm1"},
+			nodes:              nodeClient,
+			expectedProviderID: "azure:///subscriptions/testSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachines/test-node1",
+		},
+		{
+			name:        "config map doesn't exist",
+			expectedErr: true,
+		},
+		{
+			name:               "config map doesn't exist resolved from the cluster",
+			nodes:              nodeClient,
+			expectedProviderID: "azure:///subscriptions/testSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachines/test-node1",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			node, err := newTestNodeMappingClient(tc.mapping, tc.nodes).Get("test-node1")
+			if tc.expectedNotFound {
+				if !apierrors.IsNotFound(err) {
+					t.Fatalf("expected a not found error, got: %v", err)
+				}
+				return
+			}
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatalf("expected an error, got node %v", node)
+				}
+				// nodes not found have their assigned identities deleted
+				if strings.Contains(err.Error(), "not found") {
+					t.Fatalf("expected the error not to read as the node not being found, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected nil error, got: %v", err)
+			}
+			if node.Name != "test-node1" || node.Spec.ProviderID != tc.expectedProviderID {
+				t.Errorf("expected node test-node1 with provider id %s, got %s with %s", tc.expectedProviderID, node.Name, node.Spec.ProviderID)
+			}
+		})
+	}
+}
+
+func TestValidateProviderID(t *testing.T) {
+	for _, providerID := range []string{
+		"azure:///subscriptions/fakeSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachines/vm1",
+		testVMSSProviderID,
+		"azure:///subscriptions/fakeSub/resourceGroups/arcGroup/providers/Microsoft.HybridCompute/machines/arc-machine1",
+	} {
+		if err := validateProviderID(providerID); err != nil {
+			t.Errorf("expected provider id %s to be valid, got: %v", providerID, err)
+		}
+	}
+	for _, providerID := range []string{
+		"",
+		"vm1",
+		"azure:///subscriptions/fakeSub/resourceGroups/fakeGroup/providers/Microsoft.Network/loadBalancers/lb",
+	} {
+		if err := validateProviderID(providerID); err == nil {
+			t.Errorf("expected provider id %q to be invalid", providerID)
+		}
+	}
+}
+
+func TestCRDOnlyNodeMapping(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{VMType: "vmss"})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, NewTestNodeClient(), &evtRecorder, false, 4, nil)
+	// the nodes of the cluster can't be read, the node is only in the mapping
+	micClient.NodeClient = newTestNodeMappingClient(map[string]string{"test-node1": testVMSSProviderID}, nil)
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid", "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+	defer micClient.testRunSync()(t)
+
+	eventCh <- internalaadpodid.PodCreated
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+
+	listAssignedIDs, err := crdClient.ListAssignedIDs()
+	if err != nil {
+		t.Fatalf("list assigned failed: %v", err)
+	}
+	if len(*listAssignedIDs) != 1 {
+		t.Fatalf("expected assigned identities len: %d, got: %d", 1, len(*listAssignedIDs))
+	}
+	if (*listAssignedIDs)[0].Status.Status != aadpodid.AssignedIDAssigned {
+		t.Fatalf("expected status to be %s, got: %s", aadpodid.AssignedIDAssigned, (*listAssignedIDs)[0].Status.Status)
+	}
+	if !cloudClient.CompareMSI("testvmss1", []string{"test-user-msi-resourceid"}) {
+		t.Fatalf("expected the identity to be assigned to the vmss of the node in the mapping")
+	}
+}
@@ -0,0 +1,72 @@
+package mic
+
+import (
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+)
+
+// nodeInstance identifies the node object and the compute resource backing a node name. A node
+// deleted and rejoined with the same name, e.g. by an autoscaler, has a different instance.
+type nodeInstance struct {
+	uid        types.UID
+	providerID string
+}
+
+// getReplacedNodes returns the nodes of the assigned identities that were replaced by a node with
+// the same name since the previous sync. Nodes seen for the first time are not considered replaced.
+func (c *Client) getReplacedNodes(currentAssignedIDs map[string]aadpodid.AzureAssignedIdentity) map[string]bool {
+	if c.nodeInstances == nil {
+		c.nodeInstances = make(map[string]nodeInstance)
+	}
+
+	replaced := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, assignedID := range currentAssignedIDs {
+		nodeName := assignedID.Spec.NodeName
+		if seen[nodeName] {
+			continue
+		}
+		seen[nodeName] = true
+
+		node, err := c.NodeClient.Get(nodeName)
+		if err != nil {
+			// nodes no longer in the cluster are cleaned up with their assigned identities
+			continue
+		}
+		current := nodeInstance{uid: node.UID, providerID: node.Spec.ProviderID}
+		previous, ok := c.nodeInstances[nodeName]
+		c.nodeInstances[nodeName] = current
+		if ok && previous != current {
+			klog.Infof("Node %s was replaced (provider id %s, uid %s), its identities will be re-applied", nodeName, current.providerID, current.uid)
+			replaced[nodeName] = true
+		}
+	}
+
+	// forget the nodes without assigned identities
+	for nodeName := range c.nodeInstances {
+		if !seen[nodeName] {
+			delete(c.nodeInstances, nodeName)
+		}
+	}
+	return replaced
+}
+
+// getListOfIdsToReapply adds the user assigned identities already assigned to the replaced nodes
+// to the identities to assign, as the compute resource backing the node doesn't have them.
+// Assigned identities being created or deleted in this sync are handled by the add and delete lists.
+func (c *Client) getListOfIdsToReapply(currentAssignedIDs, deleteList map[string]aadpodid.AzureAssignedIdentity, replacedNodes map[string]bool, nodeMap map[string]trackUserAssignedMSIIds) {
+	for _, assignedID := range currentAssignedIDs {
+		if !replacedNodes[assignedID.Spec.NodeName] || assignedID.Status.Status != aadpodid.AssignedIDAssigned {
+			continue
+		}
+		if _, deleted := deleteList[assignedID.Name]; deleted {
+			continue
+		}
+		id := assignedID.Spec.AzureIdentityRef
+		if c.checkIfUserAssignedMSI(id) {
+			klog.V(5).Infof("Re-applying identity %s/%s to replaced node %s", id.Namespace, id.Name, assignedID.Spec.NodeName)
+			c.appendToAddListForNode(id.Spec.ResourceID, assignedID.Spec.NodeName, nodeMap)
+		}
+	}
+}
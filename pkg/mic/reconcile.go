@@ -0,0 +1,213 @@
+package mic
+
+import (
+	"strings"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/cloudprovider"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	"k8s.io/klog"
+)
+
+const (
+	// driftReattach is the operation type of the drift corrections re-attaching a missing identity
+	driftReattach = "reattach"
+	// driftDetach is the operation type of the drift corrections detaching an unexpected identity
+	driftDetach = "detach"
+)
+
+// armReconciler periodically triggers the reconciliation of the user assigned identities of the VMs
+// and VMSS in ARM against the assigned identities, to correct the identities modified outside MIC.
+type armReconciler struct {
+	interval time.Duration
+	// detach allows detaching the identities MIC manages that are attached without being assigned
+	detach   bool
+	reporter *metrics.Reporter
+}
+
+// newARMReconciler returns a reconciler for the interval, or nil when the interval is not positive
+// which disables the reconciliation
+func newARMReconciler(interval time.Duration, detach bool, reporter *metrics.Reporter) *armReconciler {
+	if interval <= 0 {
+		return nil
+	}
+	return &armReconciler{interval: interval, detach: detach, reporter: reporter}
+}
+
+// tick returns the channel the reconciliation is due on and a func stopping it. The channel is nil
+// when the reconciliation is disabled.
+func (r *armReconciler) tick() (<-chan time.Time, func()) {
+	if r == nil {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(r.interval)
+	return ticker.C, ticker.Stop
+}
+
+// recordCorrection reports a drift correction of the operation type
+func (r *armReconciler) recordCorrection(operationType string) {
+	if r.reporter == nil {
+		return
+	}
+	if err := r.reporter.ReportOperation(operationType, metrics.MICARMDriftCorrectionsCountM.M(1)); err != nil {
+		klog.Warningf("failed to report drift correction metric, error: %+v", err)
+	}
+}
+
+// computeResource is the VM, VMSS or Azure Arc machine backing the nodes of assigned identities
+type computeResource struct {
+	// name is the node name of a VM or Azure Arc machine, or the VMSS name
+	name      string
+	trackList trackUserAssignedMSIIds
+	// node is a node of the compute resource, the corrections are added to its track list
+	node string
+	// desired are the identities of the assigned identities in assigned state
+	desired map[string]string
+	// inUse are the identities of all the assigned identities of the nodes
+	inUse map[string]bool
+}
+
+// getListOfDriftedIds reads the user assigned identities of the VM, VMSS or Azure Arc machine of
+// each node with assigned identities from ARM and adds the corrections of the drift from the
+// assigned identities to the node map: identities of assigned identities in assigned state missing
+// in ARM are re-attached and, when detach is allowed, identities of AzureIdentities attached without
+// being assigned to a pod of the nodes are detached. Identities being assigned or removed in this
+// sync are left to the add and delete lists. It returns the number of corrections.
+func (c *Client) getListOfDriftedIds(currentAssignedIDs, deleteList map[string]aadpodid.AzureAssignedIdentity, idMap map[string]aadpodid.AzureIdentity, nodeMap map[string]trackUserAssignedMSIIds) int {
+	resources := make(map[string]*computeResource)
+	nodeResources := make(map[string]*computeResource)
+	resourceOfNode := func(nodeName string) *computeResource {
+		if r, ok := nodeResources[nodeName]; ok {
+			return r
+		}
+		r, err := c.getComputeResource(nodeName)
+		if err != nil {
+			klog.Errorf("Unable to get compute resource of node %s for reconciliation. Error %v", nodeName, err)
+		}
+		if r != nil {
+			key := systemAssignedKey(r.name, r.trackList.isvmss)
+			if existing, ok := resources[key]; ok {
+				r = existing
+			} else {
+				resources[key] = r
+			}
+		}
+		nodeResources[nodeName] = r
+		return r
+	}
+
+	for _, assignedID := range currentAssignedIDs {
+		id := assignedID.Spec.AzureIdentityRef
+		if id == nil || !c.checkIfUserAssignedMSI(id) {
+			continue
+		}
+		r := resourceOfNode(assignedID.Spec.NodeName)
+		if r == nil {
+			continue
+		}
+		r.inUse[strings.ToLower(id.Spec.ResourceID)] = true
+		if _, deleted := deleteList[assignedID.Name]; deleted || assignedID.Status.Status != aadpodid.AssignedIDAssigned {
+			continue
+		}
+		r.desired[strings.ToLower(id.Spec.ResourceID)] = id.Spec.ResourceID
+	}
+
+	// the identities already being assigned or removed in this sync
+	pending := make(map[string]bool)
+	for nodeName, trackList := range nodeMap {
+		r := resourceOfNode(nodeName)
+		if r == nil {
+			continue
+		}
+		for _, ids := range [][]string{trackList.addUserAssignedMSIIDs, trackList.removeUserAssignedMSIIDs} {
+			for _, resourceID := range ids {
+				pending[systemAssignedKey(r.name, r.trackList.isvmss)+"/"+strings.ToLower(resourceID)] = true
+			}
+		}
+	}
+
+	// the identities MIC manages, only these are detached
+	var managed map[string]string
+	if c.armReconcile.detach && !c.assignOnly {
+		managed = make(map[string]string)
+		for _, id := range idMap {
+			if !c.checkIfUserAssignedMSI(&id) {
+				continue
+			}
+			resourceID, err := c.getIdentityResourceID(&id)
+			if err != nil || resourceID == "" {
+				continue
+			}
+			managed[strings.ToLower(resourceID)] = id.Spec.ClientID
+		}
+	}
+
+	corrections := 0
+	for key, r := range resources {
+		idList, err := c.getUserMSIListForNode(r.name, r.trackList)
+		if err == cloudprovider.ErrComputeResourceNotFound {
+			klog.V(5).Infof("%s not found in ARM, skipping reconciliation", r.name)
+			continue
+		}
+		if err != nil {
+			klog.Errorf("Getting list of msis from %s for reconciliation resulted in error %v", r.name, err)
+			continue
+		}
+		// resource ids are compared case insensitively as ARM doesn't preserve their case
+		attached := make(map[string]bool, len(idList))
+		for _, resourceID := range idList {
+			attached[strings.ToLower(resourceID)] = true
+		}
+
+		for lower, resourceID := range r.desired {
+			if attached[lower] || pending[key+"/"+lower] {
+				continue
+			}
+			klog.Warningf("Identity %s is assigned but missing on %s, re-attaching it", resourceID, r.name)
+			c.appendToAddListForNode(resourceID, r.node, nodeMap)
+			c.armReconcile.recordCorrection(driftReattach)
+			corrections++
+		}
+
+		for _, resourceID := range idList {
+			lower := strings.ToLower(resourceID)
+			clientID, ok := managed[lower]
+			if !ok || r.inUse[lower] || pending[key+"/"+lower] || c.checkIfIdentityImmutable(clientID) {
+				continue
+			}
+			klog.Warningf("Identity %s is attached to %s without being assigned, detaching it", resourceID, r.name)
+			c.appendToRemoveListForNode(resourceID, r.node, nodeMap)
+			c.armReconcile.recordCorrection(driftDetach)
+			corrections++
+		}
+	}
+	return corrections
+}
+
+// getComputeResource returns the compute resource backing the node, nil when the node is no
+// longer in the cluster
+func (c *Client) getComputeResource(nodeName string) (*computeResource, error) {
+	node, err := c.NodeClient.Get(nodeName)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			// nodes no longer in the cluster are cleaned up with their assigned identities
+			return nil, nil
+		}
+		return nil, err
+	}
+	r := &computeResource{name: nodeName, node: nodeName, desired: make(map[string]string), inUse: make(map[string]bool)}
+	vmssID, isvmss, err := isVMSS(node)
+	if err != nil {
+		return nil, err
+	}
+	if isvmss {
+		r.name = getVMSSName(vmssID)
+		r.trackList.isvmss = true
+		return r, nil
+	}
+	if r.trackList.hybridMachine, err = hybridMachineFromNode(node); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
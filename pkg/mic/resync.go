@@ -0,0 +1,128 @@
+package mic
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
+	"k8s.io/klog"
+)
+
+// slowRequestThreshold is the duration after which a request to the API server is considered slow
+const slowRequestThreshold = 5 * time.Second
+
+// resyncBackoff adapts the interval of the periodic sync to the responsiveness of the API server.
+// The interval doubles up to the max when a request of MIC to the API server is throttled or slow,
+// and halves back toward the min after each interval without a throttled or slow request.
+type resyncBackoff struct {
+	min           time.Duration
+	max           time.Duration
+	slowThreshold time.Duration
+	reporter      *metrics.Reporter
+	now           func() time.Time
+
+	mu      sync.Mutex
+	current time.Duration
+	// changed is when the interval last changed, the interval halves when it has been responsive
+	// for the current interval since then
+	changed time.Time
+}
+
+// newResyncBackoff returns a backoff between the min and max intervals, starting at the min. The
+// interval is fixed when max is not greater than min.
+func newResyncBackoff(min, max time.Duration, reporter *metrics.Reporter) *resyncBackoff {
+	if max < min {
+		max = min
+	}
+	b := &resyncBackoff{
+		min:           min,
+		max:           max,
+		slowThreshold: slowRequestThreshold,
+		reporter:      reporter,
+		now:           time.Now,
+		current:       min,
+	}
+	b.changed = b.now()
+	b.report()
+	return b
+}
+
+// observe adjusts the interval to the duration, the status code and the error of a request to the
+// API server. Requests failing otherwise than with a throttling don't change the interval.
+func (b *resyncBackoff) observe(request string, elapsed time.Duration, statusCode int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	previous := b.current
+	switch {
+	case statusCode == http.StatusTooManyRequests || elapsed > b.slowThreshold:
+		b.current *= 2
+		if b.current > b.max {
+			b.current = b.max
+		}
+		b.changed = now
+	case err == nil && statusCode < http.StatusInternalServerError && now.Sub(b.changed) >= b.current:
+		b.current /= 2
+		if b.current < b.min {
+			b.current = b.min
+		}
+		b.changed = now
+	}
+	if b.current != previous {
+		klog.Infof("Request %s took %s with status code %d and error %v, resync interval changed from %s to %s", request, elapsed, statusCode, err, previous, b.current)
+		b.report()
+	}
+}
+
+// interval returns the current interval of the periodic sync
+func (b *resyncBackoff) interval() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.current
+}
+
+func (b *resyncBackoff) report() {
+	if b.reporter != nil {
+		b.reporter.Report(metrics.MICResyncPeriodM.M(b.current.Seconds()))
+	}
+}
+
+// observeRequests returns a copy of the rest config whose requests to the API server are observed
+// by the backoff: the lists and writes of the informers, of the sync and of the leader election.
+// Watches are long running by design and are not observed. The config is returned as is when the
+// interval of the backoff is fixed.
+func observeRequests(config *rest.Config, b *resyncBackoff) *rest.Config {
+	if b.max <= b.min {
+		return config
+	}
+	observed := rest.CopyConfig(config)
+	observed.WrapTransport = transport.Wrappers(observed.WrapTransport, func(rt http.RoundTripper) http.RoundTripper {
+		return &observedRoundTripper{next: rt, backoff: b}
+	})
+	return observed
+}
+
+// observedRoundTripper reports the outcome of the requests to the resync backoff
+type observedRoundTripper struct {
+	next    http.RoundTripper
+	backoff *resyncBackoff
+}
+
+func (rt *observedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Query().Get("watch") == "true" {
+		return rt.next.RoundTrip(req)
+	}
+	begin := time.Now()
+	resp, err := rt.next.RoundTrip(req)
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	rt.backoff.observe(req.Method+" "+req.URL.Path, time.Since(begin), statusCode, err)
+	return resp, err
+}
@@ -0,0 +1,140 @@
+package mic
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fakeClock is a clock advanced by the tests
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestResyncBackoff(t *testing.T) {
+	reporter, _ := metrics.NewReporter()
+	b := newResyncBackoff(time.Minute, 8*time.Minute, reporter)
+	clock := &fakeClock{now: time.Now()}
+	b.now = clock.Now
+
+	expectInterval := func(name string, expected time.Duration) {
+		if interval := b.interval(); interval != expected {
+			t.Errorf("%s: expected interval %s, got: %s", name, expected, interval)
+		}
+	}
+	expectInterval("initial", time.Minute)
+
+	b.observe("GET /api/v1/pods", 6*time.Second, http.StatusOK, nil)
+	expectInterval("slow request", 2*time.Minute)
+
+	b.observe("GET /api/v1/nodes", 0, http.StatusTooManyRequests, nil)
+	b.observe("PUT /apis/aadpodidentity.k8s.io/v1/azureassignedidentities", 0, http.StatusTooManyRequests, nil)
+	expectInterval("throttled requests", 8*time.Minute)
+	b.observe("GET /api/v1/pods", 0, http.StatusTooManyRequests, nil)
+	expectInterval("throttled request at max", 8*time.Minute)
+
+	b.observe("GET /api/v1/pods", 0, 0, errors.New("connection refused"))
+	b.observe("GET /api/v1/pods", 0, http.StatusServiceUnavailable, nil)
+	expectInterval("failed requests", 8*time.Minute)
+
+	// responsive requests only halve the interval after a whole interval without a slow request
+	clock.now = clock.now.Add(7 * time.Minute)
+	b.observe("GET /api/v1/pods", 0, http.StatusOK, nil)
+	expectInterval("responsive request within the interval", 8*time.Minute)
+	clock.now = clock.now.Add(time.Minute)
+	b.observe("GET /api/v1/pods", 0, http.StatusOK, nil)
+	b.observe("GET /api/v1/pods", 0, http.StatusNotFound, nil)
+	expectInterval("responsive requests after the interval", 4*time.Minute)
+	for i := 0; i < 3; i++ {
+		clock.now = clock.now.Add(4 * time.Minute)
+		b.observe("GET /api/v1/pods", 0, http.StatusOK, nil)
+	}
+	expectInterval("responsive requests at min", time.Minute)
+}
+
+func TestResyncBackoffFixed(t *testing.T) {
+	b := newResyncBackoff(time.Minute, 0, nil)
+	b.observe("GET /api/v1/pods", time.Minute, http.StatusTooManyRequests, nil)
+	if interval := b.interval(); interval != time.Minute {
+		t.Errorf("expected fixed interval %s, got: %s", time.Minute, interval)
+	}
+	config := &rest.Config{Host: "https://kubernetes"}
+	if observed := observeRequests(config, b); observed != config {
+		t.Errorf("expected the requests not to be observed with a fixed interval")
+	}
+
+	c := &Client{syncRetryInterval: 10 * time.Second}
+	if interval := c.resyncInterval(); interval != 10*time.Second {
+		t.Errorf("expected sync retry interval without backoff, got: %s", interval)
+	}
+}
+
+func TestObserveRequests(t *testing.T) {
+	var throttle, watches int32
+	atomic.StoreInt32(&throttle, 1)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "true" {
+			atomic.AddInt32(&watches, 1)
+			http.Error(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","code":429}`, http.StatusTooManyRequests)
+			return
+		}
+		if atomic.LoadInt32(&throttle) == 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"TooManyRequests","code":429}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"kind":"NodeList","apiVersion":"v1","items":[]}`))
+	}))
+	defer apiServer.Close()
+
+	b := newResyncBackoff(time.Minute, 8*time.Minute, nil)
+	clock := &fakeClock{now: time.Now()}
+	b.now = clock.Now
+	c := &Client{resync: b}
+	config := &rest.Config{Host: apiServer.URL}
+	observed := observeRequests(config, b)
+	if config.WrapTransport != nil {
+		t.Fatalf("expected the rest config of MIC to be copied")
+	}
+	clientSet := kubernetes.NewForConfigOrDie(observed)
+
+	// the nodes listed by a sync are throttled, the next periodic sync is pushed back
+	clientSet.CoreV1().Nodes().List(metav1.ListOptions{})
+	if interval := c.resyncInterval(); interval <= time.Minute {
+		t.Errorf("expected the throttled requests to increase the resync interval, got: %s", interval)
+	}
+	throttled := c.resyncInterval()
+
+	// watches are long running and not observed
+	clientSet.CoreV1().Nodes().Watch(metav1.ListOptions{})
+	if atomic.LoadInt32(&watches) == 0 {
+		t.Fatalf("expected a watch request")
+	}
+	if interval := c.resyncInterval(); interval != throttled {
+		t.Errorf("expected the watches not to change the resync interval %s, got: %s", throttled, interval)
+	}
+
+	// the API server recovers, the interval halves after the interval without throttling
+	atomic.StoreInt32(&throttle, 0)
+	clock.now = clock.now.Add(throttled)
+	if _, err := clientSet.CoreV1().Nodes().List(metav1.ListOptions{}); err != nil {
+		t.Fatalf("unexpected error listing the nodes: %v", err)
+	}
+	if interval := c.resyncInterval(); interval != throttled/2 {
+		t.Errorf("expected the responsive request to halve the resync interval to %s, got: %s", throttled/2, interval)
+	}
+}
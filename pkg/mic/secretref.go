@@ -0,0 +1,92 @@
+package mic
+
+import (
+	"fmt"
+	"strings"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/klog"
+)
+
+// SecretGetter gets the secrets referenced by the AzureIdentities
+type SecretGetter interface {
+	Get(namespace, name string) (*corev1.Secret, error)
+}
+
+// SecretClient gets secrets from the kubernetes api server
+type SecretClient struct {
+	client typedcorev1.SecretsGetter
+}
+
+// Get gets the specified secret.
+//
+// The secret is read from the api server rather than a cache, so MIC only requires access to the
+// secrets referenced by the AzureIdentities instead of listing and watching all the secrets.
+func (c *SecretClient) Get(namespace, name string) (*corev1.Secret, error) {
+	return c.client.Secrets(namespace).Get(name, v1.GetOptions{})
+}
+
+// resolveIdentitySecretRefs sets the client id and resource id of the identities referencing a
+// secret to the values of the secret and returns the identities. The secrets are read on every
+// sync, so a change of the values is applied to the assigned identities by the next sync.
+// Identities whose secret references can't be resolved, because the secret or key doesn't exist,
+// the secret can't be read or secret references are disabled, are left out with an event on the
+// identity, as their pods can't be assigned the identity. The other identities are still synced.
+func (c *Client) resolveIdentitySecretRefs(ids []aadpodid.AzureIdentity) []aadpodid.AzureIdentity {
+	resolved := make([]aadpodid.AzureIdentity, 0, len(ids))
+	// the secrets read in this sync, identities can reference the same secret
+	secrets := make(map[string]*corev1.Secret)
+	for _, id := range ids {
+		if id.Spec.ClientIDSecretRef == nil && id.Spec.ResourceIDSecretRef == nil {
+			resolved = append(resolved, id)
+			continue
+		}
+		clientID, err := c.getSecretRefValue(id.Namespace, id.Spec.ClientIDSecretRef, id.Spec.ClientID, secrets)
+		if err == nil {
+			id.Spec.ClientID = clientID
+			id.Spec.ResourceID, err = c.getSecretRefValue(id.Namespace, id.Spec.ResourceIDSecretRef, id.Spec.ResourceID, secrets)
+		}
+		if err != nil {
+			message := fmt.Sprintf("Resolving the secret references of identity %s/%s failed with error %v, skipping it", id.Namespace, id.Name, err)
+			c.EventRecorder.Event(&id, corev1.EventTypeWarning, "secret reference error", message)
+			klog.Error(message)
+			continue
+		}
+		klog.V(6).Infof("Resolved the secret references of identity %s/%s to client id %s and resource id %s", id.Namespace, id.Name, id.Spec.ClientID, id.Spec.ResourceID)
+		resolved = append(resolved, id)
+	}
+	return resolved
+}
+
+// getSecretRefValue returns the value of the key of the secret in the namespace, or the inline
+// value when the reference is nil
+func (c *Client) getSecretRefValue(namespace string, ref *corev1.SecretKeySelector, inline string, secrets map[string]*corev1.Secret) (string, error) {
+	if ref == nil {
+		return inline, nil
+	}
+	key := getIDKey(namespace, ref.Name)
+	secret, ok := secrets[key]
+	if !ok {
+		if c.SecretClient == nil {
+			return "", fmt.Errorf("secret references are disabled, MIC doesn't read secret %s without --enable-secret-refs", key)
+		}
+		var err error
+		secret, err = c.SecretClient.Get(namespace, ref.Name)
+		if apierrors.IsNotFound(err) {
+			return "", fmt.Errorf("secret %s not found", key)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to get secret %s: %v", key, err)
+		}
+		secrets[key] = secret
+	}
+	value := strings.TrimSpace(string(secret.Data[ref.Key]))
+	if value == "" {
+		return "", fmt.Errorf("key %s of secret %s not found or empty", ref.Key, key)
+	}
+	return value, nil
+}
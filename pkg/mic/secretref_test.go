@@ -0,0 +1,246 @@
+package mic
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	internalaadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity/v1"
+	"github.com/Azure/aad-pod-identity/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type TestSecretClient struct {
+	mu      sync.Mutex
+	secrets map[string]*corev1.Secret
+	err     error
+	gets    int
+}
+
+func NewTestSecretClient() *TestSecretClient {
+	return &TestSecretClient{secrets: make(map[string]*corev1.Secret)}
+}
+
+func (c *TestSecretClient) Get(namespace, name string) (*corev1.Secret, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gets++
+	if c.err != nil {
+		return nil, c.err
+	}
+	secret, ok := c.secrets[getIDKey(namespace, name)]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
+	}
+	return secret, nil
+}
+
+func (c *TestSecretClient) SetSecret(namespace, name string, data map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	secret := &corev1.Secret{ObjectMeta: v1.ObjectMeta{Name: name, Namespace: namespace}, Data: make(map[string][]byte)}
+	for k, v := range data {
+		secret.Data[k] = []byte(v)
+	}
+	c.secrets[getIDKey(namespace, name)] = secret
+}
+
+func secretKeyRef(name, key string) *corev1.SecretKeySelector {
+	return &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: name}, Key: key}
+}
+
+func TestResolveIdentitySecretRefs(t *testing.T) {
+	secretClient := NewTestSecretClient()
+	secretClient.SetSecret("default", "identity", map[string]string{"clientid": "secret-clientid", "resourceid": "secret-resourceid\n"})
+	evtRecorder := &TestEventRecorder{lastEvent: new(LastEvent), eventChannel: make(chan bool, 100)}
+	c := &Client{SecretClient: secretClient, EventRecorder: evtRecorder}
+
+	newID := func(name string, clientIDRef, resourceIDRef *corev1.SecretKeySelector) internalaadpodid.AzureIdentity {
+		return internalaadpodid.AzureIdentity{
+			ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: internalaadpodid.AzureIdentitySpec{
+				ClientID:            "inline-clientid",
+				ResourceID:          "inline-resourceid",
+				ClientIDSecretRef:   clientIDRef,
+				ResourceIDSecretRef: resourceIDRef,
+			},
+		}
+	}
+	ids := c.resolveIdentitySecretRefs([]internalaadpodid.AzureIdentity{
+		newID("inline", nil, nil),
+		newID("both", secretKeyRef("identity", "clientid"), secretKeyRef("identity", "resourceid")),
+		newID("resourceid", nil, secretKeyRef("identity", "resourceid")),
+		newID("missing-secret", secretKeyRef("missing", "clientid"), nil),
+		newID("missing-key", nil, secretKeyRef("identity", "missing")),
+	})
+
+	resolved := make(map[string]internalaadpodid.AzureIdentitySpec)
+	for _, id := range ids {
+		resolved[id.Name] = id.Spec
+	}
+	for name, expected := range map[string][2]string{
+		"inline":     {"inline-clientid", "inline-resourceid"},
+		"both":       {"secret-clientid", "secret-resourceid"},
+		"resourceid": {"inline-clientid", "secret-resourceid"},
+	} {
+		spec, ok := resolved[name]
+		if !ok {
+			t.Errorf("expected identity %s to be resolved", name)
+			continue
+		}
+		if spec.ClientID != expected[0] || spec.ResourceID != expected[1] {
+			t.Errorf("expected identity %s to have client id %s and resource id %s, got %s and %s", name, expected[0], expected[1], spec.ClientID, spec.ResourceID)
+		}
+	}
+	for _, name := range []string{"missing-secret", "missing-key"} {
+		if _, ok := resolved[name]; ok {
+			t.Errorf("expected identity %s with an unresolved secret reference to be skipped", name)
+		}
+	}
+	// the secret shared by the identities is read once, the missing secret once
+	if secretClient.gets != 2 {
+		t.Errorf("expected 2 secret reads, got %d", secretClient.gets)
+	}
+
+	// an event is recorded on each skipped identity
+	if len(evtRecorder.eventChannel) != 2 {
+		t.Errorf("expected 2 events, got %d", len(evtRecorder.eventChannel))
+	}
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	// the identities whose secret can't be read are skipped, the others are still resolved
+	secretClient.err = errors.New("forbidden")
+	ids = c.resolveIdentitySecretRefs([]internalaadpodid.AzureIdentity{
+		newID("inline", nil, nil),
+		newID("both", secretKeyRef("identity", "clientid"), nil),
+	})
+	if len(ids) != 1 || ids[0].Name != "inline" {
+		t.Errorf("expected only the inline identity when the secret can't be read, got %+v", ids)
+	}
+	if len(evtRecorder.eventChannel) != 1 || evtRecorder.lastEvent.Reason != "secret reference error" {
+		t.Errorf("expected a secret reference error event, got %d events, last %+v", len(evtRecorder.eventChannel), evtRecorder.lastEvent)
+	}
+
+	// secret references are disabled without a secret client
+	c.SecretClient = nil
+	ids = c.resolveIdentitySecretRefs([]internalaadpodid.AzureIdentity{
+		newID("inline", nil, nil),
+		newID("both", secretKeyRef("identity", "clientid"), nil),
+	})
+	if len(ids) != 1 || ids[0].Name != "inline" {
+		t.Errorf("expected only the inline identity when secret references are disabled, got %+v", ids)
+	}
+}
+
+func TestSyncResolvesIdentitySecretRefs(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	secretClient := NewTestSecretClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+	micClient.SecretClient = secretClient
+
+	secretClient.SetSecret("default", "test-id1", map[string]string{"resourceid": "test-user-msi-resourceid1"})
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, "", "test-user-msi-clientid1", nil, "", "", "", "")
+	crdClient.mu.Lock()
+	crdClient.idMap[getIDKey("default", "test-id1")].Spec.ResourceIDSecretRef = secretKeyRef("test-id1", "resourceid")
+	crdClient.mu.Unlock()
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+	eventCh <- internalaadpodid.PodCreated
+	defer micClient.testRunSync()(t)
+
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if !cloudClient.CompareMSI("test-node1", []string{"test-user-msi-resourceid1"}) {
+		cloudClient.PrintMSI()
+		t.Fatalf("expected the resource id of the secret to be assigned to the node")
+	}
+
+	// the resource id in the secret is changed
+	secretClient.SetSecret("default", "test-id1", map[string]string{"resourceid": "test-user-msi-resourceid2"})
+	eventCh <- internalaadpodid.IdentityUpdated
+
+	// the assigned identity with the previous resource id is deleted and a new one created
+	if !evtRecorder.WaitForEvents(2) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if !cloudClient.CompareMSI("test-node1", []string{"test-user-msi-resourceid2"}) {
+		cloudClient.PrintMSI()
+		t.Fatalf("expected the updated resource id of the secret to be assigned to the node")
+	}
+
+	// as for any update of an identity, the assigned identity created with the same name as the
+	// deleted one is created again by the next sync
+	eventCh <- internalaadpodid.IdentityUpdated
+	if !evtRecorder.WaitForEvents(1) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	assignedIDs, err := crdClient.ListAssignedIDs()
+	if err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+	if len(*assignedIDs) != 1 || (*assignedIDs)[0].Spec.AzureIdentityRef.Spec.ResourceID != "test-user-msi-resourceid2" {
+		t.Fatalf("expected an assigned identity with the updated resource id, got %+v", *assignedIDs)
+	}
+}
+
+func TestSyncSkipsIdentityWithUnreadableSecret(t *testing.T) {
+	eventCh := make(chan internalaadpodid.EventType, 100)
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	secretClient := NewTestSecretClient()
+	var evtRecorder TestEventRecorder
+	evtRecorder.lastEvent = new(LastEvent)
+	evtRecorder.eventChannel = make(chan bool, 100)
+
+	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
+	micClient.SecretClient = secretClient
+	secretClient.err = errors.New("forbidden")
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, "test-user-msi-resourceid1", "test-user-msi-clientid1", nil, "", "", "", "")
+	crdClient.CreateID("test-id2", "default", aadpodid.UserAssignedMSI, "", "test-user-msi-clientid2", nil, "", "", "", "")
+	crdClient.mu.Lock()
+	crdClient.idMap[getIDKey("default", "test-id2")].Spec.ResourceIDSecretRef = secretKeyRef("test-id2", "resourceid")
+	crdClient.mu.Unlock()
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	crdClient.CreateBinding("testbinding2", "default", "test-id2", "test-select1", "")
+	nodeClient.AddNode("test-node1")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+	eventCh <- internalaadpodid.PodCreated
+	defer micClient.testRunSync()(t)
+
+	// the secret reference error of test-id2 and the binding applied of test-id1
+	if !evtRecorder.WaitForEvents(2) {
+		t.Fatalf("Timeout waiting for mic sync cycles")
+	}
+	if !cloudClient.CompareMSI("test-node1", []string{"test-user-msi-resourceid1"}) {
+		cloudClient.PrintMSI()
+		t.Fatalf("expected the identity without secret reference to be assigned to the node")
+	}
+	assignedIDs, err := crdClient.ListAssignedIDs()
+	if err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+	if len(*assignedIDs) != 1 || (*assignedIDs)[0].Spec.AzureIdentityRef.Name != "test-id1" {
+		t.Fatalf("expected only test-id1 to be assigned, got %+v", *assignedIDs)
+	}
+}
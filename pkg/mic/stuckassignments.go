@@ -0,0 +1,104 @@
+package mic
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	"k8s.io/klog"
+)
+
+// stuckAssignmentTracker tracks the time assigned identities have been waiting for their identity
+// to be assigned to the node and the last error assigning it, to report the assigned identities
+// waiting for longer than the threshold.
+type stuckAssignmentTracker struct {
+	threshold time.Duration
+	reporter  *metrics.Reporter
+
+	mu sync.Mutex
+	// waitingSince is the time each waiting assigned identity was first seen waiting
+	waitingSince map[string]time.Time
+	// lastErrors is the last error assigning the identity of each waiting assigned identity
+	lastErrors map[string]string
+	lastWarned time.Time
+}
+
+// newStuckAssignmentTracker returns a tracker for the threshold, or nil when the threshold is not
+// positive which doesn't track the assigned identities
+func newStuckAssignmentTracker(threshold time.Duration, reporter *metrics.Reporter) *stuckAssignmentTracker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &stuckAssignmentTracker{
+		threshold:    threshold,
+		reporter:     reporter,
+		waitingSince: make(map[string]time.Time),
+		lastErrors:   make(map[string]string),
+	}
+}
+
+// recordError records the error assigning the identity of the assigned identity to its node
+func (t *stuckAssignmentTracker) recordError(assignedIDName string, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastErrors[assignedIDName] = err.Error()
+}
+
+// check returns the names of the assigned identities waiting to be assigned for longer than the
+// threshold, reports their count and periodically logs them with their last error
+func (t *stuckAssignmentTracker) check(currentAssignedIDs map[string]aadpodid.AzureAssignedIdentity, now time.Time) []string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	waiting := make(map[string]bool)
+	var stuck []string
+	for name, assignedID := range currentAssignedIDs {
+		if assignedID.Status.Status != "" && assignedID.Status.Status != aadpodid.AssignedIDCreated {
+			continue
+		}
+		waiting[name] = true
+		since, ok := t.waitingSince[name]
+		if !ok {
+			since = now
+			// the creation time accounts for the time waited before this mic instance became leader
+			if created := assignedID.CreationTimestamp.Time; !created.IsZero() && created.Before(now) {
+				since = created
+			}
+			t.waitingSince[name] = since
+		}
+		if now.Sub(since) > t.threshold {
+			stuck = append(stuck, name)
+		}
+	}
+	for name := range t.waitingSince {
+		if !waiting[name] {
+			delete(t.waitingSince, name)
+			delete(t.lastErrors, name)
+		}
+	}
+	sort.Strings(stuck)
+
+	if t.reporter != nil {
+		t.reporter.Report(metrics.MICStuckAssignmentsM.M(int64(len(stuck))))
+	}
+	if len(stuck) > 0 && now.Sub(t.lastWarned) >= t.threshold {
+		t.lastWarned = now
+		for _, name := range stuck {
+			lastErr := t.lastErrors[name]
+			if lastErr == "" {
+				lastErr = "none"
+			}
+			klog.Warningf("Assigned identity %s has been waiting to be assigned for %s, last error: %s", name, now.Sub(t.waitingSince[name]).Round(time.Second), lastErr)
+		}
+	}
+	return stuck
+}
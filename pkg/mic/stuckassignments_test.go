@@ -0,0 +1,75 @@
+package mic
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newStuckTestAssignedID(name, status string, created time.Time) aadpodid.AzureAssignedIdentity {
+	return aadpodid.AzureAssignedIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: metav1.NewTime(created)},
+		Status:     aadpodid.AzureAssignedIdentityStatus{Status: status},
+	}
+}
+
+func TestStuckAssignmentTracker(t *testing.T) {
+	reporter, _ := metrics.NewReporter()
+	tracker := newStuckAssignmentTracker(10*time.Minute, reporter)
+
+	now := time.Now()
+	assignedIDs := map[string]aadpodid.AzureAssignedIdentity{
+		"created-stuck":  newStuckTestAssignedID("created-stuck", aadpodid.AssignedIDCreated, now.Add(-time.Hour)),
+		"created-recent": newStuckTestAssignedID("created-recent", aadpodid.AssignedIDCreated, now.Add(-time.Minute)),
+		"assigned":       newStuckTestAssignedID("assigned", aadpodid.AssignedIDAssigned, now.Add(-time.Hour)),
+		// no creation time, waiting since it was first seen
+		"pending": newStuckTestAssignedID("pending", "", time.Time{}),
+	}
+	tracker.recordError("created-stuck", errors.New("vm update failed"))
+
+	stuck := tracker.check(assignedIDs, now)
+	if !reflect.DeepEqual(stuck, []string{"created-stuck"}) {
+		t.Fatalf("expected only created-stuck to be stuck, got: %v", stuck)
+	}
+	if tracker.lastErrors["created-stuck"] != "vm update failed" {
+		t.Errorf("expected last error to be recorded, got: %q", tracker.lastErrors["created-stuck"])
+	}
+
+	stuck = tracker.check(assignedIDs, now.Add(15*time.Minute))
+	if !reflect.DeepEqual(stuck, []string{"created-recent", "created-stuck", "pending"}) {
+		t.Fatalf("expected waiting assigned identities to be stuck after the threshold, got: %v", stuck)
+	}
+
+	// assigned identities no longer waiting are forgotten
+	assignedIDs["created-stuck"] = newStuckTestAssignedID("created-stuck", aadpodid.AssignedIDAssigned, now.Add(-time.Hour))
+	delete(assignedIDs, "pending")
+	stuck = tracker.check(assignedIDs, now.Add(15*time.Minute))
+	if !reflect.DeepEqual(stuck, []string{"created-recent"}) {
+		t.Fatalf("expected only created-recent to be stuck, got: %v", stuck)
+	}
+	if _, ok := tracker.waitingSince["created-stuck"]; ok {
+		t.Errorf("expected created-stuck to be forgotten once assigned")
+	}
+	if _, ok := tracker.lastErrors["created-stuck"]; ok {
+		t.Errorf("expected last error of created-stuck to be forgotten once assigned")
+	}
+}
+
+func TestStuckAssignmentTrackerDisabled(t *testing.T) {
+	tracker := newStuckAssignmentTracker(0, nil)
+	if tracker != nil {
+		t.Fatalf("expected no tracker for a threshold of 0")
+	}
+	tracker.recordError("id", errors.New("vm update failed"))
+	assignedIDs := map[string]aadpodid.AzureAssignedIdentity{
+		"id": newStuckTestAssignedID("id", aadpodid.AssignedIDCreated, time.Now().Add(-time.Hour)),
+	}
+	if stuck := tracker.check(assignedIDs, time.Now()); len(stuck) != 0 {
+		t.Errorf("expected no stuck assigned identities, got: %v", stuck)
+	}
+}
@@ -0,0 +1,50 @@
+package mic
+
+import (
+	"k8s.io/klog"
+)
+
+func systemAssignedKey(nodeOrVMSSName string, isvmss bool) string {
+	if isvmss {
+		return "vmss/" + nodeOrVMSSName
+	}
+	return "vm/" + nodeOrVMSSName
+}
+
+// updateSystemAssignedOnNode enables the system assigned identity of the VM or VMSS when an
+// identity to assign requires it, and disables it when it's no longer required and MIC enabled it.
+// MIC tags the VM or VMSS with cloudprovider.SystemAssignedTag when it enables the identity, so the
+// identities it enabled before a restart or a failover are disabled too. Azure Arc machines always
+// have a system assigned identity and are left unchanged.
+func (c *Client) updateSystemAssignedOnNode(nodeOrVMSSName string, nodeTrackList trackUserAssignedMSIIds) error {
+	if !c.allowEnableSystemAssigned || nodeTrackList.hybridMachine != nil {
+		return nil
+	}
+	isvmss := nodeTrackList.isvmss
+
+	switch {
+	case nodeTrackList.enableSystemAssigned:
+		return c.armOps.do(func() error {
+			changed, err := c.CloudClient.UpdateSystemAssignedIdentity(true, nodeOrVMSSName, isvmss)
+			if err != nil {
+				return err
+			}
+			if changed {
+				klog.Infof("Enabled system assigned identity on %s", nodeOrVMSSName)
+			}
+			return nil
+		})
+	case nodeTrackList.disableSystemAssigned:
+		return c.armOps.do(func() error {
+			changed, err := c.CloudClient.UpdateSystemAssignedIdentity(false, nodeOrVMSSName, isvmss)
+			if err != nil {
+				return err
+			}
+			if changed {
+				klog.Infof("Disabled system assigned identity on %s, it is no longer in use", nodeOrVMSSName)
+			}
+			return nil
+		})
+	}
+	return nil
+}
@@ -56,7 +56,7 @@ func (mc *ManagedClient) GetIdentities(ctx context.Context, podns, podname, clie
 }
 
 // GetToken ...
-func (mc *ManagedClient) GetToken(ctx context.Context, rqClientID, rqResource string, azureID aadpodid.AzureIdentity) (token *adal.Token, err error) {
+func (mc *ManagedClient) GetToken(ctx context.Context, rqClientID, rqResource, rqClaims string, azureID aadpodid.AzureIdentity) (token *adal.Token, err error) {
 	rqHasClientID := len(rqClientID) != 0
 	clientID := azureID.Spec.ClientID
 
@@ -67,6 +67,9 @@ func (mc *ManagedClient) GetToken(ctx context.Context, rqClientID, rqResource st
 			klog.Warningf("clientid mismatch, requested:%s available:%s", rqClientID, clientID)
 		}
 		klog.Infof("matched identityType:%v clientid:%s resource:%s", idType, utils.RedactClientID(clientID), rqResource)
+		if rqClaims != "" {
+			klog.Warningf("claims challenge can't be forwarded by the instance metadata service, acquiring token for clientid:%s without it", utils.RedactClientID(clientID))
+		}
 		token, err := auth.GetServicePrincipalTokenFromMSIWithUserAssignedID(clientID, rqResource)
 		return token, err
 	case aadpodid.ServicePrincipal:
@@ -81,7 +84,14 @@ func (mc *ManagedClient) GetToken(ctx context.Context, rqClientID, rqResource st
 			clientSecret = string(v)
 			break
 		}
-		token, err := auth.GetServicePrincipalToken(tenantid, clientID, clientSecret, rqResource)
+		token, err := auth.GetServicePrincipalToken(tenantid, clientID, clientSecret, rqResource, rqClaims)
+		return token, err
+	case aadpodid.SystemAssignedMSI:
+		klog.Infof("matched identityType:%v resource:%s", idType, rqResource)
+		if rqClaims != "" {
+			klog.Warningf("claims challenge can't be forwarded by the instance metadata service, acquiring token for the system assigned identity without it")
+		}
+		token, err := auth.GetServicePrincipalTokenFromMSI(rqResource)
 		return token, err
 	default:
 		return nil, fmt.Errorf("unsupported identity type %+v", idType)
@@ -42,8 +42,9 @@ type TokenClient interface {
 	// GetIdentities gets the list of identities which match the
 	// given pod in the form of AzureIdentity.
 	GetIdentities(ctx context.Context, podns, podname, clientID string) (*aadpodid.AzureIdentity, error)
-	// GetToken acquires a token by using the AzureIdentity.
-	GetToken(ctx context.Context, clientID, resource string, podID aadpodid.AzureIdentity) (token *adal.Token, err error)
+	// GetToken acquires a token by using the AzureIdentity. A non-empty claims challenge is
+	// forwarded to AAD when acquiring the token.
+	GetToken(ctx context.Context, clientID, resource, claims string, podID aadpodid.AzureIdentity) (token *adal.Token, err error)
 }
 
 // GetTokenClient returns a token client
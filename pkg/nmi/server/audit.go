@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"k8s.io/klog"
+)
+
+const (
+	// AuditLogStdout is the audit log output writing the audit records to stdout, apart from the
+	// operational logs written to stderr
+	AuditLogStdout = "stdout"
+
+	auditGranted = "granted"
+	auditDenied  = "denied"
+)
+
+// auditRecord is the audit record of a token grant or denial, written as one line of JSON
+type auditRecord struct {
+	Time         string `json:"time"`
+	Decision     string `json:"decision"`
+	PodName      string `json:"podName,omitempty"`
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodIP        string `json:"podIP,omitempty"`
+	// ClientID is the client id of the identity granted, or requested when denied
+	ClientID string `json:"clientID,omitempty"`
+	// Identity is the namespace/name of the AzureIdentity granted, empty for the tokens of excepted pods
+	Identity   string `json:"identity,omitempty"`
+	Resource   string `json:"resource"`
+	Path       string `json:"path"`
+	ExpiresOn  string `json:"expiresOn,omitempty"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// OpenAuditLog returns the writer of the audit log output, stdout for AuditLogStdout or else the
+// file at the path, appended to
+func OpenAuditLog(output string) (io.Writer, error) {
+	if output == AuditLogStdout {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+}
+
+// auditGrant writes the audit record of the token granted to the pod. podID is the identity of the
+// token, nil for the tokens of excepted pods.
+func (s *Server) auditGrant(rec auditRecord, podID *aadpodid.AzureIdentity, token *adal.Token) {
+	rec.Decision = auditGranted
+	setAuditIdentity(&rec, podID)
+	if token != nil && token.ExpiresOn != "" {
+		rec.ExpiresOn = token.Expires().UTC().Format(time.RFC3339)
+	}
+	s.writeAuditRecord(rec)
+}
+
+// auditDenial writes the audit record of the token request of the pod denied with the error.
+// podID is the identity found for the request, nil when none was found.
+func (s *Server) auditDenial(rec auditRecord, podID *aadpodid.AzureIdentity, statusCode int, err error) {
+	rec.Decision = auditDenied
+	setAuditIdentity(&rec, podID)
+	rec.StatusCode = statusCode
+	rec.Reason = err.Error()
+	s.writeAuditRecord(rec)
+}
+
+func setAuditIdentity(rec *auditRecord, podID *aadpodid.AzureIdentity) {
+	if podID == nil {
+		return
+	}
+	rec.ClientID = podID.Spec.ClientID
+	rec.Identity = podID.Namespace + "/" + podID.Name
+}
+
+// writeAuditRecord writes the record to the audit log, nothing is written when AuditLog isn't set
+func (s *Server) writeAuditRecord(rec auditRecord) {
+	if s.AuditLog == nil {
+		return
+	}
+	rec.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	b, err := json.Marshal(rec)
+	if err != nil {
+		klog.Errorf("failed to marshal audit record, err: %+v", err)
+		return
+	}
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	if _, err := s.AuditLog.Write(append(b, '\n')); err != nil {
+		klog.Errorf("failed to write audit record, err: %+v", err)
+	}
+}
@@ -0,0 +1,402 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/auth"
+	"github.com/Azure/aad-pod-identity/pkg/k8s"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeAuditKubeClient fails to list the pod identity exceptions with exceptionsErr and reports the
+// pod as owned by the replica set rsName
+type fakeAuditKubeClient struct {
+	fakeKubeClient
+	rsName        string
+	exceptionsErr error
+}
+
+func (c *fakeAuditKubeClient) GetPodInfo(podip string) (string, string, string, *metav1.LabelSelector, error) {
+	return "default", "pod1", c.rsName, &metav1.LabelSelector{}, nil
+}
+
+func (c *fakeAuditKubeClient) ListPodIdentityExceptions(ns string) (*[]aadpodid.AzurePodIdentityException, error) {
+	if c.exceptionsErr != nil {
+		return nil, c.exceptionsErr
+	}
+	return &[]aadpodid.AzurePodIdentityException{}, nil
+}
+
+// roundTripperFunc answers the requests of a client with the function
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// fakeIMDSClient answers the token requests of the excepted pods in place of IMDS
+var fakeIMDSClient = &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+	expiresOn := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	body := `{"access_token":"token","expires_in":"3600","expires_on":"` + expiresOn + `","not_before":"` + expiresOn + `","resource":"` + warmupResource + `","token_type":"Bearer"}`
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    r,
+	}, nil
+})}
+
+func failingMarshal(v interface{}) ([]byte, error) {
+	return nil, errors.New("marshal failed")
+}
+
+func TestMsiHandlerAuditLog(t *testing.T) {
+	cases := []struct {
+		name             string
+		kubeClient       k8s.Client
+		metadataRequired bool
+		remoteAddr       string
+		noResource       bool
+		identityErr      error
+		tokenErr         error
+		marshalFails     bool
+		expectedAudit    auditRecord
+	}{
+		{
+			name: "token granted",
+			expectedAudit: auditRecord{
+				Decision:     auditGranted,
+				PodName:      "pod1",
+				PodNamespace: "default",
+				PodIP:        "10.0.0.1",
+				ClientID:     "clientid1",
+				Identity:     "default/id1",
+				Resource:     warmupResource,
+				Path:         tokenPath,
+			},
+		},
+		{
+			name:             "metadata header missing",
+			metadataRequired: true,
+			expectedAudit: auditRecord{
+				Decision:   auditDenied,
+				PodIP:      "10.0.0.1",
+				Resource:   warmupResource,
+				Path:       tokenPath,
+				StatusCode: http.StatusBadRequest,
+				Reason:     "required metadata header not specified",
+			},
+		},
+		{
+			name:       "remote address empty",
+			remoteAddr: "invalid",
+			expectedAudit: auditRecord{
+				Decision:   auditDenied,
+				Resource:   warmupResource,
+				Path:       tokenPath,
+				StatusCode: http.StatusInternalServerError,
+				Reason:     "request remote address is empty",
+			},
+		},
+		{
+			name:       "resource empty",
+			noResource: true,
+			expectedAudit: auditRecord{
+				Decision:   auditDenied,
+				PodIP:      "10.0.0.1",
+				Path:       tokenPath,
+				StatusCode: http.StatusBadRequest,
+				Reason:     "parameter resource cannot be empty",
+			},
+		},
+		{
+			name:       "listing the pod identity exceptions failed",
+			kubeClient: &fakeAuditKubeClient{rsName: "rs1", exceptionsErr: errors.New("list failed")},
+			expectedAudit: auditRecord{
+				Decision:     auditDenied,
+				PodName:      "pod1",
+				PodNamespace: "default",
+				PodIP:        "10.0.0.1",
+				Resource:     warmupResource,
+				Path:         tokenPath,
+				StatusCode:   http.StatusInternalServerError,
+				Reason:       "list failed",
+			},
+		},
+		{
+			name:        "no identity found",
+			identityErr: errors.New("no azure assigned identity found for pod:default/pod1"),
+			expectedAudit: auditRecord{
+				Decision:     auditDenied,
+				PodName:      "pod1",
+				PodNamespace: "default",
+				PodIP:        "10.0.0.1",
+				Resource:     warmupResource,
+				Path:         tokenPath,
+				StatusCode:   http.StatusNotFound,
+				Reason:       "no azure assigned identity found for pod:default/pod1",
+			},
+		},
+		{
+			name:     "token request failed",
+			tokenErr: fakeTokenRefreshError{resp: &http.Response{StatusCode: http.StatusBadRequest}},
+			expectedAudit: auditRecord{
+				Decision:     auditDenied,
+				PodName:      "pod1",
+				PodNamespace: "default",
+				PodIP:        "10.0.0.1",
+				ClientID:     "clientid1",
+				Identity:     "default/id1",
+				Resource:     warmupResource,
+				Path:         tokenPath,
+				StatusCode:   http.StatusForbidden,
+				Reason:       "token refresh failed",
+			},
+		},
+		{
+			name:         "marshaling the token failed",
+			marshalFails: true,
+			expectedAudit: auditRecord{
+				Decision:     auditDenied,
+				PodName:      "pod1",
+				PodNamespace: "default",
+				PodIP:        "10.0.0.1",
+				ClientID:     "clientid1",
+				Identity:     "default/id1",
+				Resource:     warmupResource,
+				Path:         tokenPath,
+				StatusCode:   http.StatusInternalServerError,
+				Reason:       "marshal failed",
+			},
+		},
+		{
+			name:       "excepted pod token granted",
+			kubeClient: &fakeAuditKubeClient{rsName: "mic-12345"},
+			expectedAudit: auditRecord{
+				Decision:     auditGranted,
+				PodName:      "pod1",
+				PodNamespace: "default",
+				PodIP:        "10.0.0.1",
+				Resource:     warmupResource,
+				Path:         tokenPath,
+			},
+		},
+		{
+			name:         "marshaling the token of an excepted pod failed",
+			kubeClient:   &fakeAuditKubeClient{rsName: "mic-12345"},
+			marshalFails: true,
+			expectedAudit: auditRecord{
+				Decision:     auditDenied,
+				PodName:      "pod1",
+				PodNamespace: "default",
+				PodIP:        "10.0.0.1",
+				Resource:     warmupResource,
+				Path:         tokenPath,
+				StatusCode:   http.StatusInternalServerError,
+				Reason:       "marshal failed",
+			},
+		},
+	}
+
+	reporter, err := metrics.NewReporter()
+	if err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	auth.InitReporter(reporter)
+	auth.InitUpstreamClient(fakeIMDSClient)
+	defer auth.InitUpstreamClient(nil)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var auditLog bytes.Buffer
+			tokenClient := &fakeTokenClient{podID: newTestIdentity("id1", "clientid1"), identityErr: tc.identityErr, tokenErr: tc.tokenErr}
+			s := &Server{
+				KubeClient:             tc.kubeClient,
+				TokenClient:            tokenClient,
+				AuditLog:               &auditLog,
+				MetadataHeaderRequired: tc.metadataRequired,
+				MICNamespace:           "default",
+			}
+			if s.KubeClient == nil {
+				s.KubeClient = &fakeKubeClient{}
+			}
+			if tc.marshalFails {
+				marshalResponse = failingMarshal
+				defer func() { marshalResponse = json.Marshal }()
+			}
+
+			target := tokenPath + "?resource=" + warmupResource
+			if tc.noResource {
+				target = tokenPath
+			}
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			req.RemoteAddr = "10.0.0.1:12345"
+			if tc.remoteAddr != "" {
+				req.RemoteAddr = tc.remoteAddr
+			}
+			s.msiHandler(httptest.NewRecorder(), req)
+
+			assertAuditRecord(t, auditLog.String(), tc.expectedAudit)
+		})
+	}
+}
+
+func TestHostHandlerAuditLog(t *testing.T) {
+	cases := []struct {
+		name          string
+		remoteAddr    string
+		noPodInfo     bool
+		noResource    bool
+		marshalFails  bool
+		expectedAudit auditRecord
+	}{
+		{
+			name: "token granted",
+			expectedAudit: auditRecord{
+				Decision:     auditGranted,
+				PodName:      "pod1",
+				PodNamespace: "default",
+				ClientID:     "clientid1",
+				Identity:     "default/id1",
+				Resource:     warmupResource,
+				Path:         "/host/token/",
+			},
+		},
+		{
+			name:      "pod info missing",
+			noPodInfo: true,
+			expectedAudit: auditRecord{
+				Decision:   auditDenied,
+				Resource:   warmupResource,
+				Path:       "/host/token/",
+				StatusCode: http.StatusBadRequest,
+				Reason:     "missing 'podname' and 'podns' from request header",
+			},
+		},
+		{
+			name:       "not from host",
+			remoteAddr: "10.0.0.1:12345",
+			expectedAudit: auditRecord{
+				Decision:     auditDenied,
+				PodName:      "pod1",
+				PodNamespace: "default",
+				Resource:     warmupResource,
+				Path:         "/host/token/",
+				StatusCode:   http.StatusForbidden,
+				Reason:       "request remote address is not from a host",
+			},
+		},
+		{
+			name:       "resource empty",
+			noResource: true,
+			expectedAudit: auditRecord{
+				Decision:     auditDenied,
+				PodName:      "pod1",
+				PodNamespace: "default",
+				Path:         "/host/token/",
+				StatusCode:   http.StatusBadRequest,
+				Reason:       "parameter resource cannot be empty",
+			},
+		},
+		{
+			name:         "marshaling the token failed",
+			marshalFails: true,
+			expectedAudit: auditRecord{
+				Decision:     auditDenied,
+				PodName:      "pod1",
+				PodNamespace: "default",
+				ClientID:     "clientid1",
+				Identity:     "default/id1",
+				Resource:     warmupResource,
+				Path:         "/host/token/",
+				StatusCode:   http.StatusInternalServerError,
+				Reason:       "marshal failed",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var auditLog bytes.Buffer
+			s := &Server{TokenClient: &fakeTokenClient{podID: newTestIdentity("id1", "clientid1")}, AuditLog: &auditLog}
+			if tc.marshalFails {
+				marshalResponse = failingMarshal
+				defer func() { marshalResponse = json.Marshal }()
+			}
+
+			target := "/host/token/?resource=" + warmupResource
+			if tc.noResource {
+				target = "/host/token/"
+			}
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			req.RemoteAddr = "127.0.0.1:12345"
+			if tc.remoteAddr != "" {
+				req.RemoteAddr = tc.remoteAddr
+			}
+			if !tc.noPodInfo {
+				req.Header.Set("podns", "default")
+				req.Header.Set("podname", "pod1")
+			}
+			s.hostHandler(httptest.NewRecorder(), req)
+
+			assertAuditRecord(t, auditLog.String(), tc.expectedAudit)
+		})
+	}
+}
+
+// assertAuditRecord asserts the audit log holds the single expected record
+func assertAuditRecord(t *testing.T, auditLog string, expected auditRecord) {
+	t.Helper()
+
+	lines := strings.Split(strings.TrimSuffix(auditLog, "\n"), "\n")
+	if len(lines) != 1 || lines[0] == "" {
+		t.Fatalf("expected 1 audit record, got %d: %s", len(lines), auditLog)
+	}
+	var rec auditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatalf("failed to unmarshal audit record %s, %+v", lines[0], err)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, rec.Time); err != nil {
+		t.Errorf("expected the time of the audit record to be RFC 3339, got %s", rec.Time)
+	}
+	rec.Time = ""
+	rec.ExpiresOn = ""
+	if rec != expected {
+		t.Errorf("expected audit record %+v, got %+v", expected, rec)
+	}
+}
+
+func TestAuditGrantExpiresOn(t *testing.T) {
+	var auditLog bytes.Buffer
+	s := &Server{AuditLog: &auditLog}
+	token := newTestToken("token", time.Hour)
+	s.auditGrant(auditRecord{Resource: warmupResource}, newTestIdentity("id1", "clientid1"), &token)
+
+	var rec auditRecord
+	if err := json.Unmarshal(auditLog.Bytes(), &rec); err != nil {
+		t.Fatalf("failed to unmarshal audit record %s, %+v", auditLog.String(), err)
+	}
+	if expected := token.Expires().UTC().Format(time.RFC3339); rec.ExpiresOn != expected {
+		t.Errorf("expected expiresOn %s, got %s", expected, rec.ExpiresOn)
+	}
+	if strings.Contains(auditLog.String(), "token\"") {
+		t.Errorf("expected the access token not to be audited, got %s", auditLog.String())
+	}
+}
+
+func TestAuditLogDisabled(t *testing.T) {
+	s := &Server{}
+	// nothing is written and nothing panics without an audit log
+	s.auditDenial(auditRecord{Resource: warmupResource}, nil, http.StatusNotFound, errors.New("denied"))
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+func TestMsiHandlerForwardsClaims(t *testing.T) {
+	claims := `{"access_token":{"nbf":{"essential":true,"value":"1586132170"}}}`
+	cases := []struct {
+		name           string
+		query          string
+		expectedClaims string
+		expectedToken  string
+	}{
+		{
+			name:           "claims challenge acquires a new token",
+			query:          "?resource=" + warmupResource + "&claims=" + url.QueryEscape(claims),
+			expectedClaims: claims,
+			expectedToken:  "token",
+		},
+		{
+			name:           "no claims challenge serves the warmed up token",
+			query:          "?resource=" + warmupResource,
+			expectedClaims: "",
+			expectedToken:  "warmed-token",
+		},
+	}
+
+	for _, tc := range cases {
+		id := newTestIdentity("id1", "clientid1")
+		tokenClient := &fakeTokenClient{podID: id, claims: "unset"}
+		s := &Server{
+			KubeClient:  &fakeKubeClient{},
+			TokenClient: tokenClient,
+		}
+		s.tokens.set(*id, warmupResource, adal.Token{
+			AccessToken: "warmed-token",
+			ExpiresOn:   json.Number(strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)),
+			Resource:    warmupResource,
+		})
+
+		req := httptest.NewRequest(http.MethodGet, tokenPath+tc.query, nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		recorder := httptest.NewRecorder()
+		s.msiHandler(recorder, req)
+
+		var resp msiResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: failed to unmarshal token response, %+v", tc.name, err)
+		}
+		if resp.AccessToken != tc.expectedToken {
+			t.Errorf("%s: expected token %s, got: %s", tc.name, tc.expectedToken, resp.AccessToken)
+		}
+		if tc.expectedClaims != "" && tokenClient.claims != tc.expectedClaims {
+			t.Errorf("%s: expected claims %s to be forwarded, got: %s", tc.name, tc.expectedClaims, tokenClient.claims)
+		}
+		if tc.expectedClaims == "" && tokenClient.claims != "unset" {
+			t.Errorf("%s: expected no token request, got one with claims %q", tc.name, tokenClient.claims)
+		}
+	}
+}
+
+func TestHostHandlerForwardsClaims(t *testing.T) {
+	tokenClient := &fakeTokenClient{podID: newTestIdentity("id1", "clientid1")}
+	s := &Server{
+		KubeClient:  &fakeKubeClient{},
+		TokenClient: tokenClient,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/host/token/?resource="+warmupResource+"&claims=challenge", nil)
+	req.RemoteAddr = localhost + ":12345"
+	req.Header.Set("podns", "default")
+	req.Header.Set("podname", "pod1")
+	recorder := httptest.NewRecorder()
+	s.hostHandler(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got: %d", http.StatusOK, recorder.Code)
+	}
+	if tokenClient.claims != "challenge" {
+		t.Errorf("expected claims challenge to be forwarded, got: %q", tokenClient.claims)
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"k8s.io/klog"
+)
+
+// servedIdentity is an identity NMI has served a token for to a pod
+type servedIdentity struct {
+	PodIP             string    `json:"podIP"`
+	PodNamespace      string    `json:"podNamespace"`
+	PodName           string    `json:"podName"`
+	IdentityNamespace string    `json:"identityNamespace"`
+	IdentityName      string    `json:"identityName"`
+	IdentityType      string    `json:"identityType"`
+	ClientID          string    `json:"clientID"`
+	Resource          string    `json:"resource"`
+	LastRefresh       time.Time `json:"lastRefresh"`
+}
+
+// servedIdentitiesPruneInterval is the interval at which the identities served to pod ips no longer
+// held by the pod they were served to are removed
+const servedIdentitiesPruneInterval = time.Minute
+
+// servedIdentities tracks the identities served per pod ip. The zero value is ready to use.
+type servedIdentities struct {
+	mu sync.RWMutex
+	// identities is keyed by the pod ip and then by the client id of the identity
+	identities map[string]map[string]servedIdentity
+}
+
+func (si *servedIdentities) record(podIP, podns, podname, resource string, id *aadpodid.AzureIdentity) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	if si.identities == nil {
+		si.identities = make(map[string]map[string]servedIdentity)
+	}
+	if !si.servedTo(podIP, podns, podname) {
+		// the ip was reused by another pod, which doesn't inherit the identities of the previous pod
+		si.identities[podIP] = make(map[string]servedIdentity)
+	}
+	idType := "UserAssignedMSI"
+	switch id.Spec.Type {
+	case aadpodid.ServicePrincipal:
+		idType = "ServicePrincipal"
+	case aadpodid.SystemAssignedMSI:
+		idType = "SystemAssignedMSI"
+	}
+	si.identities[podIP][id.Spec.ClientID] = servedIdentity{
+		PodIP:             podIP,
+		PodNamespace:      podns,
+		PodName:           podname,
+		IdentityNamespace: id.Namespace,
+		IdentityName:      id.Name,
+		IdentityType:      idType,
+		ClientID:          id.Spec.ClientID,
+		Resource:          resource,
+		LastRefresh:       time.Now(),
+	}
+}
+
+// servedTo returns true if identities were served to the ip and they were served to the pod with
+// the namespace and name. The caller must hold the lock.
+func (si *servedIdentities) servedTo(podIP, podns, podname string) bool {
+	byClientID, ok := si.identities[podIP]
+	if !ok {
+		return false
+	}
+	for _, id := range byClientID {
+		return id.PodNamespace == podns && id.PodName == podname
+	}
+	return true
+}
+
+// prune removes the identities served to the pod ips for which podExists returns false, given the
+// ip and the namespace and name of the pod they were served to, and returns the number of ips removed
+func (si *servedIdentities) prune(podExists func(podIP, podns, podname string) bool) int {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	pruned := 0
+	for podIP, byClientID := range si.identities {
+		for _, id := range byClientID {
+			if !podExists(podIP, id.PodNamespace, id.PodName) {
+				delete(si.identities, podIP)
+				pruned++
+			}
+			break
+		}
+	}
+	return pruned
+}
+
+// list returns the served identities sorted by pod ip and client id
+func (si *servedIdentities) list() []servedIdentity {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+
+	ids := []servedIdentity{}
+	for _, byClientID := range si.identities {
+		for _, id := range byClientID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].PodIP != ids[j].PodIP {
+			return ids[i].PodIP < ids[j].PodIP
+		}
+		return ids[i].ClientID < ids[j].ClientID
+	})
+	return ids
+}
+
+// podHoldsIP returns true if the pod with the namespace and name exists and has the ip
+func (s *Server) podHoldsIP(podIP, podns, podname string) bool {
+	pod, err := s.KubeClient.GetPod(podns, podname)
+	return err == nil && pod.Status.PodIP == podIP
+}
+
+// runServedIdentitiesPruner periodically removes the identities served to the pods that no longer
+// exist or no longer have the ip the identities were served to
+func (s *Server) runServedIdentitiesPruner() {
+	ticker := time.NewTicker(servedIdentitiesPruneInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if pruned := s.servedIdentities.prune(s.podHoldsIP); pruned > 0 {
+			klog.V(5).Infof("Removed the served identities of %d pod ips no longer held by their pod", pruned)
+		}
+	}
+}
+
+// debugListenAddr returns the address the debug server listens on. Addresses without
+// a host are bound to localhost so the debug endpoints are not exposed off the node by default.
+func debugListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// address is just the port
+		return net.JoinHostPort(localhost, addr)
+	}
+	if host == "" {
+		host = localhost
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// runDebugServer serves the debug endpoints on the debug address
+func (s *Server) runDebugServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/identities", s.debugIdentitiesHandler)
+	mux.HandleFunc("/debug/config", s.debugConfigHandler)
+
+	addr := debugListenAddr(s.DebugAddr)
+	klog.Infof("Serving debug endpoints on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Errorf("Error serving debug endpoints: %+v", err)
+	}
+}
+
+func (s *Server) debugIdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	writeDebugResponse(w, s.servedIdentities.list())
+}
+
+func (s *Server) debugConfigHandler(w http.ResponseWriter, r *http.Request) {
+	config := s.DebugConfig
+	if config == nil {
+		config = map[string]string{}
+	}
+	writeDebugResponse(w, config)
+}
+
+func writeDebugResponse(w http.ResponseWriter, v interface{}) {
+	response, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		klog.Errorf("failed to marshal debug response, %+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakePodsKubeClient is a kube client with the pods keyed by namespace/name
+type fakePodsKubeClient struct {
+	fakeKubeClient
+	pods map[string]v1.Pod
+}
+
+func (c *fakePodsKubeClient) GetPod(namespace, name string) (v1.Pod, error) {
+	pod, ok := c.pods[namespace+"/"+name]
+	if !ok {
+		return v1.Pod{}, fmt.Errorf("pod with key %s/%s doesn't exist", namespace, name)
+	}
+	return pod, nil
+}
+
+func TestDebugListenAddr(t *testing.T) {
+	for _, c := range []struct {
+		addr     string
+		expected string
+	}{
+		{"6061", "127.0.0.1:6061"},
+		{":6061", "127.0.0.1:6061"},
+		{"localhost:6061", "localhost:6061"},
+		{"0.0.0.0:6061", "0.0.0.0:6061"},
+	} {
+		if got := debugListenAddr(c.addr); got != c.expected {
+			t.Errorf("debugListenAddr(%q) expected %q, got: %q", c.addr, c.expected, got)
+		}
+	}
+}
+
+func TestDebugIdentitiesHandler(t *testing.T) {
+	s := &Server{}
+	msi := &aadpodid.AzureIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: "msi", Namespace: "default"},
+		Spec:       aadpodid.AzureIdentitySpec{Type: aadpodid.UserAssignedMSI, ClientID: "clientid-msi"},
+	}
+	sp := &aadpodid.AzureIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: "sp", Namespace: "default"},
+		Spec:       aadpodid.AzureIdentitySpec{Type: aadpodid.ServicePrincipal, ClientID: "clientid-sp"},
+	}
+	s.servedIdentities.record("10.0.0.2", "default", "pod2", "https://management.azure.com/", sp)
+	s.servedIdentities.record("10.0.0.1", "default", "pod1", "https://management.azure.com/", msi)
+	s.servedIdentities.record("10.0.0.2", "default", "pod2", "https://vault.azure.net", msi)
+	// a token refresh for the same identity replaces the previous record
+	s.servedIdentities.record("10.0.0.2", "default", "pod2", "https://management.azure.com/", sp)
+
+	recorder := httptest.NewRecorder()
+	s.debugIdentitiesHandler(recorder, httptest.NewRequest(http.MethodGet, "/debug/identities", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", recorder.Code)
+	}
+
+	var ids []servedIdentity
+	if err := json.Unmarshal(recorder.Body.Bytes(), &ids); err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct{ podIP, clientID, idType string }{
+		{"10.0.0.1", "clientid-msi", "UserAssignedMSI"},
+		{"10.0.0.2", "clientid-msi", "UserAssignedMSI"},
+		{"10.0.0.2", "clientid-sp", "ServicePrincipal"},
+	}
+	if len(ids) != len(expected) {
+		t.Fatalf("expected %d identities, got: %+v", len(expected), ids)
+	}
+	for i, e := range expected {
+		if ids[i].PodIP != e.podIP || ids[i].ClientID != e.clientID || ids[i].IdentityType != e.idType {
+			t.Errorf("expected identity %d to be %+v, got: %+v", i, e, ids[i])
+		}
+		if ids[i].LastRefresh.IsZero() {
+			t.Errorf("expected last refresh of identity %d to be set", i)
+		}
+	}
+}
+
+func TestDebugConfigHandler(t *testing.T) {
+	s := &Server{DebugConfig: map[string]string{"nmi-port": "2579"}}
+
+	recorder := httptest.NewRecorder()
+	s.debugConfigHandler(recorder, httptest.NewRequest(http.MethodGet, "/debug/config", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", recorder.Code)
+	}
+
+	var config map[string]string
+	if err := json.Unmarshal(recorder.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["nmi-port"] != "2579" {
+		t.Errorf("Unexpected config %v", config)
+	}
+}
+
+func TestServedIdentitiesIPReuse(t *testing.T) {
+	var si servedIdentities
+	id1 := newTestIdentity("id1", "clientid1")
+	id2 := newTestIdentity("id2", "clientid2")
+	si.record("10.0.0.1", "default", "pod1", "https://management.azure.com/", id1)
+	// the ip of the deleted pod1 is reused by pod3
+	si.record("10.0.0.1", "default", "pod3", "https://management.azure.com/", id2)
+
+	ids := si.list()
+	if len(ids) != 1 || ids[0].PodName != "pod3" || ids[0].ClientID != "clientid2" {
+		t.Fatalf("expected only the identity served to pod3, got: %+v", ids)
+	}
+	if keys := si.podIdentities("10.0.0.1"); len(keys) != 1 || keys[0].identityName != "id2" {
+		t.Errorf("expected a flush of the ip to only evict the identity of pod3, got: %+v", keys)
+	}
+}
+
+func TestServedIdentitiesPrune(t *testing.T) {
+	s := &Server{KubeClient: &fakePodsKubeClient{pods: map[string]v1.Pod{
+		"default/pod1": {Status: v1.PodStatus{PodIP: "10.0.0.1"}},
+		// pod2 was recreated by its stateful set with another ip
+		"default/pod2": {Status: v1.PodStatus{PodIP: "10.0.0.9"}},
+	}}}
+	id1 := newTestIdentity("id1", "clientid1")
+	id2 := newTestIdentity("id2", "clientid2")
+	s.servedIdentities.record("10.0.0.1", "default", "pod1", "https://management.azure.com/", id1)
+	s.servedIdentities.record("10.0.0.1", "default", "pod1", "https://management.azure.com/", id2)
+	s.servedIdentities.record("10.0.0.2", "default", "pod2", "https://management.azure.com/", id1)
+	// pod3 was deleted
+	s.servedIdentities.record("10.0.0.3", "default", "pod3", "https://management.azure.com/", id2)
+
+	if pruned := s.servedIdentities.prune(s.podHoldsIP); pruned != 2 {
+		t.Errorf("expected the identities of 2 pod ips to be removed, got %d", pruned)
+	}
+	ids := s.servedIdentities.list()
+	if len(ids) != 2 || ids[0].PodIP != "10.0.0.1" || ids[1].PodIP != "10.0.0.1" {
+		t.Errorf("expected only the identities served to pod1 to be kept, got: %+v", ids)
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"k8s.io/klog"
+)
+
+// ErrorCode identifies why a token request failed so that clients can react to the failure
+type ErrorCode string
+
+const (
+	// ErrorCodeInvalidRequest is returned when the request is missing a required parameter
+	ErrorCodeInvalidRequest ErrorCode = "InvalidRequest"
+	// ErrorCodeUnauthorized is returned when the caller is not allowed to request the token
+	ErrorCodeUnauthorized ErrorCode = "Unauthorized"
+	// ErrorCodeIdentityNotFound is returned when no identity is assigned to the pod
+	ErrorCodeIdentityNotFound ErrorCode = "IdentityNotFound"
+	// ErrorCodeAssignmentInProgress is returned when the identity is not assigned to the node yet.
+	// The request can be retried.
+	ErrorCodeAssignmentInProgress ErrorCode = "AssignmentInProgress"
+	// ErrorCodeARMThrottled is returned when the token request was throttled. The request can be retried.
+	ErrorCodeARMThrottled ErrorCode = "ARMThrottled"
+	// ErrorCodeTokenAcquisitionFailed is returned when the token could not be acquired for the identity
+	ErrorCodeTokenAcquisitionFailed ErrorCode = "TokenAcquisitionFailed"
+	// ErrorCodeInternalError is returned when NMI failed to process the request
+	ErrorCodeInternalError ErrorCode = "InternalError"
+)
+
+// ErrorResponse is the body returned when a token request fails
+type ErrorResponse struct {
+	ErrorCode        ErrorCode `json:"error_code"`
+	ErrorDescription string    `json:"error_description"`
+}
+
+// writeErrorResponse replies to the request with the error code and description as JSON
+// and the status code. The caller should ensure no further writes are done to w.
+func writeErrorResponse(w http.ResponseWriter, code ErrorCode, description string, statusCode int) {
+	response, err := json.Marshal(ErrorResponse{
+		ErrorCode:        code,
+		ErrorDescription: description,
+	})
+	if err != nil {
+		klog.Errorf("failed to marshal error response, %+v", err)
+		http.Error(w, description, statusCode)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	w.Write(response)
+}
+
+// getIdentityErrorCode returns the error code for identities that could not be found for the pod
+func getIdentityErrorCode(identityFound bool) ErrorCode {
+	if identityFound {
+		return ErrorCodeAssignmentInProgress
+	}
+	return ErrorCodeIdentityNotFound
+}
+
+// getTokenErrorResponse returns the error code and status code for an error acquiring a token
+func getTokenErrorResponse(err error) (ErrorCode, int) {
+	if refreshErr, ok := err.(adal.TokenRefreshError); ok {
+		if resp := refreshErr.Response(); resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+			return ErrorCodeARMThrottled, http.StatusTooManyRequests
+		}
+	}
+	return ErrorCodeTokenAcquisitionFailed, http.StatusForbidden
+}
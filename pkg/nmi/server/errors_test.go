@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/k8s"
+	"github.com/Azure/go-autorest/autorest/adal"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeKubeClient struct {
+	k8s.Client
+}
+
+func (c *fakeKubeClient) GetPodInfo(podip string) (string, string, string, *metav1.LabelSelector, error) {
+	return "default", "pod1", "rs1", &metav1.LabelSelector{}, nil
+}
+
+func (c *fakeKubeClient) ListPodIdentityExceptions(ns string) (*[]aadpodid.AzurePodIdentityException, error) {
+	return &[]aadpodid.AzurePodIdentityException{}, nil
+}
+
+type fakeTokenClient struct {
+	podID       *aadpodid.AzureIdentity
+	identityErr error
+	tokenErr    error
+	// claims is the claims challenge of the last token request
+	claims string
+}
+
+func (c *fakeTokenClient) GetIdentities(ctx context.Context, podns, podname, clientID string) (*aadpodid.AzureIdentity, error) {
+	return c.podID, c.identityErr
+}
+
+func (c *fakeTokenClient) GetToken(ctx context.Context, clientID, resource, claims string, podID aadpodid.AzureIdentity) (*adal.Token, error) {
+	c.claims = claims
+	if c.tokenErr != nil {
+		return nil, c.tokenErr
+	}
+	return &adal.Token{AccessToken: "token", Resource: resource, Type: "Bearer"}, nil
+}
+
+type fakeTokenRefreshError struct {
+	resp *http.Response
+}
+
+func (e fakeTokenRefreshError) Error() string {
+	return "token refresh failed"
+}
+
+func (e fakeTokenRefreshError) Response() *http.Response {
+	return e.resp
+}
+
+func TestMsiHandlerErrorCodes(t *testing.T) {
+	podID := &aadpodid.AzureIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: "msi", Namespace: "default"},
+		Spec:       aadpodid.AzureIdentitySpec{Type: aadpodid.UserAssignedMSI, ClientID: "clientid"},
+	}
+
+	for _, c := range []struct {
+		name               string
+		tokenClient        *fakeTokenClient
+		resource           string
+		expectedStatusCode int
+		expectedErrorCode  ErrorCode
+	}{
+		{
+			name:               "missing resource",
+			tokenClient:        &fakeTokenClient{podID: podID},
+			expectedStatusCode: http.StatusBadRequest,
+			expectedErrorCode:  ErrorCodeInvalidRequest,
+		},
+		{
+			name:               "identity not found",
+			tokenClient:        &fakeTokenClient{identityErr: errors.New("no identity found")},
+			resource:           "https://management.azure.com/",
+			expectedStatusCode: http.StatusForbidden,
+			expectedErrorCode:  ErrorCodeIdentityNotFound,
+		},
+		{
+			name:               "assignment in progress",
+			tokenClient:        &fakeTokenClient{podID: podID, identityErr: errors.New("identity in CREATED state")},
+			resource:           "https://management.azure.com/",
+			expectedStatusCode: http.StatusNotFound,
+			expectedErrorCode:  ErrorCodeAssignmentInProgress,
+		},
+		{
+			name: "throttled",
+			tokenClient: &fakeTokenClient{
+				podID:    podID,
+				tokenErr: fakeTokenRefreshError{resp: &http.Response{StatusCode: http.StatusTooManyRequests}},
+			},
+			resource:           "https://management.azure.com/",
+			expectedStatusCode: http.StatusTooManyRequests,
+			expectedErrorCode:  ErrorCodeARMThrottled,
+		},
+		{
+			name: "token acquisition failed",
+			tokenClient: &fakeTokenClient{
+				podID:    podID,
+				tokenErr: fakeTokenRefreshError{resp: &http.Response{StatusCode: http.StatusBadRequest}},
+			},
+			resource:           "https://management.azure.com/",
+			expectedStatusCode: http.StatusForbidden,
+			expectedErrorCode:  ErrorCodeTokenAcquisitionFailed,
+		},
+	} {
+		s := &Server{
+			KubeClient:  &fakeKubeClient{},
+			TokenClient: c.tokenClient,
+		}
+
+		req := httptest.NewRequest(http.MethodGet, tokenPath+"?resource="+c.resource, nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		recorder := httptest.NewRecorder()
+		s.msiHandler(recorder, req)
+
+		assertErrorResponse(t, c.name, recorder, c.expectedStatusCode, c.expectedErrorCode)
+	}
+}
+
+func TestHostHandlerUnauthorized(t *testing.T) {
+	s := &Server{
+		TokenClient: &fakeTokenClient{},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/host/token/?resource=https://management.azure.com/", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	req.Header.Set("podns", "default")
+	req.Header.Set("podname", "pod1")
+	recorder := httptest.NewRecorder()
+	s.hostHandler(recorder, req)
+
+	assertErrorResponse(t, "not from host", recorder, http.StatusForbidden, ErrorCodeUnauthorized)
+}
+
+func TestMsiHandlerSuccessResponse(t *testing.T) {
+	s := &Server{
+		KubeClient: &fakeKubeClient{},
+		TokenClient: &fakeTokenClient{
+			podID: &aadpodid.AzureIdentity{Spec: aadpodid.AzureIdentitySpec{ClientID: "clientid"}},
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, tokenPath+"?resource=https://management.azure.com/", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	recorder := httptest.NewRecorder()
+	s.msiHandler(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got: %d", http.StatusOK, recorder.Code)
+	}
+	var resp msiResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal token response, %+v", err)
+	}
+	if resp.AccessToken != "token" || resp.Resource != "https://management.azure.com/" {
+		t.Errorf("unexpected token response %+v", resp)
+	}
+}
+
+func assertErrorResponse(t *testing.T, name string, recorder *httptest.ResponseRecorder, statusCode int, code ErrorCode) {
+	if recorder.Code != statusCode {
+		t.Errorf("%s: expected status code %d, got: %d", name, statusCode, recorder.Code)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json; charset=utf-8" {
+		t.Errorf("%s: unexpected content type %s", name, contentType)
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s: failed to unmarshal error response %s, %+v", name, recorder.Body.String(), err)
+	}
+	if resp.ErrorCode != code {
+		t.Errorf("%s: expected error code %s, got: %s", name, code, resp.ErrorCode)
+	}
+	if resp.ErrorDescription == "" {
+		t.Errorf("%s: expected error description to be set", name)
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+var (
+	errFlushSelectors = errors.New("only one of podIP, identity and clientID can be set")
+	errFlushPodIP     = errors.New("podIP must be an ip address")
+	errFlushIdentity  = errors.New("identity must be the namespace/name of the AzureIdentity")
+)
+
+// FlushResponse is the response of the flush endpoint
+type FlushResponse struct {
+	// Evicted is the number of cached tokens evicted
+	Evicted int `json:"evicted"`
+}
+
+// evict removes the cached tokens whose key matches and returns the number of tokens removed
+func (tc *tokenCache) evict(match func(tokenCacheKey) bool) int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	evicted := 0
+	for key := range tc.tokens {
+		if match(key) {
+			delete(tc.tokens, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// podIdentities returns the keys of the identities served to the pod with the ip, without resource
+func (si *servedIdentities) podIdentities(podIP string) []tokenCacheKey {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+
+	var keys []tokenCacheKey
+	for _, id := range si.identities[podIP] {
+		keys = append(keys, tokenCacheKey{identityNamespace: id.IdentityNamespace, identityName: id.IdentityName, clientID: id.ClientID})
+	}
+	return keys
+}
+
+// flushMatcher returns the match of the cached tokens to evict for the query of the flush request:
+// the tokens of the identities served to the pod with the podIP, of the identity with the
+// namespace/name or of the clientID, or all the tokens when none is set
+func (s *Server) flushMatcher(r *http.Request) (func(tokenCacheKey) bool, string, error) {
+	q := r.URL.Query()
+	podIP, identity, clientID := q.Get("podIP"), q.Get("identity"), q.Get("clientID")
+	selectors := 0
+	for _, v := range []string{podIP, identity, clientID} {
+		if v != "" {
+			selectors++
+		}
+	}
+	switch {
+	case selectors > 1:
+		return nil, "", errFlushSelectors
+	case podIP != "":
+		if net.ParseIP(podIP) == nil {
+			return nil, "", errFlushPodIP
+		}
+		ids := s.servedIdentities.podIdentities(podIP)
+		return func(key tokenCacheKey) bool {
+			for _, id := range ids {
+				if key.identityNamespace == id.identityNamespace && key.identityName == id.identityName && key.clientID == id.clientID {
+					return true
+				}
+			}
+			return false
+		}, "pod " + podIP, nil
+	case identity != "":
+		parts := strings.Split(identity, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, "", errFlushIdentity
+		}
+		return func(key tokenCacheKey) bool {
+			return key.identityNamespace == parts[0] && key.identityName == parts[1]
+		}, "identity " + identity, nil
+	case clientID != "":
+		return func(key tokenCacheKey) bool {
+			return strings.EqualFold(key.clientID, clientID)
+		}, "client id " + clientID, nil
+	}
+	return func(tokenCacheKey) bool { return true }, "all identities", nil
+}
+
+// flushHandler evicts the cached tokens of a pod, an identity or all the identities, so that the
+// next token requests acquire new tokens from AAD, and reports the number of tokens evicted
+func (s *Server) flushHandler(w http.ResponseWriter, r *http.Request) (ns string) {
+	if parseRemoteAddr(r.RemoteAddr) != localhost {
+		klog.Errorf("request remote address is not from a host")
+		writeErrorResponse(w, ErrorCodeUnauthorized, "request remote address is not from a host", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, ErrorCodeInvalidRequest, "the flush endpoint only accepts POST requests", http.StatusMethodNotAllowed)
+		return
+	}
+	match, scope, err := s.flushMatcher(r)
+	if err != nil {
+		writeErrorResponse(w, ErrorCodeInvalidRequest, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := FlushResponse{Evicted: s.tokens.evict(match) + s.lastTokens.evict(match)}
+	klog.Infof("Flushed %d cached tokens of %s", res.Evicted, scope)
+
+	response, err := json.Marshal(res)
+	if err != nil {
+		klog.Errorf("failed to marshal flush response, err: %+v", err)
+		writeErrorResponse(w, ErrorCodeInternalError, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+	return
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFlush(t *testing.T) {
+	id1 := newTestIdentity("id1", "clientid1")
+	id2 := newTestIdentity("id2", "clientid2")
+	const vaultResource = "https://vault.azure.net"
+
+	cases := []struct {
+		name            string
+		query           string
+		expectedEvicted int
+		// expectedCached are the identities whose tokens are still cached after the flush
+		expectedCached map[string]bool
+	}{
+		{name: "all identities", expectedEvicted: 4, expectedCached: map[string]bool{}},
+		{name: "pod ip", query: "?podIP=10.0.0.1", expectedEvicted: 3, expectedCached: map[string]bool{"id2": true}},
+		{name: "pod ip without served identities", query: "?podIP=10.0.0.9", expectedEvicted: 0, expectedCached: map[string]bool{"id1": true, "id2": true}},
+		{name: "identity", query: "?identity=default/id2", expectedEvicted: 1, expectedCached: map[string]bool{"id1": true}},
+		{name: "client id", query: "?clientID=CLIENTID1", expectedEvicted: 3, expectedCached: map[string]bool{"id2": true}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{}
+			s.tokens.set(*id1, warmupResource, newTestToken("id1-arm", time.Hour))
+			s.tokens.set(*id1, vaultResource, newTestToken("id1-vault", time.Hour))
+			s.lastTokens.set(*id1, warmupResource, newTestToken("id1-arm", time.Hour))
+			s.tokens.set(*id2, warmupResource, newTestToken("id2-arm", time.Hour))
+			s.servedIdentities.record("10.0.0.1", "default", "pod1", warmupResource, id1)
+			s.servedIdentities.record("10.0.0.2", "default", "pod2", warmupResource, id2)
+
+			req := httptest.NewRequest(http.MethodPost, "/flush"+tc.query, nil)
+			req.RemoteAddr = "127.0.0.1:12345"
+			recorder := httptest.NewRecorder()
+			s.flushHandler(recorder, req)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got: %d", http.StatusOK, recorder.Code)
+			}
+			var resp FlushResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal flush response, %+v", err)
+			}
+			if resp.Evicted != tc.expectedEvicted {
+				t.Errorf("expected %d tokens evicted, got: %d", tc.expectedEvicted, resp.Evicted)
+			}
+			if _, ok := s.tokens.get(*id1, warmupResource); ok != tc.expectedCached["id1"] {
+				t.Errorf("expected token of id1 cached to be %v, got: %v", tc.expectedCached["id1"], ok)
+			}
+			if _, ok := s.lastTokens.get(*id1, warmupResource); ok != tc.expectedCached["id1"] {
+				t.Errorf("expected last token of id1 kept to be %v, got: %v", tc.expectedCached["id1"], ok)
+			}
+			if _, ok := s.tokens.get(*id2, warmupResource); ok != tc.expectedCached["id2"] {
+				t.Errorf("expected token of id2 cached to be %v, got: %v", tc.expectedCached["id2"], ok)
+			}
+		})
+	}
+}
+
+func TestFlushHandlerInvalidRequests(t *testing.T) {
+	cases := []struct {
+		name       string
+		method     string
+		remoteAddr string
+		query      string
+		statusCode int
+		code       ErrorCode
+	}{
+		{name: "not from host", method: http.MethodPost, remoteAddr: "10.0.0.1:12345", statusCode: http.StatusForbidden, code: ErrorCodeUnauthorized},
+		{name: "not a post", method: http.MethodGet, remoteAddr: "127.0.0.1:12345", statusCode: http.StatusMethodNotAllowed, code: ErrorCodeInvalidRequest},
+		{name: "several selectors", method: http.MethodPost, remoteAddr: "127.0.0.1:12345", query: "?podIP=10.0.0.1&clientID=clientid1", statusCode: http.StatusBadRequest, code: ErrorCodeInvalidRequest},
+		{name: "invalid pod ip", method: http.MethodPost, remoteAddr: "127.0.0.1:12345", query: "?podIP=pod1", statusCode: http.StatusBadRequest, code: ErrorCodeInvalidRequest},
+		{name: "invalid identity", method: http.MethodPost, remoteAddr: "127.0.0.1:12345", query: "?identity=id1", statusCode: http.StatusBadRequest, code: ErrorCodeInvalidRequest},
+	}
+	for _, tc := range cases {
+		s := &Server{}
+		s.tokens.set(*newTestIdentity("id1", "clientid1"), warmupResource, newTestToken("id1-arm", time.Hour))
+
+		req := httptest.NewRequest(tc.method, "/flush"+tc.query, nil)
+		req.RemoteAddr = tc.remoteAddr
+		recorder := httptest.NewRecorder()
+		s.flushHandler(recorder, req)
+
+		assertErrorResponse(t, tc.name, recorder, tc.statusCode, tc.code)
+		if _, ok := s.tokens.get(*newTestIdentity("id1", "clientid1"), warmupResource); !ok {
+			t.Errorf("%s: expected no token to be evicted", tc.name)
+		}
+	}
+}
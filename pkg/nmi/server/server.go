@@ -1,9 +1,11 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -14,9 +16,11 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
 	auth "github.com/Azure/aad-pod-identity/pkg/auth"
 	k8s "github.com/Azure/aad-pod-identity/pkg/k8s"
 	"github.com/Azure/aad-pod-identity/pkg/metrics"
@@ -29,6 +33,8 @@ import (
 
 const (
 	localhost = "127.0.0.1"
+	// DefaultResponseHeader is the header added to the token responses served by NMI
+	DefaultResponseHeader = "X-AADPodIdentity-NMI"
 )
 
 // Server encapsulates all of the parameters necessary for starting up
@@ -48,6 +54,33 @@ type Server struct {
 	// TokenClient is client that fetches identities and tokens
 	TokenClient nmi.TokenClient
 	Reporter    *metrics.Reporter
+	// DebugAddr is the address the debug endpoints are served on, disabled when empty
+	DebugAddr string
+	// DebugConfig is the active configuration served on /debug/config
+	DebugConfig map[string]string
+	// WarmupInterval is the interval at which tokens are pre-acquired for the identities assigned
+	// on the node, disabled when zero
+	WarmupInterval time.Duration
+	// ResponseHeaderName and ResponseHeaderValue are the header added to the token responses served
+	// by NMI, to tell them apart from responses of the metadata endpoint. No header is added when
+	// the name is empty.
+	ResponseHeaderName  string
+	ResponseHeaderValue string
+	// UpstreamClient is the http client of the requests forwarded to the metadata endpoint, a client
+	// with the default transport when nil
+	UpstreamClient *http.Client
+	// ServeStaleOnError serves the last token acquired for the identity and resource when acquiring
+	// a new token fails, until the token expires
+	ServeStaleOnError bool
+	// AuditLog receives one JSON audit record per token granted or denied to a pod, disabled when nil
+	AuditLog io.Writer
+
+	servedIdentities servedIdentities
+	tokens           tokenCache
+	// lastTokens are the last tokens acquired for the token requests, kept when ServeStaleOnError is set
+	// until they expire or their identity is no longer assigned on the node
+	lastTokens tokenCache
+	auditMu    sync.Mutex
 }
 
 // NMIResponse is the response returned to caller
@@ -82,22 +115,51 @@ func NewServer(micNamespace string, blockInstanceMetadata bool, metadataHeaderRe
 // Run runs the specified Server.
 func (s *Server) Run() error {
 	go s.updateIPTableRules()
+	go s.runServedIdentitiesPruner()
+	if s.DebugAddr != "" {
+		go s.runDebugServer()
+	}
+	if s.WarmupInterval > 0 {
+		go s.runWarmer()
+	}
+	if s.ServeStaleOnError {
+		go s.runLastTokensPruner()
+	}
+
+	klog.Infof("Listening on port %s", s.NMIPort)
+	if err := http.ListenAndServe(":"+s.NMIPort, s.newServeMux()); err != nil {
+		klog.Fatalf("Error creating http server: %+v", err)
+	}
+	return nil
+}
 
+// newServeMux returns the handler of the NMI endpoints. Only token requests are intercepted,
+// all other requests are forwarded to the metadata endpoint.
+func (s *Server) newServeMux() *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.Handle("/metadata/identity/oauth2/token", appHandler(s.msiHandler))
-	mux.Handle("/metadata/identity/oauth2/token/", appHandler(s.msiHandler))
-	mux.Handle("/host/token", appHandler(s.hostHandler))
-	mux.Handle("/host/token/", appHandler(s.hostHandler))
+	mux.Handle("/metadata/identity/oauth2/token", s.withResponseHeader(appHandler(s.msiHandler)))
+	mux.Handle("/metadata/identity/oauth2/token/", s.withResponseHeader(appHandler(s.msiHandler)))
+	mux.Handle("/host/token", s.withResponseHeader(appHandler(s.hostHandler)))
+	mux.Handle("/host/token/", s.withResponseHeader(appHandler(s.hostHandler)))
+	mux.Handle("/warmup", appHandler(s.warmupHandler))
+	mux.Handle("/flush", appHandler(s.flushHandler))
 	if s.BlockInstanceMetadata {
 		mux.Handle("/metadata/instance", http.HandlerFunc(forbiddenHandler))
 	}
 	mux.Handle("/", appHandler(s.defaultPathHandler))
+	return mux
+}
 
-	klog.Infof("Listening on port %s", s.NMIPort)
-	if err := http.ListenAndServe(":"+s.NMIPort, mux); err != nil {
-		klog.Fatalf("Error creating http server: %+v", err)
+// withResponseHeader adds the configured response header to the responses of the handler, which
+// marks the token responses served by NMI. Forwarded requests are left unmarked.
+func (s *Server) withResponseHeader(h http.Handler) http.Handler {
+	if s.ResponseHeaderName == "" {
+		return h
 	}
-	return nil
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(s.ResponseHeaderName, s.ResponseHeaderValue)
+		h.ServeHTTP(w, r)
+	})
 }
 
 func (s *Server) updateIPTableRulesInternal() {
@@ -158,6 +220,9 @@ func newResponseWriter(w http.ResponseWriter) *responseWriter {
 
 var appHandlerReporter *metrics.Reporter
 
+// marshalResponse marshals the token responses, a variable so that tests can make it fail
+var marshalResponse = json.Marshal
+
 // ServeHTTP implements the net/http server handler interface
 // and recovers from panics.
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -204,47 +269,57 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (s *Server) hostHandler(w http.ResponseWriter, r *http.Request) (ns string) {
 	hostIP := parseRemoteAddr(r.RemoteAddr)
 	rqClientID, rqResource := parseRequestClientIDAndResource(r)
+	rqClaims := parseRequestClaims(r)
 
 	podns, podname := parsePodInfo(r)
+	audit := auditRecord{PodName: podname, PodNamespace: podns, ClientID: rqClientID, Resource: rqResource, Path: r.URL.Path}
 	if podns == "" || podname == "" {
 		klog.Error("missing podname and podns from request")
-		http.Error(w, "missing 'podname' and 'podns' from request header", http.StatusBadRequest)
+		s.auditDenial(audit, nil, http.StatusBadRequest, errors.New("missing 'podname' and 'podns' from request header"))
+		writeErrorResponse(w, ErrorCodeInvalidRequest, "missing 'podname' and 'podns' from request header", http.StatusBadRequest)
 		return
 	}
 	// set the ns so it can be used for metrics
 	ns = podns
 	if hostIP != localhost {
 		klog.Errorf("request remote address is not from a host")
-		http.Error(w, "request remote address is not from a host", http.StatusInternalServerError)
+		s.auditDenial(audit, nil, http.StatusForbidden, errors.New("request remote address is not from a host"))
+		writeErrorResponse(w, ErrorCodeUnauthorized, "request remote address is not from a host", http.StatusForbidden)
 		return
 	}
 	if !validateResourceParamExists(rqResource) {
 		klog.Warning("parameter resource cannot be empty")
-		http.Error(w, "parameter resource cannot be empty", http.StatusBadRequest)
+		s.auditDenial(audit, nil, http.StatusBadRequest, errors.New("parameter resource cannot be empty"))
+		writeErrorResponse(w, ErrorCodeInvalidRequest, "parameter resource cannot be empty", http.StatusBadRequest)
 		return
 	}
 	podID, err := s.TokenClient.GetIdentities(r.Context(), podns, podname, rqClientID)
 	if err != nil {
 		klog.Error(err)
-		http.Error(w, err.Error(), getErrorResponseStatusCode(podID != nil))
+		s.auditDenial(audit, nil, getErrorResponseStatusCode(podID != nil), err)
+		writeErrorResponse(w, getIdentityErrorCode(podID != nil), err.Error(), getErrorResponseStatusCode(podID != nil))
 		return
 	}
-	token, err := s.TokenClient.GetToken(r.Context(), rqClientID, rqResource, *podID)
+	token, err := s.getToken(r.Context(), rqClientID, rqResource, rqClaims, *podID)
 	if err != nil {
 		klog.Errorf("failed to get service principal token for pod:%s/%s, err: %+v", podns, podname, err)
-		http.Error(w, err.Error(), http.StatusForbidden)
+		code, statusCode := getTokenErrorResponse(err)
+		s.auditDenial(audit, podID, statusCode, err)
+		writeErrorResponse(w, code, err.Error(), statusCode)
 		return
 	}
 	nmiResp := NMIResponse{
 		Token:    newMSIResponse(*token),
 		ClientID: podID.Spec.ClientID,
 	}
-	response, err := json.Marshal(nmiResp)
+	response, err := marshalResponse(nmiResp)
 	if err != nil {
 		klog.Errorf("failed to marshal service principal token and clientid for pod:%s/%s, err: %+v", podns, podname, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.auditDenial(audit, podID, http.StatusInternalServerError, err)
+		writeErrorResponse(w, ErrorCodeInternalError, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.auditGrant(audit, podID, token)
 	w.Write(response)
 	return
 }
@@ -276,6 +351,43 @@ func newMSIResponse(token adal.Token) msiResponse {
 	}
 }
 
+// getToken returns the token of the identity for the resource pre-acquired by the warmup, or
+// acquires a new one when there is none. A request with a claims challenge always acquires a new
+// token, since the challenge means the resource rejected the tokens issued so far. When acquiring
+// the token fails and ServeStaleOnError is set, a cached token that hasn't expired yet is served
+// instead of the error.
+func (s *Server) getToken(ctx context.Context, rqClientID, rqResource, rqClaims string, podID aadpodid.AzureIdentity) (*adal.Token, error) {
+	if rqClaims == "" {
+		if token, ok := s.tokens.get(podID, rqResource); ok {
+			klog.V(5).Infof("serving warmed up token for identity %s/%s", podID.Namespace, podID.Name)
+			return token, nil
+		}
+	}
+	token, err := s.TokenClient.GetToken(ctx, rqClientID, rqResource, rqClaims, podID)
+	if !s.ServeStaleOnError {
+		return token, err
+	}
+	if err == nil {
+		s.lastTokens.set(podID, rqResource, *token)
+		return token, nil
+	}
+	if rqClaims != "" {
+		return nil, err
+	}
+	staleToken, ok := s.lastTokens.getUnexpired(podID, rqResource)
+	if !ok {
+		if staleToken, ok = s.tokens.getUnexpired(podID, rqResource); !ok {
+			return nil, err
+		}
+	}
+	klog.Warningf("failed to acquire token for identity %s/%s, serving the cached token expiring at %s, err: %+v",
+		podID.Namespace, podID.Name, staleToken.Expires().UTC().Format(time.RFC3339), err)
+	if s.Reporter != nil {
+		s.Reporter.Report(metrics.NMIStaleTokensServedCountM.M(1))
+	}
+	return staleToken, nil
+}
+
 func (s *Server) isMIC(podNS, rsName string) bool {
 	micRegEx := regexp.MustCompile(`^mic-*`)
 	if strings.EqualFold(podNS, s.MICNamespace) && micRegEx.MatchString(rsName) {
@@ -284,7 +396,7 @@ func (s *Server) isMIC(podNS, rsName string) bool {
 	return false
 }
 
-func (s *Server) getTokenForExceptedPod(rqClientID, rqResource string) ([]byte, int, error) {
+func (s *Server) getTokenForExceptedPod(rqClientID, rqResource string) ([]byte, ErrorCode, int, error) {
 	var token *adal.Token
 	var err error
 	// ClientID is empty, so we are going to use System assigned MSI
@@ -297,15 +409,15 @@ func (s *Server) getTokenForExceptedPod(rqClientID, rqResource string) ([]byte,
 	}
 	if err != nil {
 		klog.Errorf("Failed to get service principal token, err: %+v", err)
-		// TODO: return the right status code based on the error we got from adal.
-		return nil, http.StatusForbidden, err
+		code, statusCode := getTokenErrorResponse(err)
+		return nil, code, statusCode, err
 	}
-	response, err := json.Marshal(newMSIResponse(*token))
+	response, err := marshalResponse(newMSIResponse(*token))
 	if err != nil {
 		klog.Errorf("Failed to marshal service principal token, err: %+v", err)
-		return nil, http.StatusInternalServerError, err
+		return nil, ErrorCodeInternalError, http.StatusInternalServerError, err
 	}
-	return response, http.StatusOK, nil
+	return response, "", http.StatusOK, nil
 }
 
 // msiHandler uses the remote address to identify the pod ip and uses it
@@ -314,49 +426,58 @@ func (s *Server) getTokenForExceptedPod(rqClientID, rqResource string) ([]byte,
 // if the requests contains client id it validates it against the admin
 // configured id.
 func (s *Server) msiHandler(w http.ResponseWriter, r *http.Request) (ns string) {
+	podIP := parseRemoteAddr(r.RemoteAddr)
+	rqClientID, rqResource := parseRequestClientIDAndResource(r)
+	rqClaims := parseRequestClaims(r)
+	audit := auditRecord{PodIP: podIP, ClientID: rqClientID, Resource: rqResource, Path: r.URL.Path}
+
 	if s.MetadataHeaderRequired && parseMetadata(r) != "true" {
-		klog.Errorf("metadata header is not specified, req.method=%s reg.path=%s req.remote=%s", r.Method, r.URL.Path, parseRemoteAddr(r.RemoteAddr))
+		klog.Errorf("metadata header is not specified, req.method=%s reg.path=%s req.remote=%s", r.Method, r.URL.Path, podIP)
+		s.auditDenial(audit, nil, http.StatusBadRequest, errors.New("required metadata header not specified"))
 		metadataNotSpecifiedError(w)
 		return
 	}
-
-	podIP := parseRemoteAddr(r.RemoteAddr)
-	rqClientID, rqResource := parseRequestClientIDAndResource(r)
-
 	if podIP == "" {
 		klog.Error("request remote address is empty")
-		http.Error(w, "request remote address is empty", http.StatusInternalServerError)
+		s.auditDenial(audit, nil, http.StatusInternalServerError, errors.New("request remote address is empty"))
+		writeErrorResponse(w, ErrorCodeInternalError, "request remote address is empty", http.StatusInternalServerError)
 		return
 	}
 	if !validateResourceParamExists(rqResource) {
 		klog.Warning("parameter resource cannot be empty")
-		http.Error(w, "parameter resource cannot be empty", http.StatusBadRequest)
+		s.auditDenial(audit, nil, http.StatusBadRequest, errors.New("parameter resource cannot be empty"))
+		writeErrorResponse(w, ErrorCodeInvalidRequest, "parameter resource cannot be empty", http.StatusBadRequest)
 		return
 	}
 	podns, podname, rsName, selectors, err := s.KubeClient.GetPodInfo(podIP)
 	if err != nil {
 		klog.Errorf("missing podname for podip:%s, %+v", podIP, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.auditDenial(audit, nil, http.StatusInternalServerError, err)
+		writeErrorResponse(w, ErrorCodeInternalError, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	// set ns for using in metrics
 	ns = podns
+	audit.PodName, audit.PodNamespace = podname, podns
 	exceptionList, err := s.KubeClient.ListPodIdentityExceptions(podns)
 	if err != nil {
 		klog.Errorf("getting list of azurepodidentityexceptions in %s namespace failed with error: %+v", podns, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.auditDenial(audit, nil, http.StatusInternalServerError, err)
+		writeErrorResponse(w, ErrorCodeInternalError, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// If its mic, then just directly get the token and pass back.
 	if pod.IsPodExcepted(selectors.MatchLabels, *exceptionList) || s.isMIC(podns, rsName) {
 		klog.Infof("Exception pod %s/%s token handling", podns, podname)
-		response, errorCode, err := s.getTokenForExceptedPod(rqClientID, rqResource)
+		response, code, statusCode, err := s.getTokenForExceptedPod(rqClientID, rqResource)
 		if err != nil {
-			klog.Errorf("failed to get service principal token for pod:%s/%s.  Error code: %d. Error: %+v", podns, podname, errorCode, err)
-			http.Error(w, err.Error(), errorCode)
+			klog.Errorf("failed to get service principal token for pod:%s/%s.  Error code: %d. Error: %+v", podns, podname, statusCode, err)
+			s.auditDenial(audit, nil, statusCode, err)
+			writeErrorResponse(w, code, err.Error(), statusCode)
 			return
 		}
+		s.auditGrant(audit, nil, nil)
 		w.Write(response)
 		return
 	}
@@ -364,22 +485,28 @@ func (s *Server) msiHandler(w http.ResponseWriter, r *http.Request) (ns string)
 	podID, err := s.TokenClient.GetIdentities(r.Context(), podns, podname, rqClientID)
 	if err != nil {
 		klog.Error(err)
-		http.Error(w, err.Error(), getErrorResponseStatusCode(podID != nil))
+		s.auditDenial(audit, nil, getErrorResponseStatusCode(podID != nil), err)
+		writeErrorResponse(w, getIdentityErrorCode(podID != nil), err.Error(), getErrorResponseStatusCode(podID != nil))
 		return
 	}
 
-	token, err := s.TokenClient.GetToken(r.Context(), rqClientID, rqResource, *podID)
+	token, err := s.getToken(r.Context(), rqClientID, rqResource, rqClaims, *podID)
 	if err != nil {
 		klog.Errorf("failed to get service principal token for pod:%s/%s, %+v", podns, podname, err)
-		http.Error(w, err.Error(), http.StatusForbidden)
+		code, statusCode := getTokenErrorResponse(err)
+		s.auditDenial(audit, podID, statusCode, err)
+		writeErrorResponse(w, code, err.Error(), statusCode)
 		return
 	}
-	response, err := json.Marshal(newMSIResponse(*token))
+	response, err := marshalResponse(newMSIResponse(*token))
 	if err != nil {
 		klog.Errorf("failed to marshal service principal token for pod:%s/%s, %+v", podns, podname, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.auditDenial(audit, podID, http.StatusInternalServerError, err)
+		writeErrorResponse(w, ErrorCodeInternalError, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.servedIdentities.record(podIP, podns, podname, rqResource, podID)
+	s.auditGrant(audit, podID, token)
 	w.Write(response)
 	return
 }
@@ -437,7 +564,14 @@ func parseRequestClientIDAndResource(r *http.Request) (clientID string, resource
 	return clientID, resource
 }
 
-// defaultPathHandler creates a new request and returns the response body and code
+// parseRequestClaims returns the claims challenge of a client enabled for continuous access evaluation
+func parseRequestClaims(r *http.Request) string {
+	return r.URL.Query().Get("claims")
+}
+
+// defaultPathHandler forwards the request to the metadata endpoint and returns the response
+// status code, headers and body unchanged. The request path, query parameters and headers are
+// preserved, so non-token metadata requests such as /metadata/instance pass through transparently.
 func (s *Server) defaultPathHandler(w http.ResponseWriter, r *http.Request) (ns string) {
 	if s.MetadataHeaderRequired && parseMetadata(r) != "true" {
 		klog.Errorf("metadata header is not specified, req.method=%s reg.path=%s req.remote=%s", r.Method, r.URL.Path, parseRemoteAddr(r.RemoteAddr))
@@ -445,7 +579,10 @@ func (s *Server) defaultPathHandler(w http.ResponseWriter, r *http.Request) (ns
 		return
 	}
 
-	client := &http.Client{}
+	client := s.UpstreamClient
+	if client == nil {
+		client = &http.Client{}
+	}
 	req, err := http.NewRequest(r.Method, r.URL.String(), r.Body)
 	if err != nil || req == nil {
 		klog.Errorf("failed creating a new request for %s, err: %+v", r.URL.String(), err)
@@ -474,7 +611,12 @@ func (s *Server) defaultPathHandler(w http.ResponseWriter, r *http.Request) (ns
 	if err != nil {
 		klog.Errorf("failed io operation of reading response body for %s, %+v", req.URL.String(), err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	// the content type defaults to json for NMI responses, use the one of the metadata endpoint instead
+	w.Header().Del("Content-Type")
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
 	w.Write(body)
 	return
 }
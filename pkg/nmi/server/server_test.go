@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 )
@@ -79,8 +80,138 @@ func TestMsiHandler_NoRemoteAddress(t *testing.T) {
 		t.Errorf("Unexpected status code %d", recorder.Code)
 	}
 
-	expected := "request remote address is empty"
-	if expected != strings.TrimSpace(recorder.Body.String()) {
+	resp := &ErrorResponse{
+		ErrorCode:        ErrorCodeInternalError,
+		ErrorDescription: "request remote address is empty",
+	}
+	expected, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(expected) != strings.TrimSpace(recorder.Body.String()) {
 		t.Errorf("Unexpected response body %s", recorder.Body.String())
 	}
 }
+
+func TestDefaultPathHandler_ForwardsMetadataRequests(t *testing.T) {
+	var forwarded *http.Request
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Imds-Test", "imds")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("Standard_D2s_v3"))
+	}))
+	defer imds.Close()
+
+	imdsURL, err := url.Parse(imds.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		MetadataIP:   imdsURL.Hostname(),
+		MetadataPort: imdsURL.Port(),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metadata/instance/compute/vmSize?api-version=2019-06-01&format=text", nil)
+	req.Header.Set("Metadata", "true")
+	recorder := httptest.NewRecorder()
+	s.newServeMux().ServeHTTP(recorder, req)
+
+	if forwarded == nil {
+		t.Fatal("expected the request to be forwarded to the metadata endpoint")
+	}
+	if forwarded.URL.Path != "/metadata/instance/compute/vmSize" || forwarded.URL.RawQuery != "api-version=2019-06-01&format=text" {
+		t.Errorf("unexpected forwarded request %s", forwarded.URL.String())
+	}
+	if forwarded.Header.Get("Metadata") != "true" {
+		t.Errorf("expected the metadata header to be forwarded, got: %v", forwarded.Header)
+	}
+	if recorder.Code != http.StatusAccepted {
+		t.Errorf("expected status code %d, got: %d", http.StatusAccepted, recorder.Code)
+	}
+	if recorder.Header().Get("Content-Type") != "text/plain; charset=utf-8" || recorder.Header().Get("X-Imds-Test") != "imds" {
+		t.Errorf("expected the response headers of the metadata endpoint, got: %v", recorder.Header())
+	}
+	if recorder.Body.String() != "Standard_D2s_v3" {
+		t.Errorf("unexpected response body %s", recorder.Body.String())
+	}
+}
+
+func TestServeMux_InterceptsOnlyTokenRequests(t *testing.T) {
+	forwarded := 0
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+	}))
+	defer imds.Close()
+
+	imdsURL, err := url.Parse(imds.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		MetadataIP:   imdsURL.Hostname(),
+		MetadataPort: imdsURL.Port(),
+	}
+	mux := s.newServeMux()
+
+	// a token request without remote address is handled by NMI and never forwarded
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, &http.Request{Method: http.MethodGet, URL: &url.URL{Path: tokenPath, RawQuery: "resource=https://vault.azure.net"}, Header: http.Header{}})
+	if forwarded != 0 {
+		t.Fatalf("expected the token request to be handled by NMI")
+	}
+
+	for _, path := range []string{"/metadata/instance", "/metadata/instance/compute", "/metadata/scheduledevents", "/metadata/identity/info"} {
+		recorder = httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path+"?api-version=2019-06-01", nil))
+	}
+	if forwarded != 4 {
+		t.Fatalf("expected 4 forwarded requests, got: %d", forwarded)
+	}
+}
+
+func TestServeMux_AddsResponseHeaderToTokenResponses(t *testing.T) {
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer imds.Close()
+
+	imdsURL, err := url.Parse(imds.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		MetadataIP:          imdsURL.Hostname(),
+		MetadataPort:        imdsURL.Port(),
+		ResponseHeaderName:  DefaultResponseHeader,
+		ResponseHeaderValue: "1.6.0",
+	}
+	mux := s.newServeMux()
+
+	// token responses, including errors, are served by NMI
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, &http.Request{Method: http.MethodGet, URL: &url.URL{Path: tokenPath, RawQuery: "resource=https://vault.azure.net"}, Header: http.Header{}})
+	if got := recorder.Header().Get(DefaultResponseHeader); got != "1.6.0" {
+		t.Errorf("expected header %s of the token response to be 1.6.0, got: %q", DefaultResponseHeader, got)
+	}
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/host/token?resource=https://vault.azure.net", nil))
+	if got := recorder.Header().Get(DefaultResponseHeader); got != "1.6.0" {
+		t.Errorf("expected header %s of the host token response to be 1.6.0, got: %q", DefaultResponseHeader, got)
+	}
+
+	// forwarded requests are left unmarked
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metadata/instance?api-version=2019-06-01", nil))
+	if _, ok := recorder.Header()[DefaultResponseHeader]; ok {
+		t.Errorf("expected no header %s on the forwarded response, got: %v", DefaultResponseHeader, recorder.Header())
+	}
+
+	// no header when the name is empty
+	s.ResponseHeaderName = ""
+	recorder = httptest.NewRecorder()
+	s.newServeMux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/host/token?resource=https://vault.azure.net", nil))
+	if _, ok := recorder.Header()[DefaultResponseHeader]; ok {
+		t.Errorf("expected no header %s when disabled, got: %v", DefaultResponseHeader, recorder.Header())
+	}
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/k8s"
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+func newTestToken(accessToken string, expiresIn time.Duration) adal.Token {
+	return adal.Token{
+		AccessToken: accessToken,
+		ExpiresOn:   json.Number(strconv.FormatInt(time.Now().Add(expiresIn).Unix(), 10)),
+		Resource:    warmupResource,
+		Type:        "Bearer",
+	}
+}
+
+func TestGetTokenServeStaleOnError(t *testing.T) {
+	id := newTestIdentity("id1", "clientid1")
+	cases := []struct {
+		name              string
+		serveStaleOnError bool
+		// acquired acquires a token before the token requests fail
+		acquired bool
+		// warmedExpiresIn is the expiry of the warmed up token, none is warmed up when zero
+		warmedExpiresIn time.Duration
+		claims          string
+		expectedToken   string
+	}{
+		{
+			name:              "last token served",
+			serveStaleOnError: true,
+			acquired:          true,
+			expectedToken:     "token-clientid1",
+		},
+		{
+			name:              "warmed up token expiring soon served",
+			serveStaleOnError: true,
+			warmedExpiresIn:   2 * time.Minute,
+			expectedToken:     "warmed-token",
+		},
+		{
+			name:              "expired token not served",
+			serveStaleOnError: true,
+			warmedExpiresIn:   -time.Minute,
+		},
+		{
+			name:              "no cached token",
+			serveStaleOnError: true,
+		},
+		{
+			name:              "claims challenge not served from the cache",
+			serveStaleOnError: true,
+			acquired:          true,
+			claims:            `{"access_token":{}}`,
+		},
+		{
+			name:     "disabled",
+			acquired: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tokenClient := &fakeWarmupTokenClient{failures: map[string]bool{}}
+			s := &Server{TokenClient: tokenClient, ServeStaleOnError: tc.serveStaleOnError}
+			if tc.warmedExpiresIn != 0 {
+				s.tokens.set(*id, warmupResource, newTestToken("warmed-token", tc.warmedExpiresIn))
+			}
+			if tc.acquired {
+				// a token is acquired while AAD is available
+				if _, err := s.getToken(context.Background(), "", warmupResource, "", *id); err != nil {
+					t.Fatalf("expected nil error, got: %v", err)
+				}
+			}
+
+			tokenClient.failures["clientid1"] = true
+			token, err := s.getToken(context.Background(), "", warmupResource, tc.claims, *id)
+			if tc.expectedToken == "" {
+				if err == nil {
+					t.Fatalf("expected an error, got token %s", token.AccessToken)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected nil error, got: %v", err)
+			}
+			if token.AccessToken != tc.expectedToken {
+				t.Errorf("expected token %s, got %s", tc.expectedToken, token.AccessToken)
+			}
+		})
+	}
+}
+
+func TestMsiHandlerServeStaleOnError(t *testing.T) {
+	id := newTestIdentity("id1", "clientid1")
+	tokenClient := &fakeTokenClient{podID: id}
+	s := &Server{
+		KubeClient:        &fakeKubeClient{},
+		TokenClient:       tokenClient,
+		ServeStaleOnError: true,
+	}
+	s.lastTokens.set(*id, warmupResource, newTestToken("stale-token", 30*time.Minute))
+	tokenClient.tokenErr = fakeTokenRefreshError{resp: &http.Response{StatusCode: http.StatusServiceUnavailable}}
+
+	req := httptest.NewRequest(http.MethodGet, tokenPath+"?resource="+warmupResource, nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	recorder := httptest.NewRecorder()
+	s.msiHandler(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	var resp msiResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal token response, %+v", err)
+	}
+	if resp.AccessToken != "stale-token" {
+		t.Errorf("expected the stale token to be served, got: %s", resp.AccessToken)
+	}
+}
+
+// fakeManagedKubeClient has no assigned identities, as in managed mode
+type fakeManagedKubeClient struct {
+	fakeKubeClient
+}
+
+func (c *fakeManagedKubeClient) ListAssignedIDsOnNode(nodeName string) ([]aadpodid.AzureAssignedIdentity, error) {
+	return nil, errors.New("azure assigned identities are not available in this operation mode")
+}
+
+func TestPruneLastTokens(t *testing.T) {
+	id1 := newTestIdentity("id1", "clientid1")
+	id2 := newTestIdentity("id2", "clientid2")
+	// id3 has the name of id1 with another client id, its tokens were acquired before id1 was recreated
+	id3 := newTestIdentity("id1", "clientid3")
+
+	cases := []struct {
+		name           string
+		kubeClient     k8s.Client
+		expectedCached map[string]bool
+	}{
+		{
+			name:       "standard mode",
+			kubeClient: &fakeWarmupKubeClient{assignedIDs: []aadpodid.AzureAssignedIdentity{newTestAssignedID("assigned1", "node1", aadpodid.AssignedIDAssigned, id1)}},
+			expectedCached: map[string]bool{
+				"id1":         true,
+				"id1-expired": false,
+				"id2":         false,
+				"id3":         false,
+			},
+		},
+		{
+			name:       "managed mode",
+			kubeClient: &fakeManagedKubeClient{},
+			expectedCached: map[string]bool{
+				"id1":         true,
+				"id1-expired": false,
+				"id2":         true,
+				"id3":         true,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{KubeClient: tc.kubeClient, NodeName: "node1"}
+			s.lastTokens.set(*id1, warmupResource, newTestToken("id1-arm", time.Hour))
+			s.lastTokens.set(*id1, "https://vault.azure.net", newTestToken("id1-expired", -time.Minute))
+			s.lastTokens.set(*id2, warmupResource, newTestToken("id2-arm", time.Hour))
+			s.lastTokens.set(*id3, warmupResource, newTestToken("id3-arm", time.Hour))
+
+			expectedEvicted := 0
+			for _, cached := range tc.expectedCached {
+				if !cached {
+					expectedEvicted++
+				}
+			}
+			if evicted := s.pruneLastTokens(); evicted != expectedEvicted {
+				t.Errorf("expected %d evicted tokens, got %d", expectedEvicted, evicted)
+			}
+
+			for name, cached := range map[string]bool{
+				"id1":         s.lastTokens.tokens[newTokenCacheKey(*id1, warmupResource)].AccessToken != "",
+				"id1-expired": s.lastTokens.tokens[newTokenCacheKey(*id1, "https://vault.azure.net")].AccessToken != "",
+				"id2":         s.lastTokens.tokens[newTokenCacheKey(*id2, warmupResource)].AccessToken != "",
+				"id3":         s.lastTokens.tokens[newTokenCacheKey(*id3, warmupResource)].AccessToken != "",
+			} {
+				if cached != tc.expectedCached[name] {
+					t.Errorf("expected token %s cached: %t, got: %t", name, tc.expectedCached[name], cached)
+				}
+			}
+		})
+	}
+}
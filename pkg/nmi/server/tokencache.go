@@ -0,0 +1,126 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"k8s.io/klog"
+)
+
+const (
+	// tokenExpiryWindow is how long before its expiry a cached token is no longer served
+	tokenExpiryWindow = 5 * time.Minute
+	// lastTokensPruneInterval is the interval at which the last tokens that can no longer be
+	// served are evicted
+	lastTokensPruneInterval = time.Minute
+)
+
+// tokenCacheKey identifies the token of an identity for a resource
+type tokenCacheKey struct {
+	identityNamespace string
+	identityName      string
+	clientID          string
+	resource          string
+}
+
+func newTokenCacheKey(id aadpodid.AzureIdentity, resource string) tokenCacheKey {
+	return tokenCacheKey{
+		identityNamespace: id.Namespace,
+		identityName:      id.Name,
+		clientID:          id.Spec.ClientID,
+		resource:          resource,
+	}
+}
+
+// tokenCache holds tokens of identities, such as the tokens pre-acquired by the warmup so that the
+// first token requests of pods don't need an AAD round trip. The zero value is ready to use.
+type tokenCache struct {
+	mu     sync.RWMutex
+	tokens map[tokenCacheKey]adal.Token
+}
+
+// get returns the cached token of the identity for the resource if it doesn't expire soon
+func (tc *tokenCache) get(id aadpodid.AzureIdentity, resource string) (*adal.Token, bool) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+
+	token, ok := tc.tokens[newTokenCacheKey(id, resource)]
+	if !ok || token.WillExpireIn(tokenExpiryWindow) {
+		return nil, false
+	}
+	return &token, true
+}
+
+// getUnexpired returns the cached token of the identity for the resource if it hasn't expired yet
+func (tc *tokenCache) getUnexpired(id aadpodid.AzureIdentity, resource string) (*adal.Token, bool) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+
+	token, ok := tc.tokens[newTokenCacheKey(id, resource)]
+	if !ok || token.IsExpired() {
+		return nil, false
+	}
+	return &token, true
+}
+
+func (tc *tokenCache) set(id aadpodid.AzureIdentity, resource string, token adal.Token) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.tokens == nil {
+		tc.tokens = make(map[tokenCacheKey]adal.Token)
+	}
+	tc.tokens[newTokenCacheKey(id, resource)] = token
+}
+
+// evictExpired removes the cached tokens that expired and returns the number of tokens removed
+func (tc *tokenCache) evictExpired() int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	evicted := 0
+	for key, token := range tc.tokens {
+		if token.IsExpired() {
+			delete(tc.tokens, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// pruneLastTokens evicts the last tokens that expired and, in standard mode, the last tokens of
+// the identities no longer assigned on the node, such as the deleted AzureIdentities, so the
+// tokens kept for ServeStaleOnError stay bounded. It returns the number of tokens evicted.
+func (s *Server) pruneLastTokens() int {
+	evicted := s.lastTokens.evictExpired()
+	assignedIDs, err := s.KubeClient.ListAssignedIDsOnNode(s.NodeName)
+	if err != nil {
+		// the assigned identities aren't available in managed mode, the tokens are evicted once expired
+		klog.V(6).Infof("not evicting the last tokens of unassigned identities, err: %+v", err)
+		return evicted
+	}
+	assigned := make(map[tokenCacheKey]bool)
+	for _, assignedID := range assignedIDs {
+		if id := assignedID.Spec.AzureIdentityRef; id != nil {
+			assigned[newTokenCacheKey(*id, "")] = true
+		}
+	}
+	return evicted + s.lastTokens.evict(func(key tokenCacheKey) bool {
+		key.resource = ""
+		return !assigned[key]
+	})
+}
+
+// runLastTokensPruner periodically evicts the last tokens that can no longer be served
+func (s *Server) runLastTokensPruner() {
+	ticker := time.NewTicker(lastTokensPruneInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if evicted := s.pruneLastTokens(); evicted > 0 {
+			klog.V(5).Infof("Evicted %d last tokens that expired or whose identity is no longer assigned", evicted)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"k8s.io/klog"
+)
+
+// warmupResource is the resource tokens are pre-acquired for
+var warmupResource = azure.PublicCloud.ResourceManagerEndpoint
+
+// WarmupResponse is the response of the warmup endpoint
+type WarmupResponse struct {
+	// Warmed is the number of identities a token was acquired for
+	Warmed int `json:"warmed"`
+	// Failures are the identities a token could not be acquired for
+	Failures []WarmupFailure `json:"failures"`
+}
+
+// WarmupFailure is an identity a token could not be acquired for during the warmup
+type WarmupFailure struct {
+	IdentityNamespace string `json:"identityNamespace"`
+	IdentityName      string `json:"identityName"`
+	ClientID          string `json:"clientID"`
+	Error             string `json:"error"`
+}
+
+// warmup acquires a management token for each identity assigned to the pods on the node and
+// caches it, so it's served to the pods without an AAD round trip
+func (s *Server) warmup(ctx context.Context) (WarmupResponse, error) {
+	res := WarmupResponse{Failures: []WarmupFailure{}}
+	assignedIDs, err := s.KubeClient.ListAssignedIDsOnNode(s.NodeName)
+	if err != nil {
+		return res, err
+	}
+
+	warmed := make(map[tokenCacheKey]bool)
+	for _, assignedID := range assignedIDs {
+		id := assignedID.Spec.AzureIdentityRef
+		// assigned identities with no state were created by an old version of mic
+		if id == nil || (assignedID.Status.Status != aadpodid.AssignedIDAssigned && assignedID.Status.Status != "") {
+			continue
+		}
+		key := newTokenCacheKey(*id, warmupResource)
+		if warmed[key] {
+			continue
+		}
+		warmed[key] = true
+
+		token, err := s.TokenClient.GetToken(ctx, id.Spec.ClientID, warmupResource, "", *id)
+		if err != nil {
+			klog.Errorf("failed to warm up token for identity %s/%s, err: %+v", id.Namespace, id.Name, err)
+			res.Failures = append(res.Failures, WarmupFailure{
+				IdentityNamespace: id.Namespace,
+				IdentityName:      id.Name,
+				ClientID:          id.Spec.ClientID,
+				Error:             err.Error(),
+			})
+			continue
+		}
+		s.tokens.set(*id, warmupResource, *token)
+		res.Warmed++
+	}
+	return res, nil
+}
+
+// warmupHandler pre-acquires tokens for the identities assigned to the pods on the node and
+// reports how many identities were warmed up and the ones that failed
+func (s *Server) warmupHandler(w http.ResponseWriter, r *http.Request) (ns string) {
+	if parseRemoteAddr(r.RemoteAddr) != localhost {
+		klog.Errorf("request remote address is not from a host")
+		writeErrorResponse(w, ErrorCodeUnauthorized, "request remote address is not from a host", http.StatusForbidden)
+		return
+	}
+	res, err := s.warmup(r.Context())
+	if err != nil {
+		klog.Errorf("failed to list assigned identities on node %s, err: %+v", s.NodeName, err)
+		writeErrorResponse(w, ErrorCodeInternalError, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response, err := json.Marshal(res)
+	if err != nil {
+		klog.Errorf("failed to marshal warmup response, err: %+v", err)
+		writeErrorResponse(w, ErrorCodeInternalError, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+	return
+}
+
+// runWarmer warms up the tokens of the identities assigned on the node at every warmup interval
+func (s *Server) runWarmer() {
+	ticker := time.NewTicker(s.WarmupInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		res, err := s.warmup(context.Background())
+		if err != nil {
+			klog.Errorf("failed to list assigned identities on node %s, err: %+v", s.NodeName, err)
+			continue
+		}
+		klog.Infof("Warmed up tokens for %d identities, %d failed", res.Warmed, len(res.Failures))
+	}
+}
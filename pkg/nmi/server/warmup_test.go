@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/go-autorest/autorest/adal"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeWarmupKubeClient struct {
+	fakeKubeClient
+	assignedIDs []aadpodid.AzureAssignedIdentity
+}
+
+func (c *fakeWarmupKubeClient) ListAssignedIDsOnNode(nodeName string) ([]aadpodid.AzureAssignedIdentity, error) {
+	var assignedIDs []aadpodid.AzureAssignedIdentity
+	for _, assignedID := range c.assignedIDs {
+		if assignedID.Spec.NodeName == nodeName {
+			assignedIDs = append(assignedIDs, assignedID)
+		}
+	}
+	return assignedIDs, nil
+}
+
+// fakeWarmupTokenClient issues tokens valid for an hour and fails for the client ids in failures
+type fakeWarmupTokenClient struct {
+	fakeTokenClient
+	failures map[string]bool
+	requests int
+}
+
+func (c *fakeWarmupTokenClient) GetToken(ctx context.Context, clientID, resource, claims string, podID aadpodid.AzureIdentity) (*adal.Token, error) {
+	c.requests++
+	if c.failures[podID.Spec.ClientID] {
+		return nil, errors.New("token request failed")
+	}
+	return &adal.Token{
+		AccessToken: "token-" + podID.Spec.ClientID,
+		ExpiresOn:   json.Number(strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)),
+		Resource:    resource,
+		Type:        "Bearer",
+	}, nil
+}
+
+func newTestAssignedID(name, nodeName, status string, id *aadpodid.AzureIdentity) aadpodid.AzureAssignedIdentity {
+	return aadpodid.AzureAssignedIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       aadpodid.AzureAssignedIdentitySpec{AzureIdentityRef: id, NodeName: nodeName},
+		Status:     aadpodid.AzureAssignedIdentityStatus{Status: status},
+	}
+}
+
+func newTestIdentity(name, clientID string) *aadpodid.AzureIdentity {
+	return &aadpodid.AzureIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       aadpodid.AzureIdentitySpec{Type: aadpodid.UserAssignedMSI, ClientID: clientID},
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	id1 := newTestIdentity("id1", "clientid1")
+	id2 := newTestIdentity("id2", "clientid2")
+	id3 := newTestIdentity("id3", "clientid3")
+	id4 := newTestIdentity("id4", "clientid4")
+	kubeClient := &fakeWarmupKubeClient{assignedIDs: []aadpodid.AzureAssignedIdentity{
+		newTestAssignedID("pod1-id1", "node1", aadpodid.AssignedIDAssigned, id1),
+		// the same identity assigned to another pod is only warmed up once
+		newTestAssignedID("pod2-id1", "node1", aadpodid.AssignedIDAssigned, id1),
+		newTestAssignedID("pod1-id2", "node1", aadpodid.AssignedIDAssigned, id2),
+		// identities not assigned yet or on other nodes are not warmed up
+		newTestAssignedID("pod1-id3", "node1", aadpodid.AssignedIDCreated, id3),
+		newTestAssignedID("pod3-id4", "node2", aadpodid.AssignedIDAssigned, id4),
+	}}
+	tokenClient := &fakeWarmupTokenClient{failures: map[string]bool{"clientid2": true}}
+	s := &Server{
+		KubeClient:  kubeClient,
+		TokenClient: tokenClient,
+		NodeName:    "node1",
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/warmup", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	recorder := httptest.NewRecorder()
+	s.warmupHandler(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got: %d", http.StatusOK, recorder.Code)
+	}
+	var resp WarmupResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal warmup response, %+v", err)
+	}
+	if resp.Warmed != 1 {
+		t.Errorf("expected 1 identity to be warmed up, got: %d", resp.Warmed)
+	}
+	if len(resp.Failures) != 1 || resp.Failures[0].IdentityName != "id2" || resp.Failures[0].Error == "" {
+		t.Errorf("expected warmup of id2 to fail, got: %+v", resp.Failures)
+	}
+	if tokenClient.requests != 2 {
+		t.Errorf("expected 2 token requests, got: %d", tokenClient.requests)
+	}
+
+	if _, ok := s.tokens.get(*id1, warmupResource); !ok {
+		t.Errorf("expected token of id1 to be cached")
+	}
+	for _, id := range []*aadpodid.AzureIdentity{id2, id3, id4} {
+		if _, ok := s.tokens.get(*id, warmupResource); ok {
+			t.Errorf("expected no token cached for %s", id.Name)
+		}
+	}
+}
+
+func TestWarmupHandlerUnauthorized(t *testing.T) {
+	s := &Server{
+		KubeClient:  &fakeWarmupKubeClient{},
+		TokenClient: &fakeWarmupTokenClient{},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/warmup", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	recorder := httptest.NewRecorder()
+	s.warmupHandler(recorder, req)
+
+	assertErrorResponse(t, "not from host", recorder, http.StatusForbidden, ErrorCodeUnauthorized)
+}
+
+func TestMsiHandlerServesWarmedUpToken(t *testing.T) {
+	id := newTestIdentity("id1", "clientid1")
+	tokenClient := &fakeWarmupTokenClient{fakeTokenClient: fakeTokenClient{podID: id}}
+	s := &Server{
+		KubeClient:  &fakeWarmupKubeClient{},
+		TokenClient: tokenClient,
+	}
+	s.tokens.set(*id, warmupResource, adal.Token{
+		AccessToken: "warmed-token",
+		ExpiresOn:   json.Number(strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)),
+		Resource:    warmupResource,
+	})
+
+	req := httptest.NewRequest(http.MethodGet, tokenPath+"?resource="+warmupResource, nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	recorder := httptest.NewRecorder()
+	s.msiHandler(recorder, req)
+
+	var resp msiResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal token response, %+v", err)
+	}
+	if resp.AccessToken != "warmed-token" {
+		t.Errorf("expected warmed up token to be served, got: %s", resp.AccessToken)
+	}
+	if tokenClient.requests != 0 {
+		t.Errorf("expected no token requests, got: %d", tokenClient.requests)
+	}
+}
+
+func TestTokenCacheExpiry(t *testing.T) {
+	id := newTestIdentity("id1", "clientid1")
+	var tc tokenCache
+	tc.set(*id, warmupResource, adal.Token{
+		AccessToken: "token",
+		ExpiresOn:   json.Number(strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)),
+	})
+	if _, ok := tc.get(*id, warmupResource); ok {
+		t.Errorf("expected token expiring within %s not to be served", tokenExpiryWindow)
+	}
+	if _, ok := tc.get(*id, "https://vault.azure.net"); ok {
+		t.Errorf("expected no token for another resource")
+	}
+}
@@ -66,6 +66,17 @@ func (sc *StandardClient) GetIdentities(ctx context.Context, podns, podname, cli
 		}
 	}
 
+	// if client id doesn't exist in the request and multiple identities are assigned to the pod, then
+	// prefer the system assigned identity which, unlike the others, can't be requested by client id
+	if len(clientID) == 0 && len(filterPodIdentities) > 1 {
+		for _, id := range filterPodIdentities {
+			if id.Spec.Type == aadpodid.SystemAssignedMSI {
+				klog.Infof("No clientID in request. %s/%s has been matched with system assigned azure identity %s/%s", podns, podname, id.Namespace, id.Name)
+				return &id, nil
+			}
+		}
+	}
+
 	for _, id := range filterPodIdentities {
 		// if client doesn't exist in the request, then return the first identity
 		if len(clientID) == 0 {
@@ -73,7 +84,7 @@ func (sc *StandardClient) GetIdentities(ctx context.Context, podns, podname, cli
 			return &id, nil
 		}
 		// if client id exists in the request, then send the first identity that matched the client id
-		if len(clientID) != 0 && id.Spec.ClientID == clientID {
+		if len(clientID) != 0 && strings.EqualFold(id.Spec.ClientID, clientID) {
 			return &id, nil
 		}
 	}
@@ -151,7 +162,7 @@ func (sc *StandardClient) listPodIDsWithRetry(ctx context.Context, podns, podnam
 }
 
 // GetToken ...
-func (sc *StandardClient) GetToken(ctx context.Context, rqClientID, rqResource string, azureID aadpodid.AzureIdentity) (token *adal.Token, err error) {
+func (sc *StandardClient) GetToken(ctx context.Context, rqClientID, rqResource, rqClaims string, azureID aadpodid.AzureIdentity) (token *adal.Token, err error) {
 	rqHasClientID := len(rqClientID) != 0
 	clientID := azureID.Spec.ClientID
 
@@ -162,6 +173,9 @@ func (sc *StandardClient) GetToken(ctx context.Context, rqClientID, rqResource s
 			klog.Warningf("clientid mismatch, requested:%s available:%s", rqClientID, clientID)
 		}
 		klog.Infof("matched identityType:%v clientid:%s resource:%s", idType, utils.RedactClientID(clientID), rqResource)
+		if rqClaims != "" {
+			klog.Warningf("claims challenge can't be forwarded by the instance metadata service, acquiring token for clientid:%s without it", utils.RedactClientID(clientID))
+		}
 		token, err := auth.GetServicePrincipalTokenFromMSIWithUserAssignedID(clientID, rqResource)
 		return token, err
 	case aadpodid.ServicePrincipal:
@@ -176,7 +190,14 @@ func (sc *StandardClient) GetToken(ctx context.Context, rqClientID, rqResource s
 			clientSecret = string(v)
 			break
 		}
-		token, err := auth.GetServicePrincipalToken(tenantid, clientID, clientSecret, rqResource)
+		token, err := auth.GetServicePrincipalToken(tenantid, clientID, clientSecret, rqResource, rqClaims)
+		return token, err
+	case aadpodid.SystemAssignedMSI:
+		klog.Infof("matched identityType:%v resource:%s", idType, rqResource)
+		if rqClaims != "" {
+			klog.Warningf("claims challenge can't be forwarded by the instance metadata service, acquiring token for the system assigned identity without it")
+		}
+		token, err := auth.GetServicePrincipalTokenFromMSI(rqResource)
 		return token, err
 	default:
 		return nil, fmt.Errorf("unsupported identity type %+v", idType)
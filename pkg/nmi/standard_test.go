@@ -3,8 +3,14 @@ package nmi
 import (
 	"context"
 	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
 	auth "github.com/Azure/aad-pod-identity/pkg/auth"
@@ -69,7 +75,76 @@ func TestGetTokenForMatchingIDBySP(t *testing.T) {
 			ClientPassword: secretRef,
 		},
 	}
-	tokenClient.GetToken(context.Background(), podID.Spec.ClientID, "https://management.azure.com/", podID)
+	tokenClient.GetToken(context.Background(), podID.Spec.ClientID, "https://management.azure.com/", "", podID)
+}
+
+// roundTripperFunc answers the requests of a client with the function
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestGetTokenForMSITypes(t *testing.T) {
+	reporter, err := metrics.NewReporter()
+	if err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	auth.InitReporter(reporter)
+
+	resource := "https://management.azure.com/"
+	var queries []url.Values
+	auth.InitUpstreamClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		queries = append(queries, r.URL.Query())
+		expiresOn := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		body := `{"access_token":"token","expires_in":"3600","expires_on":"` + expiresOn + `","not_before":"` + expiresOn + `","resource":"` + resource + `","token_type":"Bearer"}`
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}, nil
+	})})
+	defer auth.InitUpstreamClient(nil)
+
+	tokenClient, err := NewStandardTokenClient(NewTestKubeClient(nil), Config{})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+
+	cases := []struct {
+		name             string
+		azureID          aadpodid.AzureIdentity
+		expectedClientID string
+	}{
+		{
+			name:             "user assigned msi",
+			azureID:          aadpodid.AzureIdentity{Spec: aadpodid.AzureIdentitySpec{Type: aadpodid.UserAssignedMSI, ClientID: "clientid-msi"}},
+			expectedClientID: "clientid-msi",
+		},
+		{
+			name:    "system assigned msi",
+			azureID: aadpodid.AzureIdentity{Spec: aadpodid.AzureIdentitySpec{Type: aadpodid.SystemAssignedMSI}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			queries = nil
+			token, err := tokenClient.GetToken(context.Background(), "", resource, "", tc.azureID)
+			if err != nil {
+				t.Fatalf("expected nil error, got: %v", err)
+			}
+			if token == nil || token.AccessToken != "token" {
+				t.Fatalf("expected the token of the instance metadata service, got: %+v", token)
+			}
+			if len(queries) != 1 {
+				t.Fatalf("expected 1 token request, got: %d", len(queries))
+			}
+			if clientID := queries[0].Get("client_id"); clientID != tc.expectedClientID {
+				t.Fatalf("expected the token request for client id %q, got: %q", tc.expectedClientID, clientID)
+			}
+		})
+	}
 }
 
 func TestGetIdentitiesStandardClient(t *testing.T) {
@@ -321,6 +396,235 @@ func TestGetIdentitiesStandardClient(t *testing.T) {
 			podNamespace: "testns",
 			isNamespaced: true,
 		},
+		{
+			name: "client id in request, user assigned msi routed with multiple identity types assigned",
+			azureIdentities: map[string][]aadpodid.AzureIdentity{
+				aadpodid.AssignedIDAssigned: []aadpodid.AzureIdentity{
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid-msi",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							Type:     aadpodid.UserAssignedMSI,
+							ClientID: "clientid-msi",
+						},
+					},
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid-sp",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							Type:     aadpodid.ServicePrincipal,
+							ClientID: "clientid-sp",
+						},
+					},
+				},
+			},
+			expectedErr: false,
+			expectedAzureIdentity: &aadpodid.AzureIdentity{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azid-msi",
+					Namespace: "default",
+				},
+				Spec: aadpodid.AzureIdentitySpec{
+					Type:     aadpodid.UserAssignedMSI,
+					ClientID: "clientid-msi",
+				},
+			},
+			podName:      "pod9",
+			podNamespace: "default",
+			clientID:     "clientid-msi",
+		},
+		{
+			name: "client id in request, service principal routed with multiple identity types assigned",
+			azureIdentities: map[string][]aadpodid.AzureIdentity{
+				aadpodid.AssignedIDAssigned: []aadpodid.AzureIdentity{
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid-msi",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							Type:     aadpodid.UserAssignedMSI,
+							ClientID: "clientid-msi",
+						},
+					},
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid-sp",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							Type:     aadpodid.ServicePrincipal,
+							ClientID: "clientid-sp",
+						},
+					},
+				},
+			},
+			expectedErr: false,
+			expectedAzureIdentity: &aadpodid.AzureIdentity{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azid-sp",
+					Namespace: "default",
+				},
+				Spec: aadpodid.AzureIdentitySpec{
+					Type:     aadpodid.ServicePrincipal,
+					ClientID: "clientid-sp",
+				},
+			},
+			podName:      "pod10",
+			podNamespace: "default",
+			clientID:     "CLIENTID-SP",
+		},
+		{
+			name: "no request client id, system assigned msi preferred over user assigned msi",
+			azureIdentities: map[string][]aadpodid.AzureIdentity{
+				aadpodid.AssignedIDAssigned: []aadpodid.AzureIdentity{
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid-msi",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							Type:     aadpodid.UserAssignedMSI,
+							ClientID: "clientid-msi",
+						},
+					},
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid-system",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							Type: aadpodid.SystemAssignedMSI,
+						},
+					},
+				},
+			},
+			expectedErr: false,
+			expectedAzureIdentity: &aadpodid.AzureIdentity{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azid-system",
+					Namespace: "default",
+				},
+				Spec: aadpodid.AzureIdentitySpec{
+					Type: aadpodid.SystemAssignedMSI,
+				},
+			},
+			podName:      "pod11",
+			podNamespace: "default",
+		},
+		{
+			name: "no request client id, system assigned msi preferred regardless of the order",
+			azureIdentities: map[string][]aadpodid.AzureIdentity{
+				aadpodid.AssignedIDAssigned: []aadpodid.AzureIdentity{
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid-system",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							Type: aadpodid.SystemAssignedMSI,
+						},
+					},
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid-msi",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							Type:     aadpodid.UserAssignedMSI,
+							ClientID: "clientid-msi",
+						},
+					},
+				},
+			},
+			expectedErr: false,
+			expectedAzureIdentity: &aadpodid.AzureIdentity{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azid-system",
+					Namespace: "default",
+				},
+				Spec: aadpodid.AzureIdentitySpec{
+					Type: aadpodid.SystemAssignedMSI,
+				},
+			},
+			podName:      "pod12",
+			podNamespace: "default",
+		},
+		{
+			name: "client id in request, user assigned msi routed with system assigned msi assigned",
+			azureIdentities: map[string][]aadpodid.AzureIdentity{
+				aadpodid.AssignedIDAssigned: []aadpodid.AzureIdentity{
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid-system",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							Type: aadpodid.SystemAssignedMSI,
+						},
+					},
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid-msi",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							Type:     aadpodid.UserAssignedMSI,
+							ClientID: "clientid-msi",
+						},
+					},
+				},
+			},
+			expectedErr: false,
+			expectedAzureIdentity: &aadpodid.AzureIdentity{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azid-msi",
+					Namespace: "default",
+				},
+				Spec: aadpodid.AzureIdentitySpec{
+					Type:     aadpodid.UserAssignedMSI,
+					ClientID: "clientid-msi",
+				},
+			},
+			podName:      "pod13",
+			podNamespace: "default",
+			clientID:     "clientid-msi",
+		},
+		{
+			name: "client id in request not matching, system assigned msi not used",
+			azureIdentities: map[string][]aadpodid.AzureIdentity{
+				aadpodid.AssignedIDAssigned: []aadpodid.AzureIdentity{
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid-msi",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							Type:     aadpodid.UserAssignedMSI,
+							ClientID: "clientid-msi",
+						},
+					},
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid-system",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							Type: aadpodid.SystemAssignedMSI,
+						},
+					},
+				},
+			},
+			expectedErr:           true,
+			expectedAzureIdentity: nil,
+			podName:               "pod14",
+			podNamespace:          "default",
+			clientID:              "clientid-unknown",
+		},
 	}
 
 	for i, tc := range cases {
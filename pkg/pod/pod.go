@@ -20,6 +20,9 @@ import (
 // Client represents new pod client
 type Client struct {
 	PodWatcher informersv1.PodInformer
+	// MatchAnnotation is an optional pod annotation key that is consulted as a
+	// fallback selector for pods without the aadpodidbinding label.
+	MatchAnnotation string
 }
 
 // ClientInt represents pod client interface
@@ -29,12 +32,13 @@ type ClientInt interface {
 }
 
 // NewPodClient returns new pod client
-func NewPodClient(i informers.SharedInformerFactory, eventCh chan aadpodid.EventType) (c ClientInt) {
+func NewPodClient(i informers.SharedInformerFactory, eventCh chan aadpodid.EventType, matchAnnotation string) (c ClientInt) {
 	podInformer := i.Core().V1().Pods()
 	addPodHandler(podInformer, eventCh)
 
 	return &Client{
-		PodWatcher: podInformer,
+		PodWatcher:      podInformer,
+		MatchAnnotation: matchAnnotation,
 	}
 }
 
@@ -84,6 +88,23 @@ func (c *Client) Start(exit <-chan struct{}) {
 // GetPods returns list of all pods
 func (c *Client) GetPods() (pods []*v1.Pod, err error) {
 	begin := time.Now()
+	if c.MatchAnnotation != "" {
+		// annotations can't be used in a selector, so list everything and
+		// filter the pods that have either the label or the annotation.
+		allPods, err := c.PodWatcher.Lister().List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range allPods {
+			_, hasLabel := pod.Labels[aadpodid.CRDLabelKey]
+			_, hasAnnotation := pod.Annotations[c.MatchAnnotation]
+			if hasLabel || hasAnnotation {
+				pods = append(pods, pod)
+			}
+		}
+		stats.Put(stats.PodList, time.Since(begin))
+		return pods, nil
+	}
 	crdReq, err := labels.NewRequirement(aadpodid.CRDLabelKey, selection.Exists, nil)
 	if err != nil {
 		klog.Error(err)
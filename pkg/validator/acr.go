@@ -0,0 +1,109 @@
+package validator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+// CheckACR exchanges a token of the identity for an Azure Container Registry refresh token
+const CheckACR = "ACR"
+
+// acrResource is the audience of the AAD tokens accepted by Azure Container Registry
+const acrResource = "https://containerregistry.azure.net"
+
+// testACR acquires a token for the container registry audience with the identity of the options
+// and exchanges it for a refresh token of the registry at ACRServer. The exchange succeeds
+// when the registry accepts the identity, which is required to pull images with it.
+func testACR(ctx context.Context, opts Options) error {
+	registry, err := acrRegistryURL(opts.ACRServer)
+	if err != nil {
+		return err
+	}
+
+	token, err := acquireToken(ctx, opts, acrResource)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to acquire a token for %s with %s", acrResource, opts.identity())
+	}
+	writeToken(opts, CheckACR, opts.identity(), token)
+
+	form := url.Values{}
+	form.Set("grant_type", "access_token")
+	form.Set("service", registry.Host)
+	form.Set("access_token", token.AccessToken)
+	if opts.useServicePrincipal() {
+		form.Set("tenant", opts.SPTenantID)
+	}
+	exchangeURL := registry.String() + "/oauth2/exchange"
+
+	klog.Infof("Verifying the access of %s to container registry %s", opts.identity(), registry.Host)
+	var body []byte
+	attempts, err := retryOnTransientError(ctx, transientRetryAttempts, transientRetryInterval, func() error {
+		req, err := http.NewRequest(http.MethodPost, exchangeURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := newSender(opts).Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return autorest.DetailedError{
+				StatusCode: resp.StatusCode,
+				Message:    fmt.Sprintf("token exchange responded with status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body))),
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to exchange the token for a refresh token of container registry %s, %s", registry.Host, failureReason(err, attempts, opts.identity(), registry.Host))
+	}
+
+	var exchange struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(body, &exchange); err != nil {
+		return errors.Wrapf(err, "Failed to parse the token exchange response of container registry %s", registry.Host)
+	}
+	if exchange.RefreshToken == "" {
+		return errors.Errorf("No refresh token found in the token exchange response of container registry %s", registry.Host)
+	}
+	if err := assertTokenTTL(opts, CheckACR, opts.identity(), token); err != nil {
+		return err
+	}
+
+	// the refresh token is a credential to the registry and is never written or logged
+	klog.Infof("Successfully exchanged the token of %s for a refresh token of container registry %s", opts.identity(), registry.Host)
+	return nil
+}
+
+// acrRegistryURL returns the URL of the container registry login server, e.g. myregistry.azurecr.io.
+// https is used when the server has no scheme.
+func acrRegistryURL(server string) (*url.URL, error) {
+	if !strings.Contains(server, "://") {
+		server = "https://" + server
+	}
+	u, err := url.Parse(strings.TrimSuffix(server, "/"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse container registry server %s", server)
+	}
+	if u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return nil, errors.Errorf("container registry server %s must be a login server, e.g. myregistry.azurecr.io", server)
+	}
+	u.Path = ""
+	return u, nil
+}
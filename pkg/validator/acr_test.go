@@ -0,0 +1,132 @@
+package validator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTestACR(t *testing.T) {
+	cases := []struct {
+		name        string
+		status      int
+		response    string
+		expectedErr string
+	}{
+		{
+			name:     "exchange succeeds",
+			status:   http.StatusOK,
+			response: `{"refresh_token":"refreshtoken"}`,
+		},
+		{
+			name:        "identity not authorized",
+			status:      http.StatusUnauthorized,
+			response:    `{"errors":[{"code":"UNAUTHORIZED"}]}`,
+			expectedErr: "is not authorized to access",
+		},
+		{
+			name:        "no refresh token",
+			status:      http.StatusOK,
+			response:    `{}`,
+			expectedErr: "No refresh token found",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			msi, _ := newTokenServer(issueToken(tokenResponse{accessToken: "aadtoken", resource: acrResource}))
+			defer msi.Close()
+
+			var form url.Values
+			registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/oauth2/exchange" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+				if err := r.ParseForm(); err != nil {
+					t.Errorf("failed to parse the form: %v", err)
+				}
+				form = r.PostForm
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, tc.response)
+			}))
+			defer registry.Close()
+
+			opts := Options{MSIEndpoint: msi.URL, IdentityClientID: "clientid", ACRServer: registry.URL}
+			err := testACR(context.Background(), opts)
+			if tc.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("expected nil error, got: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+				t.Fatalf("expected error containing %q, got: %v", tc.expectedErr, err)
+			}
+
+			expected := url.Values{
+				"grant_type":   {"access_token"},
+				"service":      {strings.TrimPrefix(registry.URL, "http://")},
+				"access_token": {"aadtoken"},
+			}
+			if form.Encode() != expected.Encode() {
+				t.Errorf("expected the exchange form %v, got %v", expected, form)
+			}
+		})
+	}
+}
+
+func TestACRRegistryURL(t *testing.T) {
+	cases := []struct {
+		server      string
+		expected    string
+		expectedErr bool
+	}{
+		{server: "myregistry.azurecr.io", expected: "https://myregistry.azurecr.io"},
+		{server: "https://myregistry.azurecr.io/", expected: "https://myregistry.azurecr.io"},
+		{server: "http://127.0.0.1:5000", expected: "http://127.0.0.1:5000"},
+		{server: "myregistry.azurecr.io/repository", expectedErr: true},
+	}
+
+	for _, tc := range cases {
+		u, err := acrRegistryURL(tc.server)
+		if tc.expectedErr {
+			if err == nil {
+				t.Errorf("expected an error for %s, got %s", tc.server, u)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expected nil error for %s, got: %v", tc.server, err)
+			continue
+		}
+		if u.String() != tc.expected {
+			t.Errorf("expected %s for %s, got %s", tc.expected, tc.server, u)
+		}
+	}
+}
+
+func TestValidateACR(t *testing.T) {
+	msi, _ := newTokenServer(issueToken(tokenResponse{accessToken: "aadtoken", resource: acrResource}))
+	defer msi.Close()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"refresh_token":"refreshtoken"}`)
+	}))
+	defer registry.Close()
+
+	opts := Options{
+		MSIEndpoint:      msi.URL,
+		IdentityClientID: "clientid",
+		Resource:         acrResource,
+		TokenOnly:        true,
+		ACRServer:        registry.URL,
+	}
+	result, err := Validate(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+	if len(result.Checks) != 2 || result.Checks[0].Name != CheckToken || result.Checks[1].Name != CheckACR {
+		t.Errorf("expected the token and ACR checks to be run, got: %+v", result.Checks)
+	}
+}
@@ -0,0 +1,77 @@
+package validator
+
+import (
+	"strings"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+// CheckAssignment verifies the identity of the options is assigned to the pod
+const CheckAssignment = "Assignment"
+
+// AssignmentLister lists the AzureAssignedIdentities of a pod
+type AssignmentLister interface {
+	ListPodAssignedIDs(podName, podNamespace string) ([]aadpodid.AzureAssignedIdentity, error)
+}
+
+// AssignmentListerFunc is an AssignmentLister calling the func
+type AssignmentListerFunc func(podName, podNamespace string) ([]aadpodid.AzureAssignedIdentity, error)
+
+// ListPodAssignedIDs calls the func
+func (f AssignmentListerFunc) ListPodAssignedIDs(podName, podNamespace string) ([]aadpodid.AzureAssignedIdentity, error) {
+	return f(podName, podNamespace)
+}
+
+// verifyAssignment looks up the AzureAssignedIdentities of the pod and returns an error naming the
+// expected and the assigned identities unless the identity selected by the client id or resource
+// id of the options is assigned to the pod
+func verifyAssignment(opts Options) error {
+	if opts.IdentityClientID == "" && opts.IdentityResourceID == "" {
+		return errors.Errorf("the assignment check requires the client id or the resource id of the expected identity")
+	}
+	if opts.PodName == "" || opts.PodNamespace == "" {
+		return errors.Errorf("the assignment check requires the name and namespace of the pod")
+	}
+	pod := opts.PodNamespace + "/" + opts.PodName
+
+	assignedIDs, err := opts.AssignmentLister.ListPodAssignedIDs(opts.PodName, opts.PodNamespace)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to list the AzureAssignedIdentities of pod %s", pod)
+	}
+	if len(assignedIDs) == 0 {
+		return errors.Errorf("expected %s to be assigned to pod %s, but no AzureAssignedIdentity exists for the pod", opts.identity(), pod)
+	}
+
+	var actual []string
+	for _, assignedID := range assignedIDs {
+		id := assignedID.Spec.AzureIdentityRef
+		if !matchesIdentity(opts, id) {
+			actual = append(actual, describeAssignedIdentity(id))
+			continue
+		}
+		if assignedID.Status.Status != aadpodid.AssignedIDAssigned {
+			return errors.Errorf("%s is assigned to pod %s by AzureAssignedIdentity %s/%s but is in the %q state, not %q yet",
+				opts.identity(), pod, assignedID.Namespace, assignedID.Name, assignedID.Status.Status, aadpodid.AssignedIDAssigned)
+		}
+		klog.Infof("Verified %s is assigned to pod %s by AzureAssignedIdentity %s/%s", opts.identity(), pod, assignedID.Namespace, assignedID.Name)
+		return nil
+	}
+	return errors.Errorf("identity mismatch: expected %s to be assigned to pod %s, but the assigned identities are: %s",
+		opts.identity(), pod, strings.Join(actual, "; "))
+}
+
+// matchesIdentity returns true if the identity is the one selected by the client id or resource id
+// of the options. Resource ids are compared case insensitively as their case isn't preserved by ARM.
+func matchesIdentity(opts Options, id *aadpodid.AzureIdentity) bool {
+	if opts.IdentityClientID != "" {
+		return strings.EqualFold(id.Spec.ClientID, opts.IdentityClientID)
+	}
+	return strings.EqualFold(id.Spec.ResourceID, opts.IdentityResourceID)
+}
+
+// describeAssignedIdentity returns the AzureIdentity, client id and resource id of the identity
+func describeAssignedIdentity(id *aadpodid.AzureIdentity) string {
+	return "AzureIdentity " + id.Namespace + "/" + id.Name + " with client id " + id.Spec.ClientID + " and resource id " + id.Spec.ResourceID
+}
@@ -0,0 +1,128 @@
+package validator
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newAssignedID(name, clientID, resourceID, status string) aadpodid.AzureAssignedIdentity {
+	return aadpodid.AzureAssignedIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: "validator-default-" + name, Namespace: "default"},
+		Spec: aadpodid.AzureAssignedIdentitySpec{
+			AzureIdentityRef: &aadpodid.AzureIdentity{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+				Spec:       aadpodid.AzureIdentitySpec{ClientID: clientID, ResourceID: resourceID},
+			},
+			Pod:          "validator",
+			PodNamespace: "default",
+		},
+		Status: aadpodid.AzureAssignedIdentityStatus{Status: status},
+	}
+}
+
+func TestVerifyAssignment(t *testing.T) {
+	resourceID := "/subscriptions/sub/resourcegroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id1"
+	assigned := []aadpodid.AzureAssignedIdentity{
+		newAssignedID("id1", "clientid1", resourceID, aadpodid.AssignedIDAssigned),
+		newAssignedID("id2", "clientid2", "", aadpodid.AssignedIDCreated),
+	}
+	cases := []struct {
+		name        string
+		opts        Options
+		assignedIDs []aadpodid.AzureAssignedIdentity
+		listErr     error
+		expectedErr []string
+	}{
+		{
+			name:        "client id is assigned",
+			opts:        Options{IdentityClientID: "clientid1"},
+			assignedIDs: assigned,
+		},
+		{
+			name:        "resource id is assigned, compared case insensitively",
+			opts:        Options{IdentityResourceID: strings.ToUpper(resourceID)},
+			assignedIDs: assigned,
+		},
+		{
+			name:        "mismatch names the expected and the assigned identities",
+			opts:        Options{IdentityClientID: "clientid3"},
+			assignedIDs: assigned[:1],
+			expectedErr: []string{"identity mismatch", "client id clientid3", "AzureIdentity default/id1 with client id clientid1"},
+		},
+		{
+			name:        "identity not assigned yet",
+			opts:        Options{IdentityClientID: "clientid2"},
+			assignedIDs: assigned,
+			expectedErr: []string{"client id clientid2", aadpodid.AssignedIDCreated},
+		},
+		{
+			name:        "no assigned identity",
+			opts:        Options{IdentityClientID: "clientid1"},
+			expectedErr: []string{"no AzureAssignedIdentity exists for the pod"},
+		},
+		{
+			name:        "list error",
+			opts:        Options{IdentityClientID: "clientid1"},
+			listErr:     errors.New("forbidden"),
+			expectedErr: []string{"Failed to list the AzureAssignedIdentities of pod default/validator", "forbidden"},
+		},
+		{
+			name:        "no expected identity",
+			opts:        Options{IdentityObjectID: "objectid"},
+			expectedErr: []string{"requires the client id or the resource id"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.opts
+			opts.PodName, opts.PodNamespace = "validator", "default"
+			opts.AssignmentLister = AssignmentListerFunc(func(podName, podNamespace string) ([]aadpodid.AzureAssignedIdentity, error) {
+				if podName != "validator" || podNamespace != "default" {
+					t.Errorf("expected the assigned identities of default/validator to be listed, got %s/%s", podNamespace, podName)
+				}
+				return tc.assignedIDs, tc.listErr
+			})
+
+			err := verifyAssignment(opts)
+			if len(tc.expectedErr) == 0 {
+				if err != nil {
+					t.Fatalf("expected nil error, got: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected error containing %v, got nil", tc.expectedErr)
+			}
+			for _, expected := range tc.expectedErr {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("expected error containing %q, got: %v", expected, err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateVerifiesAssignmentFirst(t *testing.T) {
+	opts := Options{
+		MSIEndpoint:      "http://127.0.0.1:1",
+		IdentityClientID: "clientid3",
+		PodName:          "validator",
+		PodNamespace:     "default",
+		AssignmentLister: AssignmentListerFunc(func(podName, podNamespace string) ([]aadpodid.AzureAssignedIdentity, error) {
+			return []aadpodid.AzureAssignedIdentity{newAssignedID("id1", "clientid1", "", aadpodid.AssignedIDAssigned)}, nil
+		}),
+	}
+	result, err := Validate(context.Background(), opts)
+	if err == nil || !strings.Contains(err.Error(), "identity mismatch") {
+		t.Fatalf("expected identity mismatch error, got: %v", err)
+	}
+	if len(result.Checks) != 1 || result.Checks[0].Name != CheckAssignment {
+		t.Errorf("expected validation to stop at the assignment check, got: %+v", result.Checks)
+	}
+}
@@ -0,0 +1,61 @@
+package validator
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+// Benchmark acquires a token for the identity and resource of the options the given number
+// of times and reports the latency percentiles and the error rate. An error is returned when
+// any iteration failed.
+func Benchmark(opts Options, iterations int) error {
+	if iterations <= 0 {
+		return errors.Errorf("benchmark iterations must be greater than 0, got %d", iterations)
+	}
+	opts = opts.withDefaults()
+
+	var latencies []time.Duration
+	failures := 0
+	for i := 0; i < iterations; i++ {
+		// A new token request is created for every iteration so that nothing is cached between
+		// iterations and each refresh is a round trip with the identity selected by the options.
+		refresh, err := newTokenRefresh(opts, opts.Resource)
+		if err != nil {
+			return err
+		}
+
+		begin := time.Now()
+		_, err = refresh(context.Background())
+		latency := time.Since(begin)
+		if err != nil {
+			failures++
+			klog.Warningf("Benchmark iteration %d failed after %s: %+v", i, latency, err)
+			continue
+		}
+		latencies = append(latencies, latency)
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	klog.Infof("Benchmark completed. iterations: %d, errors: %d, error rate: %.2f%%", iterations, failures, float64(failures)*100/float64(iterations))
+	klog.Infof("Benchmark latency p50: %s, p95: %s, p99: %s", percentile(latencies, 50), percentile(latencies, 95), percentile(latencies, 99))
+	if failures > 0 {
+		return errors.Errorf("%d of %d benchmark iterations failed to acquire a token for %s with %s", failures, iterations, opts.Resource, opts.identity())
+	}
+	return nil
+}
+
+// percentile returns the nearest-rank percentile of the sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
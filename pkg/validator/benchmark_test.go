@@ -0,0 +1,117 @@
+package validator
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// latencies returns n sorted latencies of 1ms to n ms
+func latencies(n int) []time.Duration {
+	sorted := make([]time.Duration, n)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+	return sorted
+}
+
+func TestPercentile(t *testing.T) {
+	cases := []struct {
+		name     string
+		samples  int
+		p        int
+		expected time.Duration
+	}{
+		{name: "no samples", samples: 0, p: 50, expected: 0},
+		{name: "1 sample p50", samples: 1, p: 50, expected: time.Millisecond},
+		{name: "1 sample p99", samples: 1, p: 99, expected: time.Millisecond},
+		{name: "2 samples p50", samples: 2, p: 50, expected: time.Millisecond},
+		{name: "2 samples p51", samples: 2, p: 51, expected: 2 * time.Millisecond},
+		{name: "2 samples p95", samples: 2, p: 95, expected: 2 * time.Millisecond},
+		{name: "2 samples p99", samples: 2, p: 99, expected: 2 * time.Millisecond},
+		{name: "100 samples p0", samples: 100, p: 0, expected: time.Millisecond},
+		{name: "100 samples p50", samples: 100, p: 50, expected: 50 * time.Millisecond},
+		{name: "100 samples p95", samples: 100, p: 95, expected: 95 * time.Millisecond},
+		{name: "100 samples p99", samples: 100, p: 99, expected: 99 * time.Millisecond},
+		{name: "100 samples p100", samples: 100, p: 100, expected: 100 * time.Millisecond},
+		// the rank is rounded up: 95% of 20 samples is exactly the 19th, 96% is the 20th
+		{name: "20 samples p95", samples: 20, p: 95, expected: 19 * time.Millisecond},
+		{name: "20 samples p96", samples: 20, p: 96, expected: 20 * time.Millisecond},
+		{name: "3 samples p34", samples: 3, p: 34, expected: 2 * time.Millisecond},
+		{name: "3 samples p33", samples: 3, p: 33, expected: time.Millisecond},
+	}
+	for _, tc := range cases {
+		if got := percentile(latencies(tc.samples), tc.p); got != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	resource := "https://management.azure.com/"
+	cases := []struct {
+		name          string
+		opts          Options
+		selector      string
+		expectedValue string
+	}{
+		{name: "client id", opts: Options{IdentityClientID: "clientid"}, selector: "client_id", expectedValue: "clientid"},
+		{name: "resource id", opts: Options{IdentityResourceID: "resourceid"}, selector: "msi_res_id", expectedValue: "resourceid"},
+		{name: "object id", opts: Options{IdentityObjectID: "objectid"}, selector: "object_id", expectedValue: "objectid"},
+		{name: "raw imds client id", opts: Options{IdentityClientID: "clientid", RawIMDS: true}, selector: "client_id", expectedValue: "clientid"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			msi, requests := newTokenServer(issueToken(tokenResponse{resource: resource}))
+			defer msi.Close()
+
+			opts := tc.opts
+			opts.MSIEndpoint, opts.Resource = msi.URL, resource
+			if err := Benchmark(opts, 3); err != nil {
+				t.Fatalf("expected nil error, got: %v", err)
+			}
+			// every iteration is a round trip to the MSI endpoint with the selected identity
+			if n := requests.count(); n != 3 {
+				t.Fatalf("expected 3 token requests, got %d", n)
+			}
+			for i := 0; i < 3; i++ {
+				if q := requests.query(i); q.Get(tc.selector) != tc.expectedValue {
+					t.Errorf("expected token request %d to select %s=%s, got query %v", i, tc.selector, tc.expectedValue, q)
+				}
+			}
+		})
+	}
+}
+
+func TestBenchmarkFailures(t *testing.T) {
+	resource := "https://management.azure.com/"
+	cases := []struct {
+		name     string
+		failures map[int]bool
+	}{
+		{name: "all iterations failed", failures: map[int]bool{1: true, 2: true, 3: true}},
+		{name: "one iteration failed", failures: map[int]bool{2: true}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			msi, requests := newTokenServer(func(r *http.Request, n int) tokenResponse {
+				if tc.failures[n] {
+					return tokenResponse{status: http.StatusBadRequest, body: `{"error":"invalid_request"}`}
+				}
+				return tokenResponse{resource: resource}
+			})
+			defer msi.Close()
+
+			err := Benchmark(Options{MSIEndpoint: msi.URL, IdentityClientID: "clientid", Resource: resource}, 3)
+			expected := fmt.Sprintf("%d of 3 benchmark iterations failed", len(tc.failures))
+			if err == nil || !strings.Contains(err.Error(), expected) {
+				t.Errorf("expected error containing %q, got: %v", expected, err)
+			}
+			if n := requests.count(); n != 3 {
+				t.Errorf("expected 3 token requests, got %d", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package validator
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// namedCheck is a check run by Validate
+type namedCheck struct {
+	name  string
+	check func() error
+}
+
+// checkOutcome is the outcome of the check at index i of the checks run concurrently
+type checkOutcome struct {
+	i      int
+	result CheckResult
+}
+
+// runConcurrently runs the checks with at most concurrency checks in flight and appends their
+// results to the result in the order of the checks, whichever finishes first. The checks not
+// finished when the context is done fail with the error of the context. It returns the errors of
+// the checks, nil for the checks that passed.
+func (r *Result) runConcurrently(ctx context.Context, concurrency int, checks []namedCheck) []error {
+	begin := time.Now()
+	outcomes := make(chan checkOutcome, len(checks))
+	slots := make(chan struct{}, concurrency)
+	for i, c := range checks {
+		go func(i int, c namedCheck) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				return
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			result := CheckResult{Name: c.name}
+			start := time.Now()
+			result.Err = c.check()
+			result.Duration = time.Since(start)
+			outcomes <- checkOutcome{i: i, result: result}
+		}(i, c)
+	}
+
+	results := make([]*CheckResult, len(checks))
+wait:
+	for finished := 0; finished < len(checks); finished++ {
+		select {
+		case o := <-outcomes:
+			result := o.result
+			results[o.i] = &result
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	errs := make([]error, len(checks))
+	for i, result := range results {
+		if result == nil {
+			result = &CheckResult{Name: checks[i].name, Duration: time.Since(begin), Err: ctx.Err()}
+		}
+		r.Checks = append(r.Checks, *result)
+		if result.Err != nil {
+			errs[i] = errors.Wrapf(result.Err, "%s failed", result.Name)
+		}
+	}
+	return errs
+}
+
+// lockedWriter serializes the writes of the checks run concurrently to the writer
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
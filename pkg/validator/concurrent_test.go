@@ -0,0 +1,129 @@
+package validator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunConcurrently(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	newCheck := func(name string, err error) namedCheck {
+		return namedCheck{name: name, check: func() error {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return err
+		}}
+	}
+	checks := []namedCheck{
+		newCheck("check1", nil),
+		newCheck("check2", errors.New("denied")),
+		newCheck("check3", nil),
+		newCheck("check4", nil),
+	}
+
+	result := Result{}
+	begin := time.Now()
+	errs := result.runConcurrently(context.Background(), 2, checks)
+	if elapsed := time.Since(begin); elapsed >= 200*time.Millisecond {
+		t.Errorf("expected the checks to run concurrently, took %s", elapsed)
+	}
+	if maxInFlight != 2 {
+		t.Errorf("expected at most 2 checks in flight, got %d", maxInFlight)
+	}
+	if len(result.Checks) != len(checks) {
+		t.Fatalf("expected %d check results, got: %+v", len(checks), result.Checks)
+	}
+	for i, c := range checks {
+		if result.Checks[i].Name != c.name {
+			t.Errorf("expected check %d to be %s, got %s", i, c.name, result.Checks[i].Name)
+		}
+	}
+	if errs[0] != nil || errs[2] != nil || errs[3] != nil {
+		t.Errorf("expected the other checks to pass, got: %v", errs)
+	}
+	if errs[1] == nil || !strings.Contains(errs[1].Error(), "check2 failed: denied") {
+		t.Errorf("expected check2 to fail, got: %v", errs[1])
+	}
+	if result.Checks[1].Passed() {
+		t.Errorf("expected the result of check2 to fail")
+	}
+}
+
+func TestRunConcurrentlyDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	checks := []namedCheck{
+		{name: "fast", check: func() error { return nil }},
+		{name: "stuck", check: func() error {
+			<-release
+			return nil
+		}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	result := Result{}
+	errs := result.runConcurrently(ctx, 2, checks)
+	if errs[0] != nil {
+		t.Errorf("expected the fast check to pass, got: %v", errs[0])
+	}
+	if errs[1] == nil || !strings.Contains(errs[1].Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("expected the stuck check to fail with the deadline of the context, got: %v", errs[1])
+	}
+	if len(result.Checks) != 2 || result.Checks[1].Passed() {
+		t.Errorf("expected the stuck check to be reported as failed, got: %+v", result.Checks)
+	}
+}
+
+func TestValidateConcurrency(t *testing.T) {
+	var tokens bytes.Buffer
+	result, err := Validate(context.Background(), Options{
+		MSIEndpoint: "http://127.0.0.1:1/metadata/identity/oauth2/token",
+		Concurrency: 2,
+		TokenWriter: &tokens,
+	})
+	if err == nil {
+		t.Fatalf("expected error when checks fail")
+	}
+	// every data-plane check is run and the first failure is returned
+	expected := []string{CheckClusterWideUserAssignedIdentity, CheckSystemAssignedIdentity}
+	if len(result.Checks) != len(expected) {
+		t.Fatalf("expected every data-plane check to run, got: %+v", result.Checks)
+	}
+	for i, name := range expected {
+		if result.Checks[i].Name != name {
+			t.Errorf("expected check %d to be %s, got: %s", i, name, result.Checks[i].Name)
+		}
+	}
+	if !strings.Contains(err.Error(), CheckClusterWideUserAssignedIdentity+" failed") {
+		t.Errorf("expected the error of the first failed check, got: %v", err)
+	}
+}
+
+func TestWithDefaultsLocksTokenWriter(t *testing.T) {
+	var tokens bytes.Buffer
+	if _, ok := (Options{TokenWriter: &tokens}).withDefaults().TokenWriter.(*lockedWriter); ok {
+		t.Errorf("expected the token writer not to be locked when the checks run in turn")
+	}
+	opts := Options{TokenWriter: &tokens, Concurrency: 2}.withDefaults()
+	if _, ok := opts.TokenWriter.(*lockedWriter); !ok {
+		t.Fatalf("expected the token writer to be locked when the checks run concurrently")
+	}
+	if w := opts.withDefaults().TokenWriter.(*lockedWriter).w; w != &tokens {
+		t.Errorf("expected the token writer to be locked once")
+	}
+}
@@ -0,0 +1,194 @@
+package validator
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+const (
+	// LayerMetadataRedirected checks the token request to the metadata address is answered by NMI
+	// rather than by the instance metadata service, which requires the NMI iptables rules
+	LayerMetadataRedirected = "MetadataRedirected"
+	// LayerNMIResponded checks NMI processed the token request
+	LayerNMIResponded = "NMIResponded"
+	// LayerIdentityReturned checks NMI returned a token for an identity assigned to the pod
+	LayerIdentityReturned = "IdentityReturned"
+	// LayerDataPlane checks the identity is authorized for the keyvault secret, or the VMs of the
+	// resource group when no keyvault secret is set
+	LayerDataPlane = "DataPlane"
+)
+
+// DiagnoseLayers are the layers checked by Diagnose, in order
+var DiagnoseLayers = []string{LayerMetadataRedirected, LayerNMIResponded, LayerIdentityReturned, LayerDataPlane}
+
+// nmiResponseHeader is the header NMI adds by default to the token responses it serves
+const nmiResponseHeader = "X-AADPodIdentity-NMI"
+
+// NMI error codes returned in the error_code of the token response
+const (
+	nmiErrorCodeIdentityNotFound       = "IdentityNotFound"
+	nmiErrorCodeAssignmentInProgress   = "AssignmentInProgress"
+	nmiErrorCodeARMThrottled           = "ARMThrottled"
+	nmiErrorCodeTokenAcquisitionFailed = "TokenAcquisitionFailed"
+	nmiErrorCodeInternalError          = "InternalError"
+)
+
+// tokenProbe is the response to the token request made to the metadata address by Diagnose
+type tokenProbe struct {
+	statusCode int
+	response   tokenProbeResponse
+	// parsed is false when the body isn't JSON
+	parsed bool
+	// nmiHeader is true when the response has the header NMI adds to the token responses it serves
+	nmiHeader bool
+}
+
+// tokenProbeResponse holds the fields telling apart the token responses of NMI and IMDS. NMI
+// errors have an error_code while IMDS errors have an error, and only IMDS tokens have a client_id.
+type tokenProbeResponse struct {
+	AccessToken      string  `json:"access_token"`
+	ClientID         *string `json:"client_id"`
+	ErrorCode        string  `json:"error_code"`
+	Error            string  `json:"error"`
+	ErrorDescription string  `json:"error_description"`
+}
+
+// servedByNMI returns true if the response has the header or the format of an NMI token response
+func (p tokenProbe) servedByNMI() bool {
+	if p.nmiHeader {
+		return true
+	}
+	if !p.parsed {
+		return false
+	}
+	if p.response.ErrorCode != "" {
+		return true
+	}
+	return p.statusCode == http.StatusOK && p.response.AccessToken != "" && p.response.ClientID == nil
+}
+
+// Diagnose checks each layer involved in acquiring a token for the identity of the pod: the
+// metadata address is redirected to NMI, NMI processed the request, NMI returned a token for an
+// identity of the pod and the identity is authorized for the data-plane call. It stops at the first
+// failing layer and returns an error describing where to look. The result holds the outcome of the
+// layers that were checked.
+func Diagnose(ctx context.Context, opts Options) (Result, error) {
+	result := Result{}
+	opts, err := opts.prepare()
+	if err != nil {
+		return result, err
+	}
+	result.MSIEndpoint = opts.MSIEndpoint
+
+	var probe tokenProbe
+	if err := result.run(LayerMetadataRedirected, func() error {
+		probe, err = probeTokenEndpoint(ctx, opts)
+		if err != nil {
+			return errors.Wrapf(err, "the metadata address is unreachable, check an NMI pod is running on the node and the NMI iptables rules")
+		}
+		if !probe.servedByNMI() {
+			return errors.Errorf("the token request was answered by the instance metadata service rather than NMI (status %d), check an NMI pod is running on the node and the NMI iptables rules redirect the metadata address", probe.statusCode)
+		}
+		return nil
+	}); err != nil {
+		return result, err
+	}
+
+	if err := result.run(LayerNMIResponded, func() error {
+		if probe.response.ErrorCode == nmiErrorCodeInternalError || probe.statusCode >= http.StatusInternalServerError {
+			return errors.Errorf("NMI failed to process the token request (status %d): %s, check the logs of the NMI pod on the node", probe.statusCode, probe.response.ErrorDescription)
+		}
+		return nil
+	}); err != nil {
+		return result, err
+	}
+
+	if err := result.run(LayerIdentityReturned, func() error {
+		if probe.statusCode == http.StatusOK && probe.response.AccessToken != "" {
+			return nil
+		}
+		return identityNotReturnedError(probe)
+	}); err != nil {
+		return result, err
+	}
+
+	if err := result.run(LayerDataPlane, func() error {
+		var err error
+		if (opts.KeyvaultName != "" || opts.KeyvaultURI != "") && opts.KeyvaultSecretName != "" {
+			err = testUserAssignedIdentityOnPod(ctx, opts)
+		} else {
+			err = testClusterWideUserAssignedIdentity(ctx, opts)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "a token was issued to the identity but the data-plane call failed, check the role assignments and access policies of the identity")
+		}
+		return nil
+	}); err != nil {
+		return result, err
+	}
+
+	klog.Infof("Diagnosis passed, the identity of the pod is working from the metadata address to the data-plane")
+	return result, nil
+}
+
+// identityNotReturnedError describes why NMI didn't return a token for the identity of the pod
+func identityNotReturnedError(probe tokenProbe) error {
+	description := probe.response.ErrorDescription
+	switch probe.response.ErrorCode {
+	case nmiErrorCodeIdentityNotFound:
+		return errors.Errorf("no identity is assigned to the pod: %s, check an AzureIdentityBinding selector matches the aadpodidbinding label of the pod and references an existing AzureIdentity", description)
+	case nmiErrorCodeAssignmentInProgress:
+		return errors.Errorf("the identity of the pod is not assigned to the node yet: %s, check the AzureAssignedIdentity status and the MIC logs if the assignment doesn't complete", description)
+	case nmiErrorCodeARMThrottled:
+		return errors.Errorf("the token request of NMI was throttled: %s, retry later", description)
+	case nmiErrorCodeTokenAcquisitionFailed:
+		return errors.Errorf("the identity is assigned to the pod but NMI failed to acquire a token for it: %s, check the identity is assigned to the VM or VMSS of the node and MIC has the Managed Identity Operator role for it", description)
+	}
+	return errors.Errorf("NMI didn't return a token (status %d): %s %s", probe.statusCode, probe.response.ErrorCode, description)
+}
+
+// probeTokenEndpoint requests a token for the resource and identity of the options from the MSI
+// endpoint and returns the response, whether it's a token or an error
+func probeTokenEndpoint(ctx context.Context, opts Options) (tokenProbe, error) {
+	msiEndpoint := opts.MSIEndpoint
+	req, err := http.NewRequest(http.MethodGet, msiEndpoint, nil)
+	if err != nil {
+		return tokenProbe{}, errors.Wrapf(err, "Failed to create token request for %s", msiEndpoint)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Metadata", "true")
+	q := url.Values{}
+	q.Set("api-version", opts.IMDSAPIVersion)
+	q.Set("resource", opts.Resource)
+	switch {
+	case opts.IdentityClientID != "":
+		q.Set("client_id", opts.IdentityClientID)
+	case opts.IdentityResourceID != "":
+		q.Set("msi_res_id", opts.IdentityResourceID)
+	case opts.IdentityObjectID != "":
+		q.Set("object_id", opts.IdentityObjectID)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	klog.Infof("Requesting token for %s with %s from %s", opts.Resource, opts.identity(), msiEndpoint)
+	resp, err := newSender(opts).Do(req)
+	if err != nil {
+		return tokenProbe{}, errors.Wrapf(err, "Failed to send token request to %s", msiEndpoint)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return tokenProbe{}, errors.Wrapf(err, "Failed to read token response from %s", msiEndpoint)
+	}
+	_, nmiHeader := resp.Header[http.CanonicalHeaderKey(nmiResponseHeader)]
+	probe := tokenProbe{statusCode: resp.StatusCode, nmiHeader: nmiHeader}
+	probe.parsed = json.Unmarshal(body, &probe.response) == nil
+	return probe, nil
+}
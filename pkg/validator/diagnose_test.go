@@ -0,0 +1,107 @@
+package validator
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDiagnose(t *testing.T) {
+	cases := []struct {
+		name          string
+		statusCode    int
+		body          string
+		nmiHeader     bool
+		expectedPass  []string
+		expectedFail  string
+		expectedError string
+	}{
+		{
+			name:          "answered by the instance metadata service",
+			statusCode:    http.StatusOK,
+			body:          `{"access_token":"token","client_id":"clientid","expires_in":"3599","resource":"https://management.azure.com/","token_type":"Bearer"}`,
+			expectedFail:  LayerMetadataRedirected,
+			expectedError: "iptables",
+		},
+		{
+			name:          "instance metadata service error",
+			statusCode:    http.StatusBadRequest,
+			body:          `{"error":"invalid_request","error_description":"Identity not found"}`,
+			expectedFail:  LayerMetadataRedirected,
+			expectedError: "answered by the instance metadata service",
+		},
+		{
+			name:          "error marked by the nmi response header",
+			statusCode:    http.StatusBadRequest,
+			body:          `{"error":"invalid_request","error_description":"bad resource"}`,
+			nmiHeader:     true,
+			expectedPass:  []string{LayerMetadataRedirected, LayerNMIResponded},
+			expectedFail:  LayerIdentityReturned,
+			expectedError: "NMI didn't return a token",
+		},
+		{
+			name:          "nmi internal error",
+			statusCode:    http.StatusInternalServerError,
+			body:          `{"error_code":"InternalError","error_description":"missing podname for podip"}`,
+			expectedPass:  []string{LayerMetadataRedirected},
+			expectedFail:  LayerNMIResponded,
+			expectedError: "logs of the NMI pod",
+		},
+		{
+			name:          "no identity assigned to the pod",
+			statusCode:    http.StatusNotFound,
+			body:          `{"error_code":"IdentityNotFound","error_description":"no azure identity found for request clientID"}`,
+			expectedPass:  []string{LayerMetadataRedirected, LayerNMIResponded},
+			expectedFail:  LayerIdentityReturned,
+			expectedError: "AzureIdentityBinding",
+		},
+		{
+			name:          "token acquisition failed",
+			statusCode:    http.StatusForbidden,
+			body:          `{"error_code":"TokenAcquisitionFailed","error_description":"identity not found"}`,
+			expectedPass:  []string{LayerMetadataRedirected, LayerNMIResponded},
+			expectedFail:  LayerIdentityReturned,
+			expectedError: "Managed Identity Operator",
+		},
+	}
+
+	for _, tc := range cases {
+		imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.nmiHeader {
+				w.Header().Set(nmiResponseHeader, "1.6.0")
+			}
+			w.WriteHeader(tc.statusCode)
+			w.Write([]byte(tc.body))
+		}))
+
+		result, err := Diagnose(context.Background(), Options{MSIEndpoint: imds.URL, IdentityClientID: "clientid"})
+		imds.Close()
+
+		if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+			t.Errorf("%s: expected error containing %q, got: %v", tc.name, tc.expectedError, err)
+		}
+		if len(result.Checks) != len(tc.expectedPass)+1 {
+			t.Fatalf("%s: expected %d layers to be checked, got: %+v", tc.name, len(tc.expectedPass)+1, result.Checks)
+		}
+		for i, layer := range tc.expectedPass {
+			if c := result.Checks[i]; c.Name != layer || !c.Passed() {
+				t.Errorf("%s: expected layer %s to pass, got: %+v", tc.name, layer, c)
+			}
+		}
+		if c := result.Checks[len(tc.expectedPass)]; c.Name != tc.expectedFail || c.Passed() {
+			t.Errorf("%s: expected layer %s to fail, got: %+v", tc.name, tc.expectedFail, c)
+		}
+	}
+}
+
+func TestDiagnoseUnreachable(t *testing.T) {
+	result, err := Diagnose(context.Background(), Options{MSIEndpoint: "http://127.0.0.1:1/metadata/identity/oauth2/token"})
+	if err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Fatalf("expected unreachable error, got: %v", err)
+	}
+	if len(result.Checks) != 1 || result.Checks[0].Name != LayerMetadataRedirected {
+		t.Errorf("expected only the %s layer to be checked, got: %+v", LayerMetadataRedirected, result.Checks)
+	}
+}
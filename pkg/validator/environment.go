@@ -0,0 +1,88 @@
+package validator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+const (
+	// azureAssetTag is the chassis asset tag of Azure VMs
+	azureAssetTag = "7783-7084-3265-9085-8269-3286-77"
+	// imdsDialAttempts is the number of times the connection to the instance metadata service is
+	// attempted before it's found unavailable
+	imdsDialAttempts = 3
+	// imdsDialTimeout is the timeout of each connection to the instance metadata service
+	imdsDialTimeout = 2 * time.Second
+)
+
+var (
+	// dmiAssetTagPath is the path of the chassis asset tag of the machine
+	dmiAssetTagPath = "/sys/class/dmi/id/chassis_asset_tag"
+	// imdsDialInterval is the interval between the connections to the instance metadata service
+	imdsDialInterval = time.Second
+)
+
+// IMDSUnavailableError is returned when the instance metadata service can't be reached and the
+// machine is not an Azure VM, so the validator runs in an unsupported environment
+type IMDSUnavailableError struct {
+	MSIEndpoint string
+	Err         error
+}
+
+func (e *IMDSUnavailableError) Error() string {
+	return fmt.Sprintf("the instance metadata service at %s is not available (%v): the identity validator must run on an Azure node "+
+		"with the instance metadata service, or use --msi-endpoint to point at a mock of the MSI endpoint", e.MSIEndpoint, e.Err)
+}
+
+// IsIMDSUnavailable returns true if the error is an IMDSUnavailableError
+func IsIMDSUnavailable(err error) bool {
+	_, ok := errors.Cause(err).(*IMDSUnavailableError)
+	return ok
+}
+
+// CheckIMDSAvailable connects to the host of the MSI endpoint and returns an IMDSUnavailableError
+// when the connection fails and the machine is not an Azure VM. On an Azure VM the connection
+// failure is returned as is, as the metadata address is redirected to NMI which may not be running.
+func CheckIMDSAvailable(msiEndpoint string) error {
+	u, err := url.Parse(msiEndpoint)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to parse msiEndpoint %s", msiEndpoint)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+
+	for attempt := 1; ; attempt++ {
+		conn, dialErr := net.DialTimeout("tcp", host, imdsDialTimeout)
+		if dialErr == nil {
+			conn.Close()
+			return nil
+		}
+		if attempt >= imdsDialAttempts {
+			if !isAzureVM() {
+				return &IMDSUnavailableError{MSIEndpoint: msiEndpoint, Err: dialErr}
+			}
+			return errors.Wrapf(dialErr, "Failed to connect to the metadata address %s of the Azure VM, check an NMI pod is running on the node", host)
+		}
+		klog.Warningf("Attempt %d of %d to connect to %s failed: %v", attempt, imdsDialAttempts, host, dialErr)
+		time.Sleep(imdsDialInterval)
+	}
+}
+
+// isAzureVM returns true if the chassis asset tag of the machine is the one of Azure VMs
+func isAzureVM() bool {
+	tag, err := ioutil.ReadFile(dmiAssetTagPath)
+	if err != nil {
+		klog.V(2).Infof("Failed to read the chassis asset tag from %s: %v", dmiAssetTagPath, err)
+		return false
+	}
+	return strings.TrimSpace(string(tag)) == azureAssetTag
+}
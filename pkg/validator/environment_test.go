@@ -0,0 +1,70 @@
+package validator
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stubEnvironment makes the machine report the asset tag and connect to the instance metadata
+// service without waiting between attempts, and returns a func restoring the defaults
+func stubEnvironment(t *testing.T, assetTag string) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dmi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "chassis_asset_tag")
+	if err := ioutil.WriteFile(path, []byte(assetTag+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	origPath, origInterval := dmiAssetTagPath, imdsDialInterval
+	dmiAssetTagPath, imdsDialInterval = path, 0
+	return func() {
+		dmiAssetTagPath, imdsDialInterval = origPath, origInterval
+		os.RemoveAll(dir)
+	}
+}
+
+// unreachableEndpoint returns an MSI endpoint nothing listens on
+func unreachableEndpoint(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr + "/metadata/identity/oauth2/token"
+}
+
+func TestCheckIMDSAvailable(t *testing.T) {
+	restore := stubEnvironment(t, "not-azure")
+	defer restore()
+
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer imds.Close()
+	if err := CheckIMDSAvailable(imds.URL + "/metadata/identity/oauth2/token"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := CheckIMDSAvailable(unreachableEndpoint(t))
+	if !IsIMDSUnavailable(err) {
+		t.Fatalf("expected the instance metadata service to be unavailable off Azure, got: %v", err)
+	}
+}
+
+func TestCheckIMDSAvailableOnAzureVM(t *testing.T) {
+	restore := stubEnvironment(t, azureAssetTag)
+	defer restore()
+
+	// on an Azure VM the metadata address being unreachable points at NMI, not the environment
+	err := CheckIMDSAvailable(unreachableEndpoint(t))
+	if err == nil || IsIMDSUnavailable(err) {
+		t.Fatalf("expected a connection error on an Azure VM, got: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package validator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+const (
+	// CheckGraph issues a read to Microsoft Graph with a token of the identity
+	CheckGraph = "Graph"
+
+	// DefaultGraphEndpoint is the Microsoft Graph endpoint of the public cloud, also the audience of
+	// its tokens
+	DefaultGraphEndpoint = "https://graph.microsoft.com/"
+	// DefaultGraphProbePath is the read issued by the Graph check, which requires the
+	// Organization.Read.All or Directory.Read.All application permission
+	DefaultGraphProbePath = "/v1.0/organization"
+)
+
+// testGraph acquires a token for Microsoft Graph with the identity of the options and issues the
+// read of GraphProbePath. A read denied by Graph is told apart from a failure to acquire the token,
+// as the identity then lacks the Graph application permission or its admin consent rather than
+// being unable to authenticate.
+func testGraph(ctx context.Context, opts Options) error {
+	token, err := acquireToken(ctx, opts, opts.GraphEndpoint)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to acquire a token for %s with %s, no Graph call was made", opts.GraphEndpoint, opts.identity())
+	}
+	writeToken(opts, CheckGraph, opts.identity(), token)
+
+	probeURL := strings.TrimSuffix(opts.GraphEndpoint, "/") + "/" + strings.TrimPrefix(opts.GraphProbePath, "/")
+	klog.Infof("Verifying the access of %s to Microsoft Graph with GET %s", opts.identity(), probeURL)
+	attempts, err := retryOnTransientError(ctx, transientRetryAttempts, transientRetryInterval, func() error {
+		req, err := http.NewRequest(http.MethodGet, probeURL, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+		resp, err := newSender(opts).Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return autorest.DetailedError{
+				StatusCode: resp.StatusCode,
+				Message:    fmt.Sprintf("Graph responded with status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body))),
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if detailed, ok := err.(autorest.DetailedError); ok && detailedErrorStatusCode(detailed) == http.StatusForbidden {
+			return errors.Wrapf(err, "The token for %s was acquired with %s but Graph denied GET %s, the identity is missing the Graph application permission of the read or its admin consent",
+				opts.GraphEndpoint, opts.identity(), opts.GraphProbePath)
+		}
+		return errors.Wrapf(err, "The token for %s was acquired with %s but GET %s failed, %s",
+			opts.GraphEndpoint, opts.identity(), opts.GraphProbePath, failureReason(err, attempts, opts.identity(), "Microsoft Graph"))
+	}
+	if err := assertTokenTTL(opts, CheckGraph, opts.identity(), token); err != nil {
+		return err
+	}
+
+	klog.Infof("Successfully read %s from Microsoft Graph with %s", opts.GraphProbePath, opts.identity())
+	return nil
+}
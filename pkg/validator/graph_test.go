@@ -0,0 +1,95 @@
+package validator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTestGraph(t *testing.T) {
+	cases := []struct {
+		name        string
+		status      int
+		response    string
+		expectedErr string
+	}{
+		{
+			name:     "read succeeds",
+			status:   http.StatusOK,
+			response: `{"value":[{"id":"tenantid"}]}`,
+		},
+		{
+			name:        "permission missing",
+			status:      http.StatusForbidden,
+			response:    `{"error":{"code":"Authorization_RequestDenied","message":"Insufficient privileges to complete the operation."}}`,
+			expectedErr: "but Graph denied GET /v1.0/applications?$top=1, the identity is missing the Graph application permission",
+		},
+		{
+			name:        "bad request",
+			status:      http.StatusBadRequest,
+			response:    `{"error":{"code":"BadRequest"}}`,
+			expectedErr: "but GET /v1.0/applications?$top=1 failed",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var authorization, requestURI string
+			graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authorization, requestURI = r.Header.Get("Authorization"), r.URL.RequestURI()
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, tc.response)
+			}))
+			defer graph.Close()
+			msi, _ := newTokenServer(issueToken(tokenResponse{accessToken: "graphtoken", resource: graph.URL + "/"}))
+			defer msi.Close()
+
+			opts := Options{
+				MSIEndpoint:      msi.URL,
+				IdentityClientID: "clientid",
+				GraphEndpoint:    graph.URL + "/",
+				GraphProbePath:   "/v1.0/applications?$top=1",
+			}.withDefaults()
+			err := testGraph(context.Background(), opts)
+			if tc.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("expected nil error, got: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+				t.Fatalf("expected error containing %q, got: %v", tc.expectedErr, err)
+			}
+			if authorization != "Bearer graphtoken" || requestURI != "/v1.0/applications?$top=1" {
+				t.Errorf("unexpected Graph request %s with authorization %q", requestURI, authorization)
+			}
+		})
+	}
+}
+
+func TestTestGraphTokenFailure(t *testing.T) {
+	graphCalled := false
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		graphCalled = true
+	}))
+	defer graph.Close()
+	msi, _ := newTokenServer(issueToken(tokenResponse{status: http.StatusBadRequest, body: `{"error":"invalid_request","error_description":"Identity not found"}`}))
+	defer msi.Close()
+
+	opts := Options{MSIEndpoint: msi.URL, IdentityClientID: "clientid", GraphEndpoint: graph.URL + "/"}.withDefaults()
+	err := testGraph(context.Background(), opts)
+	if err == nil || !strings.Contains(err.Error(), "Failed to acquire a token for "+graph.URL+"/ with client id clientid, no Graph call was made") {
+		t.Fatalf("expected the token acquisition to fail, got: %v", err)
+	}
+	if graphCalled {
+		t.Errorf("expected no Graph call without a token")
+	}
+}
+
+func TestWithDefaultsGraph(t *testing.T) {
+	opts := Options{}.withDefaults()
+	if opts.GraphEndpoint != DefaultGraphEndpoint || opts.GraphProbePath != DefaultGraphProbePath {
+		t.Errorf("expected the default Graph endpoint and probe path, got %s and %s", opts.GraphEndpoint, opts.GraphProbePath)
+	}
+}
@@ -0,0 +1,48 @@
+package validator
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+// IdentityResult is the outcome of the validation of one of the identities of ValidateIdentities
+type IdentityResult struct {
+	ClientID string
+	Result   Result
+	Err      error
+}
+
+// Passed returns true if the validation of the identity succeeded
+func (r IdentityResult) Passed() bool {
+	return r.Err == nil
+}
+
+// ValidateIdentities runs the checks of Validate for each of the identities in turn, with the
+// identity selected by its client id, and returns the outcome of each identity. The client id is
+// passed to the checks in the options rather than the environment, so the checks of an identity
+// never use the client id of another. The returned error lists the identities that failed.
+func ValidateIdentities(ctx context.Context, opts Options, clientIDs []string) ([]IdentityResult, error) {
+	var results []IdentityResult
+	var failed []string
+	for i, clientID := range clientIDs {
+		klog.Infof("Validating identity %s (%d of %d)", clientID, i+1, len(clientIDs))
+		identityOpts := opts
+		identityOpts.IdentityClientID = clientID
+
+		result, err := Validate(ctx, identityOpts)
+
+		if err != nil {
+			klog.Errorf("Validation of identity %s failed: %v", clientID, err)
+			failed = append(failed, clientID)
+		}
+		results = append(results, IdentityResult{ClientID: clientID, Result: result, Err: err})
+	}
+
+	if len(failed) > 0 {
+		return results, errors.Errorf("%d of %d identities failed: %s", len(failed), len(clientIDs), strings.Join(failed, ", "))
+	}
+	return results, nil
+}
@@ -0,0 +1,59 @@
+package validator
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateIdentities(t *testing.T) {
+	var mu sync.Mutex
+	envClientIDs := map[string]string{}
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		envClientIDs[r.URL.Query().Get("client_id")] = os.Getenv("AZURE_CLIENT_ID")
+		mu.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_request","error_description":"Identity not found"}`))
+	}))
+	defer imds.Close()
+
+	os.Setenv("AZURE_CLIENT_ID", "previous")
+	defer os.Unsetenv("AZURE_CLIENT_ID")
+
+	results, err := ValidateIdentities(context.Background(), Options{
+		MSIEndpoint:         imds.URL,
+		IdentityWaitTimeout: time.Second,
+	}, []string{"clientid1", "clientid2"})
+	if err == nil || !strings.Contains(err.Error(), "2 of 2 identities failed: clientid1, clientid2") {
+		t.Fatalf("expected both identities to fail, got: %v", err)
+	}
+	if len(results) != 2 || results[0].ClientID != "clientid1" || results[1].ClientID != "clientid2" {
+		t.Fatalf("expected a result per identity in order, got: %+v", results)
+	}
+	for _, r := range results {
+		if r.Passed() || len(r.Result.Checks) != 1 || r.Result.Checks[0].Name != CheckIdentityAvailable {
+			t.Errorf("expected the identity check of %s to fail, got: %+v", r.ClientID, r.Result.Checks)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, clientID := range []string{"clientid1", "clientid2"} {
+		env, requested := envClientIDs[clientID]
+		if !requested {
+			t.Errorf("expected a token request for %s", clientID)
+		}
+		if env != "previous" {
+			t.Errorf("expected AZURE_CLIENT_ID to be left unchanged during the checks of %s, got: %q", clientID, env)
+		}
+	}
+	if got := os.Getenv("AZURE_CLIENT_ID"); got != "previous" {
+		t.Errorf("expected AZURE_CLIENT_ID to be left unchanged, got: %q", got)
+	}
+}
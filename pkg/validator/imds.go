@@ -0,0 +1,119 @@
+package validator
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+// DefaultIMDSAPIVersion is the IMDS api-version known to work with the token endpoint
+const DefaultIMDSAPIVersion = "2018-02-01"
+
+// imdsErrorResponse is the payload returned by IMDS when a token request fails
+type imdsErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// AuthenticateWithMsiResourceID acquires a token for the resource from IMDS using the
+// resource id of the user assigned identity in the options to select the identity.
+func AuthenticateWithMsiResourceID(ctx context.Context, opts Options, resource string) (*adal.Token, error) {
+	return authenticateWithMsi(ctx, opts, resource, "msi_res_id", opts.IdentityResourceID)
+}
+
+// AuthenticateWithMsiObjectID acquires a token for the resource from IMDS using the
+// object id of the user assigned identity in the options to select the identity.
+func AuthenticateWithMsiObjectID(ctx context.Context, opts Options, resource string) (*adal.Token, error) {
+	return authenticateWithMsi(ctx, opts, resource, "object_id", opts.IdentityObjectID)
+}
+
+// authenticateWithRawIMDS acquires a token for the resource from IMDS with a hand-built request
+// instead of adal, selecting the user assigned identity by the client id, resource id or object
+// id of the options, or the system assigned identity when none is set
+func authenticateWithRawIMDS(ctx context.Context, opts Options, resource string) (*adal.Token, error) {
+	switch {
+	case opts.IdentityClientID != "":
+		return authenticateWithMsi(ctx, opts, resource, "client_id", opts.IdentityClientID)
+	case opts.IdentityResourceID != "":
+		return AuthenticateWithMsiResourceID(ctx, opts, resource)
+	case opts.IdentityObjectID != "":
+		return AuthenticateWithMsiObjectID(ctx, opts, resource)
+	}
+	return authenticateWithMsi(ctx, opts, resource, "", "system assigned identity")
+}
+
+// authenticateWithMsi acquires a token for the resource from IMDS, selecting the identity with
+// the query parameter, or the system assigned identity when the parameter is empty
+func authenticateWithMsi(ctx context.Context, opts Options, resource, identityParam, identity string) (*adal.Token, error) {
+	opts = opts.withDefaults()
+	msiEndpoint := opts.MSIEndpoint
+	req, err := http.NewRequest(http.MethodGet, msiEndpoint, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create token request for %s", msiEndpoint)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Metadata", "true")
+	q := url.Values{}
+	q.Set("api-version", opts.IMDSAPIVersion)
+	q.Set("resource", resource)
+	if identityParam != "" {
+		q.Set(identityParam, identity)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	klog.Infof("Acquiring token for %s with identity %s using IMDS api-version %s", resource, identity, opts.IMDSAPIVersion)
+	resp, err := newSender(opts).Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to send token request to %s", msiEndpoint)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read token response from %s", msiEndpoint)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if opts.RawIMDS {
+			return nil, rawIMDSError(msiEndpoint, resp.StatusCode, body)
+		}
+		return nil, imdsError(opts.IMDSAPIVersion, resp.StatusCode, body)
+	}
+
+	var token adal.Token
+	if err := json.Unmarshal(body, &token); err != nil {
+		if opts.RawIMDS {
+			return nil, errors.Wrapf(err, "Failed to unmarshal token response from %s: %s", msiEndpoint, string(body))
+		}
+		return nil, errors.Wrapf(err, "Failed to unmarshal token response from %s", msiEndpoint)
+	}
+	if token.IsZero() {
+		return nil, errors.Errorf("No token found in the response from %s", msiEndpoint)
+	}
+	return &token, nil
+}
+
+// imdsError returns the error for a failed IMDS token request, calling out an unsupported api-version
+func imdsError(apiVersion string, statusCode int, body []byte) error {
+	var errResp imdsErrorResponse
+	if err := json.Unmarshal(body, &errResp); err != nil || (errResp.Error == "" && errResp.ErrorDescription == "") {
+		return errors.Errorf("IMDS token request failed with status %d: %s", statusCode, string(body))
+	}
+	if strings.Contains(strings.ToLower(errResp.Error+" "+errResp.ErrorDescription), "api-version") {
+		return errors.Errorf("IMDS rejected api-version %s (status %d): %s %s. Set --imds-api-version to a version supported by IMDS",
+			apiVersion, statusCode, errResp.Error, errResp.ErrorDescription)
+	}
+	return errors.Errorf("IMDS token request failed with status %d: %s %s", statusCode, errResp.Error, errResp.ErrorDescription)
+}
+
+// rawIMDSError returns the error for a failed raw IMDS token request with the status and body of
+// the response as is
+func rawIMDSError(msiEndpoint string, statusCode int, body []byte) error {
+	return errors.Errorf("IMDS token request to %s failed with status %d %s: %s", msiEndpoint, statusCode, http.StatusText(statusCode), string(body))
+}
@@ -0,0 +1,149 @@
+package validator
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthenticateWithMsiResourceId(t *testing.T) {
+	imds, requests := newTokenServer(func(r *http.Request, n int) tokenResponse {
+		if r.Header.Get("Metadata") != "true" {
+			return tokenResponse{status: http.StatusBadRequest}
+		}
+		if r.URL.Query().Get("api-version") != DefaultIMDSAPIVersion {
+			return tokenResponse{status: http.StatusBadRequest, body: `{"error":"invalid_request","error_description":"Invalid api-version"}`}
+		}
+		return tokenResponse{resource: "https://vault.azure.net"}
+	})
+	defer imds.Close()
+
+	opts := Options{
+		MSIEndpoint:        imds.URL,
+		IdentityResourceID: "/subscriptions/sub/resourcegroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id",
+	}
+	token, err := AuthenticateWithMsiResourceID(context.Background(), opts, "https://vault.azure.net")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token.AccessToken != "token" {
+		t.Errorf("unexpected access token %s", token.AccessToken)
+	}
+	if query := requests.last(); query.Get("msi_res_id") != "/subscriptions/sub/resourcegroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id" || query.Get("resource") != "https://vault.azure.net" {
+		t.Errorf("unexpected query %v", query)
+	}
+
+	opts.IMDSAPIVersion = "2099-01-01"
+	_, err = AuthenticateWithMsiResourceID(context.Background(), opts, "https://vault.azure.net")
+	if err == nil || !strings.Contains(err.Error(), "IMDS rejected api-version 2099-01-01") {
+		t.Fatalf("expected unsupported api-version error, got: %v", err)
+	}
+}
+
+func TestAuthenticateWithMsiObjectId(t *testing.T) {
+	imds, requests := newTokenServer(issueToken(tokenResponse{resource: "https://vault.azure.net"}))
+	defer imds.Close()
+
+	opts := Options{
+		MSIEndpoint:      imds.URL,
+		IdentityObjectID: "00000000-0000-0000-0000-000000000001",
+	}
+	token, err := AuthenticateWithMsiObjectID(context.Background(), opts, "https://vault.azure.net")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token.AccessToken != "token" {
+		t.Errorf("unexpected access token %s", token.AccessToken)
+	}
+	query := requests.last()
+	if query.Get("object_id") != "00000000-0000-0000-0000-000000000001" || query.Get("resource") != "https://vault.azure.net" {
+		t.Errorf("unexpected query %v", query)
+	}
+	if _, ok := query["msi_res_id"]; ok {
+		t.Errorf("unexpected msi_res_id in query %v", query)
+	}
+}
+
+func TestAuthenticateWithMsiInsecureSkipVerify(t *testing.T) {
+	handler, _ := newTokenHandler(issueToken(tokenResponse{resource: "https://vault.azure.net"}))
+	imds := httptest.NewTLSServer(handler)
+	defer imds.Close()
+
+	opts := Options{
+		MSIEndpoint:        imds.URL,
+		IdentityResourceID: "/subscriptions/sub/resourcegroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id",
+	}
+	if _, err := AuthenticateWithMsiResourceID(context.Background(), opts, "https://vault.azure.net"); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("expected the self-signed certificate to be rejected by default, got: %v", err)
+	}
+
+	opts.InsecureSkipVerify = true
+	token, err := AuthenticateWithMsiResourceID(context.Background(), opts, "https://vault.azure.net")
+	if err != nil {
+		t.Fatalf("expected the self-signed certificate to be accepted with InsecureSkipVerify, got: %v", err)
+	}
+	if token.AccessToken != "token" {
+		t.Errorf("unexpected access token %s", token.AccessToken)
+	}
+}
+
+func TestAuthenticateWithRawIMDS(t *testing.T) {
+	imds, requests := newTokenServer(func(r *http.Request, n int) tokenResponse {
+		if r.URL.Query().Get("client_id") == "unknown" {
+			return tokenResponse{status: http.StatusNotFound, body: "no identity found for client id"}
+		}
+		return tokenResponse{}
+	})
+	defer imds.Close()
+
+	cases := []struct {
+		name          string
+		opts          Options
+		expectedParam string
+		expectedValue string
+	}{
+		{name: "client id", opts: Options{IdentityClientID: "00000000-0000-0000-0000-000000000001"}, expectedParam: "client_id", expectedValue: "00000000-0000-0000-0000-000000000001"},
+		{name: "resource id", opts: Options{IdentityResourceID: "/subscriptions/sub/resourcegroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id"}, expectedParam: "msi_res_id", expectedValue: "/subscriptions/sub/resourcegroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id"},
+		{name: "system assigned", opts: Options{}},
+	}
+	for _, tc := range cases {
+		tc.opts.MSIEndpoint = imds.URL
+		tc.opts.RawIMDS = true
+		token, err := acquireToken(context.Background(), tc.opts, "https://management.azure.com/")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if token.AccessToken != "token" {
+			t.Errorf("%s: unexpected access token %s", tc.name, token.AccessToken)
+		}
+		query := requests.last()
+		for _, param := range []string{"client_id", "msi_res_id", "object_id"} {
+			_, ok := query[param]
+			if param == tc.expectedParam && query.Get(param) != tc.expectedValue || param != tc.expectedParam && ok {
+				t.Errorf("%s: unexpected query %v", tc.name, query)
+			}
+		}
+	}
+
+	opts := Options{MSIEndpoint: imds.URL, IdentityClientID: "unknown", RawIMDS: true}
+	_, err := acquireToken(context.Background(), opts, "https://management.azure.com/")
+	if err == nil || !strings.Contains(err.Error(), "status 404 Not Found: no identity found for client id") {
+		t.Fatalf("expected the raw status and body of the response, got: %v", err)
+	}
+}
+
+func TestSystemAssignedIdentityWithRawIMDS(t *testing.T) {
+	imds, requests := newTokenServer(issueToken(tokenResponse{}))
+	defer imds.Close()
+
+	// the system assigned identity is used even when a user assigned identity is selected
+	opts := Options{MSIEndpoint: imds.URL, IdentityClientID: "00000000-0000-0000-0000-000000000001", RawIMDS: true}.withDefaults()
+	if _, err := testSystemAssignedIdentity(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if query := requests.last(); query.Get("client_id") != "" || query.Get("api-version") != DefaultIMDSAPIVersion {
+		t.Errorf("unexpected query %v", query)
+	}
+}
@@ -0,0 +1,97 @@
+package validator
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+// imdsHost is the link-local address of the instance metadata service
+const imdsHost = "169.254.169.254"
+
+// proxyFromEnvironment returns the proxy for a request based on the HTTP_PROXY, HTTPS_PROXY
+// and NO_PROXY environment variables. It is a variable so tests can observe it being consulted.
+var proxyFromEnvironment = http.ProxyFromEnvironment
+
+// proxyFunc returns the proxy to use for the request. Requests to the instance metadata
+// service always connect directly when noProxyIMDS is set.
+func proxyFunc(noProxyIMDS bool) func(req *http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		if noProxyIMDS && req.URL.Hostname() == imdsHost {
+			return nil, nil
+		}
+		return proxyFromEnvironment(req)
+	}
+}
+
+// newHTTPClient returns the http client used for all requests made by the validator
+func newHTTPClient(opts Options) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: proxyFunc(opts.NoProxyIMDS),
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig:       &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify},
+		},
+	}
+}
+
+// configureToken sets the sender the service principal token uses to refresh itself
+func configureToken(spt *adal.ServicePrincipalToken, opts Options) {
+	spt.SetSender(newSender(opts))
+}
+
+// newSender returns the sender used for requests that are not made through an sdk client
+func newSender(opts Options) adal.Sender {
+	var sender adal.Sender = withUserAgent(newHTTPClient(opts), opts.UserAgent)
+	if opts.VerboseSDK {
+		sender = withSenderLogging(sender)
+	}
+	return sender
+}
+
+// configureClient sets the sender and user agent of the autorest client and enables sdk logging
+func configureClient(client *autorest.Client, opts Options) {
+	client.Sender = newHTTPClient(opts)
+	if opts.UserAgent != "" {
+		client.AddToUserAgent(opts.UserAgent)
+	}
+	if opts.VerboseSDK {
+		enableSDKLogging(client)
+	}
+}
+
+// withUserAgent returns a sender adding the user agent to the user agent of the requests, such as
+// the user agent of adal for token requests
+func withUserAgent(sender adal.Sender, userAgent string) adal.Sender {
+	if userAgent == "" {
+		return sender
+	}
+	return adal.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		current := r.UserAgent()
+		if strings.Contains(current, userAgent) {
+			return sender.Do(r)
+		}
+		// the headers are copied so the request of the caller is unchanged
+		header := make(http.Header, len(r.Header)+1)
+		for k, v := range r.Header {
+			header[k] = v
+		}
+		header.Set("User-Agent", strings.TrimSpace(current+" "+userAgent))
+		r = r.WithContext(r.Context())
+		r.Header = header
+		return sender.Do(r)
+	})
+}
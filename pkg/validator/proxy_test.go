@@ -0,0 +1,152 @@
+package validator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+)
+
+// stubProxy replaces the proxy lookup with one that records the requested hosts and returns
+// the given proxy. The returned func restores the proxy lookup.
+func stubProxy(proxy *url.URL) (*[]string, func()) {
+	var consulted []string
+	origProxy := proxyFromEnvironment
+	proxyFromEnvironment = func(req *http.Request) (*url.URL, error) {
+		consulted = append(consulted, req.URL.Host)
+		return proxy, nil
+	}
+	return &consulted, func() {
+		proxyFromEnvironment = origProxy
+	}
+}
+
+func TestProxyFunc(t *testing.T) {
+	proxy, _ := url.Parse("http://proxy.example.com:3128")
+
+	for _, c := range []struct {
+		desc          string
+		url           string
+		noProxyIMDS   bool
+		expectProxy   *url.URL
+		expectConsult bool
+	}{
+		{"aad", "https://login.microsoftonline.com/tenant/oauth2/token", false, proxy, true},
+		{"arm", "https://management.azure.com/subscriptions", true, proxy, true},
+		{"imds", "http://169.254.169.254/metadata/identity/oauth2/token", false, proxy, true},
+		{"imds with no-proxy-imds", "http://169.254.169.254/metadata/identity/oauth2/token", true, nil, false},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			consulted, restore := stubProxy(proxy)
+			defer restore()
+
+			req, err := http.NewRequest(http.MethodGet, c.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := proxyFunc(c.noProxyIMDS)(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != c.expectProxy {
+				t.Fatalf("expected proxy %v, got: %v", c.expectProxy, got)
+			}
+			if (len(*consulted) > 0) != c.expectConsult {
+				t.Fatalf("expected proxy from environment consulted==%v, got: %v", c.expectConsult, *consulted)
+			}
+		})
+	}
+}
+
+func TestHTTPClientUsesProxy(t *testing.T) {
+	var proxied []string
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxyServer.Close()
+
+	proxy, _ := url.Parse(proxyServer.URL)
+	consulted, restore := stubProxy(proxy)
+	defer restore()
+
+	resp, err := newHTTPClient(Options{}).Get("http://management.azure.com/subscriptions")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if len(*consulted) != 1 || (*consulted)[0] != "management.azure.com" {
+		t.Fatalf("expected proxy from environment to be consulted for management.azure.com, got: %v", *consulted)
+	}
+	if len(proxied) != 1 || proxied[0] != "http://management.azure.com/subscriptions" {
+		t.Fatalf("expected request to be sent through the proxy, got: %v", proxied)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	var mu sync.Mutex
+	var userAgents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		userAgents = append(userAgents, r.UserAgent())
+		mu.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/secrets/") {
+			fmt.Fprint(w, `{"value":"secret"}`)
+			return
+		}
+		writeTokenResponse(w, tokenResponse{resource: "https://vault.azure.net"})
+	}))
+	defer server.Close()
+
+	userAgent := "aad-pod-identity/IdentityValidator/test contoso/prod"
+	opts := Options{MSIEndpoint: server.URL, IdentityResourceID: "resourceid", IdentityClientID: "clientid", UserAgent: userAgent}
+	lastUserAgent := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return userAgents[len(userAgents)-1]
+	}
+
+	// raw token request selecting the identity by resource id
+	if _, err := AuthenticateWithMsiResourceID(context.Background(), opts, "https://vault.azure.net"); err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+	if ua := lastUserAgent(); ua != userAgent {
+		t.Errorf("expected user agent %q for the raw token request, got %q", userAgent, ua)
+	}
+
+	// adal token request, the user agent is added to the one of adal
+	spt, err := newServicePrincipalTokenFromMSI(opts, "https://vault.azure.net")
+	if err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+	if err := spt.Refresh(); err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+	if ua := lastUserAgent(); !strings.HasSuffix(ua, " "+userAgent) || !strings.Contains(ua, "adal") {
+		t.Errorf("expected user agent of adal followed by %q for the adal token request, got %q", userAgent, ua)
+	}
+
+	// sdk client
+	keyClient := keyvault.New()
+	configureClient(&keyClient.Client, opts)
+	if _, err := keyClient.GetSecret(context.Background(), server.URL, "secret", ""); err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+	if ua := lastUserAgent(); !strings.HasSuffix(ua, " "+userAgent) {
+		t.Errorf("expected user agent of the sdk followed by %q for the keyvault request, got %q", userAgent, ua)
+	}
+}
+
+func TestDefaultUserAgent(t *testing.T) {
+	opts := Options{}.withDefaults()
+	if !strings.HasPrefix(opts.UserAgent, "aad-pod-identity/IdentityValidator/") {
+		t.Errorf("expected the default user agent of the identity validator, got %q", opts.UserAgent)
+	}
+}
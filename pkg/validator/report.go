@@ -0,0 +1,105 @@
+package validator
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/klog"
+)
+
+// ReportConfigMapKey is the key of the config map data the report of the validation is written to
+const ReportConfigMapKey = "result.json"
+
+// Report is the structured result of the validation, e.g. to persist it in a config map for
+// dashboards and inspection after the validator completed
+type Report struct {
+	// Passed is true if all the checks that were run succeeded and the validation didn't fail
+	Passed      bool      `json:"passed"`
+	MSIEndpoint string    `json:"msiEndpoint,omitempty"`
+	Identity    string    `json:"identity"`
+	CompletedAt time.Time `json:"completedAt"`
+	// Error is the error the validation failed with, e.g. the first check that failed
+	Error  string        `json:"error,omitempty"`
+	Checks []CheckReport `json:"checks"`
+}
+
+// CheckReport is the outcome of a single check in the report
+type CheckReport struct {
+	Name     string `json:"name"`
+	Passed   bool   `json:"passed"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+// NewReport returns the report of the result of the validation with the options and the error
+// the validation returned
+func NewReport(opts Options, result Result, err error) Report {
+	report := Report{
+		Passed:      err == nil && result.Passed(),
+		MSIEndpoint: result.MSIEndpoint,
+		Identity:    opts.identity(),
+		CompletedAt: time.Now().UTC(),
+		Checks:      make([]CheckReport, 0, len(result.Checks)),
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	for _, c := range result.Checks {
+		check := CheckReport{Name: c.Name, Passed: c.Passed(), Duration: c.Duration.String()}
+		if c.Err != nil {
+			check.Error = c.Err.Error()
+		}
+		report.Checks = append(report.Checks, check)
+	}
+	return report
+}
+
+// ParseConfigMapRef returns the namespace and name of the config map referenced as namespace/name
+func ParseConfigMapRef(ref string) (string, string, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("config map %q must be referenced as namespace/name", ref)
+	}
+	return parts[0], parts[1], nil
+}
+
+// WriteReportConfigMap writes the report as JSON to the ReportConfigMapKey of the config map with
+// the name, creating the config map if it doesn't exist. The other keys of the config map are kept.
+func WriteReportConfigMap(configMaps typedcorev1.ConfigMapInterface, name string, report Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "Failed to marshal the report")
+	}
+
+	cm, err := configMaps.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Data:       map[string]string{ReportConfigMapKey: string(data)},
+		}
+		if _, err := configMaps.Create(cm); err != nil {
+			return errors.Wrapf(err, "Failed to create config map %s", name)
+		}
+		klog.Infof("Successfully created config map %s with the report", name)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get config map %s", name)
+	}
+
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[ReportConfigMapKey] = string(data)
+	if _, err := configMaps.Update(cm); err != nil {
+		return errors.Wrapf(err, "Failed to update config map %s", name)
+	}
+	klog.Infof("Successfully wrote the report to config map %s", name)
+	return nil
+}
@@ -0,0 +1,105 @@
+package validator
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNewReport(t *testing.T) {
+	opts := Options{IdentityClientID: "clientid"}
+	result := Result{
+		MSIEndpoint: "http://169.254.169.254/metadata/identity/oauth2/token",
+		Checks: []CheckResult{
+			{Name: CheckIdentityAvailable, Duration: time.Second},
+			{Name: CheckTokenRotation, Duration: time.Minute, Err: errors.New("the token isn't being refreshed")},
+		},
+	}
+	report := NewReport(opts, result, errors.New("token rotation failed"))
+	if report.Passed {
+		t.Errorf("expected the report of a failed validation not to pass")
+	}
+	if report.Identity != opts.identity() || report.MSIEndpoint != result.MSIEndpoint || report.Error != "token rotation failed" {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if len(report.Checks) != 2 {
+		t.Fatalf("expected 2 checks, got: %+v", report.Checks)
+	}
+	if c := report.Checks[0]; !c.Passed || c.Duration != "1s" || c.Error != "" {
+		t.Errorf("unexpected report of the passed check: %+v", c)
+	}
+	if c := report.Checks[1]; c.Passed || c.Name != CheckTokenRotation || c.Error != "the token isn't being refreshed" {
+		t.Errorf("unexpected report of the failed check: %+v", c)
+	}
+
+	if report := NewReport(opts, Result{Checks: result.Checks[:1]}, nil); !report.Passed || report.Error != "" {
+		t.Errorf("expected the report of a passed validation to pass, got: %+v", report)
+	}
+}
+
+func TestParseConfigMapRef(t *testing.T) {
+	namespace, name, err := ParseConfigMapRef("default/result")
+	if err != nil || namespace != "default" || name != "result" {
+		t.Errorf("expected default/result, got %s/%s, %v", namespace, name, err)
+	}
+	for _, ref := range []string{"", "result", "default/", "/result", "default/result/json"} {
+		if _, _, err := ParseConfigMapRef(ref); err == nil || !strings.Contains(err.Error(), "must be referenced as namespace/name") {
+			t.Errorf("%q: expected an invalid reference error, got: %v", ref, err)
+		}
+	}
+}
+
+// readReport returns the report written to the config map
+func readReport(t *testing.T, cm *corev1.ConfigMap) Report {
+	var report Report
+	if err := json.Unmarshal([]byte(cm.Data[ReportConfigMapKey]), &report); err != nil {
+		t.Fatalf("failed to unmarshal the report of config map %s: %v", cm.Name, err)
+	}
+	return report
+}
+
+func TestWriteReportConfigMapCreate(t *testing.T) {
+	configMaps := fake.NewSimpleClientset().CoreV1().ConfigMaps("default")
+	report := NewReport(Options{}, Result{Checks: []CheckResult{{Name: CheckIdentityAvailable}}}, nil)
+	if err := WriteReportConfigMap(configMaps, "result", report); err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+
+	cm, err := configMaps.Get("result", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the config map to be created, got: %v", err)
+	}
+	written := readReport(t, cm)
+	if !written.Passed || len(written.Checks) != 1 || written.Checks[0].Name != CheckIdentityAvailable {
+		t.Errorf("unexpected report written: %+v", written)
+	}
+}
+
+func TestWriteReportConfigMapUpdate(t *testing.T) {
+	existing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "result", Namespace: "default"},
+		Data:       map[string]string{"other": "value", ReportConfigMapKey: "{}"},
+	}
+	configMaps := fake.NewSimpleClientset(existing).CoreV1().ConfigMaps("default")
+	report := NewReport(Options{}, Result{}, errors.New("failed"))
+	if err := WriteReportConfigMap(configMaps, "result", report); err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+
+	cm, err := configMaps.Get("result", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get the config map: %v", err)
+	}
+	if cm.Data["other"] != "value" {
+		t.Errorf("expected the other keys of the config map to be kept, got: %v", cm.Data)
+	}
+	if written := readReport(t, cm); written.Passed || written.Error != "failed" {
+		t.Errorf("unexpected report written: %+v", written)
+	}
+}
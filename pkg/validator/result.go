@@ -0,0 +1,114 @@
+package validator
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+// validationResult is written to the result file so that other containers in the pod can
+// reuse the discovered MSI endpoint and identity without probing them again.
+type validationResult struct {
+	MSIEndpoint string    `json:"msiEndpoint"`
+	ClientID    string    `json:"clientID"`
+	Resource    string    `json:"resource"`
+	TokenExpiry time.Time `json:"tokenExpiry"`
+}
+
+// WriteResult acquires a token for the resource with the identity of the options, selected the
+// same way as for the validation, and atomically writes the result to the given path.
+func WriteResult(ctx context.Context, path string, opts Options) error {
+	opts = opts.withDefaults()
+	msiEndpoint, identityClientID, resource := opts.MSIEndpoint, opts.IdentityClientID, opts.Resource
+	token, err := acquireToken(ctx, opts, resource)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to acquire a token for %s with %s", resource, opts.identity())
+	}
+
+	clientID := tokenClientID(token.AccessToken)
+	if clientID == "" {
+		clientID = identityClientID
+	}
+	result := validationResult{
+		MSIEndpoint: msiEndpoint,
+		ClientID:    clientID,
+		Resource:    resource,
+		TokenExpiry: token.Expires().UTC(),
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "Failed to marshal the result")
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	klog.Infof("Successfully wrote the result to %s", path)
+	return nil
+}
+
+// tokenClientID returns the client id of the identity the access token was issued to,
+// or an empty string if it can't be read from the token claims.
+func tokenClientID(accessToken string) string {
+	var claims struct {
+		AppID string `json:"appid"`
+	}
+	if !decodeTokenClaims(accessToken, &claims) {
+		return ""
+	}
+	return claims.AppID
+}
+
+// decodeTokenClaims decodes the claims of the access token into claims and returns false if the
+// access token isn't a JWT
+func decodeTokenClaims(accessToken string, claims interface{}) bool {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(payload, claims) == nil
+}
+
+// writeFileAtomic writes the data to a temporary file in the same directory and renames it
+// to the path, so a reader never observes a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	dir, file := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+file+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create temporary file for %s", path)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "Failed to write %s", tmp.Name())
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "Failed to sync %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "Failed to close %s", tmp.Name())
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return errors.Wrapf(err, "Failed to set permissions of %s", tmp.Name())
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrapf(err, "Failed to rename %s to %s", tmp.Name(), path)
+	}
+	return nil
+}
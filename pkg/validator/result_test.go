@@ -0,0 +1,195 @@
+package validator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tempDirFiles returns the names of the files in the directory
+func tempDirFiles(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", dir, err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	return names
+}
+
+// issueSelectedIdentityToken answers the token requests with a JWT whose appid is the client id of
+// the identity selected by the client_id, msi_res_id or object_id query parameter, or of the
+// system assigned identity when none is set
+func issueSelectedIdentityToken(resource string, expiresOn time.Time, clientIDs map[string]string) func(r *http.Request, n int) tokenResponse {
+	return func(r *http.Request, n int) tokenResponse {
+		clientID := clientIDs["system"]
+		for _, param := range []string{"client_id", "msi_res_id", "object_id"} {
+			if v := r.URL.Query().Get(param); v != "" {
+				clientID = clientIDs[v]
+			}
+		}
+		return tokenResponse{accessToken: newJWT(fmt.Sprintf(`{"appid":%q}`, clientID)), resource: resource, expiresOn: expiresOn}
+	}
+}
+
+func TestWriteResult(t *testing.T) {
+	resource := "https://management.azure.com/"
+	expiresOn := time.Now().Add(time.Hour).Truncate(time.Second)
+	cases := []struct {
+		name             string
+		accessToken      string
+		opts             Options
+		expectedClientID string
+	}{
+		{
+			name:             "client id of the token",
+			accessToken:      newJWT(`{"appid":"tokenclientid"}`),
+			opts:             Options{IdentityClientID: "clientid"},
+			expectedClientID: "tokenclientid",
+		},
+		{
+			name:             "client id of the options for a non JWT token",
+			accessToken:      "token",
+			opts:             Options{IdentityClientID: "clientid"},
+			expectedClientID: "clientid",
+		},
+		{
+			name:             "identity selected by resource id",
+			opts:             Options{IdentityResourceID: "/subscriptions/sub/resourcegroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id1"},
+			expectedClientID: "resourceidclientid",
+		},
+		{
+			name:             "identity selected by object id",
+			opts:             Options{IdentityObjectID: "objectid"},
+			expectedClientID: "objectidclientid",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			respond := issueToken(tokenResponse{accessToken: tc.accessToken, resource: resource, expiresOn: expiresOn})
+			if tc.accessToken == "" {
+				respond = issueSelectedIdentityToken(resource, expiresOn, map[string]string{
+					"system": "systemclientid",
+					"/subscriptions/sub/resourcegroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id1": "resourceidclientid",
+					"objectid": "objectidclientid",
+				})
+			}
+			msi, _ := newTokenServer(respond)
+			defer msi.Close()
+			dir, err := ioutil.TempDir("", "result")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "result.json")
+			opts := tc.opts
+			opts.MSIEndpoint, opts.Resource = msi.URL, resource
+			if err := WriteResult(context.Background(), path, opts); err != nil {
+				t.Fatalf("expected nil error, got: %v", err)
+			}
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read the result: %v", err)
+			}
+			var result validationResult
+			if err := json.Unmarshal(data, &result); err != nil {
+				t.Fatalf("failed to unmarshal the result %s: %v", data, err)
+			}
+			expected := validationResult{MSIEndpoint: msi.URL, ClientID: tc.expectedClientID, Resource: resource, TokenExpiry: expiresOn.UTC()}
+			if result != expected {
+				t.Errorf("expected result %+v, got %+v", expected, result)
+			}
+			if files := tempDirFiles(t, dir); len(files) != 1 {
+				t.Errorf("expected only the result file to be left, got: %v", files)
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "result.json")
+	if err := ioutil.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := writeFileAtomic(path, []byte("new")); err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(data) != "new" {
+		t.Errorf("expected the file to be replaced, got %q, %v", data, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("expected the file to be readable by the other containers, got %v, %v", info.Mode(), err)
+	}
+	if files := tempDirFiles(t, dir); len(files) != 1 {
+		t.Errorf("expected no temporary file to be left, got: %v", files)
+	}
+}
+
+func TestWriteFileAtomicFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the directory of the path doesn't exist so the temporary file can't be created
+	path := filepath.Join(dir, "missing", "result.json")
+	if err := writeFileAtomic(path, []byte("new")); err == nil {
+		t.Fatalf("expected an error writing to a missing directory")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected no file to be written, got: %v", err)
+	}
+
+	// the path is a non empty directory so the rename fails after the data is written
+	path = filepath.Join(dir, "result.json")
+	if err := os.MkdirAll(filepath.Join(path, "child"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := writeFileAtomic(path, []byte("new")); err == nil {
+		t.Fatalf("expected an error renaming over a directory")
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		t.Errorf("expected the path to be left unchanged, got %v, %v", info, err)
+	}
+	if files := tempDirFiles(t, dir); len(files) != 1 {
+		t.Errorf("expected the temporary file to be removed, got: %v", files)
+	}
+}
+
+func TestTokenClientID(t *testing.T) {
+	cases := []struct {
+		name        string
+		accessToken string
+		expected    string
+	}{
+		{name: "jwt", accessToken: newJWT(`{"appid":"clientid"}`), expected: "clientid"},
+		{name: "jwt without appid", accessToken: newJWT(`{"aud":"https://vault.azure.net"}`)},
+		{name: "not a jwt", accessToken: "token"},
+		{name: "empty"},
+		{name: "invalid payload encoding", accessToken: "header.!!!.signature"},
+		{name: "payload not json", accessToken: newJWT("claims")},
+	}
+	for _, tc := range cases {
+		if clientID := tokenClientID(tc.accessToken); clientID != tc.expected {
+			t.Errorf("%s: expected client id %q, got %q", tc.name, tc.expected, clientID)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package validator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+const (
+	// transientRetryAttempts is the number of times a request failing with a transient error is attempted
+	transientRetryAttempts = 3
+	// transientRetryInterval is the interval between attempts of a request failing with a transient error
+	transientRetryInterval = 5 * time.Second
+)
+
+// errorClass is the classification of an error returned by the azure sdk
+type errorClass int
+
+const (
+	// errorClassOther is an error that is neither a permission denial nor transient
+	errorClassOther errorClass = iota
+	// errorClassPermissionDenied is an authorization failure, retrying won't succeed until a role
+	// assignment or access policy is added for the identity
+	errorClassPermissionDenied
+	// errorClassTransient is an error that may succeed when retried, such as throttling or a reset connection
+	errorClassTransient
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case errorClassPermissionDenied:
+		return "permission denied (won't retry)"
+	case errorClassTransient:
+		return "transient (retrying)"
+	}
+	return "error (won't retry)"
+}
+
+// classifyError returns the class of the error returned by an azure sdk call
+func classifyError(err error) errorClass {
+	err = errors.Cause(err)
+	switch e := err.(type) {
+	case *azure.RequestError:
+		return classifyError(e.DetailedError)
+	case autorest.DetailedError:
+		if c := classifyStatusCode(detailedErrorStatusCode(e)); c != errorClassOther {
+			return c
+		}
+		if e.Original != nil {
+			return classifyError(e.Original)
+		}
+	case *autorest.DetailedError:
+		return classifyError(*e)
+	case adal.TokenRefreshError:
+		// the token of the identity could not be acquired, which is transient while the identity
+		// is being assigned or the token service is throttled
+		if resp := e.Response(); resp != nil && (resp.StatusCode == http.StatusNotFound || isTransientStatusCode(resp.StatusCode)) {
+			return errorClassTransient
+		}
+	case net.Error:
+		return errorClassTransient
+	}
+	return errorClassOther
+}
+
+func detailedErrorStatusCode(e autorest.DetailedError) int {
+	if statusCode, ok := e.StatusCode.(int); ok && statusCode != 0 {
+		return statusCode
+	}
+	if e.Response != nil {
+		return e.Response.StatusCode
+	}
+	return 0
+}
+
+func classifyStatusCode(statusCode int) errorClass {
+	if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+		return errorClassPermissionDenied
+	}
+	if isTransientStatusCode(statusCode) {
+		return errorClassTransient
+	}
+	return errorClassOther
+}
+
+func isTransientStatusCode(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusRequestTimeout || statusCode >= http.StatusInternalServerError
+}
+
+// retryOnTransientError runs the operation until it succeeds, fails with an error that is not
+// transient, was attempted the given number of times or the context is done while waiting to
+// retry it. It returns the number of attempts made and the last error.
+func retryOnTransientError(ctx context.Context, attempts int, interval time.Duration, operation func() error) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil {
+			return attempt, nil
+		}
+		class := classifyError(err)
+		if class != errorClassTransient || attempt >= attempts {
+			return attempt, err
+		}
+		klog.Warningf("Attempt %d of %d failed, %s: %v", attempt, attempts, class, err)
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, errors.Wrapf(err, "retry after attempt %d of %d interrupted: %v", attempt, attempts, ctx.Err())
+		}
+	}
+}
+
+// failureReason describes why the request of the identity to the scope failed after the given
+// number of attempts. A permission denial includes the identity and the scope so the missing role
+// assignment can be added.
+func failureReason(err error, attempts int, identity, scope string) string {
+	switch classifyError(err) {
+	case errorClassPermissionDenied:
+		return fmt.Sprintf("%s: identity %s is not authorized to access %s, add a role assignment or access policy for the identity", errorClassPermissionDenied, identity, scope)
+	case errorClassTransient:
+		return fmt.Sprintf("transient error persisted after %d attempts", attempts)
+	}
+	return errorClassOther.String()
+}
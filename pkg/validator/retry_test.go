@@ -0,0 +1,113 @@
+package validator
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+)
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		expected errorClass
+	}{
+		{"forbidden", autorest.DetailedError{StatusCode: http.StatusForbidden}, errorClassPermissionDenied},
+		{"unauthorized", &azure.RequestError{DetailedError: autorest.DetailedError{StatusCode: http.StatusUnauthorized}}, errorClassPermissionDenied},
+		{"wrapped forbidden", errors.Wrap(autorest.DetailedError{StatusCode: http.StatusForbidden}, "keyvault"), errorClassPermissionDenied},
+		{"throttled", autorest.DetailedError{StatusCode: http.StatusTooManyRequests}, errorClassTransient},
+		{"server error", autorest.DetailedError{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}}, errorClassTransient},
+		{"connection reset", autorest.DetailedError{Original: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}}, errorClassTransient},
+		{"not found", autorest.DetailedError{StatusCode: http.StatusNotFound}, errorClassOther},
+		{"other", errors.New("failed"), errorClassOther},
+	}
+	for _, tc := range cases {
+		if class := classifyError(tc.err); class != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.expected, class)
+		}
+	}
+}
+
+func TestRetryOnTransientError(t *testing.T) {
+	transient := autorest.DetailedError{StatusCode: http.StatusTooManyRequests}
+	forbidden := autorest.DetailedError{StatusCode: http.StatusForbidden}
+
+	calls := 0
+	attempts, err := retryOnTransientError(context.Background(), 3, time.Millisecond, func() error {
+		calls++
+		if calls < 2 {
+			return transient
+		}
+		return nil
+	})
+	if err != nil || calls != 2 || attempts != 2 {
+		t.Errorf("expected success after 2 attempts, got %d calls, %d attempts and error %v", calls, attempts, err)
+	}
+
+	calls = 0
+	attempts, err = retryOnTransientError(context.Background(), 3, time.Millisecond, func() error {
+		calls++
+		return transient
+	})
+	if err == nil || calls != 3 || attempts != 3 {
+		t.Errorf("expected failure after 3 attempts, got %d calls, %d attempts and error %v", calls, attempts, err)
+	}
+
+	calls = 0
+	attempts, err = retryOnTransientError(context.Background(), 3, time.Millisecond, func() error {
+		calls++
+		return forbidden
+	})
+	if err == nil || calls != 1 || attempts != 1 {
+		t.Errorf("expected permission denied not to be retried, got %d calls, %d attempts and error %v", calls, attempts, err)
+	}
+}
+
+func TestRetryOnTransientErrorInterrupted(t *testing.T) {
+	transient := autorest.DetailedError{StatusCode: http.StatusTooManyRequests}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	begin := time.Now()
+	attempts, err := retryOnTransientError(ctx, 3, time.Hour, func() error {
+		calls++
+		return transient
+	})
+	if elapsed := time.Since(begin); elapsed > time.Minute {
+		t.Fatalf("expected the wait to be interrupted by the context, returned after %s", elapsed)
+	}
+	if calls != 1 || attempts != 1 {
+		t.Errorf("expected a single attempt before the interruption, got %d calls and %d attempts", calls, attempts)
+	}
+	if err == nil || !strings.Contains(err.Error(), "retry after attempt 1 of 3 interrupted: context deadline exceeded") {
+		t.Errorf("expected the retry to be interrupted, got: %v", err)
+	}
+	if class := classifyError(err); class != errorClassTransient {
+		t.Errorf("expected the error of the last attempt to be kept, got class %s", class)
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	opts := Options{IdentityClientID: "client-id"}
+	reason := failureReason(autorest.DetailedError{StatusCode: http.StatusForbidden}, 1, opts.identity(), "https://kv.vault.azure.net")
+	for _, s := range []string{"permission denied (won't retry)", "client id client-id", "https://kv.vault.azure.net"} {
+		if !strings.Contains(reason, s) {
+			t.Errorf("expected %q in %q", s, reason)
+		}
+	}
+}
+
+func TestFailureReasonAttempts(t *testing.T) {
+	reason := failureReason(autorest.DetailedError{StatusCode: http.StatusTooManyRequests}, 2, "client id client-id", "https://kv.vault.azure.net")
+	if reason != "transient error persisted after 2 attempts" {
+		t.Errorf("expected the attempts made in the reason, got %q", reason)
+	}
+}
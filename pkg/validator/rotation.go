@@ -0,0 +1,67 @@
+package validator
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+// CheckTokenRotation acquires a token, waits past the point it is expected to be refreshed and
+// acquires a token again, to verify the token isn't served from a cache past its refresh
+const CheckTokenRotation = "TokenRotation"
+
+// validateRotationWait returns an error if the token rotation check is run without a rotation wait.
+// There is no default since the refresh point of the token depends on its lifetime, up to a day
+// for IMDS tokens, which would block the check for as long.
+func (o Options) validateRotationWait() error {
+	if o.VerifyRotation && o.RotationWait <= 0 {
+		return errors.Errorf("the token rotation check requires a rotation wait, got %s", o.RotationWait)
+	}
+	return nil
+}
+
+// testTokenRotation acquires a token for the resource of the options with the identity of the
+// options, waits past its expected refresh point and acquires a token again. It returns an error
+// if the same token is acquired twice, e.g. a cached token served after a refresh failure, and
+// logs the observed rotation interval, the time between the expiries of the two tokens.
+func testTokenRotation(ctx context.Context, opts Options) error {
+	first, err := acquireToken(ctx, opts, opts.Resource)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to acquire the first token for %s with %s", opts.Resource, opts.identity())
+	}
+	writeToken(opts, CheckTokenRotation, opts.identity(), first)
+	if first.IsZero() {
+		return errors.Errorf("No token found for %s with %s", opts.Resource, opts.identity())
+	}
+
+	wait := opts.RotationWait
+	klog.Infof("Acquired a token for %s with %s expiring at %s, waiting %s before acquiring it again",
+		opts.Resource, opts.identity(), first.Expires().UTC().Format(time.RFC3339), wait.Round(time.Second))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "wait of %s for the token rotation interrupted", wait.Round(time.Second))
+	}
+
+	second, err := acquireToken(ctx, opts, opts.Resource)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to acquire the second token for %s with %s", opts.Resource, opts.identity())
+	}
+	writeToken(opts, CheckTokenRotation, opts.identity(), second)
+	if second.AccessToken == first.AccessToken {
+		return errors.Errorf("the same token for %s expiring at %s was acquired with %s after waiting %s, the token isn't being refreshed",
+			opts.Resource, first.Expires().UTC().Format(time.RFC3339), opts.identity(), wait.Round(time.Second))
+	}
+	if !second.Expires().After(first.Expires()) {
+		return errors.Errorf("the token for %s acquired with %s after waiting %s expires at %s, not after the first token expiring at %s",
+			opts.Resource, opts.identity(), wait.Round(time.Second), second.Expires().UTC().Format(time.RFC3339), first.Expires().UTC().Format(time.RFC3339))
+	}
+
+	klog.Infof("The token for %s with %s was rotated, observed rotation interval: %s, the new token expires at %s",
+		opts.Resource, opts.identity(), second.Expires().Sub(first.Expires()), second.Expires().UTC().Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,89 @@
+package validator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTestTokenRotation(t *testing.T) {
+	expiresOn := time.Now().Add(time.Hour)
+	cases := []struct {
+		name        string
+		respond     func(r *http.Request, n int) tokenResponse
+		expectedErr string
+	}{
+		{
+			name: "token rotated",
+			respond: func(r *http.Request, n int) tokenResponse {
+				return tokenResponse{accessToken: fmt.Sprintf("token%d", n), expiresOn: expiresOn.Add(time.Duration(n) * time.Minute)}
+			},
+		},
+		{
+			name:        "same token",
+			respond:     issueToken(tokenResponse{expiresOn: expiresOn}),
+			expectedErr: "the token isn't being refreshed",
+		},
+		{
+			name: "new token not expiring later",
+			respond: func(r *http.Request, n int) tokenResponse {
+				return tokenResponse{accessToken: fmt.Sprintf("token%d", n), expiresOn: expiresOn}
+			},
+			expectedErr: "not after the first token",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			msi, _ := newTokenServer(tc.respond)
+			defer msi.Close()
+
+			opts := Options{MSIEndpoint: msi.URL, IdentityClientID: "clientid", RotationWait: 10 * time.Millisecond}.withDefaults()
+			err := testTokenRotation(context.Background(), opts)
+			if tc.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("expected nil error, got: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+				t.Fatalf("expected error containing %q, got: %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestTestTokenRotationInterrupted(t *testing.T) {
+	msi, _ := newTokenServer(func(r *http.Request, n int) tokenResponse {
+		return tokenResponse{accessToken: fmt.Sprintf("token%d", n)}
+	})
+	defer msi.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	opts := Options{MSIEndpoint: msi.URL, IdentityClientID: "clientid", RotationWait: time.Hour}.withDefaults()
+	err := testTokenRotation(ctx, opts)
+	if err == nil || !strings.Contains(err.Error(), "wait of 1h0m0s for the token rotation interrupted") {
+		t.Fatalf("expected the wait to be interrupted, got: %v", err)
+	}
+}
+
+func TestValidateRotationWait(t *testing.T) {
+	cases := []struct {
+		name        string
+		opts        Options
+		expectedErr bool
+	}{
+		{name: "rotation not verified", opts: Options{}},
+		{name: "rotation wait set", opts: Options{VerifyRotation: true, RotationWait: time.Minute}},
+		{name: "rotation wait missing", opts: Options{VerifyRotation: true}, expectedErr: true},
+		{name: "negative rotation wait", opts: Options{VerifyRotation: true, RotationWait: -time.Minute}, expectedErr: true},
+	}
+	for _, tc := range cases {
+		err := tc.opts.validateRotationWait()
+		if tc.expectedErr != (err != nil) {
+			t.Errorf("%s: expected error: %v, got: %v", tc.name, tc.expectedErr, err)
+		}
+	}
+}
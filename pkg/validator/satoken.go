@@ -0,0 +1,73 @@
+package validator
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+const (
+	// CheckServiceAccountToken verifies the projected service account token of the pod exists, is a
+	// JWT and isn't expired
+	CheckServiceAccountToken = "ServiceAccountToken"
+
+	// DefaultSATokenPath is the path the service account token is projected at for workload
+	// identity federation
+	DefaultSATokenPath = "/var/run/secrets/azure/tokens/azure-identity-token"
+	// federatedTokenFileEnv is the environment variable holding the path of the projected token
+	federatedTokenFileEnv = "AZURE_FEDERATED_TOKEN_FILE"
+)
+
+// saTokenPath returns the path of the projected service account token: the path of the options,
+// else the path of AZURE_FEDERATED_TOKEN_FILE, else DefaultSATokenPath
+func (o Options) saTokenPath() string {
+	if o.SATokenPath != "" {
+		return o.SATokenPath
+	}
+	if path := os.Getenv(federatedTokenFileEnv); path != "" {
+		return path
+	}
+	return DefaultSATokenPath
+}
+
+// verifySAToken returns an error if the projected service account token is missing, empty, not a
+// JWT or expired. The token is never logged.
+func verifySAToken(opts Options) error {
+	path := opts.saTokenPath()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return errors.Errorf("projected service account token %s is missing, check the service account token volume projection of the pod", path)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read projected service account token %s", path)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return errors.Errorf("projected service account token %s is empty", path)
+	}
+
+	var claims struct {
+		Issuer   string      `json:"iss"`
+		Audience interface{} `json:"aud"`
+		Expiry   float64     `json:"exp"`
+	}
+	if !decodeTokenClaims(token, &claims) {
+		return errors.Errorf("projected service account token %s is not a valid JWT", path)
+	}
+	if claims.Expiry == 0 {
+		return errors.Errorf("projected service account token %s has no expiry", path)
+	}
+	expires := time.Unix(int64(claims.Expiry), 0)
+	if !expires.After(time.Now()) {
+		return errors.Errorf("projected service account token %s expired at %s, the token isn't being refreshed by the kubelet",
+			path, expires.UTC().Format(time.RFC3339))
+	}
+
+	klog.Infof("Projected service account token %s is valid, issuer: %s, audience: %v, expires at %s",
+		path, claims.Issuer, claims.Audience, expires.UTC().Format(time.RFC3339))
+	return nil
+}
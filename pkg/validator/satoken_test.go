@@ -0,0 +1,79 @@
+package validator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySAToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "satoken")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name        string
+		missing     bool
+		token       string
+		expectedErr string
+	}{
+		{name: "missing", missing: true, expectedErr: "is missing"},
+		{name: "empty", token: "\n", expectedErr: "is empty"},
+		{name: "not a jwt", token: "not-a-jwt", expectedErr: "is not a valid JWT"},
+		{name: "no expiry", token: newJWT(`{"iss":"https://oidc.example.com","aud":"api://AzureADTokenExchange"}`), expectedErr: "has no expiry"},
+		{name: "expired", token: newJWT(`{"exp":1586132170}`), expectedErr: "expired at 2020-04-06T00:16:10Z"},
+		{name: "valid", token: newJWT(fmt.Sprintf(`{"aud":["api://AzureADTokenExchange"],"exp":%d}`, time.Now().Add(time.Hour).Unix()))},
+	}
+	for _, tc := range cases {
+		path := filepath.Join(dir, strings.Replace(tc.name, " ", "-", -1))
+		if !tc.missing {
+			if err := ioutil.WriteFile(path, []byte(tc.token), 0600); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		err := verifySAToken(Options{SATokenPath: path})
+		if tc.expectedErr == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		if tc.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedErr)) {
+			t.Errorf("%s: expected error containing %q, got: %v", tc.name, tc.expectedErr, err)
+		}
+	}
+}
+
+func TestSATokenPath(t *testing.T) {
+	defer os.Setenv(federatedTokenFileEnv, os.Getenv(federatedTokenFileEnv))
+
+	os.Unsetenv(federatedTokenFileEnv)
+	if path := (Options{}).saTokenPath(); path != DefaultSATokenPath {
+		t.Errorf("expected the default path, got %s", path)
+	}
+	os.Setenv(federatedTokenFileEnv, "/var/run/token")
+	if path := (Options{}).saTokenPath(); path != "/var/run/token" {
+		t.Errorf("expected the path of %s, got %s", federatedTokenFileEnv, path)
+	}
+	if path := (Options{SATokenPath: "/token"}).saTokenPath(); path != "/token" {
+		t.Errorf("expected the path of the options, got %s", path)
+	}
+}
+
+func TestValidateChecksSATokenFirst(t *testing.T) {
+	result, err := Validate(context.Background(), Options{
+		MSIEndpoint:  "http://127.0.0.1:1/metadata/identity/oauth2/token",
+		CheckSAToken: true,
+		SATokenPath:  filepath.Join(os.TempDir(), "missing-sa-token"),
+	})
+	if err == nil || !strings.Contains(err.Error(), CheckServiceAccountToken+" failed") {
+		t.Fatalf("expected the service account token check to fail, got: %v", err)
+	}
+	if len(result.Checks) != 1 {
+		t.Errorf("expected no check after the service account token check, got: %+v", result.Checks)
+	}
+}
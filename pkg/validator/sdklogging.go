@@ -0,0 +1,99 @@
+package validator
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"k8s.io/klog"
+)
+
+const redacted = "REDACTED"
+
+// secretValuePattern matches the JSON string fields holding credentials or secrets in the bodies
+// of the responses: the tokens of AAD and the container registry, client assertions and the value
+// of keyvault secrets. Escaped quotes in the values are matched so no part of a value is logged.
+var secretValuePattern = regexp.MustCompile(`"(value|client_assertion|[A-Za-z]*_token)"\s*:\s*"(?:[^"\\]|\\.)*"`)
+
+// enableSDKLogging installs request and response inspectors on the autorest client
+func enableSDKLogging(client *autorest.Client) {
+	client.RequestInspector = withRequestLogging()
+	client.ResponseInspector = withResponseLogging()
+}
+
+func withRequestLogging() autorest.PrepareDecorator {
+	return func(p autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err == nil {
+				logRequest(r)
+			}
+			return r, err
+		})
+	}
+}
+
+func withResponseLogging() autorest.RespondDecorator {
+	return func(r autorest.Responder) autorest.Responder {
+		return autorest.ResponderFunc(func(resp *http.Response) error {
+			logResponse(resp)
+			return r.Respond(resp)
+		})
+	}
+}
+
+func withSenderLogging(s adal.Sender) adal.Sender {
+	return adal.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		logRequest(r)
+		resp, err := s.Do(r)
+		if err != nil {
+			klog.Infof("SDK request %s %s failed: %v", r.Method, r.URL.Path, err)
+			return resp, err
+		}
+		logResponse(resp)
+		return resp, err
+	})
+}
+
+func logRequest(r *http.Request) {
+	klog.Infof("SDK request: %s %s://%s%s headers: %v", r.Method, r.URL.Scheme, r.URL.Host, r.URL.Path, redactHeaders(r.Header))
+}
+
+func logResponse(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	var body []byte
+	if resp.Body != nil {
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		// restore the body so the caller can still read it
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	path := ""
+	if resp.Request != nil {
+		path = resp.Request.URL.Path
+	}
+	klog.Infof("SDK response: %d %s headers: %v body: %s", resp.StatusCode, path, redactHeaders(resp.Header), redactBody(body))
+}
+
+// redactHeaders returns a copy of the headers with the authorization values removed
+func redactHeaders(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		if http.CanonicalHeaderKey(k) == "Authorization" {
+			c[k] = []string{redacted}
+			continue
+		}
+		c[k] = v
+	}
+	return c
+}
+
+// redactBody removes the token and secret values from the response body
+func redactBody(body []byte) string {
+	return secretValuePattern.ReplaceAllString(string(body), `"$1":"`+redacted+`"`)
+}
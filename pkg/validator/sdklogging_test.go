@@ -0,0 +1,80 @@
+package validator
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRedactHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Authorization", "Bearer secrettoken")
+	h.Set("Content-Type", "application/json")
+	redactedHeaders := redactHeaders(h)
+	if got := redactedHeaders.Get("Authorization"); got != redacted {
+		t.Errorf("expected the authorization header to be redacted, got %q", got)
+	}
+	if got := redactedHeaders.Get("Content-Type"); got != "application/json" {
+		t.Errorf("expected the other headers to be kept, got %q", got)
+	}
+	if got := h.Get("Authorization"); got != "Bearer secrettoken" {
+		t.Errorf("expected the headers of the request to be unchanged, got %q", got)
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	cases := []struct {
+		name     string
+		body     string
+		secrets  []string
+		expected []string
+	}{
+		{
+			name:     "aad token",
+			body:     `{"access_token":"secretaccess","refresh_token": "secretrefresh","expires_in":"3599","token_type":"Bearer"}`,
+			secrets:  []string{"secretaccess", "secretrefresh"},
+			expected: []string{`"access_token":"REDACTED"`, `"refresh_token":"REDACTED"`, `"expires_in":"3599"`, `"token_type":"Bearer"`},
+		},
+		{
+			name:     "other token fields",
+			body:     `{"id_token":"secretid","client_assertion":"secretassertion"}`,
+			secrets:  []string{"secretid", "secretassertion"},
+			expected: []string{`"id_token":"REDACTED"`, `"client_assertion":"REDACTED"`},
+		},
+		{
+			name:     "keyvault secret",
+			body:     `{"value":"hunter\"2","id":"https://myvault.vault.azure.net/secrets/test/1","attributes":{"enabled":true}}`,
+			secrets:  []string{"hunter", `2"`},
+			expected: []string{`"value":"REDACTED"`, `"id":"https://myvault.vault.azure.net/secrets/test/1"`},
+		},
+		{
+			name:     "no secret",
+			body:     `{"error":{"code":"Forbidden"}}`,
+			expected: []string{`{"error":{"code":"Forbidden"}}`},
+		},
+	}
+	for _, tc := range cases {
+		body := redactBody([]byte(tc.body))
+		for _, secret := range tc.secrets {
+			if strings.Contains(body, secret) {
+				t.Errorf("%s: expected %q to be redacted, got %s", tc.name, secret, body)
+			}
+		}
+		for _, expected := range tc.expected {
+			if !strings.Contains(body, expected) {
+				t.Errorf("%s: expected %s in %s", tc.name, expected, body)
+			}
+		}
+	}
+}
+
+func TestLogResponseRestoresBody(t *testing.T) {
+	body := `{"value":"secretvalue"}`
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(body))}
+	logResponse(resp)
+	restored, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(restored) != body {
+		t.Errorf("expected the body to be restored unredacted for the caller, got %q, %v", restored, err)
+	}
+}
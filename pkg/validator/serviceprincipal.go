@@ -0,0 +1,100 @@
+package validator
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+// useServicePrincipal returns true if the checks authenticate with the service principal
+// certificate of the options instead of the MSI endpoint
+func (o Options) useServicePrincipal() bool {
+	return o.SPClientID != "" || o.SPTenantID != "" || o.SPCertPath != ""
+}
+
+// validateServicePrincipal returns an error if only some of the service principal options are set
+func (o Options) validateServicePrincipal() error {
+	if o.useServicePrincipal() && (o.SPClientID == "" || o.SPTenantID == "" || o.SPCertPath == "") {
+		return errors.New("the service principal client id, tenant id and certificate path must be set together")
+	}
+	return nil
+}
+
+// newServicePrincipalTokenFromCertificate returns a token for the resource acquired from AAD with
+// the client certificate of the service principal in the options
+func newServicePrincipalTokenFromCertificate(opts Options, resource string) (*adal.ServicePrincipalToken, error) {
+	data, err := ioutil.ReadFile(opts.SPCertPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read the service principal certificate %s", opts.SPCertPath)
+	}
+	certificate, privateKey, err := parseCertificate(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse the service principal certificate %s", opts.SPCertPath)
+	}
+
+	oauthConfig, err := adal.NewOAuthConfig(azure.PublicCloud.ActiveDirectoryEndpoint, opts.SPTenantID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create OAuth config for tenant %s", opts.SPTenantID)
+	}
+	spt, err := adal.NewServicePrincipalTokenFromCertificate(*oauthConfig, opts.SPClientID, certificate, privateKey, resource)
+	if err != nil {
+		return nil, err
+	}
+	configureToken(spt, opts)
+
+	klog.Infof("Using service principal %s with certificate %s", opts.SPClientID, opts.SPCertPath)
+	return spt, nil
+}
+
+// parseCertificate returns the certificate and the RSA private key of the PEM encoded data
+func parseCertificate(data []byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	var certificate *x509.Certificate
+	var privateKey *rsa.PrivateKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			if certificate != nil {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			certificate = cert
+		case "RSA PRIVATE KEY":
+			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			privateKey = key
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return nil, nil, errors.New("private key is not an RSA key")
+			}
+			privateKey = rsaKey
+		}
+	}
+	if certificate == nil {
+		return nil, nil, errors.New("no certificate found")
+	}
+	if privateKey == nil {
+		return nil, nil, errors.New("no RSA private key found")
+	}
+	return certificate, privateKey, nil
+}
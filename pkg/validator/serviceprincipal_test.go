@@ -0,0 +1,100 @@
+package validator
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestCertificate returns a PEM encoded self-signed certificate and private key
+func newTestCertificate(t *testing.T, pkcs8 bool) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "validator"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBlock := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if pkcs8 {
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyBlock = &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}
+	}
+	return append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(keyBlock)...)
+}
+
+func TestParseCertificate(t *testing.T) {
+	for _, c := range []struct {
+		desc string
+		data []byte
+		xErr bool
+	}{
+		{"pkcs1 key", newTestCertificate(t, false), false},
+		{"pkcs8 key", newTestCertificate(t, true), false},
+		{"no pem", []byte("not a certificate"), true},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			cert, key, err := parseCertificate(c.data)
+			if (err != nil) != c.xErr {
+				t.Fatalf("expected err==%v, got: %v", c.xErr, err)
+			}
+			if !c.xErr && (cert == nil || key == nil) {
+				t.Fatalf("expected certificate and key, got: %v %v", cert, key)
+			}
+		})
+	}
+}
+
+func TestNewServicePrincipalTokenFromCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath := filepath.Join(dir, "sp.pem")
+	if err := ioutil.WriteFile(certPath, newTestCertificate(t, false), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{SPClientID: "clientid", SPTenantID: "tenantid", SPCertPath: certPath}
+	if _, err := newServicePrincipalTokenFromCertificate(opts, "https://vault.azure.net"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts.SPCertPath = filepath.Join(dir, "missing.pem")
+	if _, err := newServicePrincipalTokenFromCertificate(opts, "https://vault.azure.net"); err == nil {
+		t.Fatalf("expected error for missing certificate")
+	}
+}
+
+func TestValidateRequiresAllServicePrincipalOptions(t *testing.T) {
+	result, err := Validate(context.Background(), Options{
+		MSIEndpoint: "http://127.0.0.1:1/metadata/identity/oauth2/token",
+		SPClientID:  "clientid",
+	})
+	if err == nil {
+		t.Fatalf("expected error when only the service principal client id is set")
+	}
+	if len(result.Checks) != 0 {
+		t.Fatalf("expected no checks to run, got: %+v", result.Checks)
+	}
+}
@@ -0,0 +1,27 @@
+package validator
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+// WaitStartupDelay waits for the delay before the first token acquisition, e.g. for NMI to install
+// its iptables rules on a freshly booted node when the validator runs as an init container. It
+// returns the error of the context if the context is done before the delay is over.
+func WaitStartupDelay(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	klog.Infof("Waiting %s before the first token acquisition", delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "startup delay of %s interrupted", delay)
+	}
+}
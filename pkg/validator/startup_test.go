@@ -0,0 +1,39 @@
+package validator
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitStartupDelay(t *testing.T) {
+	begin := time.Now()
+	if err := WaitStartupDelay(context.Background(), 50*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed < 50*time.Millisecond {
+		t.Errorf("expected to wait for the delay, waited %s", elapsed)
+	}
+
+	if err := WaitStartupDelay(context.Background(), 0); err != nil {
+		t.Errorf("expected no wait without a delay, got: %v", err)
+	}
+}
+
+func TestWaitStartupDelayCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	begin := time.Now()
+	err := WaitStartupDelay(ctx, time.Hour)
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Errorf("expected the cancellation to return promptly, took %s", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("expected the error of the cancelled context, got: %v", err)
+	}
+}
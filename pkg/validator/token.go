@@ -0,0 +1,124 @@
+package validator
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+// CheckToken acquires a token for the resource with the identity and validates its expiry and
+// audience without calling any data-plane api
+const CheckToken = "Token"
+
+// testToken acquires a token for the resource of the options with the identity of the options and
+// verifies it isn't expired and is issued for the resource
+func testToken(ctx context.Context, opts Options) error {
+	token, err := acquireToken(ctx, opts, opts.Resource)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to acquire a token for %s with %s", opts.Resource, opts.identity())
+	}
+	writeToken(opts, CheckToken, opts.identity(), token)
+
+	if token.IsZero() {
+		return errors.Errorf("No token found for %s with %s", opts.Resource, opts.identity())
+	}
+	expires := token.Expires()
+	if !expires.After(time.Now()) {
+		return errors.Errorf("the token acquired for %s with %s expired at %s", opts.Resource, opts.identity(), expires.UTC().Format(time.RFC3339))
+	}
+	audience := tokenAudience(*token)
+	if !sameResource(audience, opts.Resource) {
+		return errors.Errorf("the token acquired with %s is for audience %s, expected %s", opts.identity(), audience, opts.Resource)
+	}
+	if err := assertTokenTTL(opts, CheckToken, opts.identity(), token); err != nil {
+		return err
+	}
+
+	klog.Infof("Successfully acquired a token for %s with %s, expires at %s", audience, opts.identity(), expires.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// acquireToken returns a token for the resource acquired with the identity of the options
+func acquireToken(ctx context.Context, opts Options, resource string) (*adal.Token, error) {
+	refresh, err := newTokenRefresh(opts, resource)
+	if err != nil {
+		return nil, err
+	}
+	return refresh(ctx)
+}
+
+// newTokenRefresh returns the request of a new token for the resource with the identity of the
+// options, selected by service principal, client id, resource id or object id, or the system
+// assigned identity when none is set. Nothing is cached, each call is a round trip.
+func newTokenRefresh(opts Options, resource string) (func(ctx context.Context) (*adal.Token, error), error) {
+	switch {
+	case opts.useServicePrincipal():
+		spt, err := newServicePrincipalTokenFromCertificate(opts, resource)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to get service principal token from certificate")
+		}
+		return func(ctx context.Context) (*adal.Token, error) { return refreshToken(ctx, spt) }, nil
+	case opts.RawIMDS:
+		return func(ctx context.Context) (*adal.Token, error) { return authenticateWithRawIMDS(ctx, opts, resource) }, nil
+	case opts.IdentityResourceID != "":
+		return func(ctx context.Context) (*adal.Token, error) {
+			return AuthenticateWithMsiResourceID(ctx, opts, resource)
+		}, nil
+	case opts.IdentityObjectID != "":
+		return func(ctx context.Context) (*adal.Token, error) {
+			return AuthenticateWithMsiObjectID(ctx, opts, resource)
+		}, nil
+	}
+	spt, err := newServicePrincipalTokenFromMSI(opts, resource)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get service principal token from MSI")
+	}
+	return func(ctx context.Context) (*adal.Token, error) { return refreshToken(ctx, spt) }, nil
+}
+
+// refreshToken acquires the token of the service principal token
+func refreshToken(ctx context.Context, spt *adal.ServicePrincipalToken) (*adal.Token, error) {
+	if err := spt.RefreshWithContext(ctx); err != nil {
+		return nil, err
+	}
+	token := spt.Token()
+	return &token, nil
+}
+
+// newServicePrincipalTokenFromMSI returns a token for the user assigned identity when a client
+// id is given in the options, otherwise for the system assigned identity.
+func newServicePrincipalTokenFromMSI(opts Options, resource string) (*adal.ServicePrincipalToken, error) {
+	var spt *adal.ServicePrincipalToken
+	var err error
+	if opts.IdentityClientID == "" {
+		spt, err = adal.NewServicePrincipalTokenFromMSI(opts.MSIEndpoint, resource)
+	} else {
+		spt, err = adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(opts.MSIEndpoint, resource, opts.IdentityClientID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	configureToken(spt, opts)
+	return spt, nil
+}
+
+// tokenAudience returns the audience of the access token, or the resource of the token response
+// when the access token claims can't be read
+func tokenAudience(token adal.Token) string {
+	var claims struct {
+		Audience string `json:"aud"`
+	}
+	if decodeTokenClaims(token.AccessToken, &claims) && claims.Audience != "" {
+		return claims.Audience
+	}
+	return token.Resource
+}
+
+// sameResource returns true if the resources are the same, ignoring case and a trailing slash
+func sameResource(x, y string) bool {
+	return strings.EqualFold(strings.TrimSuffix(x, "/"), strings.TrimSuffix(y, "/"))
+}
@@ -0,0 +1,189 @@
+package validator
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenResponse is the response of a mock of the MSI endpoint to a token request: the access token
+// for the resource expiring at expiresOn, else the status and body of the error when status is set.
+// The access token defaults to "token", the resource to ARM and the expiry to an hour from now.
+type tokenResponse struct {
+	accessToken string
+	resource    string
+	expiresOn   time.Time
+	status      int
+	body        string
+}
+
+// writeTokenResponse writes the response of a mock of the MSI endpoint to a token request
+func writeTokenResponse(w http.ResponseWriter, resp tokenResponse) {
+	if resp.status != 0 {
+		w.WriteHeader(resp.status)
+		w.Write([]byte(resp.body))
+		return
+	}
+	if resp.accessToken == "" {
+		resp.accessToken = "token"
+	}
+	if resp.resource == "" {
+		resp.resource = "https://management.azure.com/"
+	}
+	if resp.expiresOn.IsZero() {
+		resp.expiresOn = time.Now().Add(time.Hour)
+	}
+	fmt.Fprintf(w, `{"access_token":%q,"expires_in":"3599","expires_on":"%d","not_before":"1586132170","resource":%q,"token_type":"Bearer"}`,
+		resp.accessToken, resp.expiresOn.Unix(), resp.resource)
+}
+
+// tokenRequests are the token requests received by a mock of the MSI endpoint
+type tokenRequests struct {
+	mu      sync.Mutex
+	queries []url.Values
+}
+
+// count returns the number of token requests received
+func (r *tokenRequests) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.queries)
+}
+
+// query returns the query of the token request i, starting at 0
+func (r *tokenRequests) query(i int) url.Values {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queries[i]
+}
+
+// last returns the query of the last token request, nil when none was received
+func (r *tokenRequests) last() url.Values {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.queries) == 0 {
+		return nil
+	}
+	return r.queries[len(r.queries)-1]
+}
+
+// newTokenHandler returns the handler of a mock of the MSI endpoint answering each token request
+// with the response returned by respond for the request and its number, starting at 1, and the
+// token requests it received
+func newTokenHandler(respond func(r *http.Request, n int) tokenResponse) (http.Handler, *tokenRequests) {
+	requests := &tokenRequests{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.mu.Lock()
+		requests.queries = append(requests.queries, r.URL.Query())
+		n := len(requests.queries)
+		requests.mu.Unlock()
+		writeTokenResponse(w, respond(r, n))
+	}), requests
+}
+
+// newTokenServer returns a mock of the MSI endpoint answering each token request with the response
+// returned by respond, see newTokenHandler
+func newTokenServer(respond func(r *http.Request, n int) tokenResponse) (*httptest.Server, *tokenRequests) {
+	handler, requests := newTokenHandler(respond)
+	return httptest.NewServer(handler), requests
+}
+
+// issueToken answers every token request with the response
+func issueToken(resp tokenResponse) func(r *http.Request, n int) tokenResponse {
+	return func(*http.Request, int) tokenResponse {
+		return resp
+	}
+}
+
+// newJWT returns an unsigned JWT with the JSON claims
+func newJWT(claims string) string {
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".signature"
+}
+
+func TestTestToken(t *testing.T) {
+	resource := "https://management.azure.com/"
+	cases := []struct {
+		name        string
+		accessToken string
+		resource    string
+		expiresOn   time.Time
+		expectedErr string
+	}{
+		{
+			name:        "valid token",
+			accessToken: "token",
+			resource:    resource,
+			expiresOn:   time.Now().Add(time.Hour),
+		},
+		{
+			name:        "audience of the claims without trailing slash",
+			accessToken: newJWT(`{"aud":"https://management.azure.com"}`),
+			resource:    "https://vault.azure.net",
+			expiresOn:   time.Now().Add(time.Hour),
+		},
+		{
+			name:        "expired token",
+			accessToken: "token",
+			resource:    resource,
+			expiresOn:   time.Now().Add(-time.Minute),
+			expectedErr: "expired at",
+		},
+		{
+			name:        "audience mismatch",
+			accessToken: newJWT(`{"aud":"https://vault.azure.net"}`),
+			resource:    resource,
+			expiresOn:   time.Now().Add(time.Hour),
+			expectedErr: "for audience https://vault.azure.net, expected https://management.azure.com/",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			msi, _ := newTokenServer(issueToken(tokenResponse{accessToken: tc.accessToken, resource: tc.resource, expiresOn: tc.expiresOn}))
+			defer msi.Close()
+
+			opts := Options{MSIEndpoint: msi.URL, IdentityClientID: "clientid", Resource: resource}
+			err := testToken(context.Background(), opts)
+			if tc.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("expected nil error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+				t.Fatalf("expected error containing %q, got: %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateTokenOnly(t *testing.T) {
+	msi, requests := newTokenServer(issueToken(tokenResponse{resource: "https://vault.azure.net"}))
+	defer msi.Close()
+
+	opts := Options{
+		MSIEndpoint:        msi.URL,
+		IdentityClientID:   "clientid",
+		Resource:           "https://vault.azure.net",
+		KeyvaultName:       "keyvault",
+		KeyvaultSecretName: "secret",
+		TokenOnly:          true,
+	}
+	result, err := Validate(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+	if len(result.Checks) != 1 || result.Checks[0].Name != CheckToken {
+		t.Errorf("expected only the token check to be run, got: %+v", result.Checks)
+	}
+	if n := requests.count(); n != 1 {
+		t.Errorf("expected a single token request, got %d", n)
+	}
+}
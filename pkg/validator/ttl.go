@@ -0,0 +1,43 @@
+package validator
+
+import (
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+// assertTokenTTL returns an error if the remaining lifetime of the token acquired by the check is
+// below the min token ttl of the options. Nothing is asserted when the min token ttl isn't set or
+// no token was acquired.
+func assertTokenTTL(opts Options, check, identity string, tokenProvider adal.OAuthTokenProvider) error {
+	if opts.MinTokenTTL <= 0 {
+		return nil
+	}
+	var token adal.Token
+	switch t := tokenProvider.(type) {
+	case *adal.Token:
+		if t == nil {
+			return nil
+		}
+		token = *t
+	case *adal.ServicePrincipalToken:
+		if t == nil {
+			return nil
+		}
+		token = t.Token()
+	default:
+		return nil
+	}
+	if token.IsZero() {
+		return nil
+	}
+
+	ttl := time.Until(token.Expires()).Round(time.Second)
+	if ttl < opts.MinTokenTTL {
+		return errors.Errorf("the token acquired by the %s check with %s expires in %s, below the min ttl of %s", check, identity, ttl, opts.MinTokenTTL)
+	}
+	klog.Infof("The token acquired by the %s check with %s expires in %s", check, identity, ttl)
+	return nil
+}
@@ -0,0 +1,83 @@
+package validator
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+func TestAssertTokenTTL(t *testing.T) {
+	newToken := func(expiresIn time.Duration) *adal.Token {
+		return &adal.Token{
+			AccessToken: "token",
+			ExpiresOn:   json.Number(strconv.FormatInt(time.Now().Add(expiresIn).Unix(), 10)),
+		}
+	}
+	cases := []struct {
+		name          string
+		minTokenTTL   time.Duration
+		tokenProvider adal.OAuthTokenProvider
+		expectedErr   bool
+	}{
+		{
+			name:          "not asserted",
+			tokenProvider: newToken(time.Minute),
+		},
+		{
+			name:          "ttl above the min",
+			minTokenTTL:   30 * time.Minute,
+			tokenProvider: newToken(time.Hour),
+		},
+		{
+			name:          "ttl below the min",
+			minTokenTTL:   30 * time.Minute,
+			tokenProvider: newToken(10 * time.Minute),
+			expectedErr:   true,
+		},
+		{
+			name:          "no token acquired",
+			minTokenTTL:   30 * time.Minute,
+			tokenProvider: &adal.Token{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := assertTokenTTL(Options{MinTokenTTL: tc.minTokenTTL}, CheckToken, "client id clientid", tc.tokenProvider)
+			if tc.expectedErr && err == nil {
+				t.Fatalf("expected an error")
+			}
+			if !tc.expectedErr && err != nil {
+				t.Fatalf("expected nil error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateAssertMinTTL(t *testing.T) {
+	resource := "https://management.azure.com/"
+	msi, _ := newTokenServer(issueToken(tokenResponse{resource: resource, expiresOn: time.Now().Add(10 * time.Minute)}))
+	defer msi.Close()
+
+	opts := Options{
+		MSIEndpoint:      msi.URL,
+		IdentityClientID: "clientid",
+		Resource:         resource,
+		TokenOnly:        true,
+		MinTokenTTL:      30 * time.Minute,
+	}
+	_, err := Validate(context.Background(), opts)
+	if err == nil || !strings.Contains(err.Error(), "below the min ttl of 30m0s") {
+		t.Fatalf("expected the token ttl to be below the min ttl, got: %v", err)
+	}
+
+	opts.MinTokenTTL = 5 * time.Minute
+	if _, err := Validate(context.Background(), opts); err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+}
@@ -0,0 +1,673 @@
+// Package validator verifies that the identities assigned to the pod it runs in can be used to
+// acquire tokens and access Azure resources. It is used by the identity validator and can be
+// called directly from Go tests.
+package validator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+
+	"github.com/Azure/aad-pod-identity/version"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-12-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+const (
+	// CheckIdentityAvailable waits until a token is issued to the user assigned identity
+	CheckIdentityAvailable = "IdentityAvailable"
+	// CheckUserAssignedIdentityOnPod reads a keyvault secret with the user assigned identity
+	CheckUserAssignedIdentityOnPod = "UserAssignedIdentityOnPod"
+	// CheckClusterWideUserAssignedIdentity lists the VMs of the resource group with the user assigned identity
+	CheckClusterWideUserAssignedIdentity = "ClusterWideUserAssignedIdentity"
+	// CheckSystemAssignedIdentity acquires a token with the system assigned identity
+	CheckSystemAssignedIdentity = "SystemAssignedIdentity"
+)
+
+// Options configures the validation
+type Options struct {
+	// MSIEndpoint is the endpoint tokens are acquired from. The MSI endpoint of the VM is used when empty.
+	MSIEndpoint string
+	// SubscriptionID and ResourceGroup are used by the cluster-wide user assigned identity check
+	SubscriptionID string
+	ResourceGroup  string
+	// VMName scopes the cluster-wide user assigned identity check to a single VM of the resource
+	// group, which only requires read permission to the VM. All VMs of the resource group are listed when empty.
+	VMName string
+	// IdentityClientID is the client id of the user assigned identity
+	IdentityClientID string
+	// IdentityResourceID is the resource id of the user assigned identity
+	IdentityResourceID string
+	// IdentityObjectID is the principal object id of the user assigned identity. At most one of
+	// IdentityClientID, IdentityResourceID and IdentityObjectID can be set.
+	IdentityObjectID string
+	// KeyvaultName, KeyvaultSecretName and KeyvaultSecretVersion select the secret read by the
+	// user assigned identity on pod check. The cluster-wide check is run when they are not set.
+	KeyvaultName string
+	// KeyvaultURI is the https URI of the keyvault, used as is instead of the URI derived from
+	// KeyvaultName, e.g. for a private link custom domain. It takes precedence over KeyvaultName.
+	KeyvaultURI           string
+	KeyvaultSecretName    string
+	KeyvaultSecretVersion string
+	// ExpectedSecretSHA256 is the hex encoded SHA-256 of the value of the secret. When set, the user
+	// assigned identity on pod check fails if the secret read doesn't match it, e.g. for an identity
+	// resolving to another vault or secret. The value of the secret is never logged.
+	ExpectedSecretSHA256 string
+	// Resource is the resource to acquire tokens for. Defaults to the Azure Resource Manager endpoint.
+	Resource string
+	// CheckSAToken verifies the projected service account token at SATokenPath exists, is a JWT and
+	// isn't expired before any other check, for workload identity federation. SATokenPath defaults to
+	// the path of AZURE_FEDERATED_TOKEN_FILE, else DefaultSATokenPath.
+	CheckSAToken bool
+	SATokenPath  string
+	// IdentityWaitTimeout is how long to wait for a token to be issued to the identity before
+	// running the checks. The checks are run right away when zero.
+	IdentityWaitTimeout time.Duration
+	// IMDSAPIVersion is the api-version used for token requests made directly to IMDS
+	IMDSAPIVersion string
+	// RawIMDS acquires every token of the MSI endpoint, including the tokens of the system assigned
+	// identity and of the identity selected by client id, with a hand-built request instead of adal,
+	// and reports the status and body of the response as is when it fails. The tokens of the service
+	// principal are still acquired by adal.
+	RawIMDS bool
+	// NoProxyIMDS connects directly to the instance metadata service even when a proxy is
+	// configured in the environment
+	NoProxyIMDS bool
+	// InsecureSkipVerify disables the verification of the TLS certificates of all the endpoints, e.g.
+	// for a mock of the MSI endpoint with a self-signed certificate. For tests only, never in production.
+	InsecureSkipVerify bool
+	// UserAgent is added to the user agent of the requests of the validator. Defaults to
+	// aad-pod-identity/IdentityValidator/<version>.
+	UserAgent string
+	// VerboseSDK logs the requests and responses made by the azure sdk clients, with
+	// authorization headers and tokens redacted
+	VerboseSDK bool
+	// SPClientID, SPTenantID and SPCertPath select a service principal that authenticates with the
+	// PEM encoded certificate and RSA private key at SPCertPath. When set, the keyvault and
+	// cluster-wide checks use the service principal instead of the MSI endpoint and the system
+	// assigned identity check is skipped.
+	SPClientID string
+	SPTenantID string
+	SPCertPath string
+	// TokenOnly replaces the data-plane checks with the token check, which acquires a token for
+	// Resource with the identity and validates its expiry and audience without calling keyvault or
+	// ARM, so the identity doesn't need any Azure role
+	TokenOnly bool
+	// ACRServer is the login server of an Azure Container Registry, e.g. myregistry.azurecr.io. When
+	// set, the ACR check exchanges a token of the identity for a refresh token of the registry.
+	ACRServer string
+	// GraphProbe runs the Graph check, which acquires a token for GraphEndpoint with the identity and
+	// reads GraphProbePath from Microsoft Graph, to verify the Graph application permissions of the
+	// identity. GraphEndpoint defaults to DefaultGraphEndpoint and GraphProbePath to DefaultGraphProbePath.
+	GraphProbe     bool
+	GraphEndpoint  string
+	GraphProbePath string
+	// VerifyRotation runs the token rotation check, which acquires a token for Resource with the
+	// identity, waits RotationWait and acquires a token again, to verify the token is refreshed
+	// instead of served from a cache. RotationWait is required by the check and should be past the
+	// point the first token is refreshed, e.g. 5 minutes before its expiry for NMI.
+	VerifyRotation bool
+	RotationWait   time.Duration
+	// MinTokenTTL fails each check whose acquired token expires in less than the duration, to
+	// catch identities issued unusually short-lived tokens. Not asserted when zero.
+	MinTokenTTL time.Duration
+	// RunAll runs every check even when a previous check failed, instead of stopping at the first failure
+	RunAll bool
+	// Concurrency runs the data-plane checks, i.e. the keyvault, cluster-wide or token check, the
+	// ACR, Graph and token rotation checks and the system assigned identity check, concurrently with
+	// at most Concurrency checks in flight. Every data-plane check is then run and the error of the
+	// first failed one is returned unless RunAll is set. The checks are run in turn when not greater
+	// than 1.
+	Concurrency int
+	// TokenWriter, when set, receives the raw access token acquired by each check, one per line, to
+	// inspect its claims. Tokens are credentials and are only written there, never logged.
+	TokenWriter io.Writer
+	// AssignmentLister, when set, is used by the assignment check to verify the identity selected by
+	// IdentityClientID or IdentityResourceID is assigned to the pod PodName in PodNamespace before
+	// the data-plane checks
+	AssignmentLister AssignmentLister
+	PodName          string
+	PodNamespace     string
+}
+
+// CheckResult is the outcome of a single check
+type CheckResult struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// Passed returns true if the check succeeded
+func (c CheckResult) Passed() bool {
+	return c.Err == nil
+}
+
+// Result is the outcome of the validation
+type Result struct {
+	// MSIEndpoint is the endpoint the tokens were acquired from
+	MSIEndpoint string
+	// Checks are the checks that were run, in order
+	Checks []CheckResult
+}
+
+// Passed returns true if all the checks that were run succeeded
+func (r Result) Passed() bool {
+	for _, c := range r.Checks {
+		if !c.Passed() {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate runs the checks for the identities of the pod. It stops at the first check that fails
+// and returns its error unless RunAll is set, in which case every check is run and the returned
+// error lists the checks that failed. The result holds the outcome of every check that was run.
+func Validate(ctx context.Context, opts Options) (Result, error) {
+	result := Result{}
+	opts, err := opts.prepare()
+	if err != nil {
+		return result, err
+	}
+	result.MSIEndpoint = opts.MSIEndpoint
+
+	var failed []string
+	runCheck := func(name string, check func() error) error {
+		err := result.run(name, check)
+		if err != nil && opts.RunAll {
+			klog.Errorf("%+v", err)
+			failed = append(failed, name)
+			return nil
+		}
+		return err
+	}
+
+	if opts.CheckSAToken {
+		if err := runCheck(CheckServiceAccountToken, func() error {
+			return verifySAToken(opts)
+		}); err != nil {
+			return result, err
+		}
+	}
+
+	if opts.IdentityWaitTimeout > 0 {
+		if err := runCheck(CheckIdentityAvailable, func() error {
+			return waitForIdentity(opts, opts.IdentityWaitTimeout)
+		}); err != nil {
+			return result, err
+		}
+	}
+
+	if opts.AssignmentLister != nil {
+		if err := runCheck(CheckAssignment, func() error {
+			return verifyAssignment(opts)
+		}); err != nil {
+			return result, err
+		}
+	}
+
+	var checks []namedCheck
+	if opts.TokenOnly {
+		// Test if a token can be acquired with the identity, skipping the data-plane checks
+		checks = append(checks, namedCheck{CheckToken, func() error {
+			return testToken(ctx, opts)
+		}})
+	} else if (opts.KeyvaultName != "" || opts.KeyvaultURI != "") && opts.KeyvaultSecretName != "" {
+		// Test if the pod identity is set up correctly
+		checks = append(checks, namedCheck{CheckUserAssignedIdentityOnPod, func() error {
+			return testUserAssignedIdentityOnPod(ctx, opts)
+		}})
+	} else {
+		// Test if the cluster-wide user assigned identity is set up correctly
+		checks = append(checks, namedCheck{CheckClusterWideUserAssignedIdentity, func() error {
+			return testClusterWideUserAssignedIdentity(ctx, opts)
+		}})
+	}
+
+	if opts.ACRServer != "" {
+		// Test if the identity can authenticate to the container registry
+		checks = append(checks, namedCheck{CheckACR, func() error {
+			return testACR(ctx, opts)
+		}})
+	}
+
+	if opts.GraphProbe {
+		// Test if the identity can read from Microsoft Graph
+		checks = append(checks, namedCheck{CheckGraph, func() error {
+			return testGraph(ctx, opts)
+		}})
+	}
+
+	if opts.VerifyRotation {
+		// Test if the token of the identity is refreshed
+		checks = append(checks, namedCheck{CheckTokenRotation, func() error {
+			return testTokenRotation(ctx, opts)
+		}})
+	}
+
+	if opts.useServicePrincipal() {
+		klog.Infof("Skipping system assigned identity check when using service principal %s", opts.SPClientID)
+	} else if opts.TokenOnly {
+		klog.Infof("Skipping system assigned identity check in token only mode")
+	} else {
+		// Test if a service principal token can be obtained when using a system assigned identity
+		checks = append(checks, namedCheck{CheckSystemAssignedIdentity, func() error {
+			_, err := testSystemAssignedIdentity(opts)
+			return err
+		}})
+	}
+
+	if opts.Concurrency > 1 && len(checks) > 1 {
+		klog.Infof("Running %d data-plane checks with a concurrency of %d", len(checks), opts.Concurrency)
+		var firstErr error
+		for i, err := range result.runConcurrently(ctx, opts.Concurrency, checks) {
+			if err == nil {
+				continue
+			}
+			if !opts.RunAll {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			klog.Errorf("%+v", err)
+			failed = append(failed, checks[i].name)
+		}
+		if firstErr != nil {
+			return result, firstErr
+		}
+	} else {
+		for _, c := range checks {
+			if err := runCheck(c.name, c.check); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return result, errors.Errorf("%d of %d checks failed: %s", len(failed), len(result.Checks), strings.Join(failed, ", "))
+	}
+	return result, nil
+}
+
+// prepare returns the options with the defaults applied and the MSI endpoint resolved, or an
+// error if the options are invalid
+func (o Options) prepare() (Options, error) {
+	o = o.withDefaults()
+	if err := o.validateServicePrincipal(); err != nil {
+		return o, err
+	}
+	if err := o.validateIdentitySelector(); err != nil {
+		return o, err
+	}
+	if err := o.validateKeyvaultURI(); err != nil {
+		return o, err
+	}
+	if err := o.validateExpectedSecretSHA256(); err != nil {
+		return o, err
+	}
+	if err := o.validateRotationWait(); err != nil {
+		return o, err
+	}
+
+	if o.MSIEndpoint == "" {
+		msiEndpoint, err := adal.GetMSIVMEndpoint()
+		if err != nil {
+			return o, errors.Wrapf(err, "Failed to get msiEndpoint")
+		}
+		klog.Infof("Successfully obtain MSIEndpoint: %s\n", msiEndpoint)
+		o.MSIEndpoint = msiEndpoint
+	}
+	return o, nil
+}
+
+// run runs the check and records its outcome
+func (r *Result) run(name string, check func() error) error {
+	begin := time.Now()
+	err := check()
+	r.Checks = append(r.Checks, CheckResult{
+		Name:     name,
+		Duration: time.Since(begin),
+		Err:      err,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "%s failed", name)
+	}
+	return nil
+}
+
+// identity returns the identity the keyvault and cluster-wide checks authenticate with
+func (o Options) identity() string {
+	switch {
+	case o.useServicePrincipal():
+		return "service principal " + o.SPClientID
+	case o.IdentityClientID != "":
+		return "client id " + o.IdentityClientID
+	case o.IdentityResourceID != "":
+		return "resource id " + o.IdentityResourceID
+	case o.IdentityObjectID != "":
+		return "object id " + o.IdentityObjectID
+	}
+	return "system assigned identity"
+}
+
+// validateIdentitySelector returns an error if the user assigned identity is selected by more than
+// one of its client id, resource id and object id
+func (o Options) validateIdentitySelector() error {
+	var selectors []string
+	if o.IdentityClientID != "" {
+		selectors = append(selectors, "client id")
+	}
+	if o.IdentityResourceID != "" {
+		selectors = append(selectors, "resource id")
+	}
+	if o.IdentityObjectID != "" {
+		selectors = append(selectors, "object id")
+	}
+	if len(selectors) > 1 {
+		return errors.Errorf("the identity must be selected by only one of its client id, resource id or object id, got %s", strings.Join(selectors, " and "))
+	}
+	return nil
+}
+
+// validateKeyvaultURI returns an error if the keyvault URI is set but isn't an https URL
+func (o Options) validateKeyvaultURI() error {
+	if o.KeyvaultURI == "" {
+		return nil
+	}
+	u, err := url.Parse(o.KeyvaultURI)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to parse keyvault uri %s", o.KeyvaultURI)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return errors.Errorf("keyvault uri %s must be an https URL", o.KeyvaultURI)
+	}
+	return nil
+}
+
+// validateExpectedSecretSHA256 returns an error if the expected secret SHA-256 is set but isn't a
+// hex encoded SHA-256
+func (o Options) validateExpectedSecretSHA256() error {
+	if o.ExpectedSecretSHA256 == "" {
+		return nil
+	}
+	if b, err := hex.DecodeString(o.ExpectedSecretSHA256); err != nil || len(b) != sha256.Size {
+		return errors.Errorf("expected secret sha256 %s must be a hex encoded SHA-256", o.ExpectedSecretSHA256)
+	}
+	return nil
+}
+
+// verifySecretSHA256 returns an error if the expected secret SHA-256 is set and doesn't match the
+// SHA-256 of the value of the secret. Only the SHA-256 of the value is part of the error.
+func verifySecretSHA256(opts Options, vaultURI, value string) error {
+	if opts.ExpectedSecretSHA256 == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(value))
+	actual := hex.EncodeToString(sum[:])
+	if !strings.EqualFold(actual, opts.ExpectedSecretSHA256) {
+		return errors.Errorf("Failed to verify user assigned identity on pod, the sha256 of secret %s in %s is %s, expected %s. The identity with %s may have read another vault or secret",
+			opts.KeyvaultSecretName, vaultURI, actual, opts.ExpectedSecretSHA256, opts.identity())
+	}
+	klog.Infof("The sha256 of secret %s in %s matches the expected sha256", opts.KeyvaultSecretName, vaultURI)
+	return nil
+}
+
+// vaultURI returns the URI of the keyvault the secret is read from
+func (o Options) vaultURI() string {
+	if o.KeyvaultURI != "" {
+		if o.KeyvaultName != "" {
+			klog.Infof("Using keyvault uri %s instead of keyvault name %s", o.KeyvaultURI, o.KeyvaultName)
+		}
+		return o.KeyvaultURI
+	}
+	return fmt.Sprintf("https://%s.vault.azure.net", o.KeyvaultName)
+}
+
+func (o Options) withDefaults() Options {
+	if o.Resource == "" {
+		o.Resource = azure.PublicCloud.ResourceManagerEndpoint
+	}
+	if o.IMDSAPIVersion == "" {
+		o.IMDSAPIVersion = DefaultIMDSAPIVersion
+	}
+	if o.GraphEndpoint == "" {
+		o.GraphEndpoint = DefaultGraphEndpoint
+	}
+	if o.GraphProbePath == "" {
+		o.GraphProbePath = DefaultGraphProbePath
+	}
+	if o.UserAgent == "" {
+		o.UserAgent = version.GetUserAgent("IdentityValidator", version.IdentityValidatorVersion)
+	}
+	// the tokens of the checks run concurrently are written one at a time
+	if o.Concurrency > 1 && o.TokenWriter != nil {
+		if _, ok := o.TokenWriter.(*lockedWriter); !ok {
+			o.TokenWriter = &lockedWriter{w: o.TokenWriter}
+		}
+	}
+	return o
+}
+
+// testClusterWideUserAssignedIdentity will verify whether cluster-wide user assigned identity is working properly
+func testClusterWideUserAssignedIdentity(ctx context.Context, opts Options) error {
+	var tokenProvider adal.OAuthTokenProvider
+	var err error
+	if opts.useServicePrincipal() {
+		spt, err := newServicePrincipalTokenFromCertificate(opts, azure.PublicCloud.ResourceManagerEndpoint)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get service principal token from certificate")
+		}
+		tokenProvider = spt
+	} else if opts.IdentityResourceID != "" {
+		token, err := AuthenticateWithMsiResourceID(ctx, opts, azure.PublicCloud.ResourceManagerEndpoint)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get token from user assigned identity %s", opts.IdentityResourceID)
+		}
+		tokenProvider = token
+	} else if opts.IdentityObjectID != "" {
+		token, err := AuthenticateWithMsiObjectID(ctx, opts, azure.PublicCloud.ResourceManagerEndpoint)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get token from user assigned identity %s", opts.IdentityObjectID)
+		}
+		tokenProvider = token
+	} else if opts.RawIMDS {
+		token, err := authenticateWithRawIMDS(ctx, opts, azure.PublicCloud.ResourceManagerEndpoint)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get token from %s", opts.identity())
+		}
+		tokenProvider = token
+	} else {
+		// the client id is passed to the token explicitly rather than through AZURE_CLIENT_ID, so
+		// the checks never depend on or leak into the environment of the process
+		spt, err := adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(opts.MSIEndpoint, azure.PublicCloud.ResourceManagerEndpoint, opts.IdentityClientID)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get service principal token from user assigned identity")
+		}
+		configureToken(spt, opts)
+		tokenProvider = spt
+	}
+	// the token is written once acquired, even when the call fails, to inspect its claims
+	defer writeToken(opts, CheckClusterWideUserAssignedIdentity, opts.identity(), tokenProvider)
+
+	vmClient := compute.NewVirtualMachinesClient(opts.SubscriptionID)
+	vmClient.Authorizer = autorest.NewBearerAuthorizer(tokenProvider)
+	configureClient(&vmClient.Client, opts)
+
+	if opts.VMName != "" {
+		klog.Infof("Verifying cluster-wide user assigned identity by getting VM %s in resource group %s", opts.VMName, opts.ResourceGroup)
+		attempts, err := retryOnTransientError(ctx, transientRetryAttempts, transientRetryInterval, func() error {
+			_, err := vmClient.Get(ctx, opts.ResourceGroup, opts.VMName, "")
+			return err
+		})
+		if err != nil {
+			scope := fmt.Sprintf("VM %s in resource group %s of subscription %s", opts.VMName, opts.ResourceGroup, opts.SubscriptionID)
+			return errors.Wrapf(err, "Failed to verify cluster-wide user assigned identity, %s", failureReason(err, attempts, opts.identity(), scope))
+		}
+		if err := assertTokenTTL(opts, CheckClusterWideUserAssignedIdentity, opts.identity(), tokenProvider); err != nil {
+			return err
+		}
+		klog.Infof("Successfully verified cluster-wide user assigned identity. Got VM %s", opts.VMName)
+		return nil
+	}
+
+	klog.Infof("Verifying cluster-wide user assigned identity by listing the VMs in resource group %s", opts.ResourceGroup)
+	var vmlist compute.VirtualMachineListResultPage
+	attempts, err := retryOnTransientError(ctx, transientRetryAttempts, transientRetryInterval, func() error {
+		var err error
+		vmlist, err = vmClient.List(ctx, opts.ResourceGroup)
+		return err
+	})
+	if err != nil {
+		scope := fmt.Sprintf("resource group %s of subscription %s", opts.ResourceGroup, opts.SubscriptionID)
+		return errors.Wrapf(err, "Failed to verify cluster-wide user assigned identity, %s", failureReason(err, attempts, opts.identity(), scope))
+	}
+	if err := assertTokenTTL(opts, CheckClusterWideUserAssignedIdentity, opts.identity(), tokenProvider); err != nil {
+		return err
+	}
+
+	klog.Infof("Successfully verified cluster-wide user assigned identity. VM count: %d", len(vmlist.Values()))
+	return nil
+}
+
+// testUserAssignedIdentityOnPod will verify whether a pod identity is working properly
+func testUserAssignedIdentityOnPod(ctx context.Context, opts Options) error {
+	keyvaultResource := strings.TrimSuffix(azure.PublicCloud.ResourceIdentifiers.KeyVault, "/")
+
+	// The token for the keyvault dataplane is acquired explicitly with the desired user assigned identity rather
+	// than through the authorizer from the environment, so that the token requests use the validator's http client.
+	var tokenProvider adal.OAuthTokenProvider
+	if opts.useServicePrincipal() {
+		spt, err := newServicePrincipalTokenFromCertificate(opts, keyvaultResource)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get service principal token from certificate")
+		}
+		tokenProvider = spt
+	} else if opts.IdentityResourceID != "" {
+		token, err := AuthenticateWithMsiResourceID(ctx, opts, keyvaultResource)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get token from user assigned identity %s", opts.IdentityResourceID)
+		}
+		tokenProvider = token
+	} else if opts.IdentityObjectID != "" {
+		token, err := AuthenticateWithMsiObjectID(ctx, opts, keyvaultResource)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get token from user assigned identity %s", opts.IdentityObjectID)
+		}
+		tokenProvider = token
+	} else if opts.RawIMDS {
+		token, err := authenticateWithRawIMDS(ctx, opts, keyvaultResource)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get token from %s", opts.identity())
+		}
+		tokenProvider = token
+	} else {
+		spt, err := newServicePrincipalTokenFromMSI(opts, keyvaultResource)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get service principal token from user assigned identity")
+		}
+		tokenProvider = spt
+	}
+	defer writeToken(opts, CheckUserAssignedIdentityOnPod, opts.identity(), tokenProvider)
+
+	keyClient := keyvault.New()
+	keyClient.Authorizer = autorest.NewBearerAuthorizer(tokenProvider)
+	configureClient(&keyClient.Client, opts)
+
+	vaultURI := opts.vaultURI()
+	klog.Infof("%s %s %s\n", vaultURI, opts.KeyvaultSecretName, opts.KeyvaultSecretVersion)
+	var secret keyvault.SecretBundle
+	attempts, err := retryOnTransientError(ctx, transientRetryAttempts, transientRetryInterval, func() error {
+		var err error
+		secret, err = keyClient.GetSecret(ctx, vaultURI, opts.KeyvaultSecretName, opts.KeyvaultSecretVersion)
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to verify user assigned identity on pod, %s", failureReason(err, attempts, opts.identity(), vaultURI))
+	}
+	if secret.Value == nil || *secret.Value == "" {
+		return errors.Errorf("Failed to verify user assigned identity on pod, secret %s in %s has no value", opts.KeyvaultSecretName, vaultURI)
+	}
+	if err := verifySecretSHA256(opts, vaultURI, *secret.Value); err != nil {
+		return err
+	}
+	if err := assertTokenTTL(opts, CheckUserAssignedIdentityOnPod, opts.identity(), tokenProvider); err != nil {
+		return err
+	}
+
+	klog.Infof("Successfully verified user assigned identity on pod")
+	return nil
+}
+
+// testSystemAssignedIdentity will return a service principal token obtained through a system assigned identity
+func testSystemAssignedIdentity(opts Options) (*adal.Token, error) {
+	if opts.RawIMDS {
+		return testSystemAssignedIdentityWithRawIMDS(opts)
+	}
+	spt, err := adal.NewServicePrincipalTokenFromMSI(opts.MSIEndpoint, azure.PublicCloud.ResourceManagerEndpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to acquire a token using the MSI VM extension")
+	}
+	configureToken(spt, opts)
+
+	if err := spt.Refresh(); err != nil {
+		return nil, errors.Wrapf(err, "Failed to refresh ServicePrincipalTokenFromMSI using the MSI VM extension, msiEndpoint(%s)", opts.MSIEndpoint)
+	}
+
+	token := spt.Token()
+	if token.IsZero() {
+		return nil, errors.Errorf("No token found, MSI VM extension, msiEndpoint(%s)", opts.MSIEndpoint)
+	}
+
+	klog.Infof("Successfully acquired a token using the MSI, msiEndpoint(%s)", opts.MSIEndpoint)
+	writeToken(opts, CheckSystemAssignedIdentity, "system assigned identity", &token)
+	if err := assertTokenTTL(opts, CheckSystemAssignedIdentity, "system assigned identity", &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// testSystemAssignedIdentityWithRawIMDS acquires a token with the system assigned identity with a
+// hand-built request to the MSI endpoint instead of adal
+func testSystemAssignedIdentityWithRawIMDS(opts Options) (*adal.Token, error) {
+	systemAssigned := opts
+	systemAssigned.IdentityClientID, systemAssigned.IdentityResourceID, systemAssigned.IdentityObjectID = "", "", ""
+	token, err := authenticateWithRawIMDS(context.Background(), systemAssigned, azure.PublicCloud.ResourceManagerEndpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to acquire a token with the system assigned identity, msiEndpoint(%s)", opts.MSIEndpoint)
+	}
+
+	klog.Infof("Successfully acquired a token with the system assigned identity using raw IMDS requests, msiEndpoint(%s)", opts.MSIEndpoint)
+	writeToken(opts, CheckSystemAssignedIdentity, "system assigned identity", token)
+	if err := assertTokenTTL(opts, CheckSystemAssignedIdentity, "system assigned identity", token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// writeToken writes the access token of the provider to the token writer of the options, one token
+// per line, when both are set. The token is never logged.
+func writeToken(opts Options, check, identity string, tokenProvider adal.OAuthTokenProvider) {
+	if opts.TokenWriter == nil || tokenProvider == nil {
+		return
+	}
+	accessToken := tokenProvider.OAuthToken()
+	if accessToken == "" {
+		return
+	}
+	klog.Infof("Writing the access token acquired by the %s check with %s", check, identity)
+	if _, err := fmt.Fprintln(opts.TokenWriter, accessToken); err != nil {
+		klog.Errorf("Failed to write the access token acquired by the %s check: %v", check, err)
+	}
+}
@@ -0,0 +1,288 @@
+package validator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+func TestValidateStopsAtFirstFailedCheck(t *testing.T) {
+	result, err := Validate(context.Background(), Options{
+		MSIEndpoint:         "http://127.0.0.1:1/metadata/identity/oauth2/token",
+		IdentityWaitTimeout: time.Second,
+	})
+	if err == nil {
+		t.Fatalf("expected error waiting for an identity without client id")
+	}
+	if result.MSIEndpoint != "http://127.0.0.1:1/metadata/identity/oauth2/token" {
+		t.Errorf("unexpected msi endpoint %s", result.MSIEndpoint)
+	}
+	if len(result.Checks) != 1 || result.Checks[0].Name != CheckIdentityAvailable {
+		t.Fatalf("expected only the %s check to run, got: %+v", CheckIdentityAvailable, result.Checks)
+	}
+	if result.Checks[0].Passed() || result.Passed() {
+		t.Errorf("expected the check and the result to fail")
+	}
+}
+
+func TestResultPassed(t *testing.T) {
+	result := Result{Checks: []CheckResult{{Name: CheckUserAssignedIdentityOnPod}, {Name: CheckSystemAssignedIdentity}}}
+	if !result.Passed() {
+		t.Errorf("expected result to pass")
+	}
+	result.Checks[1].Err = errors.New("failed")
+	if result.Passed() {
+		t.Errorf("expected result to fail")
+	}
+}
+
+func TestValidateRunAll(t *testing.T) {
+	result, err := Validate(context.Background(), Options{
+		MSIEndpoint:         "http://127.0.0.1:1/metadata/identity/oauth2/token",
+		IdentityWaitTimeout: time.Second,
+		RunAll:              true,
+	})
+	if err == nil {
+		t.Fatalf("expected error when checks fail")
+	}
+	expected := []string{CheckIdentityAvailable, CheckClusterWideUserAssignedIdentity, CheckSystemAssignedIdentity}
+	if len(result.Checks) != len(expected) {
+		t.Fatalf("expected every check to run, got: %+v", result.Checks)
+	}
+	for i, name := range expected {
+		if result.Checks[i].Name != name {
+			t.Errorf("expected check %d to be %s, got: %s", i, name, result.Checks[i].Name)
+		}
+		if result.Checks[i].Passed() {
+			t.Errorf("expected check %s to fail", name)
+		}
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected error %q to name the failed check %s", err.Error(), name)
+		}
+	}
+}
+
+func TestValidateRequiresSingleIdentitySelector(t *testing.T) {
+	result, err := Validate(context.Background(), Options{
+		MSIEndpoint:      "http://127.0.0.1:1/metadata/identity/oauth2/token",
+		IdentityClientID: "clientid",
+		IdentityObjectID: "objectid",
+	})
+	if err == nil || !strings.Contains(err.Error(), "client id and object id") {
+		t.Fatalf("expected error when the identity is selected by client id and object id, got: %v", err)
+	}
+	if len(result.Checks) != 0 {
+		t.Fatalf("expected no checks to run, got: %+v", result.Checks)
+	}
+}
+
+func TestClusterWideUserAssignedIdentityWithResourceID(t *testing.T) {
+	var query url.Values
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_request","error_description":"Identity not found"}`))
+	}))
+	defer imds.Close()
+
+	resourceID := "/subscriptions/sub/resourcegroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id"
+	opts := Options{MSIEndpoint: imds.URL, IdentityResourceID: resourceID}.withDefaults()
+	err := testClusterWideUserAssignedIdentity(context.Background(), opts)
+	if err == nil || !strings.Contains(err.Error(), resourceID) {
+		t.Fatalf("expected error naming the identity %s, got: %v", resourceID, err)
+	}
+	if query.Get("msi_res_id") != resourceID || query.Get("resource") != azure.PublicCloud.ResourceManagerEndpoint {
+		t.Errorf("expected token request for the resource id and the ARM resource, got: %v", query)
+	}
+	if query.Get("client_id") != "" {
+		t.Errorf("expected no client id in the token request, got: %v", query)
+	}
+}
+
+func TestClusterWideUserAssignedIdentityChecksDontInterfere(t *testing.T) {
+	var mu sync.Mutex
+	var clientIDs []string
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		clientIDs = append(clientIDs, r.URL.Query().Get("client_id"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_request","error_description":"Identity not found"}`))
+	}))
+	defer imds.Close()
+
+	// a client id left in the environment, e.g. by a killed process, is never used
+	os.Setenv("AZURE_CLIENT_ID", "stale")
+	defer os.Unsetenv("AZURE_CLIENT_ID")
+
+	for _, clientID := range []string{"clientid1", "clientid2"} {
+		mu.Lock()
+		clientIDs = nil
+		mu.Unlock()
+
+		opts := Options{MSIEndpoint: imds.URL, IdentityClientID: clientID}.withDefaults()
+		if err := testClusterWideUserAssignedIdentity(context.Background(), opts); err == nil {
+			t.Fatalf("expected the check of %s to fail", clientID)
+		}
+
+		mu.Lock()
+		if len(clientIDs) == 0 {
+			t.Errorf("expected a token request for %s", clientID)
+		}
+		for _, requested := range clientIDs {
+			if requested != clientID {
+				t.Errorf("expected the token requests of the check of %s to be for %s, got %s", clientID, clientID, requested)
+			}
+		}
+		mu.Unlock()
+		if got := os.Getenv("AZURE_CLIENT_ID"); got != "stale" {
+			t.Errorf("expected AZURE_CLIENT_ID to be left unchanged by the check of %s, got %q", clientID, got)
+		}
+	}
+}
+
+func TestVaultURI(t *testing.T) {
+	cases := []struct {
+		name        string
+		opts        Options
+		expectedURI string
+		expectedErr bool
+	}{
+		{
+			name:        "keyvault name",
+			opts:        Options{KeyvaultName: "kv"},
+			expectedURI: "https://kv.vault.azure.net",
+		},
+		{
+			name:        "keyvault uri is used as is",
+			opts:        Options{KeyvaultURI: "https://kv.privatelink.contoso.com"},
+			expectedURI: "https://kv.privatelink.contoso.com",
+		},
+		{
+			name:        "keyvault uri takes precedence over keyvault name",
+			opts:        Options{KeyvaultName: "kv", KeyvaultURI: "https://kv.privatelink.contoso.com"},
+			expectedURI: "https://kv.privatelink.contoso.com",
+		},
+		{
+			name:        "keyvault uri without https",
+			opts:        Options{KeyvaultURI: "http://kv.privatelink.contoso.com"},
+			expectedErr: true,
+		},
+		{
+			name:        "keyvault uri without host",
+			opts:        Options{KeyvaultURI: "kv.privatelink.contoso.com"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		err := tc.opts.validateKeyvaultURI()
+		if tc.expectedErr {
+			if err == nil {
+				t.Errorf("%s: expected error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		if uri := tc.opts.vaultURI(); uri != tc.expectedURI {
+			t.Errorf("%s: expected uri %s, got: %s", tc.name, tc.expectedURI, uri)
+		}
+	}
+}
+
+func TestSystemAssignedIdentityWritesToken(t *testing.T) {
+	imds, _ := newTokenServer(issueToken(tokenResponse{accessToken: "test-access-token"}))
+	defer imds.Close()
+
+	var tokens bytes.Buffer
+	opts := Options{MSIEndpoint: imds.URL, TokenWriter: &tokens}.withDefaults()
+	if _, err := testSystemAssignedIdentity(opts); err != nil {
+		t.Fatalf("expected token to be acquired, got: %v", err)
+	}
+	if tokens.String() != "test-access-token\n" {
+		t.Errorf("expected the access token to be written, got: %q", tokens.String())
+	}
+
+	opts.TokenWriter = nil
+	if _, err := testSystemAssignedIdentity(opts); err != nil {
+		t.Fatalf("expected token to be acquired without a token writer, got: %v", err)
+	}
+}
+
+func TestExpectedSecretSHA256(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/secrets/") {
+			w.Write([]byte(`{"value":"secret"}`))
+			return
+		}
+		writeTokenResponse(w, tokenResponse{resource: "https://vault.azure.net"})
+	}))
+	defer server.Close()
+
+	// sha256 of "secret"
+	secretSHA256 := "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"
+	cases := []struct {
+		name                 string
+		expectedSecretSHA256 string
+		expectedErr          string
+	}{
+		{
+			name: "not verified",
+		},
+		{
+			name:                 "matching secret",
+			expectedSecretSHA256: secretSHA256,
+		},
+		{
+			name:                 "matching secret with upper case sha256",
+			expectedSecretSHA256: strings.ToUpper(secretSHA256),
+		},
+		{
+			name:                 "another secret",
+			expectedSecretSHA256: strings.Repeat("0", 64),
+			expectedErr:          "the sha256 of secret test-secret in " + server.URL + " is " + secretSHA256,
+		},
+		{
+			name:                 "invalid sha256",
+			expectedSecretSHA256: "secret",
+			expectedErr:          "must be a hex encoded SHA-256",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts, err := Options{
+				MSIEndpoint:          server.URL,
+				IdentityResourceID:   "resourceid",
+				KeyvaultURI:          server.URL,
+				KeyvaultSecretName:   "test-secret",
+				ExpectedSecretSHA256: tc.expectedSecretSHA256,
+				InsecureSkipVerify:   true,
+			}.prepare()
+			if err == nil {
+				err = testUserAssignedIdentityOnPod(context.Background(), opts)
+			}
+			if tc.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("expected nil error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+				t.Fatalf("expected error containing %q, got: %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
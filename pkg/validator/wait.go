@@ -0,0 +1,62 @@
+package validator
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// identityPollInterval is the interval between token acquisitions while waiting for the identity,
+// a variable so that tests can shorten it
+var identityPollInterval = 2 * time.Second
+
+// waitForIdentity acquires tokens for the resource until the token is issued to the identity with
+// the client id of the options, which is the case once the identity has been assigned to the node.
+func waitForIdentity(opts Options, timeout time.Duration) error {
+	identityClientID := opts.IdentityClientID
+	if identityClientID == "" {
+		return errors.New("waiting for the identity requires the identity client id")
+	}
+
+	begin := time.Now()
+	err := wait.PollImmediate(identityPollInterval, timeout, func() (bool, error) {
+		var token adal.Token
+		if opts.RawIMDS {
+			t, err := authenticateWithRawIMDS(context.Background(), opts, opts.Resource)
+			if err != nil {
+				klog.Infof("Identity %s is not available yet: %v", identityClientID, err)
+				return false, nil
+			}
+			token = *t
+		} else {
+			spt, err := newServicePrincipalTokenFromMSI(opts, opts.Resource)
+			if err != nil {
+				return false, errors.Wrapf(err, "Failed to create service principal token from MSI")
+			}
+			if err := spt.Refresh(); err != nil {
+				klog.Infof("Identity %s is not available yet: %v", identityClientID, err)
+				return false, nil
+			}
+			token = spt.Token()
+		}
+		clientID := tokenClientID(token.AccessToken)
+		if !strings.EqualFold(clientID, identityClientID) {
+			klog.Infof("Token was issued to client id %s, waiting for identity %s", clientID, identityClientID)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("identity %s was not available after %s", identityClientID, timeout)
+	}
+	if err != nil {
+		return err
+	}
+	klog.Infof("Identity %s is available after waiting %s", identityClientID, time.Since(begin))
+	return nil
+}
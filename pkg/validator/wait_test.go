@@ -0,0 +1,88 @@
+package validator
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// issueIdentityToken answers the token requests with a JWT whose appid is the client id returned by
+// clientID for the number of the request, failing the request when it is empty
+func issueIdentityToken(clientID func(n int) string) func(r *http.Request, n int) tokenResponse {
+	return func(r *http.Request, n int) tokenResponse {
+		id := clientID(n)
+		if id == "" {
+			return tokenResponse{status: http.StatusBadRequest, body: `{"error":"invalid_request","error_description":"Identity not found"}`}
+		}
+		return tokenResponse{accessToken: newJWT(fmt.Sprintf(`{"appid":%q}`, id))}
+	}
+}
+
+func TestWaitForIdentity(t *testing.T) {
+	defer func(interval time.Duration) { identityPollInterval = interval }(identityPollInterval)
+	identityPollInterval = 10 * time.Millisecond
+
+	cases := []struct {
+		name        string
+		clientID    func(n int) string
+		timeout     time.Duration
+		expectedErr string
+		minRequests int
+	}{
+		{
+			name: "identity assigned after 3 polls",
+			clientID: func(n int) string {
+				switch {
+				case n == 1:
+					return ""
+				case n < 4:
+					return "otherclientid"
+				}
+				return "CLIENTID"
+			},
+			timeout:     time.Minute,
+			minRequests: 4,
+		},
+		{
+			name:        "deadline expired",
+			clientID:    func(n int) string { return "" },
+			timeout:     100 * time.Millisecond,
+			expectedErr: "identity clientid was not available after 100ms",
+			minRequests: 2,
+		},
+		{
+			name:        "mismatched client id",
+			clientID:    func(n int) string { return "otherclientid" },
+			timeout:     100 * time.Millisecond,
+			expectedErr: "identity clientid was not available after 100ms",
+			minRequests: 2,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			msi, requests := newTokenServer(issueIdentityToken(tc.clientID))
+			defer msi.Close()
+
+			opts := Options{MSIEndpoint: msi.URL, IdentityClientID: "clientid", Resource: "https://management.azure.com/"}
+			err := waitForIdentity(opts, tc.timeout)
+			if tc.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("expected nil error, got: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+				t.Fatalf("expected error containing %q, got: %v", tc.expectedErr, err)
+			}
+			if n := requests.count(); n < tc.minRequests {
+				t.Errorf("expected at least %d token requests, got %d", tc.minRequests, n)
+			}
+		})
+	}
+}
+
+func TestWaitForIdentityWithoutClientID(t *testing.T) {
+	if err := waitForIdentity(Options{}, time.Minute); err == nil || !strings.Contains(err.Error(), "requires the identity client id") {
+		t.Fatalf("expected the identity client id to be required, got: %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// envName returns the environment variable the flag is bound to, e.g. KEYVAULT_NAME for --keyvault-name
+func envName(flagName string) string {
+	return strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// bindEnv sets each flag that is not set on the command line to the value of its environment
+// variable, if set. Flags set on the command line take precedence over environment variables.
+func bindEnv(fs *pflag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = errors.Wrapf(setErr, "invalid value %q of environment variable %s", value, envName(f.Name))
+		}
+	})
+	return err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func setEnv(t *testing.T, key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatalf("failed to set %s: %v", key, err)
+	}
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestBindEnv(t *testing.T) {
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	keyvaultName := fs.String("keyvault-name", "", "")
+	resourceGroup := fs.String("resource-group", "", "")
+	benchmarkIterations := fs.Int("benchmark-iterations", 100, "")
+	subscriptionID := fs.String("subscription-id", "default", "")
+
+	defer setEnv(t, "KEYVAULT_NAME", "env-keyvault")()
+	defer setEnv(t, "RESOURCE_GROUP", "env-rg")()
+	defer setEnv(t, "BENCHMARK_ITERATIONS", "5")()
+	os.Unsetenv("SUBSCRIPTION_ID")
+
+	if err := fs.Parse([]string{"--resource-group", "flag-rg"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := bindEnv(fs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if *keyvaultName != "env-keyvault" {
+		t.Errorf("expected keyvault name from the environment, got: %s", *keyvaultName)
+	}
+	if *resourceGroup != "flag-rg" {
+		t.Errorf("expected the flag to take precedence over the environment, got: %s", *resourceGroup)
+	}
+	if *benchmarkIterations != 5 {
+		t.Errorf("expected benchmark iterations from the environment, got: %d", *benchmarkIterations)
+	}
+	if *subscriptionID != "default" {
+		t.Errorf("expected the default when neither the flag nor the environment is set, got: %s", *subscriptionID)
+	}
+}
+
+func TestBindEnvInvalidValue(t *testing.T) {
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs.Int("benchmark-iterations", 100, "")
+
+	defer setEnv(t, "BENCHMARK_ITERATIONS", "many")()
+
+	if err := fs.Parse(nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := bindEnv(fs); err == nil {
+		t.Errorf("expected an error for an invalid environment variable value")
+	}
+}
@@ -2,32 +2,81 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
-	"github.com/pkg/errors"
-	"k8s.io/klog"
-
-	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-12-01/compute"
-	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
-	"github.com/Azure/azure-sdk-for-go/services/keyvault/auth"
-	"github.com/Azure/go-autorest/autorest"
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/crd"
+	"github.com/Azure/aad-pod-identity/pkg/validator"
+	"github.com/Azure/aad-pod-identity/version"
 	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/spf13/pflag"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
 )
 
+// exitCodeUnsupportedEnvironment is the exit code when the validator doesn't run on an Azure node
+// with the instance metadata service, so CI can skip the run rather than report a product failure
+const exitCodeUnsupportedEnvironment = 3
+
 var (
 	subscriptionID        = pflag.String("subscription-id", "", "subscription id for test")
-	identityClientID      = pflag.String("identity-client-id", "", "client id for the msi id")
+	identityClientIDs     = pflag.StringSlice("identity-client-id", nil, "client id for the msi id. Repeat to validate several identities in turn")
+	identityResourceID    = pflag.String("identity-resource-id", "", "resource id for the msi id, instead of the client id")
+	identityObjectID      = pflag.String("identity-object-id", "", "principal object id for the msi id, instead of the client id")
 	resourceGroup         = pflag.String("resource-group", "", "any resource group name with reader permission to the aad object")
+	vmName                = pflag.String("vm-name", "", "name of a VM in --resource-group to get instead of listing all VMs of the resource group")
 	keyvaultName          = pflag.String("keyvault-name", "", "the name of the keyvault to extract the secret from")
+	keyvaultURI           = pflag.String("keyvault-uri", "", "the https URI of the keyvault to extract the secret from, used instead of --keyvault-name")
 	keyvaultSecretName    = pflag.String("keyvault-secret-name", "", "the name of the keyvault secret we are extracting with pod identity")
 	keyvaultSecretVersion = pflag.String("keyvault-secret-version", "", "the version of the keyvault secret we are extracting with pod identity")
+	expectedSecretSHA256  = pflag.String("expected-secret-sha256", "", "hex encoded sha256 of the value of the keyvault secret. the check fails if the secret read doesn't match it")
+	resource              = pflag.String("resource", azure.PublicCloud.ResourceManagerEndpoint, "the resource to acquire a token for")
+	benchmark             = pflag.Bool("benchmark", false, "repeatedly acquire tokens for the identity and resource, report the latency and error rate and exit")
+	benchmarkIterations   = pflag.Int("benchmark-iterations", 100, "number of token acquisitions performed in benchmark mode")
+	checkSAToken          = pflag.Bool("check-sa-token", false, "verify the projected service account token exists, is a valid JWT and isn't expired before any azure call, for workload identity federation")
+	saTokenPath           = pflag.String("sa-token-path", "", "path of the projected service account token verified by --check-sa-token. default is $AZURE_FEDERATED_TOKEN_FILE, else "+validator.DefaultSATokenPath)
+	startupDelay          = pflag.Duration("startup-delay", 0, "wait for the duration before the first probe, e.g. for NMI to install its iptables rules on a freshly booted node when run as an init container")
+	identityWaitTimeout   = pflag.Duration("wait-for-identity", 0, "poll until a token is issued to --identity-client-id or the duration passes before running the checks")
+	writeResultFile       = pflag.String("write-result-file", "", "path of a JSON file to write the msi endpoint, client id and token expiry to on success")
+	imdsAPIVersion        = pflag.String("imds-api-version", validator.DefaultIMDSAPIVersion, "api-version used for token requests made directly to IMDS")
+	rawIMDS               = pflag.Bool("raw-imds", false, "acquire every token of the msi endpoint with a hand-built request instead of adal and report the raw status and body of the response on failure")
+	noProxyIMDS           = pflag.Bool("no-proxy-imds", false, "connect directly to the instance metadata service even when a proxy is configured in the environment")
+	verboseSDK            = pflag.Bool("verbose-sdk", false, "log the requests and responses made by the azure sdk clients, with authorization headers, tokens and secret values redacted")
+	spClientID            = pflag.String("sp-client-id", "", "client id of a service principal to use for the keyvault and cluster-wide checks instead of MSI")
+	spTenantID            = pflag.String("sp-tenant-id", "", "tenant id of the service principal")
+	spCertPath            = pflag.String("sp-cert-path", "", "path of the PEM encoded certificate and RSA private key of the service principal")
+	runAll                = pflag.Bool("run-all", false, "run every check even when a check fails and print a summary of all the checks, instead of stopping at the first failure")
+	checkConcurrency      = pflag.Int("check-concurrency", 1, "number of data-plane checks run concurrently. every data-plane check is run when greater than 1, the checks are run in turn otherwise")
+	customMSIEndpoint     = pflag.String("msi-endpoint", "", "MSI endpoint to request tokens from instead of the instance metadata service, e.g. a mock outside Azure")
+	diagnose              = pflag.Bool("diagnose", false, "check the iptables redirect, NMI, the identity of the pod and the data-plane call in order, report a verdict for each and exit")
+	verifyAssignment      = pflag.Bool("verify-assignment", false, "verify the AzureAssignedIdentity of the pod is for --identity-client-id or --identity-resource-id before the data-plane checks")
+	kubeconfig            = pflag.String("kubeconfig", "", "path of the kubeconfig used by --verify-assignment and --result-configmap. default is the in-cluster config")
+	resultConfigMap       = pflag.String("result-configmap", "", "namespace/name of a config map to write the JSON report of the validation to on completion, created if it doesn't exist")
+	printToken            = pflag.Bool("print-token", false, "print the raw access token acquired by each check to stdout to inspect its claims. tokens are sensitive credentials")
+	tokenOnly             = pflag.Bool("token-only", false, "only acquire a token for --resource with the identity and validate its expiry and audience, without keyvault or ARM calls")
+	acrServer             = pflag.String("acr-server", "", "login server of an azure container registry, e.g. myregistry.azurecr.io, to exchange a token of the identity for a registry refresh token with")
+	graphProbe            = pflag.Bool("graph-probe", false, "acquire a token for microsoft graph with the identity and read --graph-probe-path, to verify the graph application permissions of the identity")
+	graphProbePath        = pflag.String("graph-probe-path", validator.DefaultGraphProbePath, "path of the microsoft graph read of --graph-probe, e.g. /v1.0/applications?$top=1")
+	verifyRotation        = pflag.Bool("verify-rotation", false, "acquire a token for --resource, wait --rotation-wait and acquire it again, failing if the same token is served twice")
+	rotationWait          = pflag.Duration("rotation-wait", 0, "time to wait between the token acquisitions of --verify-rotation, required with --verify-rotation. should be past the refresh of the first token, 5m before its expiry for NMI")
+	assertMinTTL          = pflag.Duration("assert-min-ttl", 0, "fail each check whose acquired token expires in less than the duration, e.g. 30m. not asserted when 0")
+	userAgentSuffix       = pflag.String("user-agent-suffix", "", "suffix appended to the user agent of the requests, e.g. to tag the deployment")
+	insecureSkipVerify    = pflag.Bool("insecure-skip-verify", false, "TEST ONLY: skip the verification of the TLS certificates, e.g. of a mock --msi-endpoint with a self-signed certificate. never use in production")
 )
 
 func main() {
 	pflag.Parse()
+	if err := bindEnv(pflag.CommandLine); err != nil {
+		klog.Fatalf("%+v", err)
+	}
+
+	version.SetUserAgentSuffix(*userAgentSuffix)
 
 	podname := os.Getenv("E2E_TEST_POD_NAME")
 	podnamespace := os.Getenv("E2E_TEST_POD_NAMESPACE")
@@ -35,90 +84,253 @@ func main() {
 
 	klog.Infof("Starting identity validator pod %s/%s %s", podnamespace, podname, podip)
 
-	msiEndpoint, err := adal.GetMSIVMEndpoint()
-	if err != nil {
-		klog.Fatalf("Failed to get msiEndpoint: %+v", err)
+	if *resultConfigMap != "" {
+		if _, _, err := validator.ParseConfigMapRef(*resultConfigMap); err != nil {
+			klog.Fatalf("%+v", err)
+		}
+	}
+
+	if *startupDelay > 0 {
+		ctx, stop := signalContext()
+		err := validator.WaitStartupDelay(ctx, *startupDelay)
+		stop()
+		if err != nil {
+			klog.Fatalf("%+v", err)
+		}
 	}
-	klog.Infof("Successfully obtain MSIEndpoint: %s\n", msiEndpoint)
 
-	if *keyvaultName != "" && *keyvaultSecretName != "" {
-		// Test if the pod identity is set up correctly
-		if err := testUserAssignedIdentityOnPod(msiEndpoint, *identityClientID, *keyvaultName, *keyvaultSecretName, *keyvaultSecretVersion); err != nil {
-			klog.Fatalf("testUserAssignedIdentityOnPod failed, %+v", err)
+	msiEndpoint := *customMSIEndpoint
+	if msiEndpoint == "" {
+		var err error
+		msiEndpoint, err = adal.GetMSIVMEndpoint()
+		if err != nil {
+			klog.Fatalf("Failed to get msiEndpoint: %+v", err)
 		}
-	} else {
-		// Test if the cluster-wide user assigned identity is set up correctly
-		if err := testClusterWideUserAssignedIdentity(msiEndpoint, *subscriptionID, *resourceGroup, *identityClientID); err != nil {
-			klog.Fatalf("testClusterWideUserAssignedIdentity failed, %+v", err)
+		klog.Infof("Successfully obtain MSIEndpoint: %s\n", msiEndpoint)
+
+		if err := validator.CheckIMDSAvailable(msiEndpoint); err != nil {
+			if validator.IsIMDSUnavailable(err) {
+				klog.Errorf("Unsupported environment: %v", err)
+				klog.Flush()
+				os.Exit(exitCodeUnsupportedEnvironment)
+			}
+			// the checks report the failure of the metadata address
+			klog.Warningf("%v", err)
 		}
 	}
 
-	// Test if a service principal token can be obtained when using a system assigned identity
-	if t1, err := testSystemAssignedIdentity(msiEndpoint); err != nil || t1 == nil {
-		klog.Fatalf("testSystemAssignedIdentity failed, %+v", err)
+	var identityClientID string
+	if len(*identityClientIDs) == 1 {
+		identityClientID = (*identityClientIDs)[0]
 	}
-}
 
-// testClusterWideUserAssignedIdentity will verify whether cluster-wide user assigned identity is working properly
-func testClusterWideUserAssignedIdentity(msiEndpoint, subscriptionID, resourceGroup, identityClientID string) error {
-	os.Setenv("AZURE_CLIENT_ID", identityClientID)
-	defer os.Unsetenv("AZURE_CLIENT_ID")
-	token, err := adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint, azure.PublicCloud.ResourceManagerEndpoint, identityClientID)
-	if err != nil {
-		return errors.Wrapf(err, "Failed to get service principal token from user assigned identity")
+	opts := validator.Options{
+		MSIEndpoint:           msiEndpoint,
+		SubscriptionID:        *subscriptionID,
+		ResourceGroup:         *resourceGroup,
+		VMName:                *vmName,
+		IdentityClientID:      identityClientID,
+		IdentityResourceID:    *identityResourceID,
+		IdentityObjectID:      *identityObjectID,
+		KeyvaultName:          *keyvaultName,
+		KeyvaultURI:           *keyvaultURI,
+		KeyvaultSecretName:    *keyvaultSecretName,
+		KeyvaultSecretVersion: *keyvaultSecretVersion,
+		ExpectedSecretSHA256:  *expectedSecretSHA256,
+		Resource:              *resource,
+		CheckSAToken:          *checkSAToken,
+		SATokenPath:           *saTokenPath,
+		IdentityWaitTimeout:   *identityWaitTimeout,
+		IMDSAPIVersion:        *imdsAPIVersion,
+		RawIMDS:               *rawIMDS,
+		NoProxyIMDS:           *noProxyIMDS,
+		VerboseSDK:            *verboseSDK,
+		SPClientID:            *spClientID,
+		SPTenantID:            *spTenantID,
+		SPCertPath:            *spCertPath,
+		RunAll:                *runAll,
+		Concurrency:           *checkConcurrency,
+		TokenOnly:             *tokenOnly,
+		InsecureSkipVerify:    *insecureSkipVerify,
+		ACRServer:             *acrServer,
+		GraphProbe:            *graphProbe,
+		GraphProbePath:        *graphProbePath,
+		VerifyRotation:        *verifyRotation,
+		RotationWait:          *rotationWait,
+		MinTokenTTL:           *assertMinTTL,
+	}
+	if *insecureSkipVerify {
+		klog.Warningf("WARNING: --insecure-skip-verify is set, the TLS certificates of the MSI endpoint, AAD, ARM and keyvault are NOT verified. " +
+			"This is for tests against a mock MSI endpoint only and must never be used in production")
+	}
+	if *verifyAssignment {
+		config, err := buildConfig(*kubeconfig)
+		if err != nil {
+			klog.Fatalf("Failed to create the kubernetes client config for --verify-assignment: %+v", err)
+		}
+		opts.PodName, opts.PodNamespace = podname, podnamespace
+		opts.AssignmentLister = validator.AssignmentListerFunc(func(podName, podNamespace string) ([]aadpodid.AzureAssignedIdentity, error) {
+			return crd.ListPodAssignedIDs(config, podName, podNamespace)
+		})
+	}
+	if *printToken {
+		klog.Warningf("WARNING: --print-token is set, the access tokens acquired by the checks are printed to stdout. " +
+			"Tokens are credentials granting access to the resources of the identity until they expire, " +
+			"do not share them and delete the pod logs holding them")
+		opts.TokenWriter = os.Stdout
 	}
 
-	vmClient := compute.NewVirtualMachinesClient(subscriptionID)
-	vmClient.Authorizer = autorest.NewBearerAuthorizer(token)
-	vmlist, err := vmClient.List(context.Background(), resourceGroup)
-	if err != nil {
-		return errors.Wrapf(err, "Failed to verify cluster-wide user assigned identity")
+	if len(*identityClientIDs) > 1 {
+		if *benchmark || *diagnose || *writeResultFile != "" || *resultConfigMap != "" {
+			klog.Fatalf("--benchmark, --diagnose, --write-result-file and --result-configmap require a single --identity-client-id")
+		}
+		results, err := validator.ValidateIdentities(context.Background(), opts, *identityClientIDs)
+		printIdentityMatrix(results)
+		if err != nil {
+			klog.Fatalf("%+v", err)
+		}
+		return
 	}
 
-	klog.Infof("Successfully verified cluster-wide user assigned identity. VM count: %d", len(vmlist.Values()))
-	return nil
-}
+	if *benchmark {
+		if *resultConfigMap != "" {
+			klog.Fatalf("--result-configmap isn't supported with --benchmark")
+		}
+		if err := validator.Benchmark(opts, *benchmarkIterations); err != nil {
+			klog.Fatalf("benchmark failed, %+v", err)
+		}
+		return
+	}
 
-// testUserAssignedIdentityOnPod will verify whether a pod identity is working properly
-func testUserAssignedIdentityOnPod(msiEndpoint, identityClientID, keyvaultName, keyvaultSecretName, keyvaultSecretVersion string) error {
-	// When new authorizer is created, azure-sdk-for-go  tries to create dataplane authorizer using MSI. It checks the AZURE_CLIENT_ID to get the client id
-	// for the user assigned identity. If client id not found, then NewServicePrincipalTokenFromMSI is invoked instead of using the actual
-	// user assigned identity. Setting this env var ensures we validate GetSecret using the desired user assigned identity.
-	os.Setenv("AZURE_CLIENT_ID", identityClientID)
-	defer os.Unsetenv("AZURE_CLIENT_ID")
+	if *diagnose {
+		result, err := validator.Diagnose(context.Background(), opts)
+		printDiagnosis(result)
+		writeReport(opts, result, err)
+		if err != nil {
+			klog.Fatalf("%+v", err)
+		}
+		return
+	}
 
-	keyClient := keyvault.New()
-	authorizer, err := auth.NewAuthorizerFromEnvironment()
-	if err == nil {
-		keyClient.Authorizer = authorizer
+	result, err := validator.Validate(context.Background(), opts)
+	if *runAll {
+		printSummary(result)
+	}
+	writeReport(opts, result, err)
+	if err != nil {
+		klog.Fatalf("%+v", err)
 	}
 
-	klog.Infof("%s %s %s\n", keyvaultName, keyvaultSecretName, keyvaultSecretVersion)
-	secret, err := keyClient.GetSecret(context.Background(), fmt.Sprintf("https://%s.vault.azure.net", keyvaultName), keyvaultSecretName, keyvaultSecretVersion)
-	if err != nil || *secret.Value == "" {
-		return errors.Wrapf(err, "Failed to verify user assigned identity on pod")
+	if *writeResultFile != "" {
+		if err := validator.WriteResult(context.Background(), *writeResultFile, opts); err != nil {
+			klog.Fatalf("writing result failed, %+v", err)
+		}
 	}
+}
 
-	klog.Infof("Successfully verified user assigned identity on pod")
-	return nil
+// signalContext returns a context cancelled when the validator is asked to terminate, e.g. when
+// the pod is deleted, until stop is called and the signals terminate the validator again
+func signalContext() (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
 }
 
-// testMSIEndpoint will return a service principal token obtained through a system assigned identity
-func testSystemAssignedIdentity(msiEndpoint string) (*adal.Token, error) {
-	spt, err := adal.NewServicePrincipalTokenFromMSI(msiEndpoint, azure.PublicCloud.ResourceManagerEndpoint)
+// writeReport writes the report of the validation to the --result-configmap when set. The validation
+// doesn't fail when only the report can't be written, a warning is logged instead.
+func writeReport(opts validator.Options, result validator.Result, validationErr error) {
+	if *resultConfigMap == "" {
+		return
+	}
+	namespace, name, err := validator.ParseConfigMapRef(*resultConfigMap)
+	if err != nil {
+		klog.Warningf("%+v", err)
+		return
+	}
+	config, err := buildConfig(*kubeconfig)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Failed to acquire a token using the MSI VM extension")
+		klog.Warningf("Failed to create the kubernetes client config for --result-configmap, the report isn't written: %+v", err)
+		return
+	}
+	clientSet, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		klog.Warningf("Failed to create the kubernetes client for --result-configmap, the report isn't written: %+v", err)
+		return
+	}
+	report := validator.NewReport(opts, result, validationErr)
+	if err := validator.WriteReportConfigMap(clientSet.CoreV1().ConfigMaps(namespace), name, report); err != nil {
+		klog.Warningf("Failed to write the report to config map %s, the validation result is unchanged: %+v", *resultConfigMap, err)
 	}
+}
+
+// Create the client config. Use kubeconfig if given, otherwise assume in-cluster.
+func buildConfig(kubeconfigPath string) (*rest.Config, error) {
+	if kubeconfigPath != "" {
+		return clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	}
+	return rest.InClusterConfig()
+}
 
-	if err := spt.Refresh(); err != nil {
-		return nil, errors.Wrapf(err, "Failed to refresh ServicePrincipalTokenFromMSI using the MSI VM extension, msiEndpoint(%s)", msiEndpoint)
+// printSummary logs the outcome of every check that was run
+func printSummary(result validator.Result) {
+	klog.Infof("Validation summary:")
+	for _, c := range result.Checks {
+		if c.Passed() {
+			klog.Infof("  PASS %s (%s)", c.Name, c.Duration)
+			continue
+		}
+		klog.Infof("  FAIL %s (%s): %v", c.Name, c.Duration, c.Err)
 	}
+}
 
-	token := spt.Token()
-	if token.IsZero() {
-		return nil, errors.Errorf("No token found, MSI VM extension, msiEndpoint(%s)", msiEndpoint)
+// printDiagnosis logs the verdict of every diagnosed layer and the first failing layer
+func printDiagnosis(result validator.Result) {
+	klog.Infof("Diagnosis:")
+	checked := make(map[string]validator.CheckResult)
+	for _, c := range result.Checks {
+		checked[c.Name] = c
 	}
+	for _, layer := range validator.DiagnoseLayers {
+		c, ok := checked[layer]
+		switch {
+		case !ok:
+			klog.Infof("  SKIP %s", layer)
+		case c.Passed():
+			klog.Infof("  PASS %s (%s)", layer, c.Duration)
+		default:
+			klog.Infof("  FAIL %s (%s): %v", layer, c.Duration, c.Err)
+			klog.Infof("First failing layer: %s", layer)
+		}
+	}
+}
 
-	klog.Infof("Successfully acquired a token using the MSI, msiEndpoint(%s)", msiEndpoint)
-	return &token, nil
+// printIdentityMatrix logs the outcome of every check of each identity
+func printIdentityMatrix(results []validator.IdentityResult) {
+	klog.Infof("Identity validation matrix:")
+	for _, r := range results {
+		verdict := "PASS"
+		if !r.Passed() {
+			verdict = "FAIL"
+		}
+		checks := make([]string, 0, len(r.Result.Checks))
+		for _, c := range r.Result.Checks {
+			if c.Passed() {
+				checks = append(checks, "PASS "+c.Name)
+				continue
+			}
+			checks = append(checks, "FAIL "+c.Name)
+		}
+		klog.Infof("  %s %s: %s", verdict, r.ClientID, strings.Join(checks, ", "))
+	}
 }
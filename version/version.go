@@ -17,11 +17,28 @@ var MICVersion string
 // NMIVersion is the version of the NMI component
 var NMIVersion string
 
+// IdentityValidatorVersion is the version of the identity validator
+var IdentityValidatorVersion string
+
+// userAgentSuffix is appended to the user agents returned by GetUserAgent
+var userAgentSuffix string
+
+// SetUserAgentSuffix sets the suffix appended to the user agents returned by GetUserAgent, e.g. to
+// tag the requests of a deployment. It must be set before the clients are created.
+func SetUserAgentSuffix(suffix string) {
+	userAgentSuffix = suffix
+}
+
 // GetUserAgent is used to get the user agent string which is then provided to adal
 // to use as the extended user agent header.
-// The format is: aad-pod-identity/<component - either NMI or MIC>/<Version of component>/<Git commit>/<Build date>
+// The format is: aad-pod-identity/<component - NMI, MIC or IdentityValidator>/<Version of component>/<Git commit>/<Build date>
+// followed by the user agent suffix when set.
 func GetUserAgent(component, version string) string {
-	return fmt.Sprintf("aad-pod-identity/%s/%s/%s/%s", component, version, GitCommit, BuildDate)
+	userAgent := fmt.Sprintf("aad-pod-identity/%s/%s/%s/%s", component, version, GitCommit, BuildDate)
+	if userAgentSuffix != "" {
+		userAgent += " " + userAgentSuffix
+	}
+	return userAgent
 }
 
 // PrintVersionAndExit prints the version and exits
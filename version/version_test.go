@@ -16,3 +16,16 @@ func TestVersion(t *testing.T) {
 		t.Fatalf("got unexpected user agent string: %s. Expected: %s.", gotUserAgentStr, expectedUserAgentStr)
 	}
 }
+
+func TestUserAgentSuffix(t *testing.T) {
+	BuildDate = "Now"
+	GitCommit = "Commit"
+	MICVersion = "MIC version"
+	SetUserAgentSuffix("contoso/prod")
+	defer SetUserAgentSuffix("")
+
+	expectedUserAgentStr := fmt.Sprintf("aad-pod-identity/%s/%s/%s/%s contoso/prod", "MIC", MICVersion, GitCommit, BuildDate)
+	if gotUserAgentStr := GetUserAgent("MIC", MICVersion); gotUserAgentStr != expectedUserAgentStr {
+		t.Fatalf("got unexpected user agent string: %s. Expected: %s.", gotUserAgentStr, expectedUserAgentStr)
+	}
+}